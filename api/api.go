@@ -92,7 +92,8 @@ func InitEngine(ctx context.Context) *gin.Engine {
 
 //app key 定义
 const (
-	AppUserIDKey = "AppUserIDKey"
+	AppUserIDKey    = "AppUserIDKey"
+	AppSessionIDKey = "AppSessionIDKey"
 )
 
 //GetAppUserID 获取用户id
@@ -100,6 +101,11 @@ func GetAppUserID(c *gin.Context) primitive.ObjectID {
 	return c.MustGet(AppUserIDKey).(primitive.ObjectID)
 }
 
+//GetAppSessionID 获取当前登陆会话id
+func GetAppSessionID(c *gin.Context) primitive.ObjectID {
+	return c.MustGet(AppSessionIDKey).(primitive.ObjectID)
+}
+
 //IsLogin 是否登陆
 func IsLogin(c *gin.Context) {
 	app := core.GetApp(c)
@@ -115,12 +121,21 @@ func IsLogin(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusOK, NewModel(1000, err))
 		return
 	}
-	err = app.UseRedis(func(redv core.IRedisImp) error {
-		oid, err := redv.GetUserID(tk)
+	err = app.UseDb(func(db core.IDbImp) error {
+		oid, err := db.GetUserID(tk)
+		if err != nil {
+			return err
+		}
+		sid, err := core.GetSessionID(db, tk)
 		if err != nil {
 			return err
 		}
 		c.Set(AppUserIDKey, oid)
+		c.Set(AppSessionIDKey, sid)
+		//更新活跃时间失败不影响访问
+		if err := core.TouchSession(db, sid); err != nil {
+			xginx.LogError("touch session error", err)
+		}
 		return nil
 	})
 	if err != nil {
@@ -130,16 +145,42 @@ func IsLogin(c *gin.Context) {
 	c.Next()
 }
 
+//IsAdmin 是否是管理员请求,未设置管理员token时禁止访问
+func IsAdmin(c *gin.Context) {
+	args := struct {
+		Token string `header:"X-Admin-Token" binding:"required"`
+	}{}
+	if err := c.ShouldBindHeader(&args); err != nil {
+		c.AbortWithStatusJSON(http.StatusOK, NewModel(1001, err))
+		return
+	}
+	if !core.CheckAdminToken(args.Token) {
+		c.AbortWithStatusJSON(http.StatusOK, NewModel(1001, "admin token error"))
+		return
+	}
+	c.Next()
+}
+
 //V1Entry v1接口初始化
 func V1Entry(rg *gin.RouterGroup) {
 	rg.POST("/register", registerAPI)
 	rg.POST("/login", loginAPI)
+	rg.POST("/send/code", sendCodeAPI)
+	rg.POST("/reset/pass", resetPassAPI)
+	rg.POST("/refresh/token", refreshTokenAPI)
 
 	auth := rg.Group("/", IsLogin)
 	auth.GET("/quit/login", quitLoginAPI)
+	auth.GET("/list/sessions", listSessionsAPI)
+	auth.GET("/events", eventsAPI)
+	auth.POST("/revoke/session", revokeSessionAPI)
+	auth.POST("/revoke/sessions", revokeSessionsAPI)
 	auth.GET("/user/info", userInfoAPI)
 	auth.GET("/user/coins", listCoinsAPI)
+	auth.GET("/user/balance", userBalanceAPI)
+	auth.GET("/list/history", listHistoryAPI)
 	auth.GET("/tx/info/:id", getTxInfoAPI)
+	auth.GET("/fee/rates", feeRatesAPI)
 	auth.GET("/list/txs/:addr", listTxsAPI)
 	auth.GET("/list/accounts", listUserAccountsAPI)
 	auth.GET("/list/sign/txs", listUserSignTxsAPI)
@@ -147,8 +188,45 @@ func V1Entry(rg *gin.RouterGroup) {
 	auth.POST("/new/private", createUserPrivateAPI)
 	auth.POST("/new/account", createAccountAPI)
 	auth.POST("/new/tx", createTxAPI)
+	auth.POST("/batch/payout", batchPayoutAPI)
+	auth.GET("/batch/info/:id", batchInfoAPI)
+	auth.GET("/list/batches", listBatchesAPI)
+	auth.POST("/new/schedule", createScheduleAPI)
+	auth.GET("/list/schedules", listSchedulesAPI)
+	auth.POST("/set/schedule", setScheduleAPI)
+	auth.POST("/del/schedule", deleteScheduleAPI)
+	auth.POST("/set/policy", setPolicyAPI)
+	auth.POST("/approve/policy", approvePolicyAPI)
+	auth.GET("/list/policy/changes", listPolicyChangesAPI)
+	auth.POST("/new/contact", createContactAPI)
+	auth.GET("/list/contacts", listContactsAPI)
+	auth.POST("/set/contact", setContactAPI)
+	auth.POST("/del/contact", deleteContactAPI)
+	auth.POST("/set/bonly", setBookOnlyAPI)
+	auth.POST("/set/confirms", setConfirmsAPI)
+	auth.POST("/new/webhook", createWebhookAPI)
+	auth.GET("/list/webhooks", listWebhooksAPI)
+	auth.POST("/set/webhook", setWebhookAPI)
+	auth.POST("/del/webhook", deleteWebhookAPI)
+	auth.GET("/list/deliveries", listDeliveriesAPI)
+	auth.POST("/retry/delivery", retryDeliveryAPI)
 	auth.POST("/sign/tx", signTxAPI)
+	auth.POST("/cancel/tx", cancelTxAPI)
+	auth.POST("/reject/tx", rejectTxAPI)
+	auth.POST("/export/partial", exportPartialTxAPI)
+	auth.POST("/import/sigs", importSigsAPI)
 	auth.POST("/submit/tx", submitTxAPI)
 	auth.POST("/import/account", importAccountAPI)
+	auth.POST("/import/watch", importWatchAccountAPI)
 	auth.POST("/export/account", exportAccountAPI)
+	auth.POST("/set/kpass", setKeyPassAPI)
+	auth.POST("/set/xpub", setUserXPubAPI)
+	auth.POST("/export/mnemonic", exportMnemonicAPI)
+	auth.POST("/restore/mnemonic", restoreMnemonicAPI)
+	auth.POST("/totp/enroll", enrollTOTPAPI)
+	auth.POST("/totp/verify", verifyTOTPAPI)
+	auth.POST("/totp/disable", disableTOTPAPI)
+
+	admin := rg.Group("/admin", IsAdmin)
+	admin.POST("/reset/pass", resetUserPassAPI)
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -24,8 +25,14 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+//测试时验证码输出到这里
+var testCodes = &bytes.Buffer{}
+
 func init() {
 	*xginx.IsDebug = true
+	//使用内存数据库测试
+	core.DbEngine = core.DbEngineMemory
+	core.CodeSender = core.NewLogCodeSender(testCodes)
 }
 
 //APITestSuite api测试集合
@@ -34,6 +41,7 @@ type APITestSuite struct {
 	ctx    context.Context
 	db     core.IDbImp
 	token  string
+	fresh  string //refresh token
 	m      *gin.Engine
 	A      string
 	au     *core.TUser
@@ -181,6 +189,7 @@ func (st *APITestSuite) LoginB() error {
 		return fmt.Errorf("meta error = %v", any.Get("error"))
 	}
 	st.token = any.Get("token").ToString()
+	st.fresh = any.Get("refresh").ToString()
 	xginx.LogInfo("login B account Success token=", st.token)
 	return nil
 }
@@ -211,6 +220,7 @@ func (st *APITestSuite) LoginA() error {
 		return fmt.Errorf("meta error = %v", any.Get("error"))
 	}
 	st.token = any.Get("token").ToString()
+	st.fresh = any.Get("refresh").ToString()
 	xginx.LogInfo("login A account Success token=", st.token)
 	return nil
 }
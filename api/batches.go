@@ -0,0 +1,427 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/cxuhua/xmgrs/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//付款文件格式
+const (
+	BatchFormatCSV  = "csv"
+	BatchFormatJSON = "json"
+)
+
+//付款文件中的一行
+type batchLine struct {
+	Index int    //行号
+	Dst   string //addr->amount,script
+}
+
+//生成addr->amount,script格式
+func batchDst(addr string, amount string, script string) string {
+	dst := fmt.Sprintf("%s->%s", strings.TrimSpace(addr), strings.TrimSpace(amount))
+	if script = strings.TrimSpace(script); script != "" {
+		dst += "," + script
+	}
+	return dst
+}
+
+//解析csv付款文件,每行 addr,amount[,script],第一行可以是表头
+func parseBatchCSV(r io.Reader) ([]batchLine, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	rets := []batchLine{}
+	for idx := 1; ; idx++ {
+		vs, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if idx == 1 && len(vs) > 0 && strings.EqualFold(strings.TrimSpace(vs[0]), "addr") {
+			continue
+		}
+		if len(vs) == 1 && strings.TrimSpace(vs[0]) == "" {
+			continue
+		}
+		line := batchLine{Index: idx}
+		switch len(vs) {
+		case 2:
+			line.Dst = batchDst(vs[0], vs[1], "")
+		case 3:
+			line.Dst = batchDst(vs[0], vs[1], vs[2])
+		default:
+			line.Dst = strings.Join(vs, ",")
+		}
+		rets = append(rets, line)
+	}
+	return rets, nil
+}
+
+//解析json付款文件,数组元素为 addr->amount,script 字符串或者 {"addr","amount","script"} 对象
+func parseBatchJSON(r io.Reader) ([]batchLine, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	vs := []interface{}{}
+	err := dec.Decode(&vs)
+	if err != nil {
+		return nil, err
+	}
+	rets := []batchLine{}
+	for i, v := range vs {
+		line := batchLine{Index: i + 1}
+		switch v.(type) {
+		case string:
+			line.Dst = v.(string)
+		case map[string]interface{}:
+			m := v.(map[string]interface{})
+			script, _ := m["script"].(string)
+			line.Dst = batchDst(fmt.Sprint(m["addr"]), fmt.Sprint(m["amount"]), script)
+		default:
+			return nil, fmt.Errorf("row %d format error", i+1)
+		}
+		rets = append(rets, line)
+	}
+	return rets, nil
+}
+
+//读取付款文件,格式为空时根据文件扩展名判断
+func readBatchFile(fh *multipart.FileHeader, format string) ([]batchLine, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(fh.Filename)), ".")
+	}
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	switch format {
+	case BatchFormatCSV:
+		return parseBatchCSV(file)
+	case BatchFormatJSON:
+		return parseBatchJSON(file)
+	}
+	return nil, fmt.Errorf("batch format %s error", format)
+}
+
+//BatchRowModel 付款行
+type BatchRowModel struct {
+	Index  int           `json:"idx"`             //文件中的行号
+	Dst    string        `json:"dst"`             //addr->amount,script
+	Addr   xginx.Address `json:"addr"`            //目标地址
+	Value  xginx.Amount  `json:"value"`           //金额
+	Status string        `json:"status"`          //pending failed new sign pool block confirmed cancel
+	TxID   string        `json:"tid,omitempty"`   //所在交易
+	Error  string        `json:"error,omitempty"` //失败原因
+}
+
+//BatchModel 批量付款
+type BatchModel struct {
+	ID    string          `json:"id"`             //批次id
+	Desc  string          `json:"desc"`           //描述
+	Value xginx.Amount    `json:"value"`          //总金额
+	Time  int64           `json:"time"`           //创建时间
+	Txs   []string        `json:"txs"`            //创建的交易
+	Count map[string]int  `json:"count"`          //各个状态的行数
+	Rows  []BatchRowModel `json:"rows,omitempty"` //付款行
+}
+
+//NewBatchModel 创建批量付款model,rows是否包含付款行
+func NewBatchModel(b *core.TBatch, rows bool) BatchModel {
+	m := BatchModel{
+		ID:    b.ID.Hex(),
+		Desc:  b.Desc,
+		Value: b.Value,
+		Time:  b.Time,
+		Txs:   []string{},
+		Count: map[string]int{},
+	}
+	for _, id := range b.TxIDs() {
+		m.Txs = append(m.Txs, xginx.NewHASH256(id).String())
+	}
+	for k, v := range b.Count() {
+		m.Count[string(k)] = v
+	}
+	if !rows {
+		return m
+	}
+	m.Rows = NewBatchRowModels(b.Rows)
+	return m
+}
+
+//NewBatchRowModels 创建付款行model
+func NewBatchRowModels(rows []*core.TBatchRow) []BatchRowModel {
+	rets := []BatchRowModel{}
+	for _, row := range rows {
+		i := BatchRowModel{
+			Index:  row.Index,
+			Dst:    row.Dst,
+			Addr:   row.Addr,
+			Value:  row.Value,
+			Status: string(row.Status),
+			Error:  row.Error,
+		}
+		if len(row.TxID) > 0 {
+			i.TxID = xginx.NewHASH256(row.TxID).String()
+		}
+		rets = append(rets, i)
+	}
+	return rets
+}
+
+//交易超过BatchMaxTxSize需要拆分
+var errBatchTxSize = errors.New("batch tx size too large")
+
+//为付款行创建交易,交易太大时拆分成两部分分别创建
+func createBatchTx(app *core.App, bi *xginx.BlockIndex, batch *core.TBatch, rows []*core.TBatchRow, opts txOptions) {
+	err := app.UseTx(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(batch.UserID)
+		if err != nil {
+			return err
+		}
+		avs := []AddrValue{}
+		for _, row := range rows {
+			av, err := parseUserAddrValue(db, user, row.Dst)
+			if err != nil {
+				return err
+			}
+			avs = append(avs, av)
+		}
+		tx, lis, err := newUserTx(db, bi, user, avs, opts)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 1 && tx.Size() > core.BatchMaxTxSize {
+			return errBatchTxSize
+		}
+		ttx, err := saveUserTx(db, bi, user, tx, lis, batch.Desc)
+		if err != nil {
+			return err
+		}
+		batch.SetTx(rows, ttx)
+		return db.SetBatchRows(batch.ID, batch.Rows)
+	})
+	if err == errBatchTxSize {
+		half := len(rows) / 2
+		createBatchTx(app, bi, batch, rows[:half], opts)
+		createBatchTx(app, bi, batch, rows[half:], opts)
+		return
+	}
+	if err == nil {
+		return
+	}
+	batch.SetError(rows, err)
+	err = app.UseDb(func(db core.IDbImp) error {
+		return db.SetBatchRows(batch.ID, batch.Rows)
+	})
+	if err != nil {
+		xginx.LogError("set batch rows error", err)
+	}
+}
+
+//上传付款文件批量付款
+func batchPayoutAPI(c *gin.Context) {
+	args := struct {
+		File   *multipart.FileHeader `form:"file" binding:"required"`          //付款文件
+		Format string                `form:"format"`                           //文件格式 csv json,默认根据扩展名判断
+		Desc   string                `form:"desc"`                             //描述
+		Fee    string                `form:"fee" binding:"omitempty,IsAmount"` //每个交易的交易费,为空时按每字节交易费计算
+		Rate   int64                 `form:"rate" binding:"gte=0"`             //每字节交易费,最小单位
+		Level  string                `form:"level"`                            //估算交易费的优先级 low normal high
+		Ext    bool                  `form:"external"`                         //允许使用只读账号,签名由外部提供
+		Coin   string                `form:"coin"`                             //金额选择策略
+		Accs   []xginx.Address       `form:"accs" binding:"dive,IsAddress"`    //只使用这些账号的金额
+		Tags   []string              `form:"tags"`                             //只使用包含这些标签的账号的金额
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	bi := xginx.GetBlockIndex()
+	fee, rate, err := parseTxFee(bi, args.Fee, args.Rate, args.Level)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	sel, err := core.GetCoinSelector(args.Coin)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(102, err))
+		return
+	}
+	lines, err := readBatchFile(args.File, strings.ToLower(args.Format))
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(103, err))
+		return
+	}
+	//校验所有行,有错误时返回所有错误的行
+	type invalid struct {
+		Index int    `json:"idx"`   //行号
+		Dst   string `json:"dst"`   //addr->amount,script
+		Error string `json:"error"` //错误信息
+	}
+	invs := []invalid{}
+	rows := []*core.TBatchRow{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err = app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			av, err := parseUserAddrValue(db, user, line.Dst)
+			if err != nil {
+				invs = append(invs, invalid{Index: line.Index, Dst: line.Dst, Error: err.Error()})
+				continue
+			}
+			rows = append(rows, &core.TBatchRow{Index: line.Index, Dst: line.Dst, Addr: av.Addr, Value: av.Value})
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	if len(invs) > 0 {
+		res := struct {
+			Model
+			Items []invalid `json:"items"`
+		}{
+			Model: NewModel(104, "batch rows invalid"),
+			Items: invs,
+		}
+		c.JSON(http.StatusOK, res)
+		return
+	}
+	batch, err := core.NewBatch(uid, args.Desc, rows)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(105, err))
+		return
+	}
+	err = app.UseDb(func(db core.IDbImp) error {
+		return db.InsertBatch(batch)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	opts := txOptions{
+		Fee:    fee,
+		Rate:   rate,
+		Ext:    args.Ext,
+		Sel:    sel,
+		Filter: core.CoinFilter{Accs: args.Accs, Tags: util.RemoveRepeat(args.Tags)},
+	}
+	for _, chunk := range batch.Chunks() {
+		createBatchTx(app, bi, batch, chunk, opts)
+	}
+	res := struct {
+		Code int        `json:"code"`
+		Item BatchModel `json:"item"`
+	}{
+		Code: 0,
+		Item: NewBatchModel(batch, true),
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取批量付款和每行状态,可以只获取指定状态的付款行
+func batchInfoAPI(c *gin.Context) {
+	args := struct {
+		ID string `uri:"id" binding:"required"`
+	}{}
+	if err := c.ShouldBindUri(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	query := struct {
+		Status []string `form:"status"` //付款行状态,为空获取所有行
+	}{}
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	status := []core.TBatchStatus{}
+	for _, v := range query.Status {
+		if !core.IsBatchStatus(core.TBatchStatus(v)) {
+			c.JSON(http.StatusOK, NewModel(103, "status error"))
+			return
+		}
+		status = append(status, core.TBatchStatus(v))
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code int        `json:"code"`
+		Item BatchModel `json:"item"`
+	}{
+		Code: 0,
+	}
+	err = app.UseDb(func(db core.IDbImp) error {
+		batch, err := db.GetBatch(id)
+		if err != nil {
+			return err
+		}
+		if !core.ObjectIDEqual(batch.UserID, uid) {
+			return errors.New("batch not found")
+		}
+		batch.LoadStatus(db)
+		res.Item = NewBatchModel(batch, false)
+		res.Item.Rows = NewBatchRowModels(batch.FilterRows(status...))
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(102, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户的批量付款
+func listBatchesAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int          `json:"code"`
+		Items []BatchModel `json:"items"`
+	}{
+		Code:  0,
+		Items: []BatchModel{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		bs, err := db.ListBatches(uid)
+		if err != nil {
+			return err
+		}
+		for _, batch := range bs {
+			batch.LoadStatus(db)
+			res.Items = append(res.Items, NewBatchModel(batch, false))
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,290 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//ContactModel 地址簿联系人
+type ContactModel struct {
+	ID     string        `json:"id"`     //联系人id
+	Label  string        `json:"label"`  //标签
+	Addr   xginx.Address `json:"addr"`   //地址
+	Notes  string        `json:"notes"`  //备注
+	Script string        `json:"script"` //允许的输出脚本
+	Time   int64         `json:"time"`   //创建时间
+}
+
+//NewContactModel 创建联系人model
+func NewContactModel(c *core.TContact) ContactModel {
+	return ContactModel{
+		ID:     c.ID.Hex(),
+		Label:  c.Label,
+		Addr:   c.Addr,
+		Notes:  c.Notes,
+		Script: c.Script,
+		Time:   c.Time,
+	}
+}
+
+//解析用户的付款目标,@label->amount 使用地址簿中联系人的地址
+//联系人设置了输出脚本并且目标没有指定脚本时使用联系人的脚本
+func parseUserAddrValue(db core.IDbImp, user *core.TUser, s string) (AddrValue, error) {
+	addr, vss := parseValueAddress(s)
+	if label, ok := core.IsContactLabel(addr); ok {
+		ct, err := db.GetContactWithLabel(user.ID, label)
+		if err != nil {
+			return AddrValue{}, errors.New("contact " + label + " not found")
+		}
+		amts, outs := parseValueScript(vss)
+		if outs == "" {
+			outs = ct.Script
+		}
+		s = string(ct.Addr) + "->" + amts
+		if outs != "" {
+			s += "," + outs
+		}
+	}
+	av, err := ParseAddrValue(s)
+	if err != nil {
+		return av, err
+	}
+	err = core.CheckContactDst(db, user, av.Addr, av.OutScript)
+	if err != nil {
+		return av, err
+	}
+	return av, nil
+}
+
+//只允许向地址簿中的地址付款时,修改地址簿需要登陆密码和两步验证
+func checkBookAuth(db core.IDbImp, uid primitive.ObjectID, pass string, otp string) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	if !user.BookOnly {
+		return nil
+	}
+	if !user.CheckPass(pass) {
+		return errors.New("password error")
+	}
+	return user.CheckTOTP(db, otp)
+}
+
+//添加联系人
+func createContactAPI(c *gin.Context) {
+	args := struct {
+		Label  string        `form:"label" binding:"required"`            //标签
+		Addr   xginx.Address `form:"addr" binding:"IsAddress"`            //地址
+		Notes  string        `form:"notes"`                               //备注
+		Script string        `form:"script" binding:"omitempty,IsScript"` //允许的输出脚本,为空不限制
+		Pass   string        `form:"pass"`                                //登陆密码,只允许向地址簿付款时需要
+		OTP    string        `form:"otp"`                                 //两步验证码,只允许向地址簿付款时需要
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	uid := GetAppUserID(c)
+	ct, err := core.NewContact(uid, args.Label, args.Addr)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	ct.Notes = args.Notes
+	ct.Script = args.Script
+	app := core.GetApp(c)
+	code := 200
+	err = app.UseDb(func(db core.IDbImp) error {
+		err := checkBookAuth(db, uid, args.Pass, args.OTP)
+		if err != nil {
+			code = 102
+			return err
+		}
+		return db.InsertContact(ct)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	res := struct {
+		Code int          `json:"code"`
+		Item ContactModel `json:"item"`
+	}{
+		Code: 0,
+		Item: NewContactModel(ct),
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户的地址簿
+func listContactsAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int            `json:"code"`
+		Items []ContactModel `json:"items"`
+	}{
+		Code:  0,
+		Items: []ContactModel{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		cs, err := db.ListContacts(uid)
+		if err != nil {
+			return err
+		}
+		for _, ct := range cs {
+			res.Items = append(res.Items, NewContactModel(ct))
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取自己的联系人
+func getUserContact(db core.IDbImp, uid primitive.ObjectID, cid string) (*core.TContact, error) {
+	id, err := primitive.ObjectIDFromHex(cid)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := db.GetContact(id)
+	if err != nil {
+		return nil, err
+	}
+	if !core.ObjectIDEqual(ct.UserID, uid) {
+		return nil, errors.New("contact not found")
+	}
+	return ct, nil
+}
+
+//修改联系人
+func setContactAPI(c *gin.Context) {
+	args := struct {
+		ID     string        `form:"id" binding:"required"`               //联系人id
+		Label  string        `form:"label" binding:"required"`            //标签
+		Addr   xginx.Address `form:"addr" binding:"IsAddress"`            //地址
+		Notes  string        `form:"notes"`                               //备注
+		Script string        `form:"script" binding:"omitempty,IsScript"` //允许的输出脚本,为空不限制
+		Pass   string        `form:"pass"`                                //登陆密码,只允许向地址簿付款时需要
+		OTP    string        `form:"otp"`                                 //两步验证码,只允许向地址簿付款时需要
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code int          `json:"code"`
+		Item ContactModel `json:"item"`
+	}{
+		Code: 0,
+	}
+	code := 200
+	err := app.UseDb(func(db core.IDbImp) error {
+		err := checkBookAuth(db, uid, args.Pass, args.OTP)
+		if err != nil {
+			code = 101
+			return err
+		}
+		ct, err := getUserContact(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		ct.Label = args.Label
+		ct.Addr = args.Addr
+		ct.Notes = args.Notes
+		ct.Script = args.Script
+		err = ct.Check()
+		if err != nil {
+			return err
+		}
+		err = db.UpdateContact(ct)
+		if err != nil {
+			return err
+		}
+		res.Item = NewContactModel(ct)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//删除联系人
+func deleteContactAPI(c *gin.Context) {
+	args := struct {
+		ID   string `form:"id" binding:"required"` //联系人id
+		Pass string `form:"pass"`                  //登陆密码,只允许向地址簿付款时需要
+		OTP  string `form:"otp"`                   //两步验证码,只允许向地址簿付款时需要
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	code := 200
+	err := app.UseDb(func(db core.IDbImp) error {
+		err := checkBookAuth(db, uid, args.Pass, args.OTP)
+		if err != nil {
+			code = 101
+			return err
+		}
+		ct, err := getUserContact(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		return db.DeleteContact(ct.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//设置是否只允许向地址簿中的地址付款,需要两步验证,关闭时还需要登陆密码
+func setBookOnlyAPI(c *gin.Context) {
+	args := struct {
+		Only bool   `form:"only"` //只允许向地址簿中的地址付款
+		Pass string `form:"pass"` //登陆密码,关闭时需要
+		OTP  string `form:"otp"`  //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	code := 200
+	err := app.UseDb(func(db core.IDbImp) error {
+		var err error
+		if args.Only {
+			err = checkUserOTP(db, uid, args.OTP)
+		} else {
+			err = checkBookAuth(db, uid, args.Pass, args.OTP)
+		}
+		if err != nil {
+			code = 101
+			return err
+		}
+		return db.SetUserBookOnly(uid, args.Only)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+)
+
+//事件流设置
+var (
+	//单个连接的最长时间,超时后客户端需要重新连接
+	EventStreamTimeout = time.Hour
+	//心跳间隔,防止代理关闭空闲连接
+	EventPingInterval = time.Second * 30
+)
+
+//用户事件流 text/event-stream
+//event为事件类型,data为事件json,ping事件只用来保持连接
+//事件通过redis订阅获取,连接到任意实例都能收到
+func eventsAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseRedisWithTimeout(EventStreamTimeout, func(redv core.IRedisImp) error {
+		sub := redv.Subscribe(core.EventChannel(uid))
+		defer sub.Close()
+		ping := time.NewTicker(EventPingInterval)
+		defer ping.Stop()
+		timeout := time.NewTimer(EventStreamTimeout)
+		defer timeout.Stop()
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		ch := sub.Channel()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return false
+				}
+				ev, err := core.ParseEvent(msg.Payload)
+				if err != nil {
+					return true
+				}
+				c.SSEvent(string(ev.Type), msg.Payload)
+			case <-ping.C:
+				c.SSEvent("ping", time.Now().Unix())
+			case <-timeout.C:
+				return false
+			case <-c.Request.Context().Done():
+				return false
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/cxuhua/xmgrs/util"
+	"github.com/gin-gonic/gin"
+)
+
+//HistoryModel 账号收支记录
+type HistoryModel struct {
+	TxID    string           `json:"tid"`     //交易id
+	Account xginx.Address    `json:"account"` //账号
+	Dir     core.THistoryDir `json:"dir"`     //1收入 2支出 3收支相等
+	In      xginx.Amount     `json:"in"`      //输出到账号的金额
+	Out     xginx.Amount     `json:"out"`     //账号输入的金额
+	Value   xginx.Amount     `json:"value"`   //净收入,支出时为负数
+	Peers   []xginx.Address  `json:"peers"`   //对方地址
+	Height  uint32           `json:"height"`  //区块高度
+	Confirm uint32           `json:"confirm"` //确认数
+	Time    int64            `json:"time"`    //区块时间
+}
+
+//NewHistoryModel 创建收支记录model
+func NewHistoryModel(h *core.THistory, height uint32) HistoryModel {
+	return HistoryModel{
+		TxID:    xginx.NewHASH256(h.TxID).String(),
+		Account: h.Account,
+		Dir:     h.Dir,
+		In:      h.In,
+		Out:     h.Out,
+		Value:   h.Value,
+		Peers:   h.Peers,
+		Height:  h.Height,
+		Confirm: h.Confirm(height),
+		Time:    h.Time,
+	}
+}
+
+//获取用户账号的收支记录,从区块连接时保存的索引获取
+func listHistoryAPI(c *gin.Context) {
+	args := struct {
+		PageArgs
+		Confirms uint32 `form:"confirms"` //只返回确认数不小于这个值的记录
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortHeight, core.PageSortTime, core.PageSortValue)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	bi := xginx.GetBlockIndex()
+	res := struct {
+		Code   int            `json:"code"`
+		Height uint32         `json:"height"` //区块链高度
+		Items  []HistoryModel `json:"items"`
+		Next   string         `json:"next"` //下一页游标,为空没有下一页
+	}{
+		Code:   0,
+		Height: bi.Height(),
+		Items:  []HistoryModel{},
+	}
+	flt := args.Filter()
+	if args.Confirms > 0 {
+		//链高度不够时没有达到确认数的记录
+		if args.Confirms > res.Height {
+			c.JSON(http.StatusOK, res)
+			return
+		}
+		flt.MaxHeight = res.Height - args.Confirms + 1
+	}
+	err = app.UseDb(func(db core.IDbImp) error {
+		hs, next, err := core.UserHistory(db, bi, uid, flt, page)
+		if err != nil {
+			return err
+		}
+		for _, h := range hs {
+			res.Items = append(res.Items, NewHistoryModel(h, res.Height))
+		}
+		res.Next = next
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户账号的余额,根据收支记录汇总,没有补全记录的账号先从链上补全
+func userBalanceAPI(c *gin.Context) {
+	args := struct {
+		Accs []xginx.Address `form:"accs" binding:"dive,IsAddress"` //只返回这些账号
+		Tags []string        `form:"tags"`                          //只返回包含任意一个标签的账号
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	type item struct {
+		Account xginx.Address `json:"account"` //账号
+		In      xginx.Amount  `json:"in"`      //总收入
+		Out     xginx.Amount  `json:"out"`     //总支出
+		Balance xginx.Amount  `json:"balance"` //余额
+	}
+	res := struct {
+		Code  int          `json:"code"`
+		Total xginx.Amount `json:"total"` //所有账号余额
+		Items []item       `json:"items"`
+	}{
+		Code:  0,
+		Items: []item{},
+	}
+	flt := core.CoinFilter{Accs: args.Accs, Tags: util.RemoveRepeat(args.Tags)}
+	bi := xginx.GetBlockIndex()
+	err := app.UseDb(func(db core.IDbImp) error {
+		bs, err := core.UserBalances(db, bi, uid, flt)
+		if err != nil {
+			return err
+		}
+		for _, b := range bs {
+			res.Items = append(res.Items, item{
+				Account: b.Account,
+				In:      b.In,
+				Out:     b.Out,
+				Balance: b.Balance(),
+			})
+			res.Total += b.Balance()
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/cxuhua/xmgrs/util"
+)
+
+//PageArgs 列表接口的分页和过滤参数
+//返回 {code,items,next},next不为空时作为cursor获取下一页
+type PageArgs struct {
+	Limit  int             `form:"limit" binding:"gte=0"`         //每页数量,为0使用默认数量
+	Cursor string          `form:"cursor"`                        //上一页返回的next,为空从第一条开始
+	Sort   string          `form:"sort"`                          //排序字段 id time value height,每个接口支持的不同
+	Desc   bool            `form:"desc"`                          //是否降序
+	Accs   []xginx.Address `form:"accs" binding:"dive,IsAddress"` //只返回这些账号相关的记录
+	Tags   []string        `form:"tags"`                          //只返回包含任意一个标签的账号相关的记录
+	States []int           `form:"states"`                        //交易状态
+	Start  int64           `form:"start"`                         //开始时间,包含
+	End    int64           `form:"end"`                           //结束时间,不包含
+}
+
+//Page 获取分页参数,sorts是接口支持的排序字段,第一个是默认字段
+func (args PageArgs) Page(sorts ...string) (core.Page, error) {
+	p := core.Page{
+		Limit:  args.Limit,
+		Cursor: args.Cursor,
+		Sort:   args.Sort,
+		Desc:   args.Desc,
+	}
+	err := p.Check(sorts...)
+	return p, err
+}
+
+//Filter 获取过滤条件
+func (args PageArgs) Filter() core.ListFilter {
+	f := core.ListFilter{
+		CoinFilter: core.CoinFilter{
+			Accs: args.Accs,
+			Tags: util.RemoveRepeat(args.Tags),
+		},
+		Start: args.Start,
+		End:   args.End,
+	}
+	for _, v := range args.States {
+		f.States = append(f.States, core.TTxState(v))
+	}
+	return f
+}
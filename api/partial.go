@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/cxuhua/xmgrs/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//PartialCoinModel 输入引用的金额
+type PartialCoinModel struct {
+	Idx    int           `json:"idx"`    //输入索引
+	Addr   xginx.Address `json:"addr"`   //金额所属地址
+	Value  xginx.Amount  `json:"value"`  //金额
+	Script string        `json:"script"` //锁定脚本
+}
+
+//PartialSigModel 等待签名的记录
+type PartialSigModel struct {
+	ID    string `json:"id"`   //签名记录id,导入签名时使用
+	KeyID string `json:"kid"`  //私钥id
+	Pks   string `json:"pks"`  //hex格式公钥
+	Hash  string `json:"hash"` //hex格式需要签名的hash
+	Idx   int    `json:"idx"`  //输入索引
+	Ext   bool   `json:"ext"`  //是否是只读账号的外部签名
+	Mine  bool   `json:"mine"` //是否需要当前用户签名
+}
+
+//PartialTxModel 部分签名交易
+type PartialTxModel struct {
+	Tx    TTxModel           `json:"tx"`
+	Coins []PartialCoinModel `json:"coins"`
+	Sigs  []PartialSigModel  `json:"sigs"`
+}
+
+//NewPartialTxModel 创建部分签名交易model
+func NewPartialTxModel(ptx *core.PartialTx, uid primitive.ObjectID, bi *xginx.BlockIndex) PartialTxModel {
+	m := PartialTxModel{
+		Tx:    NewTTxModel(ptx.Tx, bi),
+		Coins: []PartialCoinModel{},
+		Sigs:  []PartialSigModel{},
+	}
+	for _, coin := range ptx.Coins {
+		m.Coins = append(m.Coins, PartialCoinModel{
+			Idx:    coin.Idx,
+			Addr:   coin.Addr,
+			Value:  coin.Value,
+			Script: util.ScriptToStr(coin.Script),
+		})
+	}
+	for _, sig := range ptx.Sigs {
+		m.Sigs = append(m.Sigs, PartialSigModel{
+			ID:    sig.ID.Hex(),
+			KeyID: sig.KeyID,
+			Pks:   hex.EncodeToString(sig.Pks.Bytes()),
+			Hash:  hex.EncodeToString(sig.Hash),
+			Idx:   sig.Idx,
+			Ext:   sig.External,
+			Mine:  core.ObjectIDEqual(sig.UserID, uid),
+		})
+	}
+	return m
+}
+
+//导出部分签名交易,离线签名使用
+func exportPartialTxAPI(c *gin.Context) {
+	args := struct {
+		ID string `form:"id" binding:"HexHash256"` //交易id hex格式
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Item PartialTxModel `json:"item"`
+	}
+	res := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	id := xginx.NewHASH256(args.ID)
+	bi := xginx.GetBlockIndex()
+	err := app.UseDb(func(db core.IDbImp) error {
+		ttx, err := db.GetTx(id.Bytes())
+		if err != nil {
+			res.Code = 101
+			return err
+		}
+		//交易创建者或者需要签名的用户可以导出
+		if !core.ObjectIDEqual(ttx.UserID, uid) {
+			sigs, err := db.ListUserSigs(uid, id)
+			if err != nil || len(sigs) == 0 {
+				res.Code = 103
+				return errors.New("no access")
+			}
+		}
+		ptx, err := ttx.NewPartial(db, bi)
+		if err != nil {
+			res.Code = 102
+			return err
+		}
+		res.Item = NewPartialTxModel(ptx, uid, bi)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(res.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//解析签名参数 id:sigs
+func parseExternalSig(s string) (primitive.ObjectID, []byte, error) {
+	vs := strings.Split(s, ":")
+	if len(vs) != 2 {
+		return primitive.NilObjectID, nil, fmt.Errorf("sigs %s format error", s)
+	}
+	id, err := primitive.ObjectIDFromHex(strings.TrimSpace(vs[0]))
+	if err != nil {
+		return primitive.NilObjectID, nil, err
+	}
+	sb, err := hex.DecodeString(strings.TrimSpace(vs[1]))
+	if err != nil {
+		return primitive.NilObjectID, nil, err
+	}
+	return id, sb, nil
+}
+
+//导入离线签名,验证成功后保存
+func importSigsAPI(c *gin.Context) {
+	args := struct {
+		ID   string   `form:"id" binding:"HexHash256"` //交易id hex格式
+		Sigs []string `form:"sigs" binding:"gt=0"`     //签名记录id:hex格式签名
+		OTP  string   `form:"otp"`                     //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Sign bool `json:"sign"` //交易是否已经完成签名
+	}
+	res := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	id := xginx.NewHASH256(args.ID)
+	bi := xginx.GetBlockIndex()
+	err := app.UseTx(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			res.Code = 101
+			return err
+		}
+		ttx, err := db.GetTx(id.Bytes())
+		if err != nil {
+			res.Code = 102
+			return err
+		}
+		for _, s := range args.Sigs {
+			sid, sb, err := parseExternalSig(s)
+			if err != nil {
+				res.Code = 103
+				return err
+			}
+			err = ttx.SetExternalSig(db, bi, uid, sid, sb)
+			if err != nil {
+				res.Code = 104
+				return err
+			}
+		}
+		ttx.PublishCosigned(db, uid)
+		res.Sign, err = ttx.SetSigned(db, bi)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(res.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
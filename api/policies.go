@@ -0,0 +1,247 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//ViolationModel 违反的策略规则
+type ViolationModel struct {
+	Account xginx.Address `json:"acc"`  //账号
+	Rule    string        `json:"rule"` //tx_limit day_limit whitelist window
+	Message string        `json:"msg"`  //详细信息
+}
+
+//ViolationsModel 违反账号策略时返回
+type ViolationsModel struct {
+	Model
+	Items []ViolationModel `json:"items"`
+}
+
+//NewErrorModel 创建错误信息,违反账号策略时返回违反的规则
+func NewErrorModel(code int, err error) interface{} {
+	var perr *core.PolicyError
+	if !errors.As(err, &perr) {
+		return NewModel(code, err)
+	}
+	m := ViolationsModel{
+		Model: NewModel(code, err),
+		Items: []ViolationModel{},
+	}
+	for _, v := range perr.Violations {
+		m.Items = append(m.Items, ViolationModel{Account: v.Account, Rule: v.Rule, Message: v.Message})
+	}
+	return m
+}
+
+//PolicyModel 账号策略
+type PolicyModel struct {
+	TxLimit   xginx.Amount    `json:"txl"`   //单笔交易限额
+	DayLimit  xginx.Amount    `json:"dayl"`  //每日限额
+	Whitelist []xginx.Address `json:"wl"`    //目标地址白名单
+	Days      []int           `json:"days"`  //允许签名的星期
+	Start     int             `json:"start"` //允许签名的开始时间,一天中的分钟数
+	End       int             `json:"end"`   //允许签名的结束时间,一天中的分钟数
+}
+
+//NewPolicyModel 创建账号策略model
+func NewPolicyModel(p core.TPolicy) PolicyModel {
+	m := PolicyModel{
+		TxLimit:   p.TxLimit,
+		DayLimit:  p.DayLimit,
+		Whitelist: p.Whitelist,
+		Days:      p.Window.Days,
+		Start:     p.Window.Start,
+		End:       p.Window.End,
+	}
+	if m.Whitelist == nil {
+		m.Whitelist = []xginx.Address{}
+	}
+	if m.Days == nil {
+		m.Days = []int{}
+	}
+	return m
+}
+
+//PolicyChangeModel 策略修改申请
+type PolicyChangeModel struct {
+	ID       string        `json:"id"`       //申请id
+	Account  xginx.Address `json:"acc"`      //账号
+	UserID   string        `json:"uid"`      //申请用户
+	Policy   PolicyModel   `json:"policy"`   //新策略
+	Approves []string      `json:"approves"` //同意的用户
+	State    int           `json:"state"`    //0等待同意 1已生效 2被拒绝
+	Mine     bool          `json:"mine"`     //当前用户是否已经同意
+	Time     int64         `json:"time"`     //申请时间
+}
+
+//NewPolicyChangeModel 创建策略修改申请model
+func NewPolicyChangeModel(pc *core.TPolicyChange, uid primitive.ObjectID) PolicyChangeModel {
+	m := PolicyChangeModel{
+		ID:       pc.ID.Hex(),
+		Account:  pc.Account,
+		UserID:   pc.UserID.Hex(),
+		Policy:   NewPolicyModel(pc.Policy),
+		Approves: []string{},
+		State:    int(pc.State),
+		Mine:     pc.HasApprove(uid),
+		Time:     pc.Time,
+	}
+	for _, v := range pc.Approves {
+		m.Approves = append(m.Approves, v.Hex())
+	}
+	return m
+}
+
+//申请修改账号策略,账号有多个所有者时需要其他所有者同意
+func setPolicyAPI(c *gin.Context) {
+	args := struct {
+		ID        xginx.Address   `form:"id" binding:"IsAddress"`            //账号
+		TxLimit   string          `form:"txl" binding:"omitempty,IsAmount"`  //单笔交易限额,为空不限制
+		DayLimit  string          `form:"dayl" binding:"omitempty,IsAmount"` //每日限额,为空不限制
+		Whitelist []xginx.Address `form:"wl" binding:"dive,IsAddress"`       //目标地址白名单
+		Days      []int           `form:"days" binding:"dive,min=0,max=6"`   //允许签名的星期,0是星期日
+		Start     int             `form:"start" binding:"min=0,max=1439"`    //允许签名的开始时间,一天中的分钟数
+		End       int             `form:"end" binding:"min=0,max=1439"`      //允许签名的结束时间,和开始时间相同不限制
+		OTP       string          `form:"otp"`                               //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	policy := core.TPolicy{
+		Whitelist: args.Whitelist,
+		Window: core.TPolicyWindow{
+			Days:  args.Days,
+			Start: args.Start,
+			End:   args.End,
+		},
+	}
+	var err error
+	if args.TxLimit != "" {
+		if policy.TxLimit, err = xginx.ParseAmount(args.TxLimit); err != nil {
+			c.JSON(http.StatusOK, NewModel(101, err))
+			return
+		}
+	}
+	if args.DayLimit != "" {
+		if policy.DayLimit, err = xginx.ParseAmount(args.DayLimit); err != nil {
+			c.JSON(http.StatusOK, NewModel(101, err))
+			return
+		}
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code int               `json:"code"`
+		Item PolicyChangeModel `json:"item"`
+	}{
+		Code: 0,
+	}
+	err = app.UseTx(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			return err
+		}
+		pc, err := core.ProposePolicy(db, args.ID, uid, policy)
+		if err != nil {
+			return err
+		}
+		res.Item = NewPolicyChangeModel(pc, uid)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//同意或者拒绝策略修改申请
+func approvePolicyAPI(c *gin.Context) {
+	args := struct {
+		ID      string `form:"id" binding:"required"` //申请id
+		Approve bool   `form:"approve"`               //true同意 false拒绝
+		OTP     string `form:"otp"`                   //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code int               `json:"code"`
+		Item PolicyChangeModel `json:"item"`
+	}{
+		Code: 0,
+	}
+	err = app.UseTx(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			return err
+		}
+		pc, err := db.GetPolicyChange(id)
+		if err != nil {
+			return err
+		}
+		err = pc.Approve(db, uid, args.Approve)
+		if err != nil {
+			return err
+		}
+		res.Item = NewPolicyChangeModel(pc, uid)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户账号等待同意的策略修改申请
+func listPolicyChangesAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int                 `json:"code"`
+		Items []PolicyChangeModel `json:"items"`
+	}{
+		Code:  0,
+		Items: []PolicyChangeModel{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		accs, err := db.ListAccounts(uid)
+		if err != nil {
+			return err
+		}
+		for _, acc := range accs {
+			pcs, err := db.ListPolicyChanges(acc.ID)
+			if err != nil {
+				return err
+			}
+			for _, pc := range pcs {
+				if pc.State != core.TPolicyChangePending {
+					continue
+				}
+				res.Items = append(res.Items, NewPolicyChangeModel(pc, uid))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/cxuhua/xmgrs/util"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//ScheduleModel 计划付款
+type ScheduleModel struct {
+	ID      string          `json:"id"`             //计划id
+	Desc    string          `json:"desc"`           //描述
+	Dst     []string        `json:"dst"`            //addr->amount,script
+	Fee     string          `json:"fee"`            //固定交易费
+	Rate    int64           `json:"rate"`           //每字节交易费
+	Level   string          `json:"level"`          //估算交易费的优先级
+	Coin    string          `json:"coin"`           //金额选择策略
+	Accs    []xginx.Address `json:"accs"`           //使用的账号
+	Tags    []string        `json:"tags"`           //使用的账号标签
+	Keep    string          `json:"keep"`           //找零策略
+	KAcc    xginx.Address   `json:"kacc"`           //找零账号
+	Cron    string          `json:"cron"`           //执行计划,为空只执行一次
+	Auto    bool            `json:"auto"`           //自动签名并发布
+	Enable  bool            `json:"enable"`         //是否启用
+	Next    int64           `json:"next"`           //下次执行时间
+	Last    int64           `json:"last"`           //最后执行时间
+	LastTx  string          `json:"ltx,omitempty"`  //最后创建的交易
+	LastErr string          `json:"lerr,omitempty"` //最后执行错误
+	Runs    int             `json:"runs"`           //执行次数
+	Time    int64           `json:"time"`           //创建时间
+}
+
+//NewScheduleModel 创建计划付款model
+func NewScheduleModel(s *core.TSchedule) ScheduleModel {
+	m := ScheduleModel{
+		ID:      s.ID.Hex(),
+		Desc:    s.Desc,
+		Dst:     s.Dst,
+		Fee:     s.Fee,
+		Rate:    s.Rate,
+		Level:   s.Level,
+		Coin:    s.Coin,
+		Accs:    s.Accs,
+		Tags:    s.Tags,
+		Keep:    s.Keep,
+		KAcc:    s.KAcc,
+		Cron:    s.Cron,
+		Auto:    s.Auto,
+		Enable:  s.Enable,
+		Next:    s.Next,
+		Last:    s.Last,
+		LastErr: s.LastErr,
+		Runs:    s.Runs,
+		Time:    s.Time,
+	}
+	if len(s.LastTx) > 0 {
+		m.LastTx = xginx.NewHASH256(s.LastTx).String()
+	}
+	return m
+}
+
+//执行计划付款,在计划执行记录的事务中创建交易
+func scheduleTx(db core.IDbImp, s *core.TSchedule) (*core.TTx, error) {
+	bi := xginx.GetBlockIndex()
+	fee, rate, err := parseTxFee(bi, s.Fee, s.Rate, s.Level)
+	if err != nil {
+		return nil, err
+	}
+	sel, err := core.GetCoinSelector(s.Coin)
+	if err != nil {
+		return nil, err
+	}
+	opts := txOptions{
+		Fee:    fee,
+		Rate:   rate,
+		Sel:    sel,
+		Filter: core.CoinFilter{Accs: s.Accs, Tags: s.Tags},
+		Keep:   core.KeepPolicy(s.Keep),
+		KAcc:   s.KAcc,
+	}
+	user, err := db.GetUserInfo(s.UserID)
+	if err != nil {
+		return nil, err
+	}
+	//每次执行时解析,使用地址簿中联系人最新的地址
+	avs := []AddrValue{}
+	for _, dst := range s.Dst {
+		av, err := parseUserAddrValue(db, user, dst)
+		if err != nil {
+			return nil, err
+		}
+		avs = append(avs, av)
+	}
+	tx, lis, err := newUserTx(db, bi, user, avs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return saveUserTx(db, bi, user, tx, lis, s.Desc)
+}
+
+//自动签名的计划签名完成后发布,签名失败时交易保留,可以手动签名
+func scheduleDone(app *core.App) core.ScheduleDone {
+	return func(s *core.TSchedule, ttx *core.TTx) error {
+		if !s.Auto || ttx == nil {
+			return nil
+		}
+		bi := xginx.GetBlockIndex()
+		return app.UseTx(func(db core.IDbImp) error {
+			stx, err := signUserTx(db, bi, s.UserID, xginx.NewHASH256(ttx.ID))
+			if err != nil {
+				return err
+			}
+			//还需要其他用户签名
+			if stx.State != core.TTxStateSign {
+				return nil
+			}
+			return pushUserTx(db, bi, stx)
+		})
+	}
+}
+
+//RunScheduler 定时执行到期的计划付款,直到ctx结束
+func RunScheduler(ctx context.Context, app *core.App) {
+	ticker := time.NewTicker(core.ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			num, err := app.RunSchedules(now, scheduleTx, scheduleDone(app))
+			if err != nil {
+				xginx.LogError("run schedules error", err)
+			}
+			if num > 0 {
+				xginx.LogInfof("run %d schedules", num)
+			}
+		}
+	}
+}
+
+//创建计划付款
+func createScheduleAPI(c *gin.Context) {
+	args := struct {
+		Dst   []string        `form:"dst" binding:"gt=0"`                 //addr->amount,script 或者 @label->amount
+		Fee   string          `form:"fee" binding:"omitempty,IsAmount"`   //交易费,为空时按每字节交易费计算
+		Rate  int64           `form:"rate" binding:"gte=0"`               //每字节交易费,最小单位
+		Level string          `form:"level"`                              //估算交易费的优先级 low normal high
+		Coin  string          `form:"coin"`                               //金额选择策略
+		Accs  []xginx.Address `form:"accs" binding:"dive,IsAddress"`      //只使用这些账号的金额,自动签名时必须设置
+		Tags  []string        `form:"tags"`                               //只使用包含这些标签的账号的金额
+		Keep  string          `form:"keep"`                               //找零策略
+		KAcc  xginx.Address   `form:"kacc" binding:"omitempty,IsAddress"` //找零账号
+		Cron  string          `form:"cron"`                               //分 时 日 月 星期,为空时在at执行一次
+		At    int64           `form:"at"`                                 //开始时间,为空从现在开始
+		Auto  bool            `form:"auto"`                               //自动签名并发布
+		Desc  string          `form:"desc"`                               //描述
+		OTP   string          `form:"otp"`                                //两步验证码,自动签名时需要
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	if _, err := core.GetCoinSelector(args.Coin); err != nil {
+		c.JSON(http.StatusOK, NewModel(102, err))
+		return
+	}
+	at := time.Now()
+	if args.At > 0 {
+		at = time.Unix(args.At, 0)
+	}
+	uid := GetAppUserID(c)
+	s, err := core.NewSchedule(uid, args.Cron, at)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(103, err))
+		return
+	}
+	s.Desc = args.Desc
+	s.Dst = args.Dst
+	s.Fee = args.Fee
+	s.Rate = args.Rate
+	s.Level = args.Level
+	s.Coin = args.Coin
+	s.Accs = args.Accs
+	s.Tags = util.RemoveRepeat(args.Tags)
+	s.Keep = args.Keep
+	s.KAcc = args.KAcc
+	s.Auto = args.Auto
+	app := core.GetApp(c)
+	code := 200
+	err = app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			return err
+		}
+		for _, dst := range args.Dst {
+			if _, err := parseUserAddrValue(db, user, dst); err != nil {
+				code = 101
+				return err
+			}
+		}
+		if s.Auto {
+			err := checkUserOTP(db, uid, args.OTP)
+			if err != nil {
+				return err
+			}
+			err = core.CheckAutoSign(db, uid, s.Accs)
+			if err != nil {
+				return err
+			}
+		}
+		return db.InsertSchedule(s)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	res := struct {
+		Code int           `json:"code"`
+		Item ScheduleModel `json:"item"`
+	}{
+		Code: 0,
+		Item: NewScheduleModel(s),
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户的计划付款
+func listSchedulesAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int             `json:"code"`
+		Items []ScheduleModel `json:"items"`
+	}{
+		Code:  0,
+		Items: []ScheduleModel{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		ss, err := db.ListSchedules(uid)
+		if err != nil {
+			return err
+		}
+		for _, s := range ss {
+			res.Items = append(res.Items, NewScheduleModel(s))
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取自己的计划付款
+func getUserSchedule(db core.IDbImp, uid primitive.ObjectID, sid string) (*core.TSchedule, error) {
+	id, err := primitive.ObjectIDFromHex(sid)
+	if err != nil {
+		return nil, err
+	}
+	s, err := db.GetSchedule(id)
+	if err != nil {
+		return nil, err
+	}
+	if !core.ObjectIDEqual(s.UserID, uid) {
+		return nil, errors.New("schedule not found")
+	}
+	return s, nil
+}
+
+//启用或者停用计划付款,启用时从现在开始计算下次执行时间
+func setScheduleAPI(c *gin.Context) {
+	args := struct {
+		ID     string `form:"id" binding:"required"` //计划id
+		Enable bool   `form:"enable"`                //是否启用
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		s, err := getUserSchedule(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		if args.Enable && !s.Enable {
+			//只执行一次的计划执行后不能再启用
+			if s.Cron == "" && s.Runs > 0 {
+				return errors.New("schedule finished")
+			}
+			if s.Cron != "" {
+				s.Next, err = s.NextTime(time.Now())
+				if err != nil {
+					return err
+				}
+			}
+		}
+		s.Enable = args.Enable
+		return db.UpdateSchedule(s)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//删除计划付款
+func deleteScheduleAPI(c *gin.Context) {
+	args := struct {
+		ID string `form:"id" binding:"required"` //计划id
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		s, err := getUserSchedule(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		return db.DeleteSchedule(s.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//TokenModel 登陆或者刷新token返回
+type TokenModel struct {
+	Model
+	Token         string `json:"token"`          //access token
+	Refresh       string `json:"refresh"`        //refresh token
+	TokenExpire   int64  `json:"token_expire"`   //access token过期时间
+	RefreshExpire int64  `json:"refresh_expire"` //refresh token过期时间
+}
+
+//NewTokenModel 创建token返回
+func NewTokenModel(tk *core.SessionToken) TokenModel {
+	return TokenModel{
+		Token:         tk.Access,
+		Refresh:       tk.Refresh,
+		TokenExpire:   tk.AccessExpire,
+		RefreshExpire: tk.RefreshExpire,
+	}
+}
+
+//使用refresh token换取新的token
+func refreshTokenAPI(c *gin.Context) {
+	args := struct {
+		Refresh string `form:"refresh" binding:"required"` //refresh token
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	rv := TokenModel{}
+	app := core.GetApp(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		_, tk, err := app.RefreshSession(db, args.Refresh, c.ClientIP())
+		if err != nil {
+			return err
+		}
+		rv = NewTokenModel(tk)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
+//获取用户登陆的设备会话
+func listSessionsAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	sid := GetAppSessionID(c)
+	type item struct {
+		ID      string `json:"id"`      //会话id
+		Device  string `json:"device"`  //设备标识
+		Agent   string `json:"agent"`   //user agent
+		IP      string `json:"ip"`      //ip地址
+		Time    int64  `json:"time"`    //登陆时间
+		Last    int64  `json:"last"`    //最后活跃时间
+		Current bool   `json:"current"` //是否是当前会话
+	}
+	type result struct {
+		Code  int    `json:"code"`
+		Items []item `json:"items"`
+	}
+	res := result{
+		Code:  0,
+		Items: []item{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		ss, err := db.ListSessions(uid)
+		if err != nil {
+			return err
+		}
+		for _, v := range ss {
+			i := item{
+				ID:      v.ID.Hex(),
+				Device:  v.Device,
+				Agent:   v.Agent,
+				IP:      v.IP,
+				Time:    v.Time,
+				Last:    v.Last,
+				Current: v.ID == sid,
+			}
+			res.Items = append(res.Items, i)
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//注销一个会话
+func revokeSessionAPI(c *gin.Context) {
+	args := struct {
+		ID string `form:"id" binding:"required"` //会话id
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err = app.UseDb(func(db core.IDbImp) error {
+		sess, err := db.GetSession(id)
+		if err != nil {
+			return err
+		}
+		if !core.ObjectIDEqual(sess.UserID, uid) {
+			return errors.New("no access")
+		}
+		return core.RevokeSession(db, sess)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//注销所有会话,包括当前会话
+func revokeSessionsAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		return core.RevokeUserSessions(db, uid)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//检测用户两步验证码,未启用两步验证时直接通过
+func checkUserOTP(db core.IDbImp, uid primitive.ObjectID, code string) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	return user.CheckTOTP(db, code)
+}
+
+//开始绑定两步验证,返回密钥,验证一次后生效
+func enrollTOTPAPI(c *gin.Context) {
+	args := struct {
+		Pass string `form:"pass" binding:"required"` //登陆密码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Secret string `json:"secret"` //base32密钥
+		URL    string `json:"url"`    //otpauth地址,生成二维码使用
+	}
+	rv := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		if !user.CheckPass(args.Pass) {
+			rv.Code = 102
+			return errors.New("password error")
+		}
+		if user.TOTP.IsEnable() {
+			rv.Code = 103
+			return errors.New("totp enabled")
+		}
+		totp, secret, err := core.NewTOTP()
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		err = db.SetUserTOTP(user.ID, totp)
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		rv.Secret = secret
+		rv.URL = core.TOTPURL(user.Mobile, secret)
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
+//验证并启用两步验证,返回恢复码
+func verifyTOTPAPI(c *gin.Context) {
+	args := struct {
+		Code string `form:"code" binding:"required"` //验证器上的验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Recovery []string `json:"recovery"` //恢复码,只返回一次
+	}
+	rv := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		if user.TOTP.IsEnable() || len(user.TOTP.Secret) == 0 {
+			rv.Code = 102
+			return errors.New("totp not enrolled")
+		}
+		totp := user.TOTP
+		if _, ok := totp.Check(args.Code, time.Now()); !ok {
+			rv.Code = 103
+			return core.ErrTOTPCode
+		}
+		rv.Recovery, err = totp.NewRecovery()
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		totp.Enable = true
+		err = db.SetUserTOTP(user.ID, totp)
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
+//关闭两步验证
+func disableTOTPAPI(c *gin.Context) {
+	args := struct {
+		Pass string `form:"pass" binding:"required"` //登陆密码
+		OTP  string `form:"otp" binding:"required"`  //验证码或者恢复码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	rv := Model{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		if !user.CheckPass(args.Pass) {
+			rv.Code = 102
+			return errors.New("password error")
+		}
+		if !user.TOTP.IsEnable() {
+			rv.Code = 103
+			return errors.New("totp not enabled")
+		}
+		err = user.CheckTOTP(db, args.OTP)
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		return db.SetUserTOTP(user.ID, core.TTOTP{})
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/cxuhua/xmgrs/util"
 
@@ -204,6 +205,39 @@ func getTxInfoAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+//获取每字节交易费建议
+func feeRatesAPI(c *gin.Context) {
+	bi := xginx.GetBlockIndex()
+	fr := core.GetFeeEstimator().Estimate(bi)
+	type item struct {
+		Level string       `json:"level"` //优先级
+		Rate  xginx.Amount `json:"rate"`  //每字节交易费
+	}
+	res := struct {
+		Code   int    `json:"code"`
+		Items  []item `json:"items"`
+		Blocks int    `json:"blocks"` //统计的区块数量
+		Txs    int    `json:"txs"`    //统计的区块中交易数量
+		Pool   int    `json:"pool"`   //统计的交易池中交易数量
+		Skip   int    `json:"skip"`   //无法计算交易费没有统计的交易数量
+	}{
+		Code:   0,
+		Items:  []item{},
+		Blocks: fr.Blocks,
+		Txs:    fr.Txs,
+		Pool:   fr.Pool,
+		Skip:   fr.Skip,
+	}
+	for _, level := range []core.FeeLevel{core.FeeLevelLow, core.FeeLevelNormal, core.FeeLevelHigh} {
+		rate, err := fr.Get(level)
+		if err != nil {
+			continue
+		}
+		res.Items = append(res.Items, item{Level: string(level), Rate: rate})
+	}
+	c.JSON(http.StatusOK, res)
+}
+
 //发布交易
 func submitTxAPI(c *gin.Context) {
 	args := struct {
@@ -217,7 +251,6 @@ func submitTxAPI(c *gin.Context) {
 	app := core.GetApp(c)
 	uid := GetAppUserID(c)
 	bi := xginx.GetBlockIndex()
-	var tx *xginx.TX = nil
 	err := app.UseTx(func(db core.IDbImp) error {
 		ttx, err := db.GetTx(id.Bytes())
 		if err != nil {
@@ -230,20 +263,7 @@ func submitTxAPI(c *gin.Context) {
 		if !core.ObjectIDEqual(ttx.UserID, uid) {
 			return errors.New("not mine ttx")
 		}
-		tx, err = ttx.ToTx(db, bi)
-		if err != nil {
-			return err
-		}
-		err = ttx.SetTxState(db, core.TTxStatePool)
-		if err != nil {
-			return err
-		}
-		txp := bi.GetTxPool()
-		err = txp.PushTx(bi, tx)
-		if err != nil {
-			return err
-		}
-		return nil
+		return pushUserTx(db, bi, ttx)
 	})
 	if err != nil {
 		c.JSON(http.StatusOK, NewModel(200, err))
@@ -252,54 +272,178 @@ func submitTxAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, NewModel(0, "OK"))
 }
 
+//发布交易到交易池
+func pushUserTx(db core.IDbImp, bi *xginx.BlockIndex, ttx *core.TTx) error {
+	if ttx.IsDead(time.Now()) {
+		return errors.New("tx cancelled or expired")
+	}
+	tx, err := ttx.ToTx(db, bi)
+	if err != nil {
+		return err
+	}
+	//进入交易池成功后才更新状态,更新失败时区块连接时会根据交易id更新
+	txp := bi.GetTxPool()
+	err = txp.PushTx(bi, tx)
+	if err != nil {
+		return err
+	}
+	return ttx.SetTxState(db, core.TTxStatePool)
+}
+
+//解析交易费,固定交易费为空时使用每字节交易费,都为空时按优先级估算每字节交易费
+func parseTxFee(bi *xginx.BlockIndex, fee string, rate int64, level string) (xginx.Amount, xginx.Amount, error) {
+	if fee != "" {
+		amt, err := xginx.ParseAmount(fee)
+		return amt, 0, err
+	}
+	if rate > 0 {
+		return 0, xginx.Amount(rate), nil
+	}
+	amt, err := core.GetFeeEstimator().Estimate(bi).Get(core.FeeLevel(level))
+	return 0, amt, err
+}
+
+//创建交易的设置
+type txOptions struct {
+	Fee    xginx.Amount       //固定交易费
+	Rate   xginx.Amount       //每字节交易费,固定交易费为0时使用
+	Script string             //交易脚本
+	Ext    bool               //允许使用只读账号
+	Sel    core.ICoinSelector //金额选择策略
+	Filter core.CoinFilter    //限制使用的账号
+	Keep   core.KeepPolicy    //找零策略
+	KAcc   xginx.Address      //找零账号
+}
+
+//创建用户交易,返回交易和签名监听器
+func newUserTx(db core.IDbImp, bi *xginx.BlockIndex, user *core.TUser, avs []AddrValue, opts txOptions) (*xginx.TX, *core.DbSignListener, error) {
+	amt := xginx.Amount(0)
+	for _, av := range avs {
+		amt += av.Value
+	}
+	lis := core.NewSignListener(db, user)
+	lis.SetExternal(opts.Ext)
+	lis.SetFilter(opts.Filter)
+	err := lis.SetKeep(opts.Keep, opts.KAcc)
+	if err != nil {
+		return nil, nil, err
+	}
+	newtx := func(fee xginx.Amount) (*xginx.TX, error) {
+		lis.SetSelector(opts.Sel, amt+fee)
+		mi := bi.NewTrans(lis)
+		for _, av := range avs {
+			mi.Add(av.Addr, av.Value, xginx.Script(av.OutScript))
+		}
+		mi.Fee = fee
+		tx, err := mi.NewTx(0, []byte(opts.Script))
+		//优先返回获取找零地址的错误
+		if kerr := lis.KeepErr(); kerr != nil {
+			return nil, kerr
+		}
+		return tx, err
+	}
+	var tx *xginx.TX
+	if opts.Fee == 0 && opts.Rate > 0 {
+		//选择金额后根据交易大小计算交易费
+		tx, _, err = core.NewTxWithFeeRate(opts.Rate, newtx)
+	} else {
+		tx, err = newtx(opts.Fee)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return tx, lis, nil
+}
+
+//保存交易,检查输入账号的策略并记录账号支出
+func saveUserTx(db core.IDbImp, bi *xginx.BlockIndex, user *core.TUser, tx *xginx.TX, lis *core.DbSignListener, desc string) (*core.TTx, error) {
+	ttx, err := user.SaveTx(db, tx, lis, desc)
+	if err != nil {
+		return nil, err
+	}
+	spends, err := ttx.CheckPolicy(db, bi, time.Now(), false)
+	if err != nil {
+		return nil, err
+	}
+	err = db.InsertSpends(spends...)
+	if err != nil {
+		return nil, err
+	}
+	ttx.PublishSignRequest(db)
+	return ttx, nil
+}
+
 //创建交易
 func createTxAPI(c *gin.Context) {
 	args := struct {
-		Dst    []string `form:"dst" binding:"gt=0"`        //addr->amount 向addr转amount个,使用script脚本
-		Fee    string   `form:"fee" binding:"IsAmount"`    //交易费
-		Desc   string   `form:"desc"`                      //描述
-		Script string   `form:"script" binding:"IsScript"` //交易脚本
+		Dst    []string        `form:"dst" binding:"gt=0"`                 //addr->amount 向addr转amount个,使用script脚本,@label->amount 向地址簿中的联系人转账
+		Fee    string          `form:"fee" binding:"omitempty,IsAmount"`   //交易费,为空时按每字节交易费计算
+		Rate   int64           `form:"rate" binding:"gte=0"`               //每字节交易费,最小单位
+		Level  string          `form:"level"`                              //没有交易费时使用估算的交易费 low normal high,默认normal
+		Desc   string          `form:"desc"`                               //描述
+		Script string          `form:"script" binding:"IsScript"`          //交易脚本
+		Ext    bool            `form:"external"`                           //允许使用只读账号,签名由外部提供
+		Coin   string          `form:"coin"`                               //金额选择策略 largest smallest bnb oldest
+		Accs   []xginx.Address `form:"accs" binding:"dive,IsAddress"`      //只使用这些账号的金额
+		Tags   []string        `form:"tags"`                               //只使用包含这些标签的账号的金额
+		Keep   string          `form:"keep"`                               //找零策略 spend account fresh,默认第一个账号
+		KAcc   xginx.Address   `form:"kacc" binding:"omitempty,IsAddress"` //account策略指定的找零账号
 	}{}
 	if err := c.ShouldBind(&args); err != nil {
 		c.JSON(http.StatusOK, NewModel(100, err))
 		return
 	}
-	fee, err := xginx.ParseAmount(args.Fee)
+	bi := xginx.GetBlockIndex()
+	fee, rate, err := parseTxFee(bi, args.Fee, args.Rate, args.Level)
 	if err != nil {
 		c.JSON(http.StatusOK, NewModel(101, err))
 		return
 	}
+	sel, err := core.GetCoinSelector(args.Coin)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(102, err))
+		return
+	}
+	opts := txOptions{
+		Fee:    fee,
+		Rate:   rate,
+		Script: args.Script,
+		Ext:    args.Ext,
+		Sel:    sel,
+		Filter: core.CoinFilter{Accs: args.Accs, Tags: util.RemoveRepeat(args.Tags)},
+		Keep:   core.KeepPolicy(args.Keep),
+		KAcc:   args.KAcc,
+	}
 	app := core.GetApp(c)
 	uid := GetAppUserID(c)
-	bi := xginx.GetBlockIndex()
 	var ttx *core.TTx = nil
+	code := 200
 	err = app.UseTx(func(db core.IDbImp) error {
 		user, err := db.GetUserInfo(uid)
 		if err != nil {
 			return err
 		}
-		lis := core.NewSignListener(db, user)
-		mi := bi.NewTrans(lis)
+		avs := []AddrValue{}
 		for _, dst := range args.Dst {
-			av, err := ParseAddrValue(dst)
+			av, err := parseUserAddrValue(db, user, dst)
 			if err != nil {
+				code = 103
 				return err
 			}
-			mi.Add(av.Addr, av.Value, xginx.Script(av.OutScript))
+			avs = append(avs, av)
 		}
-		mi.Fee = fee
-		tx, err := mi.NewTx(0, []byte(args.Script))
+		tx, lis, err := newUserTx(db, bi, user, avs, opts)
 		if err != nil {
 			return err
 		}
-		ttx, err = user.SaveTx(db, tx, lis, args.Desc)
+		ttx, err = saveUserTx(db, bi, user, tx, lis, args.Desc)
 		if err != nil {
 			return err
 		}
 		return nil
 	})
 	if err != nil {
-		c.JSON(http.StatusOK, NewModel(200, err))
+		c.JSON(http.StatusOK, NewErrorModel(code, err))
 		return
 	}
 	res := struct {
@@ -376,11 +520,19 @@ func createAccountAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+//私钥派生方式
+const (
+	PrivateModeHardened = "hardened"
+	PrivateModePublic   = "public"
+)
+
 //创建一个私钥
 func createUserPrivateAPI(c *gin.Context) {
 	args := struct {
-		Desc string   `form:"desc"` //私钥描述
-		Pass []string `form:"pass"` //私钥密码,如果有密码必须一致
+		Desc   string   `form:"desc"`   //私钥描述
+		Pass   []string `form:"pass"`   //私钥密码,如果有密码必须一致
+		Mode   string   `form:"mode"`   //派生方式 hardened(默认) public(使用扩展公钥,不需要密码)
+		Parent string   `form:"parent"` //public方式时从这个私钥派生,为空使用用户主私钥
 	}{}
 	if err := c.ShouldBind(&args); err != nil {
 		c.JSON(http.StatusOK, NewModel(100, err))
@@ -394,24 +546,46 @@ func createUserPrivateAPI(c *gin.Context) {
 		Desc   string `json:"desc"`
 		Cipher int    `json:"cipher"`
 		Index  uint32 `json:"index"`
+		XPub   string `json:"xpub"`
 		Time   int64  `json:"time"`
 	}
 	type result struct {
 		Code int  `json:"code"`
 		Item item `json:"item"`
 	}
+	if args.Mode != "" && args.Mode != PrivateModeHardened && args.Mode != PrivateModePublic {
+		c.JSON(http.StatusOK, NewModel(101, "mode error"))
+		return
+	}
 	m := result{}
 	err := app.UseTx(func(db core.IDbImp) error {
 		user, err := db.GetUserInfo(uid)
 		if err != nil {
 			return err
 		}
-		pri, err := user.NewPrivate(db, args.Desc, args.Pass...)
+		var pri *core.TPrivate
+		if args.Mode != PrivateModePublic {
+			pri, err = user.NewPrivate(db, args.Desc, args.Pass...)
+		} else if args.Parent == "" {
+			pri, err = user.NewPublicPrivate(db, args.Desc)
+		} else {
+			var parent *core.TPrivate
+			parent, err = db.GetUserPrivate(args.Parent, uid)
+			//升级后需要私钥密码重新生成扩展公钥
+			if err == nil && parent.XPub == "" && !parent.IsCipherPublicKey() {
+				err = parent.SetXPub(db, args.Pass...)
+			}
+			if err == nil {
+				pri, err = parent.NewPublic(db, args.Desc)
+			}
+		}
 		if err != nil {
 			return err
 		}
 		i := item{}
 		i.ID = pri.ID
+		i.Parent = pri.Root
+		i.XPub = pri.XPub
 		i.Index = pri.Idx
 		i.Desc = pri.Desc
 		i.Cipher = int(pri.Cipher)
@@ -428,6 +602,16 @@ func createUserPrivateAPI(c *gin.Context) {
 
 //获取用户的私钥
 func listPrivatesAPI(c *gin.Context) {
+	args := PageArgs{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortTime, core.PageSortID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
 	app := core.GetApp(c)
 	uid := GetAppUserID(c)
 	type item struct {
@@ -436,31 +620,36 @@ func listPrivatesAPI(c *gin.Context) {
 		Desc   string `json:"desc"`
 		Cipher int    `json:"cipher"`
 		Index  uint32 `json:"index"`
+		XPub   string `json:"xpub"`
 		Time   int64  `json:"time"`
 	}
 	type result struct {
 		Code  int    `json:"code"`
 		Items []item `json:"items"`
+		Next  string `json:"next"` //下一页游标,为空没有下一页
 	}
 	res := result{
 		Code:  0,
 		Items: []item{},
 	}
-	err := app.UseDb(func(db core.IDbImp) error {
-		pris, err := db.ListPrivates(uid)
+	err = app.UseDb(func(db core.IDbImp) error {
+		pris, next, err := db.PagePrivates(uid, args.Filter(), page)
 		if err != nil {
 			return err
 		}
 		for _, v := range pris {
 			i := item{
 				ID:     v.ID,
+				Parent: v.Root,
 				Desc:   v.Desc,
 				Cipher: int(v.Cipher),
 				Index:  v.Idx,
+				XPub:   v.XPub,
 				Time:   v.Time,
 			}
 			res.Items = append(res.Items, i)
 		}
+		res.Next = next
 		return nil
 	})
 	if err != nil {
@@ -479,22 +668,43 @@ func listTxsAPI(c *gin.Context) {
 		c.JSON(http.StatusOK, NewModel(100, err))
 		return
 	}
+	pargs := PageArgs{}
+	if err := c.ShouldBind(&pargs); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	//按照交易在索引中的顺序分页
+	page, err := pargs.Page(core.PageSortHeight)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(105, err))
+		return
+	}
 	bi := xginx.GetBlockIndex()
 	txs, err := bi.ListTxs(args.Addr)
 	if err != nil {
 		c.JSON(http.StatusOK, NewModel(101, err))
 		return
 	}
+	idxs, next, err := core.PageIndex(page, len(txs), func(i int) string {
+		return txs[i].TxID.String()
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(105, err))
+		return
+	}
 	res := struct {
 		Code   int       `json:"code"`
 		Height uint32    `json:"height"` //区块链高度
 		Items  []TxModel `json:"items"`
+		Next   string    `json:"next"` //下一页游标,为空没有下一页
 	}{
 		Height: bi.Height(),
 		Items:  []TxModel{},
+		Next:   next,
 	}
 	txp := bi.GetTxPool()
-	for _, v := range txs {
+	for _, i := range idxs {
+		v := txs[i]
 		if v.IsPool() {
 			tx, err := txp.Get(v.TxID)
 			if err != nil {
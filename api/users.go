@@ -1,9 +1,11 @@
 package api
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/cxuhua/xginx"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/cxuhua/xmgrs/util"
 
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 //导出账号地址
@@ -18,6 +21,7 @@ func exportAccountAPI(c *gin.Context) {
 	args := struct {
 		ID   xginx.Address `form:"id" binding:"IsAddress"` //账号id
 		Pass []string      `form:"pass"`                   //加密密码
+		OTP  string        `form:"otp"`                    //两步验证码
 	}{}
 	if err := c.ShouldBind(&args); err != nil {
 		c.JSON(http.StatusOK, NewModel(100, err))
@@ -27,6 +31,10 @@ func exportAccountAPI(c *gin.Context) {
 	uid := GetAppUserID(c)
 	var dump string
 	err := app.UseTx(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			return err
+		}
 		acc, err := db.GetAccount(args.ID)
 		if err != nil {
 			return err
@@ -34,6 +42,14 @@ func exportAccountAPI(c *gin.Context) {
 		if !acc.HasUserID(uid) {
 			return fmt.Errorf("no access")
 		}
+		if acc.Watch {
+			return core.ErrWatchOnly
+		}
+		//非强化派生的私钥和扩展公钥可以计算出同一个根派生的所有私钥
+		err = acc.CheckExport(db)
+		if err != nil {
+			return err
+		}
 		xacc, err := acc.ToAccount(db, true, args.Pass...)
 		if err != nil {
 			return err
@@ -90,25 +106,265 @@ func importAccountAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, NewModel(0, id))
 }
 
+//导入只读账号,只需要公钥,签名由外部提供
+func importWatchAccountAPI(c *gin.Context) {
+	args := struct {
+		Pks  []string `form:"pks" binding:"gt=0"` //hex格式的压缩公钥
+		Num  uint8    `form:"num"`                //公钥数量
+		Less uint8    `form:"less"`               //至少通过数量
+		Arb  bool     `form:"arb"`                //启用仲裁
+		Desc string   `form:"desc"`               //描述
+		Tags []string `form:"tags"`               //标签
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	pks := []xginx.PKBytes{}
+	for _, v := range args.Pks {
+		bs, err := hex.DecodeString(v)
+		if err != nil {
+			c.JSON(http.StatusOK, NewModel(101, err))
+			return
+		}
+		pub, err := xginx.NewPublicKey(bs)
+		if err != nil {
+			c.JSON(http.StatusOK, NewModel(101, err))
+			return
+		}
+		pks = append(pks, pub.GetPks())
+	}
+	var id xginx.Address
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseTx(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			return err
+		}
+		tacc, err := user.ImportWatchAccount(db, args.Num, args.Less, args.Arb, pks, args.Desc, util.RemoveRepeat(args.Tags))
+		if err != nil {
+			return err
+		}
+		id = tacc.ID
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, id))
+}
+
 //退出登陆
 func quitLoginAPI(c *gin.Context) {
 	app := core.GetApp(c)
-	uid := GetAppUserID(c)
+	sid := GetAppSessionID(c)
 	app.UseDb(func(db core.IDbImp) error {
-		user, err := db.GetUserInfo(uid)
+		sess, err := db.GetSession(sid)
 		if err != nil {
 			return err
 		}
-		return db.DelUserID(user.Token)
+		return core.RevokeSession(db, sess)
 	})
 	c.JSON(http.StatusOK, NewModel(0, "OK"))
 }
 
+//修改私钥密码,id为空时修改用户主私钥密码
+func setKeyPassAPI(c *gin.Context) {
+	args := struct {
+		ID  string `form:"id"`                     //私钥id
+		Old string `form:"old"`                    //旧密码
+		New string `form:"new" binding:"required"` //新密码
+		OTP string `form:"otp"`                    //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	if len(args.New) < 6 {
+		c.JSON(http.StatusOK, NewModel(101, "new pass length < 6"))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseTx(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			return err
+		}
+		if args.ID == "" {
+			return db.SetUserKeyPass(uid, args.Old, args.New)
+		}
+		return db.SetPrivateKeyPass(uid, args.ID, args.Old, args.New)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//生成非强化派生根的扩展公钥,旧用户开启公钥派生前调用
+func setUserXPubAPI(c *gin.Context) {
+	args := struct {
+		KPass string `form:"kpass"` //私钥密码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		XPub string `json:"xpub"` //扩展公钥
+	}
+	rv := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		dk, err := user.GetDeterKey(args.KPass)
+		if err != nil {
+			rv.Code = 102
+			return err
+		}
+		xpub, err := dk.PublicExtPub()
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
+		rv.XPub = xpub.Dump()
+		return db.SetUserXPub(user.ID, rv.XPub)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
+//导出主私钥助记词,需要登陆密码和私钥密码
+func exportMnemonicAPI(c *gin.Context) {
+	args := struct {
+		Pass  string `form:"pass" binding:"required"` //登陆密码
+		KPass string `form:"kpass"`                   //私钥密码
+		OTP   string `form:"otp"`                     //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Words string `json:"words"` //助记词
+	}
+	rv := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		if !user.CheckPass(args.Pass) {
+			rv.Code = 102
+			return errors.New("password error")
+		}
+		err = user.CheckTOTP(db, args.OTP)
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
+		dk, err := user.GetDeterKey(args.KPass)
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		rv.Words, err = dk.Mnemonic()
+		if err != nil {
+			rv.Code = 105
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
+//从助记词恢复主私钥,并恢复派生的私钥和账号
+func restoreMnemonicAPI(c *gin.Context) {
+	args := struct {
+		Pass    string `form:"pass" binding:"required"`  //登陆密码
+		Words   string `form:"words" binding:"required"` //助记词
+		KPass   string `form:"kpass"`                    //恢复后使用的私钥密码
+		OTP     string `form:"otp"`                      //两步验证码
+		Replace bool   `form:"replace"`                  //助记词和现有主私钥不同时是否替换
+		OPass   string `form:"opass"`                    //替换时需要的原私钥密码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	type result struct {
+		Model
+		Idx      uint32          `json:"idx"`      //派生索引
+		Privates []string        `json:"privates"` //恢复的私钥
+		Accounts []xginx.Address `json:"accounts"` //恢复的账号
+	}
+	rv := result{}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	bi := xginx.GetBlockIndex()
+	err := app.UseTx(func(db core.IDbImp) error {
+		user, err := db.GetUserInfo(uid)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		if !user.CheckPass(args.Pass) {
+			rv.Code = 102
+			return errors.New("password error")
+		}
+		err = user.CheckTOTP(db, args.OTP)
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
+		res, err := user.RestoreDeterKey(db, bi, args.Words, args.Replace, args.OPass, args.KPass)
+		if errors.Is(err, core.ErrRestoreMismatch) {
+			rv.Code = 105
+			return err
+		}
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		rv.Idx = res.Idx
+		rv.Privates = res.Privates
+		rv.Accounts = res.Accounts
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, rv)
+}
+
 //签名一个交易
 func signTxAPI(c *gin.Context) {
 	args := struct {
 		ID   string `form:"id" binding:"HexHash256"` //交易id hex格式
 		Pass string `form:"pass"`                    //私钥密码
+		OTP  string `form:"otp"`                     //两步验证码
 	}{}
 	if err := c.ShouldBind(&args); err != nil {
 		c.JSON(http.StatusOK, NewModel(100, err))
@@ -119,68 +375,180 @@ func signTxAPI(c *gin.Context) {
 	id := xginx.NewHASH256(args.ID)
 	bi := xginx.GetBlockIndex()
 	err := app.UseTx(func(db core.IDbImp) error {
-		ttx, err := db.GetTx(id.Bytes())
+		err := checkUserOTP(db, uid, args.OTP)
 		if err != nil {
 			return err
 		}
-		//如果不是新交易
-		if ttx.State != core.TTxStateNew {
-			return fmt.Errorf("new tx can sign")
+		_, err = signUserTx(db, bi, uid, id, args.Pass)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewErrorModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "SignOK"))
+}
+
+//签名需要用户签名的部分,所有签名完成时更新为已签名状态
+func signUserTx(db core.IDbImp, bi *xginx.BlockIndex, uid primitive.ObjectID, id xginx.HASH256, pass ...string) (*core.TTx, error) {
+	ttx, err := db.GetTx(id.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	//如果不是新交易
+	if ttx.State != core.TTxStateNew {
+		return nil, fmt.Errorf("new tx can sign")
+	}
+	now := time.Now()
+	if ttx.IsExpired(now) {
+		return nil, fmt.Errorf("tx expired")
+	}
+	//签名前检查输入账号的策略
+	if _, err := ttx.CheckPolicy(db, bi, now, true); err != nil {
+		return nil, err
+	}
+	//获取需要我签名的信息
+	sigs, err := db.ListUserSigs(uid, id)
+	if err != nil {
+		return nil, err
+	}
+	//开始签名,外部签名的记录需要单独导入
+	signed := false
+	for _, sig := range sigs {
+		if sig.IsSign || sig.External {
+			continue
 		}
-		//获取需要我签名的信息
-		sigs, err := db.ListUserSigs(uid, id)
+		err := sig.Sign(db, pass...)
 		if err != nil {
-			return err
-		}
-		//开始签名
-		for _, sig := range sigs {
-			if sig.IsSign {
-				continue
-			}
-			err := sig.Sign(db, args.Pass)
-			if err != nil {
-				return err
-			}
+			return nil, err
 		}
-		//再次查询交易信息
-		ttx, err = db.GetTx(id.Bytes())
+		signed = true
+	}
+	//再次查询交易信息
+	ttx, err = db.GetTx(id.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		ttx.PublishCosigned(db, uid)
+	}
+	//如果签名验证成功,更新为已经签名，否则需要等待所有签名执行完成
+	if ttx.Verify(db, bi) {
+		err = ttx.SetTxState(db, core.TTxStateSign)
+	}
+	return ttx, err
+}
+
+//撤回自己创建的交易
+func cancelTxAPI(c *gin.Context) {
+	args := struct {
+		ID     string `form:"id" binding:"HexHash256"`   //交易id hex格式
+		Reason string `form:"reason" binding:"required"` //撤回原因
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	id := xginx.NewHASH256(args.ID)
+	err := app.UseTx(func(db core.IDbImp) error {
+		ttx, err := db.GetTx(id.Bytes())
 		if err != nil {
 			return err
 		}
-		//如果签名验证成功,更新为已经签名，否则需要等待所有签名执行完成
-		if ttx.Verify(db, bi) {
-			err = ttx.SetTxState(db, core.TTxStateSign)
+		return ttx.CancelTx(db, uid, args.Reason)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//拒绝签名交易,交易将作废
+func rejectTxAPI(c *gin.Context) {
+	args := struct {
+		ID     string `form:"id" binding:"HexHash256"`   //交易id hex格式
+		Reason string `form:"reason" binding:"required"` //拒绝原因
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	id := xginx.NewHASH256(args.ID)
+	err := app.UseTx(func(db core.IDbImp) error {
+		ttx, err := db.GetTx(id.Bytes())
+		if err != nil {
+			return err
 		}
-		return err
+		return ttx.RejectTx(db, uid, args.Reason)
 	})
 	if err != nil {
 		c.JSON(http.StatusOK, NewModel(200, err))
 		return
 	}
-	c.JSON(http.StatusOK, NewModel(0, "SignOK"))
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//TTxCancelModel 交易取消信息
+type TTxCancelModel struct {
+	Type   core.TTxCancelType `json:"type"`   //取消方式
+	UserID string             `json:"uid"`    //操作用户
+	Reason string             `json:"reason"` //原因
+	Time   int64              `json:"time"`   //取消时间
 }
 
 //TTxModel 交易model
 type TTxModel struct {
-	ID    string        `json:"id"`
-	Ver   uint32        `json:"ver"`
-	Ins   []interface{} `json:"ins"`
-	Outs  []TxOutModel  `json:"outs"`
-	Time  int64         `json:"time"`
-	Desc  string        `json:"desc"`
-	State core.TTxState `json:"state"`
+	ID      string          `json:"id"`
+	Ver     uint32          `json:"ver"`
+	Ins     []interface{}   `json:"ins"`
+	Outs    []TxOutModel    `json:"outs"`
+	Time    int64           `json:"time"`
+	Desc    string          `json:"desc"`
+	State   core.TTxState   `json:"state"`
+	Expire  int64           `json:"expire"`           //过期时间,为0不过期
+	Cancel  *TTxCancelModel `json:"cancel,omitempty"` //取消信息
+	Block   string          `json:"blk,omitempty"`    //所在区块id
+	Height  uint32          `json:"height"`           //所在区块高度
+	Confirm uint32          `json:"confirm"`          //确认数
+	Need    uint32          `json:"need"`             //完成需要的确认数
 }
 
 //NewTTxModel 创建交易model
 func NewTTxModel(ttx *core.TTx, bi *xginx.BlockIndex) TTxModel {
 	m := TTxModel{
-		ID:    xginx.NewHASH256(ttx.ID).String(),
-		Ver:   ttx.Ver,
-		Ins:   []interface{}{},
-		Outs:  []TxOutModel{},
-		Time:  ttx.Time,
-		Desc:  ttx.Desc,
-		State: ttx.State,
+		ID:      xginx.NewHASH256(ttx.ID).String(),
+		Ver:     ttx.Ver,
+		Ins:     []interface{}{},
+		Outs:    []TxOutModel{},
+		Time:    ttx.Time,
+		Desc:    ttx.Desc,
+		State:   ttx.State,
+		Expire:  ttx.Expire,
+		Height:  ttx.Height,
+		Confirm: ttx.Confirm,
+		Need:    ttx.NeedConfirm(),
+	}
+	if len(ttx.Block) > 0 {
+		m.Block = xginx.NewHASH256(ttx.Block).String()
+	}
+	//完成后不再更新保存的确认数,使用链高度计算
+	if bi != nil {
+		m.Confirm = ttx.Confirms(bi.Height())
+	}
+	if ttx.Cancel.Type != core.TTxCancelNone {
+		m.Cancel = &TTxCancelModel{
+			Type:   ttx.Cancel.Type,
+			Reason: ttx.Cancel.Reason,
+			Time:   ttx.Cancel.Time,
+		}
+		if !ttx.Cancel.UserID.IsZero() {
+			m.Cancel.UserID = ttx.Cancel.UserID.Hex()
+		}
 	}
 	for _, in := range ttx.Ins {
 		inv := TxInModel{}
@@ -206,22 +574,29 @@ func NewTTxModel(ttx *core.TTx, bi *xginx.BlockIndex) TTxModel {
 
 //获取待签名交易
 func listUserSignTxsAPI(c *gin.Context) {
+	args := PageArgs{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortTime, core.PageSortID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
 	app := core.GetApp(c)
 	bi := xginx.GetBlockIndex()
 	uid := GetAppUserID(c)
 	ttxs := []*core.TTx{}
-	err := app.UseDb(func(db core.IDbImp) error {
-		txs, err := db.ListUserTxs(uid, false)
+	next := ""
+	err = app.UseDb(func(db core.IDbImp) error {
+		//未签名的交易已经排除了验证成功的交易
+		txs, cur, err := db.PageUserTxs(uid, false, args.Filter(), page)
 		if err != nil {
 			return err
 		}
-		for _, ttx := range txs {
-			//如果已经签名
-			if ttx.Verify(db, bi) {
-				continue
-			}
-			ttxs = append(ttxs, ttx)
-		}
+		ttxs = txs
+		next = cur
 		return nil
 	})
 	if err != nil {
@@ -231,10 +606,12 @@ func listUserSignTxsAPI(c *gin.Context) {
 	type result struct {
 		Code  int        `json:"code"`
 		Items []TTxModel `json:"items"`
+		Next  string     `json:"next"` //下一页游标,为空没有下一页
 	}
 	res := result{
 		Code:  0,
 		Items: []TTxModel{},
+		Next:  next,
 	}
 	for _, ttx := range ttxs {
 		res.Items = append(res.Items, NewTTxModel(ttx, bi))
@@ -244,19 +621,33 @@ func listUserSignTxsAPI(c *gin.Context) {
 
 //获取用户的账号
 func listUserAccountsAPI(c *gin.Context) {
+	args := PageArgs{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortTime, core.PageSortID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
 	//账户管理
 	type item struct {
-		ID   xginx.Address `json:"id"`   //账号地址id
-		Tags []string      `json:"tags"` //标签，分组用
-		Num  uint8         `json:"num"`  //总的密钥数量
-		Less uint8         `json:"less"` //至少通过的签名数量
-		Arb  bool          `json:"arb"`  //是否仲裁
-		Kid  []string      `json:"kid"`  //相关的私钥
-		Desc string        `json:"desc"` //描述
+		ID       xginx.Address `json:"id"`       //账号地址id
+		Tags     []string      `json:"tags"`     //标签，分组用
+		Num      uint8         `json:"num"`      //总的密钥数量
+		Less     uint8         `json:"less"`     //至少通过的签名数量
+		Arb      bool          `json:"arb"`      //是否仲裁
+		Kid      []string      `json:"kid"`      //相关的私钥
+		Desc     string        `json:"desc"`     //描述
+		Watch    bool          `json:"watch"`    //是否是只读账号
+		Policy   PolicyModel   `json:"policy"`   //链下审批策略
+		Confirms uint32        `json:"confirms"` //交易完成需要的确认数,为0使用默认值
 	}
 	type result struct {
 		Code  int    `json:"code"`
 		Items []item `json:"items"`
+		Next  string `json:"next"` //下一页游标,为空没有下一页
 	}
 	res := result{
 		Code:  0,
@@ -265,12 +656,13 @@ func listUserAccountsAPI(c *gin.Context) {
 	app := core.GetApp(c)
 	uid := GetAppUserID(c)
 	var accs []*core.TAccount = nil
-	err := app.UseDb(func(db core.IDbImp) error {
-		acc, err := db.ListAccounts(uid)
+	err = app.UseDb(func(db core.IDbImp) error {
+		acc, next, err := db.PageAccounts(uid, args.Filter(), page)
 		if err != nil {
 			return err
 		}
 		accs = acc
+		res.Next = next
 		return nil
 	})
 	if err != nil {
@@ -279,19 +671,60 @@ func listUserAccountsAPI(c *gin.Context) {
 	}
 	for _, v := range accs {
 		i := item{
-			ID:   v.ID,
-			Tags: v.Tags,
-			Num:  v.Num,
-			Less: v.Less,
-			Arb:  v.Arb != xginx.InvalidArb,
-			Desc: v.Desc,
-			Kid:  v.Kid,
+			ID:       v.ID,
+			Tags:     v.Tags,
+			Num:      v.Num,
+			Less:     v.Less,
+			Arb:      v.Arb != xginx.InvalidArb,
+			Desc:     v.Desc,
+			Kid:      v.Kid,
+			Watch:    v.Watch,
+			Policy:   NewPolicyModel(v.Policy),
+			Confirms: v.Confirms,
 		}
 		res.Items = append(res.Items, i)
 	}
 	c.JSON(http.StatusOK, res)
 }
 
+//设置账号交易完成需要的确认数,为0使用默认值
+func setConfirmsAPI(c *gin.Context) {
+	args := struct {
+		ID       xginx.Address `form:"id" binding:"IsAddress"` //账号
+		Confirms uint32        `form:"confirms"`               //需要的确认数
+		OTP      string        `form:"otp"`                    //两步验证码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	if args.Confirms > core.MaxConfirmNum {
+		c.JSON(http.StatusOK, NewModel(101, fmt.Errorf("confirms max %d", core.MaxConfirmNum)))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		err := checkUserOTP(db, uid, args.OTP)
+		if err != nil {
+			return err
+		}
+		acc, err := db.GetAccount(args.ID)
+		if err != nil {
+			return err
+		}
+		if !acc.HasUserID(uid) {
+			return errors.New("not mine account")
+		}
+		return db.SetAccountConfirms(acc.ID, args.Confirms)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
 //注册
 func registerAPI(c *gin.Context) {
 	args := struct {
@@ -312,13 +745,14 @@ func registerAPI(c *gin.Context) {
 		c.JSON(http.StatusOK, NewModel(102, "error,login pass == key pass"))
 		return
 	}
-	if args.Code != "9527" {
-		c.JSON(http.StatusOK, NewModel(103, "code error"))
-		return
-	}
 	rv := Model{}
 	app := core.GetApp(c)
 	err := app.UseDb(func(sdb core.IDbImp) error {
+		err := core.CheckCode(sdb, core.CodeTypeRegister, args.Mobile, args.Code)
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
 		user, err := sdb.GetUserInfoWithMobile(args.Mobile)
 		if err == nil {
 			rv.Code = 104
@@ -343,10 +777,97 @@ func registerAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, rv)
 }
 
+//发送手机验证码
+func sendCodeAPI(c *gin.Context) {
+	args := struct {
+		Mobile string        `form:"mobile" binding:"required"` //手机号
+		Type   core.CodeType `form:"type" binding:"required"`   //验证码类型 register reset
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	if !args.Type.IsValid() {
+		c.JSON(http.StatusOK, NewModel(101, "code type error"))
+		return
+	}
+	rv := Model{}
+	app := core.GetApp(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		_, err := db.GetUserInfoWithMobile(args.Mobile)
+		//注册时手机号不能存在，重置密码时手机号必须存在
+		if args.Type == core.CodeTypeRegister && err == nil {
+			rv.Code = 102
+			return errors.New("mobile exists")
+		}
+		if args.Type == core.CodeTypeResetPass && err != nil {
+			rv.Code = 102
+			return errors.New("mobile not exists")
+		}
+		err = core.SendCode(db, args.Type, args.Mobile)
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//使用手机验证码重置登陆密码
+func resetPassAPI(c *gin.Context) {
+	args := struct {
+		Mobile string `form:"mobile" binding:"required"` //手机号
+		Code   string `form:"code" binding:"required"`   //手机验证码
+		Pass   string `form:"pass" binding:"required"`   //新登陆密码
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	rv := Model{}
+	app := core.GetApp(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		err := core.CheckCode(db, core.CodeTypeResetPass, args.Mobile, args.Code)
+		if err != nil {
+			rv.Code = 101
+			return err
+		}
+		user, err := db.GetUserInfoWithMobile(args.Mobile)
+		if err != nil {
+			rv.Code = 102
+			return err
+		}
+		pwd, err := core.NewPassword(args.Pass)
+		if err != nil {
+			rv.Code = 103
+			return err
+		}
+		err = db.SetUserPass(user.ID, pwd)
+		if err != nil {
+			rv.Code = 104
+			return err
+		}
+		//所有设备需要重新登陆
+		return core.RevokeUserSessions(db, user.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(rv.Code, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
 func loginAPI(c *gin.Context) {
 	args := struct {
 		Mobile string `form:"mobile" binding:"required"`
 		Pass   string `form:"pass" binding:"required"`
+		Device string `form:"device"` //设备标识,同一设备只保留一个会话
+		OTP    string `form:"otp"`    //两步验证码,启用后必须
 	}{}
 	if err := c.ShouldBind(&args); err != nil {
 		c.JSON(http.StatusOK, NewModel(100, err))
@@ -356,11 +877,7 @@ func loginAPI(c *gin.Context) {
 		c.JSON(http.StatusOK, NewModel(101, "mobile or pass args error"))
 		return
 	}
-	type result struct {
-		Model
-		Token string `json:"token"`
-	}
-	rv := result{}
+	rv := TokenModel{}
 	app := core.GetApp(c)
 	err := app.UseDb(func(db core.IDbImp) error {
 		user, err := db.GetUserInfoWithMobile(args.Mobile)
@@ -372,19 +889,37 @@ func loginAPI(c *gin.Context) {
 			rv.Code = 103
 			return errors.New("password error")
 		}
-		tk := app.GenToken()
-		err = db.SetUserToken(user.ID, tk)
+		//被管理员强制重置的密码不能再使用
+		if user.Reset {
+			rv.Code = 106
+			return errors.New("password must reset")
+		}
+		//启用两步验证后需要验证码
+		err = user.CheckTOTP(db, args.OTP)
+		if err == core.ErrTOTPRequired {
+			rv.Code = 107
+			return err
+		}
 		if err != nil {
-			rv.Code = 104
+			rv.Code = 108
 			return err
 		}
-		err = db.SetUserID(tk, user.ID, core.TokenTime)
+		//旧版本密码升级,失败不影响登陆
+		if user.NeedUpgradePass() {
+			pwd, err := core.NewPassword(args.Pass)
+			if err == nil {
+				err = db.SetUserPass(user.ID, pwd)
+			}
+			if err != nil {
+				xginx.LogError("upgrade user pass error", err)
+			}
+		}
+		_, tk, err := app.NewSession(db, user.ID, args.Device, c.Request.UserAgent(), c.ClientIP())
 		if err != nil {
-			rv.Code = 105
+			rv.Code = 104
 			return err
 		}
-		//返回加密的token
-		rv.Token = app.EncryptToken(tk)
+		rv = NewTokenModel(tk)
 		return nil
 	})
 	if err != nil {
@@ -394,8 +929,48 @@ func loginAPI(c *gin.Context) {
 	c.JSON(http.StatusOK, rv)
 }
 
+//强制用户重置登陆密码
+func resetUserPassAPI(c *gin.Context) {
+	args := struct {
+		Mobile string `form:"mobile" binding:"required"` //手机号
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		user, err := db.GetUserInfoWithMobile(args.Mobile)
+		if err != nil {
+			return err
+		}
+		err = db.ForceResetPass(user.ID)
+		if err != nil {
+			return err
+		}
+		//已经登陆的会话失效
+		return core.RevokeUserSessions(db, user.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
 //获取可用的金额列表
 func listCoinsAPI(c *gin.Context) {
+	args := PageArgs{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortHeight, core.PageSortValue)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(103, err))
+		return
+	}
+	filter := args.Filter()
 	app := core.GetApp(c)
 	uid := GetAppUserID(c)
 	type item struct {
@@ -406,11 +981,14 @@ func listCoinsAPI(c *gin.Context) {
 		TxID   string        `json:"tx"`     //交易id
 		Index  uint32        `json:"index"`  //输出索引
 		Height uint32        `json:"height"` //所在区块高度
+		Watch  bool          `json:"watch"`  //是否是只读账号的金额，需要外部签名
+		Resv   bool          `json:"resv"`   //是否被未完成的交易占用
 	}
 	type result struct {
 		Model
 		Height uint32 `json:"height"` //当前区块高度
 		Items  []item `json:"items"`
+		Next   string `json:"next"` //下一页游标,为空没有下一页
 	}
 	bi := xginx.GetBlockIndex()
 	res := result{
@@ -419,25 +997,52 @@ func listCoinsAPI(c *gin.Context) {
 	}
 	//判断消费高度下金额是否可用
 	spent := bi.NextHeight()
-	err := app.UseDb(func(sdb core.IDbImp) error {
+	err = app.UseDb(func(sdb core.IDbImp) error {
 		user, err := sdb.GetUserInfo(uid)
 		if err != nil {
 			res.Code = 101
 			return err
 		}
-		//获取用户余额
-		coins, err := user.ListCoins(sdb, bi)
+		accs, err := user.ListAccounts(sdb)
 		if err != nil {
 			res.Code = 102
 			return err
 		}
-		coins.All.Sort()
-		for _, coin := range coins.All {
-			i := item{}
-			id, err := xginx.EncodeAddress(coin.CPkh)
-			if err != nil {
+		//只获取过滤后账号的金额
+		amap := map[xginx.Address]*core.TAccount{}
+		vs := []*xginx.CoinKeyValue{}
+		ids := []xginx.Address{}
+		for _, acc := range accs {
+			if !filter.Match(acc) {
 				continue
 			}
+			amap[acc.ID] = acc
+			coins, err := acc.ListCoins(bi)
+			if err != nil {
+				res.Code = 102
+				return err
+			}
+			for _, coin := range coins.All {
+				vs = append(vs, coin)
+				ids = append(ids, acc.ID)
+			}
+		}
+		idxs, next, err := core.PageSlice(page, len(vs), func(i int) (int64, string) {
+			coin := vs[i]
+			key := fmt.Sprintf("%s:%d", coin.TxID, coin.Index.ToUInt32())
+			if page.Sort == core.PageSortValue {
+				return int64(coin.Value), key
+			}
+			return int64(coin.Height.ToUInt32()), key
+		})
+		if err != nil {
+			res.Code = 103
+			return err
+		}
+		res.Next = next
+		for _, idx := range idxs {
+			coin, id := vs[idx], ids[idx]
+			i := item{}
 			i.ID = id
 			//未成熟的金额将被锁定
 			i.Locked = !coin.IsMatured(spent)
@@ -446,6 +1051,8 @@ func listCoinsAPI(c *gin.Context) {
 			i.TxID = coin.TxID.String()
 			i.Index = coin.Index.ToUInt32()
 			i.Height = coin.Height.ToUInt32()
+			i.Watch = amap[id].Watch
+			i.Resv = core.IsReserved(sdb, coin.TxID, i.Index)
 			res.Items = append(res.Items, i)
 		}
 		return nil
@@ -467,6 +1074,8 @@ func userInfoAPI(c *gin.Context) {
 		Locks  xginx.Amount `json:"locks"`  //锁定的int
 		Cipher int          `json:"cipher"` //key加密方式
 		Index  uint32       `json:"index"`  //keys idx
+		Watch  xginx.Amount `json:"watch"`  //只读账号余额，包含在coins中
+		BOnly  bool         `json:"bonly"`  //只允许向地址簿中的地址付款
 	}
 	res := result{}
 	err := app.UseDb(func(db core.IDbImp) error {
@@ -483,9 +1092,16 @@ func userInfoAPI(c *gin.Context) {
 		}
 		res.Coins = coins.Coins.Balance()
 		res.Locks = coins.Locks.Balance()
+		watch, err := user.ListWatchCoins(db, bi)
+		if err != nil {
+			res.Code = 101
+			return err
+		}
+		res.Watch = watch.Coins.Balance()
 		res.Mobile = user.Mobile
 		res.Cipher = int(user.Cipher)
 		res.Index = user.Idx
+		res.BOnly = user.BookOnly
 		return nil
 	})
 	if err != nil {
@@ -1,19 +1,50 @@
 package api
 
 import (
+	"encoding/base32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/cxuhua/xmgrs/core"
 
 	"github.com/cxuhua/xginx"
 )
 
+//发送验证码并从测试输出中获取
+func (st *APITestSuite) SendCode(mobile string, typ string) string {
+	v := url.Values{}
+	v.Set("mobile", mobile)
+	v.Set("type", typ)
+	any, err := st.Post("/v1/send/code", v)
+	st.Require().NoError(err)
+	st.Require().NotNil(any)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	lines := strings.Split(strings.TrimSpace(testCodes.String()), "\n")
+	fs := strings.Fields(lines[len(lines)-1])
+	st.Require().Equal(3, len(fs))
+	st.Require().Equal(mobile, fs[0])
+	return fs[2]
+}
+
 func (st *APITestSuite) RegisterUser() {
 	v := url.Values{}
 	v.Set("mobile", st.mobile)
 	v.Set("upass", "password")
 	v.Set("kpass", "kpassword")
-	v.Set("code", "9527")
+	v.Set("code", "000000")
+	//错误的验证码
 	any, err := st.Post("/v1/register", v)
 	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 103, any.Get("error").ToString())
+	v.Set("code", st.SendCode(st.mobile, "register"))
+	any, err = st.Post("/v1/register", v)
+	st.Require().NoError(err)
 	st.Require().NotNil(any)
 	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
 	user, err := st.db.GetUserInfoWithMobile(st.mobile)
@@ -24,11 +55,161 @@ func (st *APITestSuite) RegisterUser() {
 	st.Require().NotNil(dk)
 }
 
+//使用验证码重置密码
+func (st *APITestSuite) ResetPass() {
+	v := url.Values{}
+	v.Set("mobile", st.mobile)
+	v.Set("pass", "newpassword")
+	v.Set("code", st.SendCode(st.mobile, "reset"))
+	any, err := st.Post("/v1/reset/pass", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	//验证码只能使用一次
+	any, err = st.Post("/v1/reset/pass", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 101, any.Get("error").ToString())
+	user, err := st.db.GetUserInfoWithMobile(st.mobile)
+	st.Require().NoError(err)
+	st.Require().True(user.CheckPass("newpassword"))
+}
+
+//管理员强制重置密码,重置前不能登陆
+func (st *APITestSuite) ForceReset() {
+	post := func(token string) jsoniter.Any {
+		v := url.Values{}
+		v.Set("mobile", st.mobile)
+		req := httptest.NewRequest(http.MethodPost, "/v1/admin/reset/pass", strings.NewReader(v.Encode()))
+		req.Header.Set("content-type", "application/x-www-form-urlencoded")
+		req.Header.Set(core.AdminHeader, token)
+		wr := httptest.NewRecorder()
+		st.Do(wr, req)
+		body, err := ioutil.ReadAll(wr.Result().Body)
+		st.Require().NoError(err)
+		return jsoniter.Get(body)
+	}
+	//未设置管理员token时禁用
+	st.Require().Equal(1001, post("admin_test_token").Get("code").ToInt())
+	core.AdminToken = "admin_test_token"
+	defer func() {
+		core.AdminToken = ""
+	}()
+	st.Require().Equal(1001, post("other_token").Get("code").ToInt())
+	any := post("admin_test_token")
+	st.Require().Equal(0, any.Get("code").ToInt(), any.Get("error").ToString())
+	//原来的密码不能登陆
+	v := url.Values{}
+	v.Set("mobile", st.mobile)
+	v.Set("pass", "newpassword")
+	any, err := st.Post("/v1/login", v)
+	st.Require().NoError(err)
+	st.Require().Equal(106, any.Get("code").ToInt())
+	//重新设置密码后可以登陆
+	user, err := st.db.GetUserInfoWithMobile(st.mobile)
+	st.Require().NoError(err)
+	st.Require().True(user.Reset)
+	pwd, err := core.NewPassword("newpassword")
+	st.Require().NoError(err)
+	st.Require().NoError(st.db.SetUserPass(user.ID, pwd))
+	any, err = st.Post("/v1/login", v)
+	st.Require().NoError(err)
+	st.Require().Equal(0, any.Get("code").ToInt(), any.Get("error").ToString())
+}
+
+//会话刷新和注销
+func (st *APITestSuite) Sessions() {
+	any, err := st.Get("/v1/list/sessions")
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	st.Require().Equal(any.Get("items").Size(), 1)
+	st.Require().True(any.Get("items", 0, "current").ToBool())
+	//刷新token,旧的access token失效
+	old, fresh := st.token, st.fresh
+	v := url.Values{}
+	v.Set("refresh", fresh)
+	any, err = st.Post("/v1/refresh/token", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	st.token = any.Get("token").ToString()
+	st.fresh = any.Get("refresh").ToString()
+	st.Require().NotEqual(old, st.token)
+	any, err = st.Get("/v1/user/info")
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	st.token = old
+	any, err = st.Get("/v1/user/info")
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 1000)
+	//再次使用旧的refresh token,会话被注销
+	any, err = st.Post("/v1/refresh/token", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 101)
+	v.Set("refresh", st.fresh)
+	any, err = st.Post("/v1/refresh/token", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 101)
+	//重新登陆并注销所有会话
+	st.token = ""
+	st.Require().NoError(st.LoginA())
+	any, err = st.Post("/v1/revoke/sessions", url.Values{})
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	any, err = st.Get("/v1/user/info")
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 1000)
+	st.token = ""
+	st.Require().NoError(st.LoginA())
+}
+
+//两步验证绑定,登陆和关闭
+func (st *APITestSuite) TOTP() {
+	v := url.Values{}
+	v.Set("pass", "xh0714")
+	any, err := st.Post("/v1/totp/enroll", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(any.Get("secret").ToString())
+	st.Require().NoError(err)
+	step := core.TOTPStep(time.Now())
+	v = url.Values{}
+	v.Set("code", core.TOTPCode(key, step))
+	any, err = st.Post("/v1/totp/verify", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	recovery := any.Get("recovery", 0).ToString()
+	st.Require().NotEmpty(recovery)
+	//启用后登陆需要验证码
+	v = url.Values{}
+	v.Set("mobile", st.A)
+	v.Set("pass", "xh0714")
+	any, err = st.Post("/v1/login", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 107)
+	v.Set("otp", core.TOTPCode(key, step+1))
+	any, err = st.Post("/v1/login", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+	//使用恢复码关闭
+	v = url.Values{}
+	v.Set("pass", "xh0714")
+	v.Set("otp", recovery)
+	any, err = st.Post("/v1/totp/disable", v)
+	st.Require().NoError(err)
+	st.Require().Equal(any.Get("code").ToInt(), 0, any.Get("error").ToString())
+}
+
 func (st *APITestSuite) TestAll() {
 	st.RegisterUser()
 
+	st.ResetPass()
+
+	st.ForceReset()
+
 	st.GetUserInfo()
 
+	st.Sessions()
+
+	st.TOTP()
+
 	st.ListUserAccounts()
 
 	st.GetUserCoins()
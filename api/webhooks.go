@@ -0,0 +1,324 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cxuhua/xmgrs/core"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//WebhookModel 用户webhook,不返回密钥
+type WebhookModel struct {
+	ID     string           `json:"id"`     //webhook id
+	URL    string           `json:"url"`    //回调地址
+	Events []core.EventType `json:"events"` //接收的事件,为空接收所有事件
+	Enable bool             `json:"enable"` //是否启用
+	Time   int64            `json:"time"`   //创建时间
+}
+
+//NewWebhookModel 创建webhook model
+func NewWebhookModel(h *core.TWebhook) WebhookModel {
+	m := WebhookModel{
+		ID:     h.ID.Hex(),
+		URL:    h.URL,
+		Events: h.Events,
+		Enable: h.Enable,
+		Time:   h.Time,
+	}
+	if m.Events == nil {
+		m.Events = []core.EventType{}
+	}
+	return m
+}
+
+//DeliveryModel 事件投递记录
+type DeliveryModel struct {
+	ID      string              `json:"id"`      //投递id,和请求头X-Xmgrs-Delivery相同
+	Type    core.EventType      `json:"type"`    //事件类型
+	Payload string              `json:"payload"` //请求内容
+	State   core.TDeliveryState `json:"state"`   //0等待投递 1成功 2失败
+	Tries   int                 `json:"tries"`   //已经投递次数
+	Next    int64               `json:"next"`    //下次投递时间
+	Code    int                 `json:"code"`    //最后一次响应状态码
+	Error   string              `json:"error"`   //最后一次错误
+	Time    int64               `json:"time"`    //创建时间
+	Done    int64               `json:"done"`    //成功或者失败的时间
+}
+
+//NewDeliveryModel 创建投递记录model
+func NewDeliveryModel(d *core.TDelivery) DeliveryModel {
+	return DeliveryModel{
+		ID:      d.ID.Hex(),
+		Type:    d.Type,
+		Payload: d.Payload,
+		State:   d.State,
+		Tries:   d.Tries,
+		Next:    d.Next,
+		Code:    d.Code,
+		Error:   d.Error,
+		Time:    d.Time,
+		Done:    d.Done,
+	}
+}
+
+//转换事件类型参数
+func toEventTypes(vs []string) []core.EventType {
+	rets := []core.EventType{}
+	for _, v := range vs {
+		rets = append(rets, core.EventType(v))
+	}
+	return rets
+}
+
+//获取自己的webhook
+func getUserWebhook(db core.IDbImp, uid primitive.ObjectID, hid string) (*core.TWebhook, error) {
+	id, err := primitive.ObjectIDFromHex(hid)
+	if err != nil {
+		return nil, err
+	}
+	h, err := db.GetWebhook(id)
+	if err != nil {
+		return nil, err
+	}
+	if !core.ObjectIDEqual(h.UserID, uid) {
+		return nil, errors.New("webhook not found")
+	}
+	return h, nil
+}
+
+//注册webhook,密钥只在创建时返回
+//请求头 X-Xmgrs-Signature: sha256=hex(hmac_sha256(secret,X-Xmgrs-Timestamp + "." + body))
+func createWebhookAPI(c *gin.Context) {
+	args := struct {
+		URL    string   `form:"url" binding:"required"` //回调地址 http或者https
+		Secret string   `form:"secret"`                 //签名密钥,为空随机生成
+		Events []string `form:"events"`                 //接收的事件,为空接收所有事件
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	uid := GetAppUserID(c)
+	h, secret, err := core.NewWebhook(uid, args.URL, args.Secret, toEventTypes(args.Events))
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	code := 200
+	err = app.UseDb(func(db core.IDbImp) error {
+		hs, err := db.ListWebhooks(uid)
+		if err != nil {
+			return err
+		}
+		if len(hs) >= core.WebhookMaxNum {
+			code = 102
+			return errors.New("webhook num limit")
+		}
+		return db.InsertWebhook(h)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(code, err))
+		return
+	}
+	res := struct {
+		Code   int          `json:"code"`
+		Item   WebhookModel `json:"item"`
+		Secret string       `json:"secret"`
+	}{
+		Code:   0,
+		Item:   NewWebhookModel(h),
+		Secret: secret,
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//获取用户的webhook
+func listWebhooksAPI(c *gin.Context) {
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int            `json:"code"`
+		Items []WebhookModel `json:"items"`
+	}{
+		Code:  0,
+		Items: []WebhookModel{},
+	}
+	err := app.UseDb(func(db core.IDbImp) error {
+		hs, err := db.ListWebhooks(uid)
+		if err != nil {
+			return err
+		}
+		for _, h := range hs {
+			res.Items = append(res.Items, NewWebhookModel(h))
+		}
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//修改webhook,参数为空时不修改
+func setWebhookAPI(c *gin.Context) {
+	args := struct {
+		ID     string   `form:"id" binding:"required"` //webhook id
+		URL    string   `form:"url"`                   //回调地址
+		Secret string   `form:"secret"`                //新的签名密钥
+		Events []string `form:"events"`                //接收的事件,all接收所有事件
+		Enable *bool    `form:"enable"`                //是否启用
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseDb(func(db core.IDbImp) error {
+		h, err := getUserWebhook(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		if args.URL != "" {
+			h.URL = args.URL
+		}
+		if len(args.Events) == 1 && args.Events[0] == "all" {
+			h.Events = nil
+		} else if len(args.Events) > 0 {
+			h.Events = toEventTypes(args.Events)
+		}
+		if args.Enable != nil {
+			h.Enable = *args.Enable
+		}
+		err = h.Check()
+		if err != nil {
+			return err
+		}
+		if args.Secret != "" {
+			err = h.SetSecret(args.Secret)
+			if err != nil {
+				return err
+			}
+		}
+		return db.UpdateWebhook(h)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//删除webhook和投递记录
+func deleteWebhookAPI(c *gin.Context) {
+	args := struct {
+		ID string `form:"id" binding:"required"` //webhook id
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err := app.UseTx(func(db core.IDbImp) error {
+		h, err := getUserWebhook(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		return db.DeleteWebhook(h.ID)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
+
+//获取webhook的投递记录,用来排查回调问题
+func listDeliveriesAPI(c *gin.Context) {
+	args := struct {
+		PageArgs
+		ID string `form:"id" binding:"required"` //webhook id
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	page, err := args.Page(core.PageSortTime, core.PageSortID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	res := struct {
+		Code  int             `json:"code"`
+		Items []DeliveryModel `json:"items"`
+		Next  string          `json:"next"` //下一页游标,为空没有下一页
+	}{
+		Code:  0,
+		Items: []DeliveryModel{},
+	}
+	err = app.UseDb(func(db core.IDbImp) error {
+		h, err := getUserWebhook(db, uid, args.ID)
+		if err != nil {
+			return err
+		}
+		ds, next, err := db.PageDeliveries(h.ID, args.Filter(), page)
+		if err != nil {
+			return err
+		}
+		for _, d := range ds {
+			res.Items = append(res.Items, NewDeliveryModel(d))
+		}
+		res.Next = next
+		return nil
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+//重新投递已经成功或者失败的记录
+func retryDeliveryAPI(c *gin.Context) {
+	args := struct {
+		ID string `form:"id" binding:"required"` //投递id
+	}{}
+	if err := c.ShouldBind(&args); err != nil {
+		c.JSON(http.StatusOK, NewModel(100, err))
+		return
+	}
+	id, err := primitive.ObjectIDFromHex(args.ID)
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(101, err))
+		return
+	}
+	app := core.GetApp(c)
+	uid := GetAppUserID(c)
+	err = app.UseDb(func(db core.IDbImp) error {
+		d, err := db.GetDelivery(id)
+		if err != nil {
+			return err
+		}
+		if !core.ObjectIDEqual(d.UserID, uid) {
+			return errors.New("delivery not found")
+		}
+		err = d.Retry(time.Now())
+		if err != nil {
+			return err
+		}
+		return db.UpdateDelivery(d)
+	})
+	if err != nil {
+		c.JSON(http.StatusOK, NewModel(200, err))
+		return
+	}
+	c.JSON(http.StatusOK, NewModel(0, "OK"))
+}
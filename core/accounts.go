@@ -102,19 +102,41 @@ func NewAccount(db IDbImp, num uint8, less uint8, arb bool, ids []string, desc s
 	return NewAccountFrom(uids, acc, desc, tags)
 }
 
+//NewWatchAccount 利用公钥创建只读账号，不需要保存私钥
+func NewWatchAccount(uids []primitive.ObjectID, num uint8, less uint8, arb bool, pks []xginx.PKBytes, desc string, tags []string) (*TAccount, error) {
+	if num == 0 || len(pks) != int(num) {
+		return nil, errors.New("pks count != num")
+	}
+	acc, err := xginx.NewAccountWithPks(num, less, arb, pks)
+	if err != nil {
+		return nil, err
+	}
+	a, err := NewAccountFrom(uids, acc, desc, tags)
+	if err != nil {
+		return nil, err
+	}
+	a.Watch = true
+	return a, nil
+}
+
 //TAccount 账户数据结构
 //一个账号可能有多个私钥构成，签名时必须按照规则签名所需的私钥
 type TAccount struct {
-	ID     xginx.Address        `bson:"_id"`  //账号地址id
-	UserID []primitive.ObjectID `bson:"uid"`  //所属的多个账户，当用多个私钥创建时，所属私钥的用户集合
-	Tags   []string             `bson:"tags"` //标签，分组用
-	Num    uint8                `bson:"num"`  //总的密钥数量
-	Less   uint8                `bson:"less"` //至少通过的签名数量
-	Arb    uint8                `bson:"arb"`  //是否仲裁
-	Pks    []xginx.PKBytes      `bson:"pks"`  //包含的公钥
-	Kid    []string             `bson:"kid"`  //包含的密钥id
-	Time   int64                `bson:"time"` //创建时间
-	Desc   string               `bson:"desc"` //描述
+	ID       xginx.Address        `bson:"_id"`      //账号地址id
+	UserID   []primitive.ObjectID `bson:"uid"`      //所属的多个账户，当用多个私钥创建时，所属私钥的用户集合
+	Tags     []string             `bson:"tags"`     //标签，分组用
+	Num      uint8                `bson:"num"`      //总的密钥数量
+	Less     uint8                `bson:"less"`     //至少通过的签名数量
+	Arb      uint8                `bson:"arb"`      //是否仲裁
+	Pks      []xginx.PKBytes      `bson:"pks"`      //包含的公钥
+	Kid      []string             `bson:"kid"`      //包含的密钥id
+	Time     int64                `bson:"time"`     //创建时间
+	Desc     string               `bson:"desc"`     //描述
+	Watch    bool                 `bson:"watch"`    //只读账号，只有公钥，签名由外部提供
+	Policy   TPolicy              `bson:"policy"`   //链下审批策略
+	Confirms uint32               `bson:"confirms"` //交易完成需要的确认数,为0使用TxConfirmNum
+	SpendVer int64                `bson:"spendv"`   //支出版本,检查每日限额时更新
+	Indexed  bool                 `bson:"indexed"`  //收支记录是否已经从链上补全
 }
 
 //HasUserID 是否包含用户
@@ -127,6 +149,16 @@ func (acc TAccount) HasUserID(uid primitive.ObjectID) bool {
 	return false
 }
 
+//HasTag 是否包含标签
+func (acc TAccount) HasTag(tag string) bool {
+	for _, v := range acc.Tags {
+		if v == tag {
+			return true
+		}
+	}
+	return false
+}
+
 //GetPrivate 获取第几个私钥
 func (acc TAccount) GetPrivate(db IDbImp, idx int) (*TPrivate, error) {
 	if idx < 0 || idx <= len(acc.Kid) {
@@ -135,6 +167,21 @@ func (acc TAccount) GetPrivate(db IDbImp, idx int) (*TPrivate, error) {
 	return db.GetPrivate(acc.Kid[idx])
 }
 
+//CheckExport 检查账号私钥是否可以导出
+//非强化派生的私钥不能导出,和扩展公钥一起可以计算出同一个根派生的所有私钥
+func (acc *TAccount) CheckExport(db IDbImp) error {
+	for _, kid := range acc.Kid {
+		pri, err := db.GetPrivate(kid)
+		if err != nil {
+			return err
+		}
+		if pri.IsCipherPublicKey() {
+			return ErrPublicDerived
+		}
+	}
+	return nil
+}
+
 //ToAccount pri是否加载私钥
 func (acc *TAccount) ToAccount(db IDbImp, pri bool, pass ...string) (*xginx.Account, error) {
 	aj := &xginx.Account{
@@ -160,7 +207,7 @@ func (acc *TAccount) ToAccount(db IDbImp, pri bool, pass ...string) (*xginx.Acco
 		if err != nil {
 			return nil, err
 		}
-		kp, err := pri.ToPrivate(pass...)
+		kp, err := pri.LoadPrivate(db, pass...)
 		if err != nil {
 			return nil, err
 		}
@@ -217,6 +264,36 @@ func (ctx *dbimp) DeleteAccount(id xginx.Address, uid primitive.ObjectID) error
 	return nil
 }
 
+//账号添加所属用户
+func (ctx *dbimp) AddAccountUser(id xginx.Address, uid primitive.ObjectID) error {
+	col := ctx.table(TAccountName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$addToSet": bson.M{"uid": uid}})
+	return sr.Err()
+}
+
+//获取包含私钥的账号
+func (ctx *dbimp) ListAccountsWithKid(kid string) ([]*TAccount, error) {
+	col := ctx.table(TAccountName)
+	rets := []*TAccount{}
+	iter, err := col.Find(ctx, bson.M{"kid": kid})
+	if err != nil {
+		return nil, err
+	}
+	for iter.Next(ctx) {
+		a := &TAccount{}
+		err := iter.Decode(a)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, a)
+	}
+	err = iter.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rets, nil
+}
+
 //添加一个私钥
 func (ctx *dbimp) InsertAccount(obj *TAccount) error {
 	col := ctx.table(TAccountName)
@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"sync"
@@ -28,22 +29,12 @@ const (
 	TokenPassword = config.TokenKey
 	//token在header中的名称
 	TokenHeader = "X-Access-Token"
-	//token超时时间设置
-	TokenTime = time.Hour * 24 * 4
+	//access token超时时间设置,过期后使用refresh token换取
+	TokenTime = time.Minute * 30
+	//管理员token在header中的名称
+	AdminHeader = "X-Admin-Token"
 )
 
-/*
-//数据库索引
-db.accounts.createIndex({uid:1})
-db.accounts.createIndex({tags:1})
-db.accounts.createIndex({pkh:1})
-db.privates.createIndex({uid:1})
-db.txs.createIndex({uid:1})
-db.users.createIndex({mobile:1})
-db.sigs.createIndex({tid:1})
-db.sigs.createIndex({uid:1})
-*/
-
 //数据连接地址
 var (
 	//连接字符串设置
@@ -55,12 +46,25 @@ var (
 	MinPoolSize = uint64(10)
 	//默认数据库操作超时时间
 	DbTimeout = time.Second * 30
+	//数据库引擎 DbEngineMongo 或 DbEngineMemory,启动时使用-engine设置
+	DbEngine = DbEngineMongo
+	//管理员接口token,为空时禁用管理员接口,启动时使用-admin设置
+	AdminToken = ""
+)
+
+//数据库引擎定义
+const (
+	//使用mongodb和redis
+	DbEngineMongo = "mongo"
+	//使用进程内存数据库,不依赖外部服务,测试使用
+	DbEngineMemory = "memory"
 )
 
 var (
 	dbonce   = sync.Once{}
 	rediscli *redis.Client
 	mongocli *mongo.Client
+	memcli   *memStore
 	cipher   = xginx.NewAESCipher([]byte(TokenPassword))
 )
 
@@ -90,13 +94,23 @@ func ToObjectID(v interface{}) primitive.ObjectID {
 	}
 }
 
+//CheckAdminToken 检测管理员token
+func CheckAdminToken(tk string) bool {
+	if AdminToken == "" || tk == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(tk), []byte(AdminToken)) == 1
+}
+
 //IAppDbImp app接口
 type IAppDbImp interface {
-	mongo.SessionContext
+	context.Context
 	//是否在事务环境下
 	IsTx() bool
 	//使用事务连接
 	UseTx(fn func(ctx IDbImp) error) error
+	//事务提交后执行,不在事务中时直接执行,事务失败时不执行
+	AfterCommit(fn func())
 }
 
 //App 定义
@@ -104,6 +118,7 @@ type App struct {
 	context.Context
 	redis *redis.Client
 	mongo *mongo.Client
+	mem   *memStore
 }
 
 //GenToken 生成一个token
@@ -160,6 +175,9 @@ func (app *App) Close() {
 func (app *App) UseRedisWithTimeout(timeout time.Duration, fn func(redv IRedisImp) error) error {
 	ctx, cancel := context.WithTimeout(app, timeout)
 	defer cancel()
+	if app.mem != nil {
+		return fn(NewMemRedisImp(ctx, app.mem))
+	}
 	client := rediscli.WithContext(ctx)
 	conn := client.Conn()
 	defer conn.Close()
@@ -176,6 +194,9 @@ func (app *App) UseRedis(fn func(redv IRedisImp) error) error {
 func (app *App) UseDbWithTimeout(timeout time.Duration, fn func(db IDbImp) error) error {
 	ctx, cancel := context.WithTimeout(app, timeout)
 	defer cancel()
+	if app.mem != nil {
+		return fn(NewMemDbImp(ctx, app.mem, nil))
+	}
 	return mongocli.UseSession(ctx, func(sctx mongo.SessionContext) error {
 		rcli := rediscli.WithContext(ctx)
 		conn := rcli.Conn()
@@ -208,34 +229,56 @@ func (app *App) UseTx(fn func(db IDbImp) error) error {
 //初始化一个实例对象
 func InitApp(ctx context.Context) *App {
 	dbonce.Do(func() {
-		//redis init
-		ropts, err := redis.ParseURL(RedisURI)
-		if err != nil {
-			panic(err)
+		//内存数据库不需要连接外部服务
+		if DbEngine == DbEngineMemory {
+			memcli = newMemStore()
+		} else {
+			initClients(ctx)
 		}
-		ropts.PoolSize = int(MaxPoolSize)
-		ropts.MinIdleConns = int(MinPoolSize)
-		rediscli = redis.NewClient(ropts).WithContext(ctx)
-		//mongodb init
-		mopts := options.Client().
-			ApplyURI(MongoURI).
-			SetMaxPoolSize(MaxPoolSize).
-			SetMinPoolSize(MinPoolSize)
-		mcli, err := mongo.NewClient(mopts)
-		if err != nil {
+		//启动时执行未执行的数据迁移,迁移后再创建索引,迁移需要处理和索引冲突的数据
+		app := &App{Context: ctx, redis: rediscli, mongo: mongocli, mem: memcli}
+		if _, err := app.Migrate(); err != nil {
 			panic(err)
 		}
-		err = mcli.Connect(ctx)
-		if err != nil {
+		if mongocli == nil {
+			return
+		}
+		if err := EnsureIndexes(ctx, mongocli); err != nil {
 			panic(err)
 		}
-		mongocli = mcli
 	})
 	return &App{
 		Context: ctx,
 		redis:   rediscli,
 		mongo:   mongocli,
+		mem:     memcli,
+	}
+}
+
+//连接redis和mongodb
+func initClients(ctx context.Context) {
+	//redis init
+	ropts, err := redis.ParseURL(RedisURI)
+	if err != nil {
+		panic(err)
+	}
+	ropts.PoolSize = int(MaxPoolSize)
+	ropts.MinIdleConns = int(MinPoolSize)
+	rediscli = redis.NewClient(ropts).WithContext(ctx)
+	//mongodb init
+	mopts := options.Client().
+		ApplyURI(MongoURI).
+		SetMaxPoolSize(MaxPoolSize).
+		SetMinPoolSize(MinPoolSize)
+	mcli, err := mongo.NewClient(mopts)
+	if err != nil {
+		panic(err)
+	}
+	err = mcli.Connect(ctx)
+	if err != nil {
+		panic(err)
 	}
+	mongocli = mcli
 }
 
 const (
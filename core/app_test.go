@@ -17,6 +17,11 @@ import (
 	"github.com/go-redis/redis/v7"
 )
 
+func init() {
+	//使用内存数据库测试
+	DbEngine = DbEngineMemory
+}
+
 func TestToken(t *testing.T) {
 	app := InitApp(context.Background())
 	tid := primitive.NewObjectID()
@@ -39,7 +44,7 @@ func TestToken(t *testing.T) {
 		if err != nil {
 			panic(err)
 		}
-		if ObjectIDEqual(v1, tid) {
+		if !ObjectIDEqual(v1, tid) {
 			t.Error("value error")
 		}
 		time.Sleep(time.Second * 2)
@@ -0,0 +1,292 @@
+package core
+
+import (
+	"errors"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//批量付款表
+const (
+	TBatchName = "batches"
+)
+
+//批量付款设置
+var (
+	//一个批次最多行数
+	BatchMaxRows = 5000
+	//一个交易最多包含的付款行数
+	BatchMaxOuts = 100
+	//一个交易最大字节数,超过时拆分成多个交易
+	BatchMaxTxSize = 1024 * 64
+)
+
+//TBatchStatus 付款行状态
+type TBatchStatus string
+
+//付款行状态定义
+const (
+	TBatchStatusPending   TBatchStatus = "pending"   //等待创建交易
+	TBatchStatusFailed    TBatchStatus = "failed"    //创建交易失败
+	TBatchStatusNew       TBatchStatus = "new"       //交易已创建,等待签名
+	TBatchStatusSign      TBatchStatus = "sign"      //已签名,等待发布
+	TBatchStatusPool      TBatchStatus = "pool"      //已发布到交易池
+	TBatchStatusBlock     TBatchStatus = "block"     //已进入区块,未达到需要的确认数
+	TBatchStatusConfirmed TBatchStatus = "confirmed" //达到需要的确认数,付款完成
+	TBatchStatusCancel    TBatchStatus = "cancel"    //交易已取消或者过期
+)
+
+//IsBatchStatus 是否是有效的付款行状态
+func IsBatchStatus(s TBatchStatus) bool {
+	switch s {
+	case TBatchStatusPending, TBatchStatusFailed, TBatchStatusNew, TBatchStatusSign,
+		TBatchStatusPool, TBatchStatusBlock, TBatchStatusConfirmed, TBatchStatusCancel:
+		return true
+	}
+	return false
+}
+
+//TBatchRow 付款行
+type TBatchRow struct {
+	Index  int           `bson:"idx"`    //在文件中的行号,从1开始
+	Dst    string        `bson:"dst"`    //addr->amount,script
+	Addr   xginx.Address `bson:"addr"`   //目标地址
+	Value  xginx.Amount  `bson:"value"`  //金额
+	Status TBatchStatus  `bson:"status"` //TBatchStatus*
+	TxID   []byte        `bson:"tid"`    //所在交易
+	Error  string        `bson:"error"`  //创建交易失败原因
+}
+
+//TBatch 批量付款
+type TBatch struct {
+	ID     primitive.ObjectID `bson:"_id"`   //批次id
+	UserID primitive.ObjectID `bson:"uid"`   //创建用户
+	Desc   string             `bson:"desc"`  //描述
+	Rows   []*TBatchRow       `bson:"rows"`  //付款行
+	Value  xginx.Amount       `bson:"value"` //总金额
+	Time   int64              `bson:"time"`  //创建时间
+}
+
+//NewBatch 创建批量付款,所有行为等待状态
+func NewBatch(uid primitive.ObjectID, desc string, rows []*TBatchRow) (*TBatch, error) {
+	if len(rows) == 0 {
+		return nil, errors.New("batch rows empty")
+	}
+	if len(rows) > BatchMaxRows {
+		return nil, errors.New("batch rows too many")
+	}
+	b := &TBatch{
+		ID:     primitive.NewObjectID(),
+		UserID: uid,
+		Desc:   desc,
+		Rows:   rows,
+		Time:   time.Now().Unix(),
+	}
+	for _, row := range rows {
+		row.Status = TBatchStatusPending
+		b.Value += row.Value
+	}
+	return b, nil
+}
+
+//Chunks 按照BatchMaxOuts拆分等待创建交易的行
+func (b *TBatch) Chunks() [][]*TBatchRow {
+	rets := [][]*TBatchRow{}
+	cur := []*TBatchRow{}
+	for _, row := range b.Rows {
+		if row.Status != TBatchStatusPending {
+			continue
+		}
+		cur = append(cur, row)
+		if len(cur) >= BatchMaxOuts {
+			rets = append(rets, cur)
+			cur = []*TBatchRow{}
+		}
+	}
+	if len(cur) > 0 {
+		rets = append(rets, cur)
+	}
+	return rets
+}
+
+//SetTx 设置行所在交易
+func (b *TBatch) SetTx(rows []*TBatchRow, stx *TTx) {
+	for _, row := range rows {
+		row.TxID = stx.ID
+		row.Status = TBatchStatusNew
+		row.Error = ""
+	}
+}
+
+//SetError 设置行创建交易失败
+func (b *TBatch) SetError(rows []*TBatchRow, err error) {
+	for _, row := range rows {
+		row.TxID = nil
+		row.Status = TBatchStatusFailed
+		row.Error = err.Error()
+	}
+}
+
+//TxIDs 创建的交易
+func (b *TBatch) TxIDs() [][]byte {
+	rets := [][]byte{}
+	has := map[string]bool{}
+	for _, row := range b.Rows {
+		if len(row.TxID) == 0 || has[string(row.TxID)] {
+			continue
+		}
+		has[string(row.TxID)] = true
+		rets = append(rets, row.TxID)
+	}
+	return rets
+}
+
+//交易状态对应的付款行状态
+func batchTxStatus(stx *TTx, now time.Time) TBatchStatus {
+	if stx.IsDead(now) {
+		return TBatchStatusCancel
+	}
+	switch stx.State {
+	case TTxStateSign:
+		return TBatchStatusSign
+	case TTxStatePool:
+		return TBatchStatusPool
+	case TTxStateBlock:
+		return TBatchStatusBlock
+	case TTxStateConfirmed:
+		return TBatchStatusConfirmed
+	}
+	return TBatchStatusNew
+}
+
+//LoadStatus 根据交易状态更新付款行状态,交易不存在时作为取消
+func (b *TBatch) LoadStatus(db IDbImp) {
+	now := time.Now()
+	txs := map[string]TBatchStatus{}
+	for _, row := range b.Rows {
+		if len(row.TxID) == 0 {
+			continue
+		}
+		key := string(row.TxID)
+		status, has := txs[key]
+		if !has {
+			status = TBatchStatusCancel
+			if stx, err := db.GetTx(row.TxID); err == nil {
+				status = batchTxStatus(stx, now)
+			}
+			txs[key] = status
+		}
+		row.Status = status
+	}
+}
+
+//FilterRows 获取指定状态的付款行,没有指定状态时返回所有行
+func (b *TBatch) FilterRows(status ...TBatchStatus) []*TBatchRow {
+	if len(status) == 0 {
+		return b.Rows
+	}
+	rets := []*TBatchRow{}
+	for _, row := range b.Rows {
+		for _, v := range status {
+			if row.Status == v {
+				rets = append(rets, row)
+				break
+			}
+		}
+	}
+	return rets
+}
+
+//Count 各个状态的行数
+func (b *TBatch) Count() map[TBatchStatus]int {
+	rets := map[TBatchStatus]int{}
+	for _, row := range b.Rows {
+		rets[row.Status]++
+	}
+	return rets
+}
+
+//添加批量付款
+func (ctx *dbimp) InsertBatch(b *TBatch) error {
+	col := ctx.table(TBatchName)
+	_, err := col.InsertOne(ctx, b)
+	return err
+}
+
+//获取批量付款
+func (ctx *dbimp) GetBatch(id primitive.ObjectID) (*TBatch, error) {
+	col := ctx.table(TBatchName)
+	v := &TBatch{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新付款行
+func (ctx *dbimp) SetBatchRows(id primitive.ObjectID, rows []*TBatchRow) error {
+	col := ctx.table(TBatchName)
+	_, err := col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"rows": rows}})
+	return err
+}
+
+//获取用户的批量付款
+func (ctx *dbimp) ListBatches(uid primitive.ObjectID) ([]*TBatch, error) {
+	col := ctx.table(TBatchName)
+	iter, err := col.Find(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TBatch{}
+	for iter.Next(ctx) {
+		v := &TBatch{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+func (db *memimp) InsertBatch(b *TBatch) error {
+	return db.insert(TBatchName, b, &TBatch{})
+}
+
+func (db *memimp) GetBatch(id primitive.ObjectID) (*TBatch, error) {
+	v := &TBatch{}
+	err := db.first(v, TBatchName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) SetBatchRows(id primitive.ObjectID, rows []*TBatchRow) error {
+	b, err := db.GetBatch(id)
+	if err != nil {
+		return err
+	}
+	b.Rows = rows
+	return db.insert(TBatchName, b, &TBatch{})
+}
+
+func (db *memimp) ListBatches(uid primitive.ObjectID) ([]*TBatch, error) {
+	rets := []*TBatch{}
+	var err error
+	err2 := db.each(TBatchName, "uid", uid, func(obj interface{}) bool {
+		v := &TBatch{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
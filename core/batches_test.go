@@ -0,0 +1,87 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBatchStatus(t *testing.T) {
+	as := assert.New(t)
+	_, err := NewBatch(primitive.NewObjectID(), "", nil)
+	as.Error(err)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	rows := []*TBatchRow{}
+	for i := 1; i <= 5; i++ {
+		rows = append(rows, &TBatchRow{Index: i, Value: xginx.Amount(i)})
+	}
+	omax := BatchMaxOuts
+	BatchMaxOuts = 2
+	defer func() {
+		BatchMaxOuts = omax
+	}()
+	batch, err := NewBatch(uid, "batch_test", rows)
+	as.NoError(err)
+	as.Equal(xginx.Amount(15), batch.Value)
+	chunks := batch.Chunks()
+	as.Equal(3, len(chunks))
+	as.Equal(1, len(chunks[2]))
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertBatch(batch)
+		if err != nil {
+			return err
+		}
+		stx := &TTx{ID: xginx.Hash256From([]byte("batch_test_tx")).Bytes(), UserID: uid, State: TTxStateNew}
+		err = db.InsertTx(stx)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteTx(stx.ID)
+		batch.SetTx(chunks[0], stx)
+		batch.SetError(chunks[1], errors.New("coins not enough"))
+		err = db.SetBatchRows(batch.ID, batch.Rows)
+		if err != nil {
+			return err
+		}
+		v, err := db.GetBatch(batch.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(1, len(v.TxIDs()))
+		count := v.Count()
+		as.Equal(2, count[TBatchStatusNew])
+		as.Equal(2, count[TBatchStatusFailed])
+		as.Equal(1, count[TBatchStatusPending])
+		//交易状态变化后行状态跟随变化
+		err = db.SetTxState(stx.ID, TTxStatePool)
+		if err != nil {
+			return err
+		}
+		v.LoadStatus(db)
+		as.Equal(2, v.Count()[TBatchStatusPool])
+		//达到确认数后付款完成
+		err = db.SetTxState(stx.ID, TTxStateConfirmed)
+		if err != nil {
+			return err
+		}
+		v.LoadStatus(db)
+		as.Equal(2, v.Count()[TBatchStatusConfirmed])
+		as.Equal(0, v.Count()[TBatchStatusBlock])
+		as.Len(v.FilterRows(TBatchStatusConfirmed), 2)
+		as.Len(v.FilterRows(TBatchStatusConfirmed, TBatchStatusFailed), 4)
+		as.Len(v.FilterRows(), 5)
+		as.True(IsBatchStatus(TBatchStatusConfirmed))
+		as.False(IsBatchStatus("done"))
+		bs, err := db.ListBatches(uid)
+		as.NoError(err)
+		as.Equal(1, len(bs))
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,534 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//区块处理进度表
+const (
+	TBlockMarkName = "block_marks"
+	//连接区块处理进度id
+	blockMarkID = "link"
+)
+
+var (
+	//TxConfirmNum 交易完成默认需要的确认数,账号可以单独设置
+	TxConfirmNum uint32 = 6
+	//MaxConfirmNum 账号可以设置的最大确认数
+	MaxConfirmNum uint32 = 1000
+	//BlockRetryNum 区块处理失败时的重试次数,仍然失败时等待下次同步
+	BlockRetryNum = 3
+)
+
+//ConfirmNum 账号交易完成需要的确认数,多个账号时取最大值
+func ConfirmNum(db IDbImp, accs []xginx.Address) uint32 {
+	num := uint32(0)
+	for _, id := range accs {
+		v := TxConfirmNum
+		acc, err := db.GetAccount(id)
+		if err == nil && acc.Confirms > 0 {
+			v = acc.Confirms
+		}
+		if v > num {
+			num = v
+		}
+	}
+	if num == 0 {
+		num = TxConfirmNum
+	}
+	return num
+}
+
+//NeedConfirm 交易完成需要的确认数,没有设置时使用默认值
+func (stx *TTx) NeedConfirm() uint32 {
+	if stx.Need > 0 {
+		return stx.Need
+	}
+	return TxConfirmNum
+}
+
+//IsConfirmed 交易是否已经完成
+func (stx *TTx) IsConfirmed() bool {
+	return stx.State == TTxStateConfirmed
+}
+
+//Confirms 根据链高度计算确认数,不在区块中时为0
+//完成后不再更新保存的确认数,读取时使用这个方法
+func (stx *TTx) Confirms(height uint32) uint32 {
+	if len(stx.Block) == 0 || height < stx.Height {
+		return 0
+	}
+	return height - stx.Height + 1
+}
+
+//SetBlock 交易进入区块,记录所在区块id,高度和完成需要的确认数
+func (stx *TTx) SetBlock(db IDbImp, bid xginx.HASH256, height uint32, need uint32) error {
+	err := db.SetTxBlock(stx.ID, bid[:], height, need)
+	if err != nil {
+		return err
+	}
+	stx.Block = bid[:]
+	stx.Height = height
+	stx.Need = need
+	stx.Confirm = 1
+	return stx.SetTxState(db, TTxStateBlock)
+}
+
+//UnlinkBlock 交易所在区块从链断开
+//交易还在交易池中时回到TTxStatePool,输入已经被其他交易使用时作废
+//否则回到已签名状态等待用户重新发布,回到未完成状态时重新占用输入金额
+//监听器回调时区块索引可能被锁定,这里不向交易池发布交易避免死锁
+func (stx *TTx) UnlinkBlock(db IDbImp, bi *xginx.BlockIndex, tx *xginx.TX) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	if stx.State != TTxStateBlock && stx.State != TTxStateConfirmed {
+		return fmt.Errorf("tx state %d not in block", stx.State)
+	}
+	err := db.SetTxBlock(stx.ID, nil, 0, 0)
+	if err != nil {
+		return err
+	}
+	stx.Block = nil
+	stx.Height = 0
+	stx.Need = 0
+	stx.Confirm = 0
+	pooled := bi.GetTxPool().Has(xginx.NewHASH256(stx.ID))
+	if !pooled && TxConflict(bi, tx) {
+		return stx.setCancel(db, TTxCancelConflict, primitive.NilObjectID, "conflict tx in block")
+	}
+	//输入金额已经被其他未完成交易占用时作废,先检查避免写入失败中断事务
+	for _, in := range stx.Ins {
+		if IsReserved(db, xginx.NewHASH256(in.OutHash), in.OutIndex) {
+			return stx.setCancel(db, TTxCancelConflict, primitive.NilObjectID, "input reserved by other tx")
+		}
+	}
+	err = stx.Reserve(db)
+	if err != nil {
+		return err
+	}
+	if pooled {
+		return stx.SetTxState(db, TTxStatePool)
+	}
+	return stx.SetTxState(db, TTxStateSign)
+}
+
+//TxConflict 交易输入引用的输出是否已经被其他交易使用
+//被交易池中的其他交易使用或者已经不在未花费列表中
+func TxConflict(bi *xginx.BlockIndex, tx *xginx.TX) bool {
+	id, err := tx.ID()
+	if err != nil {
+		return false
+	}
+	txp := bi.GetTxPool()
+	spent := map[string]bool{}
+	for _, ptx := range txp.AllTxs() {
+		pid, err := ptx.ID()
+		if err != nil || pid.Equal(id) {
+			continue
+		}
+		for _, in := range ptx.Ins {
+			spent[fmt.Sprintf("%v:%d", in.OutHash, in.OutIndex)] = true
+		}
+	}
+	for _, in := range tx.Ins {
+		if in.IsCoinBase() {
+			continue
+		}
+		if spent[fmt.Sprintf("%v:%d", in.OutHash, in.OutIndex)] {
+			return true
+		}
+		//引用未确认的交易输出,没有被交易池中其他交易使用
+		if txp.Has(in.OutHash) {
+			continue
+		}
+		//引用的交易不存在时无法确定是否冲突
+		out, err := loadTxInOut(bi, NewTTxIn(in))
+		if err != nil {
+			continue
+		}
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			continue
+		}
+		pkh, err := addr.GetPkh()
+		if err != nil {
+			continue
+		}
+		if _, err := bi.GetCoin(pkh, in.OutHash, in.OutIndex); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+//RefreshConfirms 链高度变化时更新区块中未完成交易的确认数
+//达到需要的确认数后设置为TTxStateConfirmed,返回完成的数量
+func RefreshConfirms(db IDbImp, tip uint32) (int, error) {
+	txs, err := db.ListBlockTxs()
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, stx := range txs {
+		confirm := uint32(0)
+		if tip >= stx.Height {
+			confirm = tip - stx.Height + 1
+		}
+		if confirm != stx.Confirm {
+			err = db.SetTxConfirm(stx.ID, confirm)
+			if err != nil {
+				return num, err
+			}
+			stx.Confirm = confirm
+		}
+		if confirm < stx.NeedConfirm() {
+			continue
+		}
+		err = stx.SetTxState(db, TTxStateConfirmed)
+		if err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
+}
+
+//LinkBlockTxs 区块连接到链上时更新区块中交易的状态,每个交易单独使用事务
+//hs是区块的收支记录,用来获取交易相关账号需要的确认数
+//使用了相同输入的其他未完成或者交易池中的交易作废,失败时返回错误由调用者重试
+func LinkBlockTxs(db IDbImp, blk *xginx.BlockInfo, hs []*THistory) error {
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	accs := map[string][]xginx.Address{}
+	for _, h := range hs {
+		accs[string(h.TxID)] = append(accs[string(h.TxID)], h.Account)
+	}
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		err = db.UseTx(func(db IDbImp) error {
+			stx, err := db.GetTx(id[:])
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			need := ConfirmNum(db, accs[string(id[:])])
+			return stx.SetBlock(db, bid, blk.Meta.Height, need)
+		})
+		if err != nil {
+			return fmt.Errorf("set tx %v block error: %w", id, err)
+		}
+		err = CancelConflictTxs(db, id, tx)
+		if err != nil {
+			return fmt.Errorf("cancel tx %v conflict txs error: %w", id, err)
+		}
+	}
+	return nil
+}
+
+//CancelConflictTxs 区块交易使用的输入被其他交易占用时作废这些交易
+//未完成和交易池中的交易都占用了输入金额,每个交易单独使用事务
+func CancelConflictTxs(db IDbImp, id xginx.HASH256, tx *xginx.TX) error {
+	for _, in := range tx.Ins {
+		if in.IsCoinBase() {
+			continue
+		}
+		r, err := db.GetReserve(ReserveID(in.OutHash, in.OutIndex.ToUInt32()))
+		if err != nil || bytes.Equal(r.TxID, id[:]) {
+			continue
+		}
+		err = db.UseTx(func(db IDbImp) error {
+			stx, err := db.GetTx(r.TxID)
+			if err != nil {
+				return err
+			}
+			if !stx.IsPending() && stx.State != TTxStatePool {
+				return nil
+			}
+			return stx.setCancel(db, TTxCancelConflict, primitive.NilObjectID, fmt.Sprintf("input used by tx %v", id))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//UnlinkBlockTxs 区块从链断开时更新区块中交易的状态,每个交易单独使用事务
+//失败时返回错误由调用者重试
+func UnlinkBlockTxs(db IDbImp, bi *xginx.BlockIndex, blk *xginx.BlockInfo) error {
+	for _, tx := range blk.Txs {
+		id, err := tx.ID()
+		if err != nil {
+			return err
+		}
+		err = db.UseTx(func(db IDbImp) error {
+			stx, err := db.GetTx(id[:])
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return stx.UnlinkBlock(db, bi, tx)
+		})
+		if err != nil {
+			return fmt.Errorf("unlink tx %v block error: %w", id, err)
+		}
+	}
+	return nil
+}
+
+//TBlockMark 已经处理的最后一个区块,停止期间或者处理失败的区块在同步时补处理
+type TBlockMark struct {
+	ID     string `bson:"_id"`    //进度id
+	Height uint32 `bson:"height"` //区块高度
+	Block  []byte `bson:"blk"`    //区块id
+}
+
+//LinkBlock 区块连接到链上时保存收支记录,更新交易状态并通知用户,完成后记录处理进度
+//需要在事务中执行,失败时进度不变
+func LinkBlock(db IDbImp, bi *xginx.BlockIndex, blk *xginx.BlockInfo) error {
+	if !db.IsTx() {
+		return errors.New("need use tx")
+	}
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	//保存账号收支记录并通知收到转账的用户
+	hs, err := IndexBlock(db, bi, blk)
+	if err != nil {
+		return err
+	}
+	PublishIncoming(db, hs)
+	//记录交易所在区块,达到确认数的交易完成
+	err = LinkBlockTxs(db, blk, hs)
+	if err != nil {
+		return err
+	}
+	_, err = RefreshConfirms(db, blk.Meta.Height)
+	if err != nil {
+		return err
+	}
+	//通知达到确认数的收款
+	_, err = PublishIncomingConfirmed(db, blk.Meta.Height)
+	if err != nil {
+		return err
+	}
+	return db.SetBlockMark(&TBlockMark{ID: blockMarkID, Height: blk.Meta.Height, Block: bid.Bytes()})
+}
+
+//UnlinkBlock 区块从链断开时删除收支记录,更新交易状态,进度回到上一个区块
+//需要在事务中执行,失败时进度不变
+func UnlinkBlock(db IDbImp, bi *xginx.BlockIndex, blk *xginx.BlockInfo) error {
+	if !db.IsTx() {
+		return errors.New("need use tx")
+	}
+	//删除账号收支记录
+	err := UnindexBlock(db, blk)
+	if err != nil {
+		return err
+	}
+	//交易回到交易池,冲突的交易作废
+	err = UnlinkBlockTxs(db, bi, blk)
+	if err != nil {
+		return err
+	}
+	_, err = RefreshConfirms(db, blk.Meta.Height-1)
+	if err != nil {
+		return err
+	}
+	return db.SetBlockMark(&TBlockMark{ID: blockMarkID, Height: blk.Meta.Height - 1, Block: blk.Meta.Prev.Bytes()})
+}
+
+//同步区块时不能同时执行
+var syncBlocksMu sync.Mutex
+
+//在事务中处理区块,失败时重试
+func (app *App) retryBlock(fn func(db IDbImp) error) error {
+	var err error
+	for i := 0; i < BlockRetryNum; i++ {
+		err = app.UseTx(fn)
+		if err == nil {
+			return nil
+		}
+		xginx.LogError("process block error", err, "retry", i+1)
+	}
+	return err
+}
+
+//SyncBlocks 从处理进度同步到链上最新区块,返回连接和断开的区块数量
+//进度区块已经不在主链上时先断开,每个区块在一个事务中处理,失败时下次同步重新处理
+//没有处理进度时从最新区块开始处理
+func (app *App) SyncBlocks(bi *xginx.BlockIndex) (int, error) {
+	syncBlocksMu.Lock()
+	defer syncBlocksMu.Unlock()
+	num := 0
+	var mark *TBlockMark
+	for {
+		err := app.UseDb(func(db IDbImp) error {
+			v, err := db.GetBlockMark()
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				v, err = nil, nil
+			}
+			mark = v
+			return err
+		})
+		if err != nil {
+			return num, err
+		}
+		tip := bi.Height()
+		if mark == nil {
+			mark = &TBlockMark{ID: blockMarkID, Height: tip - 1}
+			break
+		}
+		//进度区块在主链上时连接之后的区块
+		if mark.Height <= tip {
+			blk, err := bi.LoadAt(mark.Height)
+			if err != nil {
+				return num, err
+			}
+			bid, err := blk.ID()
+			if err != nil {
+				return num, err
+			}
+			if bytes.Equal(bid.Bytes(), mark.Block) {
+				break
+			}
+		}
+		blk, err := bi.LoadBlock(xginx.NewHASH256(mark.Block))
+		if err != nil {
+			return num, err
+		}
+		err = app.retryBlock(func(db IDbImp) error {
+			return UnlinkBlock(db, bi, blk)
+		})
+		if err != nil {
+			return num, err
+		}
+		num++
+	}
+	for h := mark.Height + 1; h <= bi.Height(); h++ {
+		blk, err := bi.LoadAt(h)
+		if err != nil {
+			return num, err
+		}
+		err = app.retryBlock(func(db IDbImp) error {
+			return LinkBlock(db, bi, blk)
+		})
+		if err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
+}
+
+//SyncUnlinkBlock 区块从链断开时,进度在这个区块时断开处理
+//没有处理到这个区块时不需要断开,其他情况在同步时处理
+func (app *App) SyncUnlinkBlock(bi *xginx.BlockIndex, blk *xginx.BlockInfo) error {
+	syncBlocksMu.Lock()
+	defer syncBlocksMu.Unlock()
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	return app.retryBlock(func(db IDbImp) error {
+		mark, err := db.GetBlockMark()
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(mark.Block, bid.Bytes()) {
+			return nil
+		}
+		return UnlinkBlock(db, bi, blk)
+	})
+}
+
+//获取区块处理进度
+func (ctx *dbimp) GetBlockMark() (*TBlockMark, error) {
+	col := ctx.table(TBlockMarkName)
+	v := &TBlockMark{}
+	err := col.FindOne(ctx, bson.M{"_id": blockMarkID}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//保存区块处理进度
+func (ctx *dbimp) SetBlockMark(m *TBlockMark) error {
+	col := ctx.table(TBlockMarkName)
+	opts := options.Replace().SetUpsert(true)
+	_, err := col.ReplaceOne(ctx, bson.M{"_id": m.ID}, m, opts)
+	return err
+}
+
+func (db *memimp) GetBlockMark() (*TBlockMark, error) {
+	v := &TBlockMark{}
+	err := db.first(v, TBlockMarkName, "id", blockMarkID)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) SetBlockMark(m *TBlockMark) error {
+	return db.insert(TBlockMarkName, m, &TBlockMark{})
+}
+
+//作废交易,不检查交易状态
+func (stx *TTx) setCancel(db IDbImp, typ TTxCancelType, uid primitive.ObjectID, reason string) error {
+	stx.Cancel = TTxCancel{
+		Type:   typ,
+		UserID: uid,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+	//签名记录会被删除,先获取需要通知的用户
+	uids := stx.eventUsers(db)
+	err := db.CancelTx(stx.ID, stx.Cancel)
+	if err != nil {
+		return err
+	}
+	stx.State = TTxStateCancel
+	stx.publish(db, uids, EventCancel)
+	return nil
+}
+
+//设置账号交易完成需要的确认数
+func (ctx *dbimp) SetAccountConfirms(id xginx.Address, confirms uint32) error {
+	col := ctx.table(TAccountName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"confirms": confirms}})
+	return sr.Err()
+}
+
+func (db *memimp) SetAccountConfirms(id xginx.Address, confirms uint32) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	acc.Confirms = confirms
+	return db.insert(TAccountName, acc, &TAccount{})
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTxBlockConfirms(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	bid := xginx.Hash256From([]byte("blocks_test_blk"))
+	acc := &TAccount{ID: xginx.Address("blocks_test_acc"), UserID: []primitive.ObjectID{uid}}
+	stx := &TTx{ID: xginx.Hash256From([]byte("blocks_test_tx")).Bytes(), UserID: uid, State: TTxStatePool}
+	err := app.UseTx(func(db IDbImp) error {
+		err := db.InsertAccount(acc)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteAccount(acc.ID, uid)
+		err = db.InsertTx(stx)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteTx(stx.ID)
+		//账号没有设置时使用默认确认数
+		as.Equal(TxConfirmNum, ConfirmNum(db, []xginx.Address{acc.ID}))
+		err = db.SetAccountConfirms(acc.ID, 3)
+		if err != nil {
+			return err
+		}
+		need := ConfirmNum(db, []xginx.Address{acc.ID})
+		as.Equal(uint32(3), need)
+		err = stx.SetBlock(db, bid, 10, need)
+		if err != nil {
+			return err
+		}
+		v, err := db.GetTx(stx.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(TTxState(TTxStateBlock), v.State)
+		as.Equal(bid[:], v.Block)
+		as.Equal(uint32(10), v.Height)
+		as.Equal(uint32(1), v.Confirm)
+		as.Equal(uint32(3), v.Need)
+		//链高度增加后更新确认数,未达到需要的确认数
+		num, err := RefreshConfirms(db, 11)
+		if err != nil {
+			return err
+		}
+		as.Equal(0, num)
+		v, err = db.GetTx(stx.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(2), v.Confirm)
+		as.Equal(TTxState(TTxStateBlock), v.State)
+		//达到确认数后交易完成
+		num, err = RefreshConfirms(db, 12)
+		if err != nil {
+			return err
+		}
+		as.Equal(1, num)
+		v, err = db.GetTx(stx.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(3), v.Confirm)
+		as.True(v.IsConfirmed())
+		//完成后确认数根据链高度计算
+		as.Equal(uint32(11), v.Confirms(20))
+		as.Equal(uint32(0), v.Confirms(9))
+		//完成的交易不再更新
+		txs, err := db.ListBlockTxs()
+		if err != nil {
+			return err
+		}
+		for _, tx := range txs {
+			as.NotEqual(stx.ID, tx.ID)
+		}
+		//冲突交易进入区块后作废
+		err = db.SetTxBlock(stx.ID, nil, 0, 0)
+		if err != nil {
+			return err
+		}
+		err = stx.setCancel(db, TTxCancelConflict, primitive.NilObjectID, "conflict")
+		if err != nil {
+			return err
+		}
+		v, err = db.GetTx(stx.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(TTxState(TTxStateCancel), v.State)
+		as.Equal(TTxCancelType(TTxCancelConflict), v.Cancel.Type)
+		as.Nil(v.Block)
+		return nil
+	})
+	as.NoError(err)
+}
+
+func TestCancelConflictTxs(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	out := xginx.Hash256From([]byte("conflict_test_out"))
+	newtx := func(id string, state TTxState, idx ...uint32) *TTx {
+		stx := &TTx{ID: xginx.Hash256From([]byte(id)).Bytes(), UserID: uid, State: state}
+		for _, v := range idx {
+			stx.Ins = append(stx.Ins, TTxIn{OutHash: out.Bytes(), OutIndex: v})
+		}
+		return stx
+	}
+	sign := newtx("conflict_test_sign", TTxStateSign, 0)
+	pool := newtx("conflict_test_pool", TTxStatePool, 1)
+	other := newtx("conflict_test_other", TTxStateNew, 2)
+	self := newtx("conflict_test_self", TTxStatePool, 3)
+	err := app.UseTx(func(db IDbImp) error {
+		for _, stx := range []*TTx{sign, pool, other, self} {
+			err := db.InsertTx(stx)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteTx(stx.ID)
+			err = stx.Reserve(db)
+			if err != nil {
+				return err
+			}
+		}
+		//区块中的交易使用了sign和pool的输入
+		tx := &xginx.TX{}
+		for _, v := range []uint32{0, 1, 3} {
+			tx.Ins = append(tx.Ins, &xginx.TxIn{OutHash: out, OutIndex: xginx.VarUInt(v)})
+		}
+		err := CancelConflictTxs(db, xginx.NewHASH256(self.ID), tx)
+		if err != nil {
+			return err
+		}
+		for _, stx := range []*TTx{sign, pool} {
+			v, err := db.GetTx(stx.ID)
+			if err != nil {
+				return err
+			}
+			as.Equal(TTxState(TTxStateCancel), v.State)
+			as.Equal(TTxCancelType(TTxCancelConflict), v.Cancel.Type)
+		}
+		as.False(IsReserved(db, out, 0))
+		as.False(IsReserved(db, out, 1))
+		//没有冲突的交易和区块中的交易不变
+		for _, stx := range []*TTx{other, self} {
+			v, err := db.GetTx(stx.ID)
+			if err != nil {
+				return err
+			}
+			as.Equal(stx.State, v.State)
+		}
+		as.True(IsReserved(db, out, 2))
+		return nil
+	})
+	as.NoError(err)
+}
+
+//区块断开后交易回到交易池,已签名或者因为冲突作废
+func (st *TxsTestSuite) TestUnlinkBlock() {
+	st.Require().NotNil(st.acc, "default account miss")
+	bi := xginx.NewTestBlockIndex(100, st.acc.GetAddress())
+	defer xginx.CloseTestBlock(bi)
+	accs := xginx.GetTestAccount(bi)
+	st.Require().NotNil(accs, "get test accounts error")
+	dst, err := accs[1].GetAddress()
+	st.Require().NoError(err)
+	lis := NewSignListener(st.db, st.user)
+	mi := bi.NewTrans(lis)
+	mi.Add(dst, 1*xginx.Coin, xginx.DefaultLockedScript)
+	mi.Fee = 1 * xginx.Coin
+	tx, err := mi.NewTx(0, xginx.DefaultTxScript)
+	st.Require().NoError(err)
+	stx, err := st.user.SaveTx(st.db, tx, lis, "区块断开交易")
+	st.Require().NoError(err)
+	defer st.db.DeleteTx(stx.ID)
+	for _, sig := range lis.GetSigs() {
+		st.Require().NoError(sig.Sign(st.db))
+	}
+	ntx, err := stx.ToTx(st.db, bi)
+	st.Require().NoError(err)
+	in := stx.Ins[0]
+	out := xginx.NewHASH256(in.OutHash)
+	//输入没有被其他交易使用
+	st.Require().False(TxConflict(bi, ntx))
+	//进入区块后释放占用,不在交易池中时回到已签名并重新占用
+	bid := xginx.Hash256From([]byte("unlink_test_blk"))
+	st.Require().NoError(stx.SetBlock(st.db, bid, 100, 1))
+	st.Require().False(IsReserved(st.db, out, in.OutIndex))
+	st.Require().NoError(stx.UnlinkBlock(st.db, bi, ntx))
+	st.Require().Equal(TTxState(TTxStateSign), stx.State)
+	st.Require().True(IsReserved(st.db, out, in.OutIndex))
+	//还在交易池中时回到交易池
+	st.Require().NoError(bi.GetTxPool().PushTx(bi, ntx))
+	st.Require().NoError(stx.SetBlock(st.db, bid, 100, 1))
+	st.Require().NoError(stx.UnlinkBlock(st.db, bi, ntx))
+	st.Require().Equal(TTxState(TTxStatePool), stx.State)
+	st.Require().True(IsReserved(st.db, out, in.OutIndex))
+	//使用相同输入的其他交易和交易池中的交易冲突
+	ctx := &xginx.TX{Ver: ntx.Ver, Ins: ntx.Ins, Script: ntx.Script}
+	for _, v := range ntx.Outs {
+		ctx.Outs = append(ctx.Outs, &xginx.TxOut{Value: v.Value - 1, Script: v.Script})
+	}
+	st.Require().True(TxConflict(bi, ctx))
+	cid, err := ctx.ID()
+	st.Require().NoError(err)
+	cstx := &TTx{ID: cid.Bytes(), UserID: st.user.ID, State: TTxStateBlock}
+	st.Require().NoError(st.db.InsertTx(cstx))
+	defer st.db.DeleteTx(cstx.ID)
+	st.Require().NoError(cstx.UnlinkBlock(st.db, bi, ctx))
+	v, err := st.db.GetTx(cstx.ID)
+	st.Require().NoError(err)
+	st.Require().Equal(TTxState(TTxStateCancel), v.State)
+	st.Require().Equal(TTxCancelType(TTxCancelConflict), v.Cancel.Type)
+}
+
+func TestBlockMark(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	err := app.UseDb(func(db IDbImp) error {
+		//区块处理需要在事务中执行
+		as.Error(LinkBlock(db, nil, &xginx.BlockInfo{}))
+		as.Error(UnlinkBlock(db, nil, &xginx.BlockInfo{}))
+		m1 := &TBlockMark{ID: blockMarkID, Height: 10, Block: []byte("block_mark_10")}
+		err := db.SetBlockMark(m1)
+		if err != nil {
+			return err
+		}
+		m2 := &TBlockMark{ID: blockMarkID, Height: 11, Block: []byte("block_mark_11")}
+		err = db.SetBlockMark(m2)
+		if err != nil {
+			return err
+		}
+		v, err := db.GetBlockMark()
+		if err != nil {
+			return err
+		}
+		as.Equal(m2, v)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cxuhua/xginx"
+)
+
+//金额选择设置
+var (
+	//精确匹配时允许多出的金额,多出的部分作为交易费
+	BnBTolerance = xginx.Amount(0)
+	//精确匹配最大尝试次数
+	BnBMaxTries = 100000
+)
+
+//金额选择策略名称
+const (
+	CoinSelectDefault  = ""
+	CoinSelectLargest  = "largest"
+	CoinSelectSmallest = "smallest"
+	CoinSelectBnB      = "bnb"
+	CoinSelectOldest   = "oldest"
+)
+
+//ICoinSelector 金额选择策略
+//返回按使用优先级排列的金额,交易从前往后使用直到金额足够
+type ICoinSelector interface {
+	Select(coins xginx.Coins, target xginx.Amount) xginx.Coins
+}
+
+//CoinSelectorFunc 函数形式的选择策略
+type CoinSelectorFunc func(coins xginx.Coins, target xginx.Amount) xginx.Coins
+
+//Select 选择金额
+func (fn CoinSelectorFunc) Select(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	return fn(coins, target)
+}
+
+//复制并排序
+func sortCoins(coins xginx.Coins, less func(a, b *xginx.CoinKeyValue) bool) xginx.Coins {
+	rets := append(xginx.Coins{}, coins...)
+	sort.SliceStable(rets, func(i, j int) bool {
+		return less(rets[i], rets[j])
+	})
+	return rets
+}
+
+//默认排序
+func selectDefault(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	return coins.Sort()
+}
+
+//优先使用大额
+func selectLargest(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	return sortCoins(coins, func(a, b *xginx.CoinKeyValue) bool {
+		return a.Value > b.Value
+	})
+}
+
+//优先使用小额,用来合并零钱
+func selectSmallest(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	return sortCoins(coins, func(a, b *xginx.CoinKeyValue) bool {
+		return a.Value < b.Value
+	})
+}
+
+//优先使用最早的金额,交易池中的最后使用
+func selectOldest(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	return sortCoins(coins, func(a, b *xginx.CoinKeyValue) bool {
+		if a.IsPool() != b.IsPool() {
+			return b.IsPool()
+		}
+		return a.Height < b.Height
+	})
+}
+
+//分支定界查找金额和在[target,target+BnBTolerance]之间的组合,避免找零
+//找到后组合放在最前面,找不到时按大额优先
+func selectBnB(coins xginx.Coins, target xginx.Amount) xginx.Coins {
+	sorted := selectLargest(coins, target)
+	if target <= 0 {
+		return sorted
+	}
+	//剩余金额之和,用来剪枝
+	rest := make([]xginx.Amount, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		rest[i] = rest[i+1] + sorted[i].Value
+	}
+	if rest[0] < target {
+		return sorted
+	}
+	tries := 0
+	use := make([]bool, len(sorted))
+	var best []bool = nil
+	var search func(idx int, sum xginx.Amount) bool
+	search = func(idx int, sum xginx.Amount) bool {
+		tries++
+		if sum >= target {
+			if sum <= target+BnBTolerance {
+				best = append([]bool{}, use...)
+				return true
+			}
+			return false
+		}
+		if idx >= len(sorted) || tries > BnBMaxTries || sum+rest[idx] < target {
+			return false
+		}
+		use[idx] = true
+		if search(idx+1, sum+sorted[idx].Value) {
+			return true
+		}
+		use[idx] = false
+		return search(idx+1, sum)
+	}
+	if !search(0, 0) {
+		return sorted
+	}
+	rets := xginx.Coins{}
+	for i, v := range best {
+		if v {
+			rets = append(rets, sorted[i])
+		}
+	}
+	for i, v := range best {
+		if !v {
+			rets = append(rets, sorted[i])
+		}
+	}
+	return rets
+}
+
+var coinSelectors = map[string]ICoinSelector{
+	CoinSelectDefault:  CoinSelectorFunc(selectDefault),
+	CoinSelectLargest:  CoinSelectorFunc(selectLargest),
+	CoinSelectSmallest: CoinSelectorFunc(selectSmallest),
+	CoinSelectBnB:      CoinSelectorFunc(selectBnB),
+	CoinSelectOldest:   CoinSelectorFunc(selectOldest),
+}
+
+//GetCoinSelector 根据名称获取选择策略
+func GetCoinSelector(name string) (ICoinSelector, error) {
+	sel, has := coinSelectors[name]
+	if !has {
+		return nil, fmt.Errorf("coin selector %s not found", name)
+	}
+	return sel, nil
+}
+
+//CoinFilter 限制可以使用的账号,为空不限制
+type CoinFilter struct {
+	Accs []xginx.Address //只使用这些账号
+	Tags []string        //只使用包含任意一个标签的账号
+}
+
+//IsEmpty 是否没有设置限制
+func (f CoinFilter) IsEmpty() bool {
+	return len(f.Accs) == 0 && len(f.Tags) == 0
+}
+
+//Match 账号是否可以使用
+func (f CoinFilter) Match(acc *TAccount) bool {
+	if len(f.Accs) > 0 {
+		has := false
+		for _, id := range f.Accs {
+			if id == acc.ID {
+				has = true
+				break
+			}
+		}
+		if !has {
+			return false
+		}
+	}
+	if len(f.Tags) == 0 {
+		return true
+	}
+	for _, tag := range f.Tags {
+		if acc.HasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
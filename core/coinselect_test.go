@@ -0,0 +1,69 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCoins(vs ...xginx.Amount) xginx.Coins {
+	coins := xginx.Coins{}
+	for i, v := range vs {
+		coins = append(coins, &xginx.CoinKeyValue{
+			Value:  v,
+			Index:  xginx.VarUInt(i),
+			Height: xginx.VarUInt(len(vs) - i),
+		})
+	}
+	return coins
+}
+
+func coinValues(coins xginx.Coins) []xginx.Amount {
+	vs := []xginx.Amount{}
+	for _, v := range coins {
+		vs = append(vs, v.Value)
+	}
+	return vs
+}
+
+func TestCoinSelect(t *testing.T) {
+	as := assert.New(t)
+	coins := testCoins(5, 1, 8, 3, 4)
+	sel, err := GetCoinSelector(CoinSelectLargest)
+	as.NoError(err)
+	as.Equal([]xginx.Amount{8, 5, 4, 3, 1}, coinValues(sel.Select(coins, 10)))
+	sel, err = GetCoinSelector(CoinSelectSmallest)
+	as.NoError(err)
+	as.Equal([]xginx.Amount{1, 3, 4, 5, 8}, coinValues(sel.Select(coins, 10)))
+	//原始数据不被修改
+	as.Equal([]xginx.Amount{5, 1, 8, 3, 4}, coinValues(coins))
+	//精确匹配的组合在最前面
+	sel, err = GetCoinSelector(CoinSelectBnB)
+	as.NoError(err)
+	as.Equal([]xginx.Amount{8, 4, 5, 3, 1}, coinValues(sel.Select(coins, 12)))
+	as.Equal([]xginx.Amount{8, 1, 5, 4, 3}, coinValues(sel.Select(coins, 9)))
+	//找不到时大额优先
+	as.Equal([]xginx.Amount{8, 5, 4, 3, 1}, coinValues(sel.Select(coins, 100)))
+	_, err = GetCoinSelector("miss")
+	as.Error(err)
+}
+
+func TestSelectOldest(t *testing.T) {
+	sel, err := GetCoinSelector(CoinSelectOldest)
+	assert.NoError(t, err)
+	coins := testCoins(5, 1, 8)
+	assert.Equal(t, []xginx.Amount{8, 1, 5}, coinValues(sel.Select(coins, 10)))
+}
+
+func TestCoinFilter(t *testing.T) {
+	as := assert.New(t)
+	acc := &TAccount{ID: xginx.Address("filter_test"), Tags: []string{"a", "b"}}
+	as.True(CoinFilter{}.IsEmpty())
+	as.True(CoinFilter{}.Match(acc))
+	as.True(CoinFilter{Tags: []string{"c", "b"}}.Match(acc))
+	as.False(CoinFilter{Tags: []string{"c"}}.Match(acc))
+	as.True(CoinFilter{Accs: []xginx.Address{acc.ID}}.Match(acc))
+	as.False(CoinFilter{Accs: []xginx.Address{"other"}}.Match(acc))
+	as.False(CoinFilter{Accs: []xginx.Address{acc.ID}, Tags: []string{"c"}}.Match(acc))
+}
@@ -0,0 +1,267 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//地址簿表
+const (
+	TContactName = "contacts"
+)
+
+//ContactPrefix 交易目标使用@label引用地址簿中的联系人
+const ContactPrefix = "@"
+
+//ErrNotContact 只允许向地址簿中的地址付款时返回
+var ErrNotContact = errors.New("address not in address book")
+
+//TContact 用户地址簿中的联系人
+type TContact struct {
+	ID     primitive.ObjectID `bson:"_id"`    //联系人id
+	UserID primitive.ObjectID `bson:"uid"`    //所属用户
+	Label  string             `bson:"label"`  //标签,同一个用户下唯一
+	Addr   xginx.Address      `bson:"addr"`   //地址
+	Notes  string             `bson:"notes"`  //备注
+	Script string             `bson:"script"` //允许的输出脚本,为空不限制
+	Time   int64              `bson:"time"`   //创建时间
+}
+
+//NewContact 创建联系人
+func NewContact(uid primitive.ObjectID, label string, addr xginx.Address) (*TContact, error) {
+	c := &TContact{
+		ID:     primitive.NewObjectID(),
+		UserID: uid,
+		Label:  label,
+		Addr:   addr,
+		Time:   time.Now().Unix(),
+	}
+	err := c.Check()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Check 检查联系人标签和地址
+func (c *TContact) Check() error {
+	if c.Label == "" {
+		return errors.New("contact label miss")
+	}
+	if strings.HasPrefix(c.Label, ContactPrefix) || strings.Contains(c.Label, "->") {
+		return errors.New("contact label format error")
+	}
+	return c.Addr.Check()
+}
+
+//CheckScript 检查输出脚本是否允许,联系人没有设置脚本时不限制
+func (c *TContact) CheckScript(script string) error {
+	if c.Script == "" || c.Script == script {
+		return nil
+	}
+	return fmt.Errorf("contact %s script not allowed", c.Label)
+}
+
+//IsContactLabel 交易目标是否引用了联系人,返回联系人标签
+func IsContactLabel(s string) (string, bool) {
+	if !strings.HasPrefix(s, ContactPrefix) {
+		return "", false
+	}
+	return s[len(ContactPrefix):], true
+}
+
+//CheckContactDst 检查付款目标,设置了只允许向地址簿付款时地址必须在地址簿中
+//地址簿中有这个地址时检查输出脚本
+func CheckContactDst(db IDbImp, user *TUser, addr xginx.Address, script string) error {
+	cs, err := db.ListContactsWithAddr(user.ID, addr)
+	if err != nil {
+		return err
+	}
+	if len(cs) == 0 && user.BookOnly {
+		return ErrNotContact
+	}
+	if len(cs) == 0 {
+		return nil
+	}
+	//同一个地址多个联系人时有一个允许即可
+	for _, c := range cs {
+		if err = c.CheckScript(script); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+//添加联系人,标签重复时返回错误
+func (ctx *dbimp) InsertContact(c *TContact) error {
+	if _, err := ctx.GetContactWithLabel(c.UserID, c.Label); err == nil {
+		return fmt.Errorf("contact label %s exists", c.Label)
+	}
+	col := ctx.table(TContactName)
+	_, err := col.InsertOne(ctx, c)
+	return err
+}
+
+//获取联系人
+func (ctx *dbimp) GetContact(id primitive.ObjectID) (*TContact, error) {
+	col := ctx.table(TContactName)
+	v := &TContact{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//根据标签获取用户的联系人
+func (ctx *dbimp) GetContactWithLabel(uid primitive.ObjectID, label string) (*TContact, error) {
+	col := ctx.table(TContactName)
+	v := &TContact{}
+	err := col.FindOne(ctx, bson.M{"uid": uid, "label": label}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新联系人,标签重复时返回错误
+func (ctx *dbimp) UpdateContact(c *TContact) error {
+	if v, err := ctx.GetContactWithLabel(c.UserID, c.Label); err == nil && !ObjectIDEqual(v.ID, c.ID) {
+		return fmt.Errorf("contact label %s exists", c.Label)
+	}
+	col := ctx.table(TContactName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": c.ID}, c)
+	return sr.Err()
+}
+
+//删除联系人
+func (ctx *dbimp) DeleteContact(id primitive.ObjectID) error {
+	col := ctx.table(TContactName)
+	_, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+//获取用户的联系人
+func (ctx *dbimp) ListContacts(uid primitive.ObjectID) ([]*TContact, error) {
+	return ctx.findContacts(bson.M{"uid": uid})
+}
+
+//获取用户地址簿中地址相同的联系人
+func (ctx *dbimp) ListContactsWithAddr(uid primitive.ObjectID, addr xginx.Address) ([]*TContact, error) {
+	return ctx.findContacts(bson.M{"uid": uid, "addr": addr})
+}
+
+func (ctx *dbimp) findContacts(filter bson.M) ([]*TContact, error) {
+	col := ctx.table(TContactName)
+	iter, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TContact{}
+	for iter.Next(ctx) {
+		v := &TContact{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//设置是否只允许向地址簿中的地址付款
+func (ctx *dbimp) SetUserBookOnly(uid primitive.ObjectID, only bool) error {
+	col := ctx.table(TUsersName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{"bonly": only}})
+	return sr.Err()
+}
+
+//联系人标签索引
+func contactLabelKey(uid primitive.ObjectID, label string) string {
+	return uid.Hex() + ":" + label
+}
+
+func (db *memimp) InsertContact(c *TContact) error {
+	if _, err := db.GetContactWithLabel(c.UserID, c.Label); err == nil {
+		return fmt.Errorf("contact label %s exists", c.Label)
+	}
+	return db.insert(TContactName, c, &TContact{})
+}
+
+func (db *memimp) GetContact(id primitive.ObjectID) (*TContact, error) {
+	v := &TContact{}
+	err := db.first(v, TContactName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) GetContactWithLabel(uid primitive.ObjectID, label string) (*TContact, error) {
+	v := &TContact{}
+	err := db.first(v, TContactName, "label", contactLabelKey(uid, label))
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) UpdateContact(c *TContact) error {
+	_, err := db.GetContact(c.ID)
+	if err != nil {
+		return err
+	}
+	if v, err := db.GetContactWithLabel(c.UserID, c.Label); err == nil && !ObjectIDEqual(v.ID, c.ID) {
+		return fmt.Errorf("contact label %s exists", c.Label)
+	}
+	return db.insert(TContactName, c, &TContact{})
+}
+
+func (db *memimp) DeleteContact(id primitive.ObjectID) error {
+	return db.deleteAll(TContactName, "id", id)
+}
+
+func (db *memimp) ListContacts(uid primitive.ObjectID) ([]*TContact, error) {
+	return db.findContacts(uid, func(c *TContact) bool {
+		return true
+	})
+}
+
+func (db *memimp) ListContactsWithAddr(uid primitive.ObjectID, addr xginx.Address) ([]*TContact, error) {
+	return db.findContacts(uid, func(c *TContact) bool {
+		return c.Addr == addr
+	})
+}
+
+func (db *memimp) findContacts(uid primitive.ObjectID, fn func(c *TContact) bool) ([]*TContact, error) {
+	rets := []*TContact{}
+	var err error
+	err2 := db.each(TContactName, "uid", uid, func(obj interface{}) bool {
+		v := &TContact{}
+		err = memClone(obj, v)
+		if err == nil && fn(v) {
+			rets = append(rets, v)
+		}
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) SetUserBookOnly(uid primitive.ObjectID, only bool) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.BookOnly = only
+	return db.insert(TUsersName, user, &TUser{})
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestContacts(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	label, ok := IsContactLabel("@alice")
+	as.True(ok)
+	as.Equal("alice", label)
+	_, ok = IsContactLabel("alice")
+	as.False(ok)
+	user := &TUser{ID: primitive.NewObjectID()}
+	c1 := &TContact{ID: primitive.NewObjectID(), UserID: user.ID, Label: "alice", Addr: "contact_addr1"}
+	c2 := &TContact{ID: primitive.NewObjectID(), UserID: user.ID, Label: "bob", Addr: "contact_addr2", Script: "script"}
+	err := app.UseDb(func(db IDbImp) error {
+		for _, c := range []*TContact{c1, c2} {
+			err := db.InsertContact(c)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteContact(c.ID)
+		}
+		//同一个用户标签不能重复
+		as.Error(db.InsertContact(&TContact{ID: primitive.NewObjectID(), UserID: user.ID, Label: "alice"}))
+		other := &TContact{ID: primitive.NewObjectID(), UserID: primitive.NewObjectID(), Label: "alice"}
+		as.NoError(db.InsertContact(other))
+		defer db.DeleteContact(other.ID)
+		v, err := db.GetContactWithLabel(user.ID, "alice")
+		as.NoError(err)
+		as.Equal(c1.ID, v.ID)
+		cs, err := db.ListContacts(user.ID)
+		as.NoError(err)
+		as.Len(cs, 2)
+		//修改标签
+		c1.Label = "bob"
+		as.Error(db.UpdateContact(c1))
+		c1.Label = "carol"
+		as.NoError(db.UpdateContact(c1))
+		_, err = db.GetContactWithLabel(user.ID, "alice")
+		as.Error(err)
+		v, err = db.GetContactWithLabel(user.ID, "carol")
+		as.NoError(err)
+		as.Equal(c1.ID, v.ID)
+		//不在地址簿中的地址
+		as.NoError(CheckContactDst(db, user, "contact_addr3", ""))
+		user.BookOnly = true
+		as.Equal(ErrNotContact, CheckContactDst(db, user, "contact_addr3", ""))
+		as.NoError(CheckContactDst(db, user, "contact_addr1", "any"))
+		//联系人限制了输出脚本
+		as.NoError(CheckContactDst(db, user, "contact_addr2", "script"))
+		as.Error(CheckContactDst(db, user, "contact_addr2", "other"))
+		cs, err = db.ListContactsWithAddr(user.ID, xginx.Address("contact_addr2"))
+		as.NoError(err)
+		as.Len(cs, 1)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -29,6 +29,16 @@ type IDbImp interface {
 	DeleteUser(id interface{}) error
 	//根据手机号获取用户信息
 	GetUserInfoWithMobile(mobile string) (*TUser, error)
+	//设置用户登陆密码
+	SetUserPass(uid primitive.ObjectID, pwd TPassword) error
+	//强制用户重置登陆密码
+	ForceResetPass(uid primitive.ObjectID) error
+	//设置两步验证
+	SetUserTOTP(uid primitive.ObjectID, totp TTOTP) error
+	//设置用户主私钥和派生索引,助记词恢复时使用
+	SetUserKeys(uid primitive.ObjectID, keys string, xpub string, cipher CipherType, idx uint32) error
+	//设置用户非强化派生根的扩展公钥
+	SetUserXPub(uid primitive.ObjectID, xpub string) error
 	//修改用户主私钥密码
 	SetUserKeyPass(uid primitive.ObjectID, old string, new string) error
 	//修改用户私钥密码
@@ -51,6 +61,10 @@ type IDbImp interface {
 	GetAccount(id xginx.Address) (*TAccount, error)
 	//删除用户私钥
 	DeleteAccount(id xginx.Address, uid primitive.ObjectID) error
+	//账号添加所属用户
+	AddAccountUser(id xginx.Address, uid primitive.ObjectID) error
+	//获取包含私钥的账号
+	ListAccountsWithKid(kid string) ([]*TAccount, error)
 	//获取用户的私钥
 	ListPrivates(uid primitive.ObjectID) ([]*TPrivate, error)
 	//获取用户相关的账号
@@ -61,6 +75,16 @@ type IDbImp interface {
 	SetTxState(id []byte, state TTxState) error
 	//删除交易信息
 	DeleteTx(id []byte) error
+	//取消交易,删除交易的签名记录
+	CancelTx(id []byte, cancel TTxCancel) error
+	//获取已经过期的未完成交易
+	ListExpiredTxs(now int64) ([]*TTx, error)
+	//添加金额占用
+	InsertReserves(rs ...*TReserve) error
+	//获取金额占用
+	GetReserve(id string) (*TReserve, error)
+	//释放交易占用的金额
+	DeleteReserves(tid []byte) error
 	//插入交易信息
 	InsertTx(tx *TTx) error
 	//保存签名对象
@@ -77,12 +101,139 @@ type IDbImp interface {
 	ListUserTxs(uid primitive.ObjectID, sign bool) ([]*TTx, error)
 	//自增密钥索引
 	IncDeterIdx(name string, id interface{}) error
+	//设置私钥非强化派生根的扩展公钥
+	SetPrivateXPub(id string, xpub string) error
+	//添加会话
+	InsertSession(sess *TSession) error
+	//获取会话
+	GetSession(id primitive.ObjectID) (*TSession, error)
+	//根据refresh token hash获取会话
+	GetSessionWithRefresh(hv xginx.HASH256) (*TSession, error)
+	//轮换会话token,当前refresh token hash必须是refresh,否则返回错误
+	RotateSession(sess *TSession, refresh xginx.HASH256) error
+	//更新会话最后活跃时间
+	SetSessionLast(id primitive.ObjectID, last int64) error
+	//删除会话
+	DeleteSession(id primitive.ObjectID) error
+	//获取用户所有会话
+	ListSessions(uid primitive.ObjectID) ([]*TSession, error)
+	//添加批量付款
+	InsertBatch(b *TBatch) error
+	//获取批量付款
+	GetBatch(id primitive.ObjectID) (*TBatch, error)
+	//更新批量付款的付款行
+	SetBatchRows(id primitive.ObjectID, rows []*TBatchRow) error
+	//获取用户的批量付款
+	ListBatches(uid primitive.ObjectID) ([]*TBatch, error)
+	//添加计划付款
+	InsertSchedule(s *TSchedule) error
+	//获取计划付款
+	GetSchedule(id primitive.ObjectID) (*TSchedule, error)
+	//更新计划付款
+	UpdateSchedule(s *TSchedule) error
+	//删除计划付款
+	DeleteSchedule(id primitive.ObjectID) error
+	//获取用户的计划付款
+	ListSchedules(uid primitive.ObjectID) ([]*TSchedule, error)
+	//获取到期的计划付款
+	ListDueSchedules(now int64) ([]*TSchedule, error)
+	//设置账号策略
+	SetAccountPolicy(id xginx.Address, policy TPolicy) error
+	//更新账号支出版本,事务中锁定账号,检查每日限额使用
+	LockAccountSpends(id xginx.Address) error
+	//添加账号支出
+	InsertSpends(ss ...*TSpend) error
+	//获取账号since之后的支出
+	ListSpends(acc xginx.Address, since int64) ([]*TSpend, error)
+	//添加策略修改申请
+	InsertPolicyChange(pc *TPolicyChange) error
+	//获取策略修改申请
+	GetPolicyChange(id primitive.ObjectID) (*TPolicyChange, error)
+	//更新策略修改申请
+	UpdatePolicyChange(pc *TPolicyChange) error
+	//获取账号的策略修改申请
+	ListPolicyChanges(acc xginx.Address) ([]*TPolicyChange, error)
+	//添加联系人
+	InsertContact(c *TContact) error
+	//获取联系人
+	GetContact(id primitive.ObjectID) (*TContact, error)
+	//根据标签获取用户的联系人
+	GetContactWithLabel(uid primitive.ObjectID, label string) (*TContact, error)
+	//更新联系人
+	UpdateContact(c *TContact) error
+	//删除联系人
+	DeleteContact(id primitive.ObjectID) error
+	//获取用户的联系人
+	ListContacts(uid primitive.ObjectID) ([]*TContact, error)
+	//获取用户地址簿中地址相同的联系人
+	ListContactsWithAddr(uid primitive.ObjectID, addr xginx.Address) ([]*TContact, error)
+	//设置是否只允许向地址簿中的地址付款
+	SetUserBookOnly(uid primitive.ObjectID, only bool) error
+	//获取已经执行的迁移
+	ListMigrations() ([]*TMigration, error)
+	//添加迁移记录
+	InsertMigration(m *TMigration) error
+	//分页获取用户相关的账号
+	PageAccounts(uid primitive.ObjectID, f ListFilter, p Page) ([]*TAccount, string, error)
+	//分页获取用户的私钥
+	PagePrivates(uid primitive.ObjectID, f ListFilter, p Page) ([]*TPrivate, string, error)
+	//分页获取用户需要处理的交易
+	PageUserTxs(uid primitive.ObjectID, sign bool, f ListFilter, p Page) ([]*TTx, string, error)
+	//获取交易所有签名记录的用户
+	ListSigUsers(tid xginx.HASH256) ([]primitive.ObjectID, error)
+	//添加webhook
+	InsertWebhook(h *TWebhook) error
+	//获取webhook
+	GetWebhook(id primitive.ObjectID) (*TWebhook, error)
+	//更新webhook
+	UpdateWebhook(h *TWebhook) error
+	//删除webhook和投递记录
+	DeleteWebhook(id primitive.ObjectID) error
+	//获取用户的webhook
+	ListWebhooks(uid primitive.ObjectID) ([]*TWebhook, error)
+	//添加投递记录
+	InsertDelivery(d *TDelivery) error
+	//获取投递记录
+	GetDelivery(id primitive.ObjectID) (*TDelivery, error)
+	//更新投递记录
+	UpdateDelivery(d *TDelivery) error
+	//获取到期的投递记录
+	ListDueDeliveries(now int64) ([]*TDelivery, error)
+	//分页获取webhook的投递记录
+	PageDeliveries(hid primitive.ObjectID, f ListFilter, p Page) ([]*TDelivery, string, error)
+	//保存收支记录,已经存在时覆盖
+	InsertHistory(hs ...*THistory) error
+	//删除区块中的收支记录
+	DeleteBlockHistory(blk []byte) error
+	//分页获取账号的收支记录
+	PageHistory(accs []xginx.Address, f ListFilter, p Page) ([]*THistory, string, error)
+	//汇总账号的收支
+	SumHistory(accs []xginx.Address) (map[xginx.Address]THistoryBalance, error)
+	//标记账号收支记录已经从链上补全
+	SetAccountIndexed(id xginx.Address) error
+	//获取达到确认数还没有通知的收入记录
+	ListConfirmedIncoming(tip uint32) ([]*THistory, error)
+	//标记收入记录已经通知
+	SetHistoryDone(id string) error
+	//获取区块处理进度
+	GetBlockMark() (*TBlockMark, error)
+	//保存区块处理进度
+	SetBlockMark(m *TBlockMark) error
+	//设置交易所在区块和完成需要的确认数,blk为空时清除
+	SetTxBlock(id []byte, blk []byte, height uint32, need uint32) error
+	//设置交易确认数
+	SetTxConfirm(id []byte, confirm uint32) error
+	//获取进入区块还未完成的交易
+	ListBlockTxs() ([]*TTx, error)
+	//设置账号交易完成需要的确认数,为0使用默认值
+	SetAccountConfirms(id xginx.Address, confirms uint32) error
 }
 
 type dbimp struct {
 	mongo.SessionContext
 	*redisImp
-	isTx bool
+	isTx  bool
+	after []func() //事务提交后执行
 }
 
 func (db *dbimp) database(opts ...*options.DatabaseOptions) *mongo.Database {
@@ -98,16 +249,33 @@ func (db *dbimp) UseTx(fn func(db IDbImp) error) error {
 	if db.IsTx() {
 		return fn(db)
 	}
+	//事务可能重试,只执行最后一次提交的
+	var tdb *dbimp
 	_, err := db.WithTransaction(db, func(sdb mongo.SessionContext) (i interface{}, err error) {
-		return nil, fn(NewDbImp(sdb, db.rcli, db.conn, true))
+		tdb = NewDbImp(sdb, db.rcli, db.conn, true).(*dbimp)
+		return nil, fn(tdb)
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	for _, f := range tdb.after {
+		f()
+	}
+	return nil
 }
 
 func (db *dbimp) IsTx() bool {
 	return db.isTx
 }
 
+func (db *dbimp) AfterCommit(fn func()) {
+	if !db.IsTx() {
+		fn()
+		return
+	}
+	db.after = append(db.after, fn)
+}
+
 //NewDbImp 新建一个数据库接口
 func NewDbImp(ctx mongo.SessionContext, rcli *redis.Client, conn *redis.Conn, tx bool) IDbImp {
 	return &dbimp{
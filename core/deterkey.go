@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"math/big"
 
 	"github.com/cxuhua/xginx"
 	"github.com/cxuhua/xmgrs/util"
@@ -105,3 +106,148 @@ func NewDeterKey() *DeterKey {
 	k.Key = key
 	return k
 }
+
+//非强化派生,子公钥可以只通过父公钥和Key计算,和BIP32非强化派生一致
+func deriveHmac(key []byte, pks xginx.PKBytes, idx uint32) (*big.Int, []byte, error) {
+	h := hmac.New(sha512.New, key)
+	_, err := h.Write(pks[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	err = binary.Write(h, binary.BigEndian, idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := h.Sum(nil)
+	il := new(big.Int).SetBytes(b[:32])
+	if il.Cmp(xginx.S256().Params().N) >= 0 {
+		return nil, nil, fmt.Errorf("derive idx %d invalid", idx)
+	}
+	return il, b[32:], nil
+}
+
+//NewPublic 非强化派生一个密钥,对应的公钥可以由ExtPubKey.New计算
+func (k *DeterKey) NewPublic(idx uint32) (*DeterKey, error) {
+	pub, err := k.ExtPub()
+	if err != nil {
+		return nil, err
+	}
+	il, key, err := deriveHmac(k.Key, pub.Pks, idx)
+	if err != nil {
+		return nil, err
+	}
+	il.Add(il, new(big.Int).SetBytes(k.Body))
+	il.Mod(il, xginx.S256().Params().N)
+	if il.Sign() == 0 {
+		return nil, fmt.Errorf("derive idx %d invalid", idx)
+	}
+	body := make([]byte, 32)
+	bs := il.Bytes()
+	copy(body[32-len(bs):], bs)
+	return &DeterKey{
+		Body: body,
+		Key:  key,
+	}, nil
+}
+
+//PublicRootIdx 非强化派生根使用的强化派生索引,私钥索引从0递增不会使用
+const PublicRootIdx uint32 = 1 << 31
+
+//PublicRoot 强化派生非强化派生使用的根密钥
+//子私钥和父扩展公钥可以计算出父私钥,所以不能直接从主私钥或者强化派生的私钥非强化派生
+func (k *DeterKey) PublicRoot() (*DeterKey, error) {
+	return k.New(PublicRootIdx)
+}
+
+//PublicExtPub 非强化派生根的扩展公钥,用来派生子公钥
+func (k *DeterKey) PublicExtPub() (*ExtPubKey, error) {
+	root, err := k.PublicRoot()
+	if err != nil {
+		return nil, err
+	}
+	return root.ExtPub()
+}
+
+//NewPublicPath 按路径非强化派生
+func (k *DeterKey) NewPublicPath(path []uint32) (*DeterKey, error) {
+	dk := k
+	for _, idx := range path {
+		ndk, err := dk.NewPublic(idx)
+		if err != nil {
+			return nil, err
+		}
+		dk = ndk
+	}
+	return dk, nil
+}
+
+//ExtPub 获取扩展公钥
+func (k DeterKey) ExtPub() (*ExtPubKey, error) {
+	d := new(big.Int).SetBytes(k.Body)
+	if d.Sign() == 0 || d.Cmp(xginx.S256().Params().N) >= 0 {
+		return nil, errors.New("deter key body error")
+	}
+	pri, err := k.GetPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &ExtPubKey{
+		Pks: pri.PublicKey().GetPks(),
+		Key: append([]byte{}, k.Key...),
+	}, nil
+}
+
+//ExtPubKey 扩展公钥,不包含私钥,可以派生子公钥
+type ExtPubKey struct {
+	Pks xginx.PKBytes //压缩格式公钥
+	Key []byte        //派生密钥 32 bytes
+}
+
+//LoadExtPubKey 加载扩展公钥
+func LoadExtPubKey(s string) (*ExtPubKey, error) {
+	data, err := xginx.B58Decode(s, xginx.BitcoinAlphabet)
+	if err != nil {
+		return nil, err
+	}
+	pk := &ExtPubKey{}
+	if len(data) != len(pk.Pks)+32 {
+		return nil, errors.New("ext pub length error")
+	}
+	copy(pk.Pks[:], data)
+	pk.Key = data[len(pk.Pks):]
+	if _, err := xginx.NewPublicKey(pk.Pks[:]); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
+
+//Dump 导出扩展公钥
+func (k ExtPubKey) Dump() string {
+	data := append([]byte{}, k.Pks[:]...)
+	data = append(data, k.Key...)
+	return xginx.B58Encode(data, xginx.BitcoinAlphabet)
+}
+
+//New 派生子公钥
+func (k ExtPubKey) New(idx uint32) (*ExtPubKey, error) {
+	pub, err := xginx.NewPublicKey(k.Pks[:])
+	if err != nil {
+		return nil, err
+	}
+	il, key, err := deriveHmac(k.Key, k.Pks, idx)
+	if err != nil {
+		return nil, err
+	}
+	//子公钥 = il*G + 父公钥
+	curve := xginx.S256()
+	x, y := curve.ScalarBaseMult(il.Bytes())
+	x, y = curve.Add(x, y, pub.X, pub.Y)
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return nil, fmt.Errorf("derive idx %d invalid", idx)
+	}
+	cpk := &xginx.PublicKey{Curve: curve, X: x, Y: y}
+	return &ExtPubKey{
+		Pks: cpk.GetPks(),
+		Key: key,
+	}, nil
+}
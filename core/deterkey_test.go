@@ -2,7 +2,11 @@ package core
 
 import (
 	"bytes"
+	"encoding/hex"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestNewDeterKey(t *testing.T) {
@@ -36,3 +40,67 @@ func TestNewDeterKey(t *testing.T) {
 		t.Fatal("key not equal")
 	}
 }
+
+func TestDeterKeyMnemonic(t *testing.T) {
+	dk := NewDeterKey()
+	words, err := dk.Mnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := LoadDeterKeyWithMnemonic(words)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dk.Body, pk.Body) || !bytes.Equal(dk.Key, pk.Key) {
+		t.Fatal("mnemonic restore error")
+	}
+	//修改一个单词校验失败
+	ws := strings.Fields(words)
+	if ws[0] == "abandon" {
+		ws[0] = "ability"
+	} else {
+		ws[0] = "abandon"
+	}
+	_, err = LoadDeterKeyWithMnemonic(strings.Join(ws, " "))
+	if err == nil {
+		t.Fatal("checksum error not found")
+	}
+	_, err = LoadDeterKeyWithMnemonic(strings.Join(ws[1:], " "))
+	if err == nil {
+		t.Fatal("words count error not found")
+	}
+}
+
+func TestExtPubDerive(t *testing.T) {
+	as := assert.New(t)
+	//BIP32 测试向量1 m/0H -> m/0H/1
+	body, _ := hex.DecodeString("edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea")
+	key, _ := hex.DecodeString("47fdacbd0f1097043b78c63c20c34ef4ed9a111d980047ad16282c7ae6236141")
+	dk := &DeterKey{Body: body, Key: key}
+	pub, err := dk.ExtPub()
+	as.NoError(err)
+	as.Equal("035a784662a4a20a65bf6aab9ae98a6c068a81c52e4b032c0fb5400c706cfccc56", hex.EncodeToString(pub.Pks[:]))
+	cdk, err := dk.NewPublic(1)
+	as.NoError(err)
+	as.Equal("3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368", hex.EncodeToString(cdk.Body))
+	as.Equal("2a7857631386ba23dacac34180dd1983734e444fdbf774041578e9b6adb37c19", hex.EncodeToString(cdk.Key))
+	cpub, err := pub.New(1)
+	as.NoError(err)
+	as.Equal("03501e454bf00751f24b1b489aa925215d66af2234e3891c3b21a52bedb3cd711c", hex.EncodeToString(cpub.Pks[:]))
+	as.Equal(cdk.Key, cpub.Key)
+	//私钥派生和公钥派生结果一致
+	ndk := NewDeterKey()
+	npub, err := ndk.ExtPub()
+	as.NoError(err)
+	for i := uint32(0); i < 3; i++ {
+		c1, err := ndk.NewPublic(i)
+		as.NoError(err)
+		c2, err := npub.New(i)
+		as.NoError(err)
+		as.Equal(c1.GetPks(), c2.Pks)
+	}
+	s := npub.Dump()
+	lpub, err := LoadExtPubKey(s)
+	as.NoError(err)
+	as.Equal(npub, lpub)
+}
@@ -0,0 +1,232 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//EventType 用户事件类型
+type EventType string
+
+//用户事件定义
+const (
+	EventSignRequest       EventType = "sign_request"       //有新的交易需要签名
+	EventCosigned          EventType = "cosigned"           //其他签名者完成了签名
+	EventSigned            EventType = "signed"             //交易所有签名完成
+	EventPool              EventType = "pool"               //交易进入交易池
+	EventBlock             EventType = "block"              //交易进入区块
+	EventCancel            EventType = "cancel"             //交易取消作废
+	EventIncoming          EventType = "incoming"           //账号收到转账
+	EventConfirmed         EventType = "confirmed"          //交易达到需要的确认数
+	EventIncomingConfirmed EventType = "incoming_confirmed" //收到的转账达到需要的确认数
+)
+
+//交易状态对应的事件
+var stateEvents = map[TTxState]EventType{
+	TTxStateSign:      EventSigned,
+	TTxStatePool:      EventPool,
+	TTxStateBlock:     EventBlock,
+	TTxStateCancel:    EventCancel,
+	TTxStateConfirmed: EventConfirmed,
+}
+
+//TEvent 推送给用户的事件
+//事件只作为通知,客户端收到后应重新获取相关信息
+type TEvent struct {
+	Type    EventType     `json:"type"`              //事件类型
+	TxID    string        `json:"tid,omitempty"`     //相关交易id
+	From    string        `json:"from,omitempty"`    //触发事件的用户
+	Account xginx.Address `json:"account,omitempty"` //收到转账的账号
+	Value   xginx.Amount  `json:"value,omitempty"`   //收到的金额
+	Time    int64         `json:"time"`              //事件时间
+}
+
+//NewEvent 创建交易相关的事件
+func NewEvent(typ EventType, tid []byte) *TEvent {
+	return &TEvent{
+		Type: typ,
+		TxID: xginx.NewHASH256(tid).String(),
+		Time: time.Now().Unix(),
+	}
+}
+
+//ParseEvent 解析订阅收到的事件
+func ParseEvent(s string) (*TEvent, error) {
+	ev := &TEvent{}
+	err := json.Unmarshal([]byte(s), ev)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+//EventChannel 用户事件订阅频道
+func EventChannel(uid primitive.ObjectID) string {
+	return fmt.Sprintf("events:%s", uid.Hex())
+}
+
+//PublishEvent 通过redis发布事件给用户,多个实例都能收到
+//同时为用户的webhook创建投递记录,投递记录和业务在同一个事务中
+//在事务中时提交后才发布,事务失败不会发布
+func PublishEvent(db IDbImp, uid primitive.ObjectID, ev *TEvent) error {
+	bb, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	err = enqueueWebhooks(db, uid, ev.Type, string(bb))
+	if err != nil {
+		return err
+	}
+	db.AfterCommit(func() {
+		err := db.Publish(EventChannel(uid), bb)
+		if err != nil {
+			xginx.LogError("publish event", ev.Type, "to", uid.Hex(), "error", err)
+		}
+	})
+	return nil
+}
+
+//发布事件给多个用户,失败只记录日志不影响业务
+func publishEvents(db IDbImp, uids []primitive.ObjectID, ev *TEvent) {
+	for _, uid := range uids {
+		err := PublishEvent(db, uid, ev)
+		if err != nil {
+			xginx.LogError("publish event", ev.Type, "to", uid.Hex(), "error", err)
+		}
+	}
+}
+
+//交易相关的用户,创建者和所有签名者
+func (stx *TTx) eventUsers(db IDbImp) []primitive.ObjectID {
+	uids := []primitive.ObjectID{stx.UserID}
+	sus, err := db.ListSigUsers(xginx.NewHASH256(stx.ID))
+	if err != nil {
+		xginx.LogError("list tx sig users error", err)
+		return uids
+	}
+	for _, uid := range sus {
+		if !ObjectIDEqual(uid, stx.UserID) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+//发布交易事件给所有相关用户
+func (stx *TTx) publish(db IDbImp, uids []primitive.ObjectID, typ EventType) {
+	publishEvents(db, uids, NewEvent(typ, stx.ID))
+}
+
+//PublishSignRequest 通知还需要签名的用户
+func (stx *TTx) PublishSignRequest(db IDbImp) {
+	sigs, err := db.ListSigs(xginx.NewHASH256(stx.ID))
+	if err != nil {
+		xginx.LogError("list tx sigs error", err)
+		return
+	}
+	uids := []primitive.ObjectID{}
+	has := map[primitive.ObjectID]bool{}
+	for _, sig := range sigs {
+		if has[sig.UserID] {
+			continue
+		}
+		has[sig.UserID] = true
+		uids = append(uids, sig.UserID)
+	}
+	stx.publish(db, uids, EventSignRequest)
+}
+
+//PublishCosigned 通知交易的其他用户uid已经签名
+func (stx *TTx) PublishCosigned(db IDbImp, uid primitive.ObjectID) {
+	uids := []primitive.ObjectID{}
+	for _, v := range stx.eventUsers(db) {
+		if !ObjectIDEqual(v, uid) {
+			uids = append(uids, v)
+		}
+	}
+	ev := NewEvent(EventCosigned, stx.ID)
+	ev.From = uid.Hex()
+	publishEvents(db, uids, ev)
+}
+
+//PublishIncoming 根据区块收支记录通知收到转账的账号用户,账号有输入时是找零不通知
+func PublishIncoming(db IDbImp, hs []*THistory) {
+	for _, h := range hs {
+		if !h.IsIncoming() {
+			continue
+		}
+		acc, err := db.GetAccount(h.Account)
+		if err != nil {
+			continue
+		}
+		ev := NewEvent(EventIncoming, h.TxID)
+		ev.Account = h.Account
+		ev.Value = h.In
+		publishEvents(db, acc.UserID, ev)
+	}
+}
+
+//PublishIncomingConfirmed 收到的转账达到账号需要的确认数时通知账号用户,每个记录只通知一次
+//返回通知的记录数量
+func PublishIncomingConfirmed(db IDbImp, tip uint32) (int, error) {
+	hs, err := db.ListConfirmedIncoming(tip)
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, h := range hs {
+		err = db.SetHistoryDone(h.ID)
+		if err != nil {
+			return num, err
+		}
+		num++
+		acc, err := db.GetAccount(h.Account)
+		if err != nil {
+			continue
+		}
+		ev := NewEvent(EventIncomingConfirmed, h.TxID)
+		ev.Account = h.Account
+		ev.Value = h.In
+		publishEvents(db, acc.UserID, ev)
+	}
+	return num, nil
+}
+
+//获取交易所有签名记录的用户
+func (ctx *dbimp) ListSigUsers(tid xginx.HASH256) ([]primitive.ObjectID, error) {
+	col := ctx.table(TSigName)
+	vs, err := col.Distinct(ctx, "uid", bson.M{"tid": tid})
+	if err != nil {
+		return nil, err
+	}
+	rets := []primitive.ObjectID{}
+	for _, v := range vs {
+		if uid, ok := v.(primitive.ObjectID); ok {
+			rets = append(rets, uid)
+		}
+	}
+	return rets, nil
+}
+
+func (db *memimp) ListSigUsers(tid xginx.HASH256) ([]primitive.ObjectID, error) {
+	sigs, err := db.listSigs(tid, func(sig *TSigs) bool {
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	rets := []primitive.ObjectID{}
+	has := map[primitive.ObjectID]bool{}
+	for _, sig := range sigs {
+		if !has[sig.UserID] {
+			has[sig.UserID] = true
+			rets = append(rets, sig.UserID)
+		}
+	}
+	return rets, nil
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTxEvents(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	cid := primitive.NewObjectID()
+	stx := &TTx{ID: xginx.Hash256From([]byte("events_test_tx")).Bytes(), UserID: uid, State: TTxStateNew}
+	tid := xginx.NewHASH256(stx.ID)
+	err := app.UseDb(func(db IDbImp) error {
+		us := db.Subscribe(EventChannel(uid))
+		defer us.Close()
+		cs := db.Subscribe(EventChannel(cid))
+		defer cs.Close()
+		recv := func(ps IPubSub) *TEvent {
+			select {
+			case msg := <-ps.Channel():
+				ev, err := ParseEvent(msg.Payload)
+				as.NoError(err)
+				return ev
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+		err := db.UseTx(func(db IDbImp) error {
+			err := db.InsertTx(stx)
+			if err != nil {
+				return err
+			}
+			return db.InsertSigs(NewSigs(tid, uid, "kid1", []byte("hash"), 0), NewSigs(tid, cid, "kid2", []byte("hash"), 0))
+		})
+		if err != nil {
+			return err
+		}
+		defer db.UseTx(func(db IDbImp) error {
+			return db.DeleteTx(stx.ID)
+		})
+		//事务中的事件提交后才发布
+		err = db.UseTx(func(db IDbImp) error {
+			stx.PublishSignRequest(db)
+			as.Nil(recv(us))
+			return nil
+		})
+		as.NoError(err)
+		for _, ps := range []IPubSub{us, cs} {
+			ev := recv(ps)
+			as.NotNil(ev)
+			as.Equal(EventSignRequest, ev.Type)
+			as.Equal(tid.String(), ev.TxID)
+		}
+		//事务失败时不发布
+		err = db.UseTx(func(db IDbImp) error {
+			stx.PublishCosigned(db, cid)
+			return errors.New("rollback")
+		})
+		as.Error(err)
+		as.Nil(recv(us))
+		//签名者不会收到自己的签名通知
+		stx.PublishCosigned(db, cid)
+		ev := recv(us)
+		as.NotNil(ev)
+		as.Equal(EventCosigned, ev.Type)
+		as.Equal(cid.Hex(), ev.From)
+		as.Nil(recv(cs))
+		//取消后所有相关用户收到通知
+		err = db.UseTx(func(db IDbImp) error {
+			return stx.CancelTx(db, uid, "test")
+		})
+		if err != nil {
+			return err
+		}
+		for _, ps := range []IPubSub{us, cs} {
+			ev := recv(ps)
+			as.NotNil(ev)
+			as.Equal(EventCancel, ev.Type)
+		}
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,208 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cxuhua/xginx"
+)
+
+//交易费估算设置
+var (
+	//统计最近多少个区块的交易费
+	FeeBlocks = 12
+	//每字节最低交易费
+	MinFeeRate = xginx.Amount(1)
+	//按每字节交易费创建交易时的初始估算大小
+	FeeBaseSize = 256
+	//按每字节交易费创建交易时最多重试次数
+	FeeMaxTries = 5
+)
+
+//FeeLevel 交易费优先级
+type FeeLevel string
+
+//交易费优先级定义,对应统计交易费的百分位
+const (
+	FeeLevelLow    FeeLevel = "low"
+	FeeLevelNormal FeeLevel = "normal"
+	FeeLevelHigh   FeeLevel = "high"
+)
+
+//优先级对应的百分位
+var feeLevels = map[FeeLevel]int{
+	FeeLevelLow:    25,
+	FeeLevelNormal: 50,
+	FeeLevelHigh:   90,
+}
+
+//FeeRates 每字节交易费建议
+type FeeRates struct {
+	Rates  map[FeeLevel]xginx.Amount //每个优先级的每字节交易费
+	Blocks int                       //统计的区块数量
+	Txs    int                       //统计的交易数量
+	Pool   int                       //统计的交易池中交易数量
+	Skip   int                       //无法计算交易费没有统计的交易数量
+}
+
+//Get 获取优先级对应的交易费,优先级为空时使用normal
+func (fr FeeRates) Get(level FeeLevel) (xginx.Amount, error) {
+	if level == "" {
+		level = FeeLevelNormal
+	}
+	rate, has := fr.Rates[level]
+	if !has {
+		return 0, fmt.Errorf("fee level %s error", level)
+	}
+	return rate, nil
+}
+
+//区块中交易的每字节交易费
+type blockFees struct {
+	id    xginx.HASH256
+	rates []xginx.Amount
+	skip  int //无法计算交易费的交易数量
+}
+
+//FeeEstimator 根据最近区块和交易池估算交易费
+type FeeEstimator struct {
+	mu     sync.RWMutex
+	blocks []blockFees
+}
+
+//NewFeeEstimator 创建交易费估算
+func NewFeeEstimator() *FeeEstimator {
+	return &FeeEstimator{
+		blocks: []blockFees{},
+	}
+}
+
+var feeEstimator = NewFeeEstimator()
+
+//GetFeeEstimator 获取全局交易费估算
+func GetFeeEstimator() *FeeEstimator {
+	return feeEstimator
+}
+
+//计算交易的每字节交易费,coinbase交易返回false
+//无法计算交易费时返回错误,调用者需要记录没有统计的交易
+func txFeeRate(bi *xginx.BlockIndex, tx *xginx.TX) (xginx.Amount, bool, error) {
+	if tx.IsCoinBase() {
+		return 0, false, nil
+	}
+	size := tx.Size()
+	if size <= 0 {
+		return 0, false, errors.New("tx size error")
+	}
+	fee, err := tx.GetTransFee(bi)
+	if err != nil {
+		return 0, false, err
+	}
+	return fee / xginx.Amount(size), true, nil
+}
+
+//OnLinkBlock 区块连接到链上时统计交易费
+func (fe *FeeEstimator) OnLinkBlock(bi *xginx.BlockIndex, blk *xginx.BlockInfo) {
+	id, err := blk.ID()
+	if err != nil {
+		return
+	}
+	bf := blockFees{id: id, rates: []xginx.Amount{}}
+	for _, tx := range blk.Txs {
+		rate, ok, err := txFeeRate(bi, tx)
+		if err != nil {
+			bf.skip++
+			xginx.LogError("block tx fee rate error", id, err)
+			continue
+		}
+		if ok {
+			bf.rates = append(bf.rates, rate)
+		}
+	}
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.blocks = append(fe.blocks, bf)
+	if len(fe.blocks) > FeeBlocks {
+		fe.blocks = fe.blocks[len(fe.blocks)-FeeBlocks:]
+	}
+}
+
+//OnUnlinkBlock 区块断开时移除统计
+func (fe *FeeEstimator) OnUnlinkBlock(blk *xginx.BlockInfo) {
+	id, err := blk.ID()
+	if err != nil {
+		return
+	}
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	for i, v := range fe.blocks {
+		if v.id == id {
+			fe.blocks = append(fe.blocks[:i], fe.blocks[i+1:]...)
+			break
+		}
+	}
+}
+
+//Estimate 估算每个优先级的每字节交易费,bi为空时不统计交易池
+func (fe *FeeEstimator) Estimate(bi *xginx.BlockIndex) FeeRates {
+	fr := FeeRates{Rates: map[FeeLevel]xginx.Amount{}}
+	rates := []xginx.Amount{}
+	fe.mu.RLock()
+	for _, v := range fe.blocks {
+		rates = append(rates, v.rates...)
+		fr.Skip += v.skip
+	}
+	fr.Blocks = len(fe.blocks)
+	fe.mu.RUnlock()
+	fr.Txs = len(rates)
+	if bi != nil {
+		for _, tx := range bi.GetTxPool().AllTxs() {
+			rate, ok, err := txFeeRate(bi, tx)
+			if err != nil {
+				fr.Skip++
+				continue
+			}
+			if ok {
+				rates = append(rates, rate)
+				fr.Pool++
+			}
+		}
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i] < rates[j]
+	})
+	for level, pct := range feeLevels {
+		rate := MinFeeRate
+		if len(rates) > 0 {
+			rate = rates[(len(rates)-1)*pct/100]
+		}
+		if rate < MinFeeRate {
+			rate = MinFeeRate
+		}
+		fr.Rates[level] = rate
+	}
+	return fr
+}
+
+//NewTxWithFeeRate 按照每字节交易费创建交易
+//fn使用指定的交易费选择金额并创建交易,根据创建的交易大小重新计算交易费直到足够
+func NewTxWithFeeRate(rate xginx.Amount, fn func(fee xginx.Amount) (*xginx.TX, error)) (*xginx.TX, xginx.Amount, error) {
+	if rate <= 0 {
+		return nil, 0, errors.New("fee rate error")
+	}
+	fee := rate * xginx.Amount(FeeBaseSize)
+	for i := 0; i < FeeMaxTries; i++ {
+		tx, err := fn(fee)
+		if err != nil {
+			return nil, 0, err
+		}
+		need := rate * xginx.Amount(tx.Size())
+		if fee >= need {
+			return tx, fee, nil
+		}
+		fee = need
+	}
+	return nil, 0, fmt.Errorf("fee rate %d not enough after %d tries", rate, FeeMaxTries)
+}
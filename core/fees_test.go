@@ -0,0 +1,77 @@
+package core
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeEstimate(t *testing.T) {
+	as := assert.New(t)
+	fe := NewFeeEstimator()
+	//没有统计数据时使用最低交易费
+	fr := fe.Estimate(nil)
+	for _, level := range []FeeLevel{FeeLevelLow, FeeLevelNormal, FeeLevelHigh} {
+		rate, err := fr.Get(level)
+		as.NoError(err)
+		as.Equal(MinFeeRate, rate)
+	}
+	rates := []xginx.Amount{}
+	for i := 1; i <= 100; i++ {
+		rates = append(rates, xginx.Amount(i))
+	}
+	fe.blocks = append(fe.blocks, blockFees{id: xginx.Hash256From([]byte("fee_test")), rates: rates, skip: 2})
+	fr = fe.Estimate(nil)
+	as.Equal(1, fr.Blocks)
+	as.Equal(100, fr.Txs)
+	//无法计算交易费的交易需要记录
+	as.Equal(2, fr.Skip)
+	rate, err := fr.Get(FeeLevelLow)
+	as.NoError(err)
+	as.Equal(xginx.Amount(25), rate)
+	rate, err = fr.Get("")
+	as.NoError(err)
+	as.Equal(xginx.Amount(50), rate)
+	rate, err = fr.Get(FeeLevelHigh)
+	as.NoError(err)
+	as.Equal(xginx.Amount(90), rate)
+	_, err = fr.Get("miss")
+	as.Error(err)
+	_, _, err = NewTxWithFeeRate(0, nil)
+	as.Error(err)
+}
+
+func TestNewTxWithFeeRate(t *testing.T) {
+	as := assert.New(t)
+	//交易费越高需要的金额越多,交易越大
+	calls := 0
+	grow := func(div xginx.Amount) func(fee xginx.Amount) (*xginx.TX, error) {
+		return func(fee xginx.Amount) (*xginx.TX, error) {
+			calls++
+			tx := xginx.NewTx(0)
+			tx.Script = make(xginx.Script, 300+int(fee/div))
+			return tx, nil
+		}
+	}
+	tx, fee, err := NewTxWithFeeRate(1, grow(100))
+	as.NoError(err)
+	//重新计算后交易费足够支付交易大小
+	as.True(fee >= xginx.Amount(tx.Size()))
+	as.True(calls > 1)
+	as.True(calls <= FeeMaxTries)
+	//交易大小增长比交易费快时不能收敛,重试次数有限制
+	calls = 0
+	_, _, err = NewTxWithFeeRate(1, grow(1))
+	as.Error(err)
+	as.Equal(FeeMaxTries, calls)
+	//创建交易出错时直接返回
+	calls = 0
+	_, _, err = NewTxWithFeeRate(1, func(fee xginx.Amount) (*xginx.TX, error) {
+		calls++
+		return nil, errors.New("coins not enough")
+	})
+	as.Error(err)
+	as.Equal(1, calls)
+}
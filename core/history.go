@@ -0,0 +1,613 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//账号收支记录表
+const (
+	THistoryName = "history"
+)
+
+//THistoryDir 收支方向
+type THistoryDir int
+
+//收支方向定义
+const (
+	HistoryIn   THistoryDir = 1 //收入
+	HistoryOut  THistoryDir = 2 //支出
+	HistorySelf THistoryDir = 3 //收支相等,例如只有找零
+)
+
+//THistory 区块交易中一个账号的收支记录
+//区块连接时创建,断开时删除
+type THistory struct {
+	ID      string          `bson:"_id"`    //交易id:账号
+	TxID    []byte          `bson:"tid"`    //交易id
+	Account xginx.Address   `bson:"acc"`    //账号
+	Dir     THistoryDir     `bson:"dir"`    //收支方向
+	In      xginx.Amount    `bson:"in"`     //输出到账号的金额
+	Out     xginx.Amount    `bson:"out"`    //账号输入的金额
+	Value   xginx.Amount    `bson:"value"`  //净收入,支出时为负数
+	Peers   []xginx.Address `bson:"peers"`  //对方地址,收入时为输入地址,支出时为输出地址
+	Height  uint32          `bson:"height"` //区块高度
+	Block   []byte          `bson:"blk"`    //区块id
+	Time    int64           `bson:"time"`   //区块时间
+	Need    uint32          `bson:"need"`   //账号需要的确认数
+	Done    bool            `bson:"done"`   //收入达到确认数已经通知,不是收入时为true
+}
+
+//TxFlow 交易输入或者输出的地址和金额
+type TxFlow struct {
+	Addr  xginx.Address
+	Value xginx.Amount
+}
+
+//历史记录id
+func historyID(tid xginx.HASH256, addr xginx.Address) string {
+	return fmt.Sprintf("%s:%s", tid, addr)
+}
+
+//Confirm 根据链高度计算确认数
+func (h *THistory) Confirm(height uint32) uint32 {
+	if height < h.Height {
+		return 0
+	}
+	return height - h.Height + 1
+}
+
+//IsIncoming 是否是收到的转账,账号有输入时是找零
+func (h *THistory) IsIncoming() bool {
+	return h.In > 0 && h.Out == 0
+}
+
+//设置需要的确认数,不是收入的记录不需要通知
+func (h *THistory) setNeed(db IDbImp, tip uint32) {
+	h.Need = ConfirmNum(db, []xginx.Address{h.Account})
+	h.Done = !h.IsIncoming() || h.Confirm(tip) >= h.Need
+}
+
+//PageKey 收支记录分页排序值
+func (h *THistory) PageKey(sort string) (int64, string) {
+	switch sort {
+	case PageSortTime:
+		return h.Time, h.ID
+	case PageSortHeight:
+		return int64(h.Height), h.ID
+	case PageSortValue:
+		return int64(h.Value), h.ID
+	}
+	return 0, h.ID
+}
+
+//获取地址对应的账号,不是账号时返回nil
+type accountCache map[xginx.Address]*TAccount
+
+func (c accountCache) get(db IDbImp, addr xginx.Address) (*TAccount, error) {
+	if acc, has := c[addr]; has {
+		return acc, nil
+	}
+	acc, err := db.GetAccount(addr)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		acc, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c[addr] = acc
+	return acc, nil
+}
+
+//添加不重复的地址
+func appendPeer(peers []xginx.Address, addr xginx.Address) []xginx.Address {
+	for _, v := range peers {
+		if v == addr {
+			return peers
+		}
+	}
+	return append(peers, addr)
+}
+
+//NewTxHistory 根据交易输入引用的输出和交易输出计算每个相关账号的收支
+func NewTxHistory(db IDbImp, tid xginx.HASH256, ins []TxFlow, outs []TxFlow) ([]*THistory, error) {
+	cache := accountCache{}
+	rets := []*THistory{}
+	hs := map[xginx.Address]*THistory{}
+	get := func(addr xginx.Address) (*THistory, error) {
+		if h, has := hs[addr]; has {
+			return h, nil
+		}
+		acc, err := cache.get(db, addr)
+		if err != nil || acc == nil {
+			return nil, err
+		}
+		h := &THistory{
+			ID:      historyID(tid, addr),
+			TxID:    tid.Bytes(),
+			Account: addr,
+			Peers:   []xginx.Address{},
+		}
+		hs[addr] = h
+		rets = append(rets, h)
+		return h, nil
+	}
+	for _, in := range ins {
+		h, err := get(in.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			h.Out += in.Value
+		}
+	}
+	for _, out := range outs {
+		h, err := get(out.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if h != nil {
+			h.In += out.Value
+		}
+	}
+	for _, h := range rets {
+		h.Value = h.In - h.Out
+		//收入的对方是输入地址,支出的对方是输出地址
+		peers := outs
+		switch {
+		case h.Value > 0:
+			h.Dir = HistoryIn
+			peers = ins
+		case h.Value < 0:
+			h.Dir = HistoryOut
+		default:
+			h.Dir = HistorySelf
+		}
+		for _, v := range peers {
+			if v.Addr != h.Account {
+				h.Peers = appendPeer(h.Peers, v.Addr)
+			}
+		}
+	}
+	return rets, nil
+}
+
+//获取交易输入引用的输出和交易输出,coinbase没有输入
+func blockTxFlows(bi *xginx.BlockIndex, tx *xginx.TX) ([]TxFlow, []TxFlow, error) {
+	ins := []TxFlow{}
+	for _, in := range tx.Ins {
+		if in.IsCoinBase() {
+			continue
+		}
+		out, err := loadTxInOut(bi, NewTTxIn(in))
+		if err != nil {
+			return nil, nil, err
+		}
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			return nil, nil, err
+		}
+		ins = append(ins, TxFlow{Addr: addr, Value: out.Value})
+	}
+	outs := []TxFlow{}
+	for _, out := range tx.Outs {
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			return nil, nil, err
+		}
+		outs = append(outs, TxFlow{Addr: addr, Value: out.Value})
+	}
+	return ins, outs, nil
+}
+
+//IndexBlock 保存区块中账号的收支记录,重复连接同一个区块时覆盖
+//任一交易无法解析时返回错误,不保存不完整的记录
+func IndexBlock(db IDbImp, bi *xginx.BlockIndex, blk *xginx.BlockInfo) ([]*THistory, error) {
+	bid, err := blk.ID()
+	if err != nil {
+		return nil, err
+	}
+	rets := []*THistory{}
+	for _, tx := range blk.Txs {
+		tid, err := tx.ID()
+		if err != nil {
+			return nil, err
+		}
+		ins, outs, err := blockTxFlows(bi, tx)
+		if err != nil {
+			return nil, fmt.Errorf("index tx %v error: %w", tid, err)
+		}
+		hs, err := NewTxHistory(db, tid, ins, outs)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hs {
+			h.Height = blk.Meta.Height
+			h.Block = bid.Bytes()
+			h.Time = int64(blk.Meta.Time)
+			h.setNeed(db, blk.Meta.Height)
+		}
+		rets = append(rets, hs...)
+	}
+	if len(rets) == 0 {
+		return rets, nil
+	}
+	return rets, db.InsertHistory(rets...)
+}
+
+//UnindexBlock 区块断开时删除区块中的收支记录
+func UnindexBlock(db IDbImp, blk *xginx.BlockInfo) error {
+	bid, err := blk.ID()
+	if err != nil {
+		return err
+	}
+	return db.DeleteBlockHistory(bid.Bytes())
+}
+
+//IndexAccount 从链上补全账号创建前的收支记录,完成后标记账号
+//之后的记录在区块连接时保存,已经补全的账号不再扫描
+func IndexAccount(db IDbImp, bi *xginx.BlockIndex, acc *TAccount) error {
+	if acc.Indexed {
+		return nil
+	}
+	if bi == nil {
+		return fmt.Errorf("account %s history not indexed", acc.ID)
+	}
+	tip := bi.Height()
+	txs, err := bi.ListTxs(acc.ID)
+	if err != nil {
+		return err
+	}
+	rets := []*THistory{}
+	done := map[xginx.HASH256]bool{}
+	for _, v := range txs {
+		//交易池中的交易进入区块时保存
+		if v.IsPool() || done[v.TxID] {
+			continue
+		}
+		done[v.TxID] = true
+		txv, err := bi.LoadTxValue(v.TxID)
+		if err != nil {
+			return err
+		}
+		blk, err := bi.LoadBlock(txv.BlkID)
+		if err != nil {
+			return err
+		}
+		bid, err := blk.ID()
+		if err != nil {
+			return err
+		}
+		tx, err := blk.GetTx(txv.TxIdx.ToInt())
+		if err != nil {
+			return err
+		}
+		ins, outs, err := blockTxFlows(bi, tx)
+		if err != nil {
+			return err
+		}
+		hs, err := NewTxHistory(db, v.TxID, ins, outs)
+		if err != nil {
+			return err
+		}
+		for _, h := range hs {
+			if h.Account != acc.ID {
+				continue
+			}
+			h.Height = blk.Meta.Height
+			h.Block = bid.Bytes()
+			h.Time = int64(blk.Meta.Time)
+			//补全时已经达到确认数的收入不再通知
+			h.setNeed(db, tip)
+			rets = append(rets, h)
+		}
+	}
+	if len(rets) > 0 {
+		err = db.InsertHistory(rets...)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.SetAccountIndexed(acc.ID)
+	if err != nil {
+		return err
+	}
+	acc.Indexed = true
+	return nil
+}
+
+//THistoryBalance 账号收支汇总
+type THistoryBalance struct {
+	Account xginx.Address //账号
+	In      xginx.Amount  //总收入
+	Out     xginx.Amount  //总支出
+}
+
+//Balance 余额
+func (b THistoryBalance) Balance() xginx.Amount {
+	return b.In - b.Out
+}
+
+//SumHistory 汇总账号的收支,没有记录的账号金额为0
+func SumHistory(db IDbImp, accs []xginx.Address) ([]THistoryBalance, error) {
+	vs, err := db.SumHistory(accs)
+	if err != nil {
+		return nil, err
+	}
+	rets := []THistoryBalance{}
+	for _, acc := range accs {
+		b := vs[acc]
+		b.Account = acc
+		rets = append(rets, b)
+	}
+	return rets, nil
+}
+
+//保存收支记录,已经存在时覆盖
+func (ctx *dbimp) InsertHistory(hs ...*THistory) error {
+	col := ctx.table(THistoryName)
+	for _, h := range hs {
+		opts := options.Replace().SetUpsert(true)
+		_, err := col.ReplaceOne(ctx, bson.M{"_id": h.ID}, h, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//删除区块中的收支记录
+func (ctx *dbimp) DeleteBlockHistory(blk []byte) error {
+	col := ctx.table(THistoryName)
+	_, err := col.DeleteMany(ctx, bson.M{"blk": blk})
+	return err
+}
+
+//分页获取账号的收支记录
+func (ctx *dbimp) PageHistory(accs []xginx.Address, f ListFilter, p Page) ([]*THistory, string, error) {
+	filter := f.timeFilter(bson.M{"acc": bson.M{"$in": accs}}, "time")
+	if f.MaxHeight > 0 {
+		filter["height"] = bson.M{"$lte": f.MaxHeight}
+	}
+	query, opts, err := p.find(filter, pageField(p.Sort), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	col := ctx.table(THistoryName)
+	iter, err := col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close(ctx)
+	rets := []*THistory{}
+	for iter.Next(ctx) {
+		v := &THistory{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, "", err
+		}
+		rets = append(rets, v)
+	}
+	n, next := p.next(len(rets), func(i int) (int64, string) {
+		return rets[i].PageKey(p.Sort)
+	})
+	return rets[:n], next, nil
+}
+
+//汇总账号的收支
+func (ctx *dbimp) SumHistory(accs []xginx.Address) (map[xginx.Address]THistoryBalance, error) {
+	col := ctx.table(THistoryName)
+	pipe := bson.A{
+		bson.M{"$match": bson.M{"acc": bson.M{"$in": accs}}},
+		bson.M{"$group": bson.M{"_id": "$acc", "in": bson.M{"$sum": "$in"}, "out": bson.M{"$sum": "$out"}}},
+	}
+	iter, err := col.Aggregate(ctx, pipe)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := map[xginx.Address]THistoryBalance{}
+	for iter.Next(ctx) {
+		v := struct {
+			Account xginx.Address `bson:"_id"`
+			In      xginx.Amount  `bson:"in"`
+			Out     xginx.Amount  `bson:"out"`
+		}{}
+		err := iter.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+		rets[v.Account] = THistoryBalance{Account: v.Account, In: v.In, Out: v.Out}
+	}
+	return rets, nil
+}
+
+//获取达到确认数还没有通知的收入记录
+func (ctx *dbimp) ListConfirmedIncoming(tip uint32) ([]*THistory, error) {
+	col := ctx.table(THistoryName)
+	filter := bson.M{
+		"done":  false,
+		"$expr": bson.M{"$lte": bson.A{bson.M{"$add": bson.A{"$height", "$need"}}, tip + 1}},
+	}
+	iter, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*THistory{}
+	for iter.Next(ctx) {
+		v := &THistory{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//标记收入记录已经通知
+func (ctx *dbimp) SetHistoryDone(id string) error {
+	col := ctx.table(THistoryName)
+	_, err := col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"done": true}})
+	return err
+}
+
+//标记账号收支记录已经从链上补全
+func (ctx *dbimp) SetAccountIndexed(id xginx.Address) error {
+	col := ctx.table(TAccountName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"indexed": true}})
+	return sr.Err()
+}
+
+func (db *memimp) InsertHistory(hs ...*THistory) error {
+	for _, h := range hs {
+		err := db.insert(THistoryName, h, &THistory{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memimp) DeleteBlockHistory(blk []byte) error {
+	return db.deleteAll(THistoryName, "blk", blk)
+}
+
+func (db *memimp) PageHistory(accs []xginx.Address, f ListFilter, p Page) ([]*THistory, string, error) {
+	vs := []*THistory{}
+	for _, acc := range accs {
+		hs, err := db.listHistory(acc)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, h := range hs {
+			if f.MatchTime(h.Time) && f.MatchHeight(h.Height) {
+				vs = append(vs, h)
+			}
+		}
+	}
+	idxs, next, err := PageSlice(p, len(vs), func(i int) (int64, string) {
+		return vs[i].PageKey(p.Sort)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rets := []*THistory{}
+	for _, i := range idxs {
+		rets = append(rets, vs[i])
+	}
+	return rets, next, nil
+}
+
+func (db *memimp) SumHistory(accs []xginx.Address) (map[xginx.Address]THistoryBalance, error) {
+	rets := map[xginx.Address]THistoryBalance{}
+	for _, acc := range accs {
+		hs, err := db.listHistory(acc)
+		if err != nil {
+			return nil, err
+		}
+		b := THistoryBalance{Account: acc}
+		for _, h := range hs {
+			b.In += h.In
+			b.Out += h.Out
+		}
+		rets[acc] = b
+	}
+	return rets, nil
+}
+
+func (db *memimp) ListConfirmedIncoming(tip uint32) ([]*THistory, error) {
+	rets := []*THistory{}
+	var err error
+	err2 := db.each(THistoryName, "done", false, func(obj interface{}) bool {
+		v := &THistory{}
+		err = memClone(obj, v)
+		if err == nil && v.Height+v.Need <= tip+1 {
+			rets = append(rets, v)
+		}
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) SetHistoryDone(id string) error {
+	v := &THistory{}
+	err := db.first(v, THistoryName, "id", id)
+	if err != nil {
+		return err
+	}
+	v.Done = true
+	return db.insert(THistoryName, v, &THistory{})
+}
+
+func (db *memimp) SetAccountIndexed(id xginx.Address) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	acc.Indexed = true
+	return db.insert(TAccountName, acc, &TAccount{})
+}
+
+func (db *memimp) listHistory(acc xginx.Address) ([]*THistory, error) {
+	rets := []*THistory{}
+	var err error
+	err2 := db.each(THistoryName, "acc", acc, func(obj interface{}) bool {
+		v := &THistory{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+//用户账号中符合过滤条件的地址,收支记录没有补全的账号先从链上补全
+func filterUserAccounts(db IDbImp, bi *xginx.BlockIndex, uid primitive.ObjectID, f CoinFilter) ([]xginx.Address, error) {
+	accs, err := db.ListAccounts(uid)
+	if err != nil {
+		return nil, err
+	}
+	rets := []xginx.Address{}
+	for _, acc := range accs {
+		if !f.Match(acc) {
+			continue
+		}
+		err = IndexAccount(db, bi, acc)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, acc.ID)
+	}
+	return rets, nil
+}
+
+//UserHistory 分页获取用户账号的收支记录
+func UserHistory(db IDbImp, bi *xginx.BlockIndex, uid primitive.ObjectID, f ListFilter, p Page) ([]*THistory, string, error) {
+	accs, err := filterUserAccounts(db, bi, uid, f.CoinFilter)
+	if err != nil {
+		return nil, "", err
+	}
+	return db.PageHistory(accs, f, p)
+}
+
+//UserBalances 获取用户账号的收支汇总
+func UserBalances(db IDbImp, bi *xginx.BlockIndex, uid primitive.ObjectID, f CoinFilter) ([]THistoryBalance, error) {
+	accs, err := filterUserAccounts(db, bi, uid, f)
+	if err != nil {
+		return nil, err
+	}
+	return SumHistory(db, accs)
+}
@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestTxHistory(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	a1 := &TAccount{ID: xginx.Address("history_test_1"), UserID: []primitive.ObjectID{uid}}
+	a2 := &TAccount{ID: xginx.Address("history_test_2"), UserID: []primitive.ObjectID{uid}, Tags: []string{"cold"}}
+	other := xginx.Address("history_test_other")
+	err := app.UseTx(func(db IDbImp) error {
+		for _, acc := range []*TAccount{a1, a2} {
+			err := db.InsertAccount(acc)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteAccount(acc.ID, uid)
+		}
+		//收支记录没有从链上补全时不能汇总,补全后使用索引
+		_, err := UserBalances(db, nil, uid, CoinFilter{})
+		as.Error(err)
+		for _, acc := range []*TAccount{a1, a2} {
+			err = db.SetAccountIndexed(acc.ID)
+			if err != nil {
+				return err
+			}
+		}
+		//其他地址转入a1
+		tid1 := xginx.Hash256From([]byte("history_test_tx1"))
+		hs, err := NewTxHistory(db, tid1, []TxFlow{{Addr: other, Value: 100}}, []TxFlow{{Addr: a1.ID, Value: 90}, {Addr: other, Value: 5}})
+		if err != nil {
+			return err
+		}
+		as.Len(hs, 1)
+		as.Equal(HistoryIn, hs[0].Dir)
+		as.Equal(xginx.Amount(90), hs[0].Value)
+		as.Equal([]xginx.Address{other}, hs[0].Peers)
+		hs[0].Height = 10
+		err = db.InsertHistory(hs...)
+		if err != nil {
+			return err
+		}
+		//a1转到a2和其他地址,找零回到a1
+		tid2 := xginx.Hash256From([]byte("history_test_tx2"))
+		hs, err = NewTxHistory(db, tid2, []TxFlow{{Addr: a1.ID, Value: 90}}, []TxFlow{{Addr: a2.ID, Value: 30}, {Addr: other, Value: 20}, {Addr: a1.ID, Value: 35}})
+		if err != nil {
+			return err
+		}
+		as.Len(hs, 2)
+		as.Equal(a1.ID, hs[0].Account)
+		as.Equal(HistoryOut, hs[0].Dir)
+		as.Equal(xginx.Amount(-55), hs[0].Value)
+		as.Equal([]xginx.Address{a2.ID, other}, hs[0].Peers)
+		as.Equal(a2.ID, hs[1].Account)
+		as.Equal(HistoryIn, hs[1].Dir)
+		as.Equal([]xginx.Address{a1.ID}, hs[1].Peers)
+		for _, h := range hs {
+			h.Height = 11
+			h.Block = []byte("history_test_blk")
+		}
+		err = db.InsertHistory(hs...)
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(2), hs[0].Confirm(12))
+		//按高度降序分页
+		rets, next, err := UserHistory(db, nil, uid, ListFilter{}, Page{Limit: 2, Sort: PageSortHeight, Desc: true})
+		if err != nil {
+			return err
+		}
+		as.Len(rets, 2)
+		as.Equal(uint32(11), rets[0].Height)
+		as.NotEqual("", next)
+		bs, err := UserBalances(db, nil, uid, CoinFilter{})
+		if err != nil {
+			return err
+		}
+		as.Len(bs, 2)
+		total := xginx.Amount(0)
+		for _, b := range bs {
+			total += b.Balance()
+		}
+		as.Equal(xginx.Amount(65), total)
+		bs, err = UserBalances(db, nil, uid, CoinFilter{Tags: []string{"cold"}})
+		if err != nil {
+			return err
+		}
+		as.Len(bs, 1)
+		as.Equal(xginx.Amount(30), bs[0].Balance())
+		//区块断开后删除记录
+		err = db.DeleteBlockHistory([]byte("history_test_blk"))
+		if err != nil {
+			return err
+		}
+		rets, _, err = UserHistory(db, nil, uid, ListFilter{}, Page{Sort: PageSortHeight})
+		if err != nil {
+			return err
+		}
+		as.Len(rets, 1)
+		return db.DeleteBlockHistory(nil)
+	})
+	as.NoError(err)
+}
+
+func TestIncomingConfirmed(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	acc := &TAccount{ID: xginx.Address("history_confirmed_acc"), UserID: []primitive.ObjectID{uid}, Confirms: 3}
+	other := xginx.Address("history_confirmed_other")
+	err := app.UseTx(func(db IDbImp) error {
+		err := db.InsertAccount(acc)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteAccount(acc.ID, uid)
+		blk := []byte("history_confirmed_blk")
+		defer db.DeleteBlockHistory(blk)
+		//收入需要通知,支出不通知
+		tid1 := xginx.Hash256From([]byte("history_confirmed_tx1"))
+		in, err := NewTxHistory(db, tid1, []TxFlow{{Addr: other, Value: 100}}, []TxFlow{{Addr: acc.ID, Value: 90}})
+		if err != nil {
+			return err
+		}
+		tid2 := xginx.Hash256From([]byte("history_confirmed_tx2"))
+		out, err := NewTxHistory(db, tid2, []TxFlow{{Addr: acc.ID, Value: 90}}, []TxFlow{{Addr: other, Value: 80}})
+		if err != nil {
+			return err
+		}
+		hs := append(in, out...)
+		for _, h := range hs {
+			h.Height = 10
+			h.Block = blk
+			h.setNeed(db, 10)
+		}
+		as.False(hs[0].Done)
+		as.True(hs[1].Done)
+		as.Equal(uint32(3), hs[0].Need)
+		err = db.InsertHistory(hs...)
+		if err != nil {
+			return err
+		}
+		num, err := PublishIncomingConfirmed(db, 11)
+		if err != nil {
+			return err
+		}
+		as.Equal(0, num)
+		num, err = PublishIncomingConfirmed(db, 12)
+		if err != nil {
+			return err
+		}
+		as.Equal(1, num)
+		//每个记录只通知一次
+		num, err = PublishIncomingConfirmed(db, 13)
+		if err != nil {
+			return err
+		}
+		as.Equal(0, num)
+		return nil
+	})
+	as.NoError(err)
+}
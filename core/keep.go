@@ -0,0 +1,142 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cxuhua/xginx"
+)
+
+//找零设置
+var (
+	//专用找零账号的标签,派生的找零账号也使用这个标签
+	ChangeTag = "change"
+)
+
+//KeepPolicy 找零策略
+type KeepPolicy string
+
+//找零策略定义
+const (
+	KeepPolicyFirst   KeepPolicy = ""        //第一个可签名的账号
+	KeepPolicySpend   KeepPolicy = "spend"   //找零到使用金额所在的账号
+	KeepPolicyAccount KeepPolicy = "account" //找零到指定的账号,未指定时使用带找零标签的账号
+	KeepPolicyFresh   KeepPolicy = "fresh"   //每次派生新的找零账号
+)
+
+//SetKeep 设置找零策略,acc为指定的找零账号
+func (st *DbSignListener) SetKeep(kp KeepPolicy, acc xginx.Address) error {
+	switch kp {
+	case KeepPolicyFirst, KeepPolicySpend, KeepPolicyAccount, KeepPolicyFresh:
+	default:
+		return fmt.Errorf("keep policy %s error", kp)
+	}
+	if acc != "" && kp != KeepPolicyAccount {
+		return errors.New("keep account only for account policy")
+	}
+	st.kp = kp
+	st.kacc = acc
+	st.keep = ""
+	st.kerr = nil
+	return nil
+}
+
+//第一个可以使用的账号
+func (st *DbSignListener) firstKeep() (xginx.Address, error) {
+	accs, err := st.user.ListAccounts(st.db)
+	if err != nil {
+		return "", err
+	}
+	if len(accs) == 0 {
+		return "", errors.New("user no accounts")
+	}
+	for _, acc := range accs {
+		if !acc.Watch {
+			return acc.GetAddress(), nil
+		}
+	}
+	if !st.ext {
+		return "", errors.New("user no sign accounts")
+	}
+	return accs[0].GetAddress(), nil
+}
+
+//使用金额所在的账号,第一个金额一定会被使用
+func (st *DbSignListener) spendKeep() (xginx.Address, error) {
+	if len(st.used) == 0 {
+		return st.firstKeep()
+	}
+	return st.used[0].GetAddress(), nil
+}
+
+//指定的找零账号
+func (st *DbSignListener) accountKeep() (xginx.Address, error) {
+	accs, err := st.user.ListAccounts(st.db)
+	if err != nil {
+		return "", err
+	}
+	for _, acc := range accs {
+		if acc.Watch && !st.ext {
+			continue
+		}
+		if st.kacc != "" && acc.ID == st.kacc {
+			return acc.GetAddress(), nil
+		}
+		if st.kacc == "" && acc.HasTag(ChangeTag) {
+			return acc.GetAddress(), nil
+		}
+	}
+	if st.kacc != "" {
+		return "", fmt.Errorf("keep account %s miss", st.kacc)
+	}
+	return "", errors.New("change account miss")
+}
+
+//派生新的单签名找零账号,使用非强化派生不需要私钥密码
+func (st *DbSignListener) freshKeep() (xginx.Address, error) {
+	pri, err := st.user.NewPublicPrivate(st.db, "找零")
+	if err != nil {
+		return "", err
+	}
+	acc, err := NewAccount(st.db, 1, 1, false, []string{pri.ID}, "找零", []string{ChangeTag})
+	if err != nil {
+		return "", err
+	}
+	err = st.db.InsertAccount(acc)
+	if err != nil {
+		return "", err
+	}
+	return acc.GetAddress(), nil
+}
+
+//Keep 按照找零策略获取找零地址
+func (st *DbSignListener) Keep() (xginx.Address, error) {
+	if st.keep != "" || st.kerr != nil {
+		return st.keep, st.kerr
+	}
+	switch st.kp {
+	case KeepPolicySpend:
+		st.keep, st.kerr = st.spendKeep()
+	case KeepPolicyAccount:
+		st.keep, st.kerr = st.accountKeep()
+	case KeepPolicyFresh:
+		st.keep, st.kerr = st.freshKeep()
+	default:
+		st.keep, st.kerr = st.firstKeep()
+	}
+	return st.keep, st.kerr
+}
+
+//GetKeep 获取找零地址,错误通过KeepErr获取
+func (st *DbSignListener) GetKeep() xginx.Address {
+	keep, err := st.Keep()
+	if err != nil {
+		xginx.LogError("get keep address error", err)
+	}
+	return keep
+}
+
+//KeepErr 获取找零地址时的错误
+func (st *DbSignListener) KeepErr() error {
+	return st.kerr
+}
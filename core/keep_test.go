@@ -0,0 +1,60 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestKeepPolicy(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user := &TUser{ID: primitive.NewObjectID()}
+	err := app.UseTx(func(db IDbImp) error {
+		lis := NewSignListener(db, user)
+		as.Error(lis.SetKeep("miss", ""))
+		as.Error(lis.SetKeep(KeepPolicyFirst, "keep_test_acc"))
+		//没有账号时返回错误
+		as.NoError(lis.SetKeep(KeepPolicyFirst, ""))
+		_, err := lis.Keep()
+		as.Error(err)
+		as.Equal(xginx.Address(""), lis.GetKeep())
+		as.Error(lis.KeepErr())
+		accs := []*TAccount{
+			{ID: "keep_test_watch", UserID: []primitive.ObjectID{user.ID}, Watch: true},
+			{ID: "keep_test_acc1", UserID: []primitive.ObjectID{user.ID}},
+			{ID: "keep_test_acc2", UserID: []primitive.ObjectID{user.ID}, Tags: []string{ChangeTag}},
+		}
+		for _, acc := range accs {
+			err := db.InsertAccount(acc)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteAccount(acc.ID, user.ID)
+		}
+		//跳过只读账号
+		as.NoError(lis.SetKeep(KeepPolicyFirst, ""))
+		keep, err := lis.Keep()
+		as.NoError(err)
+		as.NotEqual(xginx.Address("keep_test_watch"), keep)
+		//带找零标签的账号
+		as.NoError(lis.SetKeep(KeepPolicyAccount, ""))
+		keep, err = lis.Keep()
+		as.NoError(err)
+		as.Equal(xginx.Address("keep_test_acc2"), keep)
+		//指定的账号
+		as.NoError(lis.SetKeep(KeepPolicyAccount, "keep_test_acc1"))
+		keep, err = lis.Keep()
+		as.NoError(err)
+		as.Equal(xginx.Address("keep_test_acc1"), keep)
+		as.NoError(lis.SetKeep(KeepPolicyAccount, "keep_test_watch"))
+		_, err = lis.Keep()
+		as.Error(err)
+		return nil
+	})
+	as.NoError(err)
+}
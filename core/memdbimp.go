@@ -0,0 +1,1067 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/hashicorp/go-memdb"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//memKey 转换索引参数为字符串
+func memKey(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return v.(string)
+	case xginx.Address:
+		return string(v.(xginx.Address))
+	case primitive.ObjectID:
+		return v.(primitive.ObjectID).Hex()
+	case xginx.HASH256:
+		id := v.(xginx.HASH256)
+		return hex.EncodeToString(id[:])
+	case []byte:
+		return hex.EncodeToString(v.([]byte))
+	case bool:
+		if v.(bool) {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+//memKeyBytes 索引值以0结尾,避免前缀查询时匹配到其他值
+func memKeyBytes(v interface{}) []byte {
+	return append([]byte(memKey(v)), 0)
+}
+
+//memIndex 单值索引
+type memIndex func(obj interface{}) interface{}
+
+func (fn memIndex) FromObject(raw interface{}) (bool, []byte, error) {
+	return true, memKeyBytes(fn(raw)), nil
+}
+
+func (fn memIndex) FromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("must provide only a single argument")
+	}
+	return memKeyBytes(args[0]), nil
+}
+
+//memMultiIndex 多值索引,例如账户的多个所属用户
+type memMultiIndex func(obj interface{}) []interface{}
+
+func (fn memMultiIndex) FromObject(raw interface{}) (bool, [][]byte, error) {
+	vs := fn(raw)
+	if len(vs) == 0 {
+		return false, nil, nil
+	}
+	keys := [][]byte{}
+	for _, v := range vs {
+		keys = append(keys, memKeyBytes(v))
+	}
+	return true, keys, nil
+}
+
+func (fn memMultiIndex) FromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("must provide only a single argument")
+	}
+	return memKeyBytes(args[0]), nil
+}
+
+//创建索引定义
+func newMemIndex(name string, unique bool, fn memIndex) *memdb.IndexSchema {
+	return &memdb.IndexSchema{Name: name, Unique: unique, Indexer: fn}
+}
+
+//创建多值索引定义
+func newMemMultiIndex(name string, fn memMultiIndex) *memdb.IndexSchema {
+	return &memdb.IndexSchema{Name: name, AllowMissing: true, Indexer: fn}
+}
+
+//创建表定义,第一个索引必须是id
+func newMemTable(name string, idxs ...*memdb.IndexSchema) *memdb.TableSchema {
+	tbl := &memdb.TableSchema{
+		Name:    name,
+		Indexes: map[string]*memdb.IndexSchema{},
+	}
+	for _, idx := range idxs {
+		tbl.Indexes[idx.Name] = idx
+	}
+	return tbl
+}
+
+//内存数据库表定义,和mongo中的集合对应
+func memSchema() *memdb.DBSchema {
+	tbls := []*memdb.TableSchema{
+		newMemTable(TUsersName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TUser).ID
+			}),
+			newMemIndex("mobile", true, func(obj interface{}) interface{} {
+				return obj.(*TUser).Mobile
+			}),
+		),
+		newMemTable(TPrivatesName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TPrivate).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TPrivate).UserID
+			}),
+		),
+		newMemTable(TAccountName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TAccount).ID
+			}),
+			newMemMultiIndex("uid", func(obj interface{}) []interface{} {
+				vs := []interface{}{}
+				for _, uid := range obj.(*TAccount).UserID {
+					vs = append(vs, uid)
+				}
+				return vs
+			}),
+			newMemMultiIndex("kid", func(obj interface{}) []interface{} {
+				vs := []interface{}{}
+				for _, kid := range obj.(*TAccount).Kid {
+					vs = append(vs, kid)
+				}
+				return vs
+			}),
+		),
+		newMemTable(TTxName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TTx).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TTx).UserID
+			}),
+			newMemIndex("state", false, func(obj interface{}) interface{} {
+				return obj.(*TTx).State
+			}),
+		),
+		newMemTable(TSigName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TSigs).ID
+			}),
+			newMemIndex("tid", false, func(obj interface{}) interface{} {
+				return obj.(*TSigs).TxID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TSigs).UserID
+			}),
+		),
+		newMemTable(TSessionName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TSession).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TSession).UserID
+			}),
+			newMemIndex("refresh", false, func(obj interface{}) interface{} {
+				return obj.(*TSession).Refresh
+			}),
+			newMemIndex("prev", false, func(obj interface{}) interface{} {
+				return obj.(*TSession).Prev
+			}),
+		),
+		newMemTable(TReserveName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TReserve).ID
+			}),
+			newMemIndex("tid", false, func(obj interface{}) interface{} {
+				return obj.(*TReserve).TxID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TReserve).UserID
+			}),
+		),
+		newMemTable(TBatchName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TBatch).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TBatch).UserID
+			}),
+		),
+		newMemTable(TScheduleName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TSchedule).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TSchedule).UserID
+			}),
+			newMemIndex("enable", false, func(obj interface{}) interface{} {
+				return obj.(*TSchedule).Enable
+			}),
+		),
+		newMemTable(TSpendName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TSpend).ID
+			}),
+			newMemIndex("acc", false, func(obj interface{}) interface{} {
+				return obj.(*TSpend).Account
+			}),
+		),
+		newMemTable(TPolicyChangeName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TPolicyChange).ID
+			}),
+			newMemIndex("acc", false, func(obj interface{}) interface{} {
+				return obj.(*TPolicyChange).Account
+			}),
+		),
+		newMemTable(TMigrationName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TMigration).Version
+			}),
+		),
+		newMemTable(TContactName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TContact).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TContact).UserID
+			}),
+			newMemIndex("label", true, func(obj interface{}) interface{} {
+				c := obj.(*TContact)
+				return contactLabelKey(c.UserID, c.Label)
+			}),
+		),
+		newMemTable(TWebhookName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TWebhook).ID
+			}),
+			newMemIndex("uid", false, func(obj interface{}) interface{} {
+				return obj.(*TWebhook).UserID
+			}),
+		),
+		newMemTable(TDeliveryName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TDelivery).ID
+			}),
+			newMemIndex("hid", false, func(obj interface{}) interface{} {
+				return obj.(*TDelivery).HookID
+			}),
+			newMemIndex("state", false, func(obj interface{}) interface{} {
+				return obj.(*TDelivery).State
+			}),
+		),
+		newMemTable(THistoryName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*THistory).ID
+			}),
+			newMemIndex("acc", false, func(obj interface{}) interface{} {
+				return obj.(*THistory).Account
+			}),
+			newMemIndex("blk", false, func(obj interface{}) interface{} {
+				return obj.(*THistory).Block
+			}),
+			newMemIndex("done", false, func(obj interface{}) interface{} {
+				return obj.(*THistory).Done
+			}),
+		),
+		newMemTable(TBlockMarkName,
+			newMemIndex("id", true, func(obj interface{}) interface{} {
+				return obj.(*TBlockMark).ID
+			}),
+		),
+	}
+	schema := &memdb.DBSchema{
+		Tables: map[string]*memdb.TableSchema{},
+	}
+	for _, tbl := range tbls {
+		schema.Tables[tbl.Name] = tbl
+	}
+	return schema
+}
+
+//memStore 进程内数据存储,包含数据表和redis替代实现
+type memStore struct {
+	db    *memdb.MemDB
+	redis *memRedis
+}
+
+//创建内存存储
+func newMemStore() *memStore {
+	db, err := memdb.NewMemDB(memSchema())
+	if err != nil {
+		panic(err)
+	}
+	return &memStore{
+		db:    db,
+		redis: newMemRedis(),
+	}
+}
+
+//通过bson复制对象,保证存储的数据不被外部修改
+func memClone(src interface{}, dst interface{}) error {
+	bb, err := bson.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(bb, dst)
+}
+
+type memimp struct {
+	context.Context
+	*memRedisImp
+	store *memStore
+	txn   *memdb.Txn
+	after []func() //事务提交后执行
+}
+
+//NewMemDbImp 创建内存数据库接口 txn不为空时在事务中
+func NewMemDbImp(ctx context.Context, store *memStore, txn *memdb.Txn) IDbImp {
+	return &memimp{
+		Context:     ctx,
+		memRedisImp: &memRedisImp{Context: ctx, store: store.redis},
+		store:       store,
+		txn:         txn,
+	}
+}
+
+func (db *memimp) IsTx() bool {
+	return db.txn != nil
+}
+
+func (db *memimp) UseTx(fn func(db IDbImp) error) error {
+	//如果已经在事务中直接调用
+	if db.IsTx() {
+		return fn(db)
+	}
+	txn := db.store.db.Txn(true)
+	//提交后Abort不起作用
+	defer txn.Abort()
+	tdb := NewMemDbImp(db.Context, db.store, txn).(*memimp)
+	err := fn(tdb)
+	if err != nil {
+		return err
+	}
+	txn.Commit()
+	for _, f := range tdb.after {
+		f()
+	}
+	return nil
+}
+
+func (db *memimp) AfterCommit(fn func()) {
+	if !db.IsTx() {
+		fn()
+		return
+	}
+	db.after = append(db.after, fn)
+}
+
+//读取数据,在事务中可以读取到事务中的修改
+func (db *memimp) read() *memdb.Txn {
+	if db.IsTx() {
+		return db.txn
+	}
+	return db.store.db.Txn(false)
+}
+
+//写入数据,不在事务中每次写入单独提交
+func (db *memimp) write(fn func(txn *memdb.Txn) error) error {
+	if db.IsTx() {
+		return fn(db.txn)
+	}
+	txn := db.store.db.Txn(true)
+	defer txn.Abort()
+	err := fn(txn)
+	if err != nil {
+		return err
+	}
+	txn.Commit()
+	return nil
+}
+
+//获取一条记录并复制到v
+func (db *memimp) first(v interface{}, tbl string, idx string, arg interface{}) error {
+	obj, err := db.read().First(tbl, idx, arg)
+	if err != nil {
+		return err
+	}
+	if obj == nil {
+		return mongo.ErrNoDocuments
+	}
+	return memClone(obj, v)
+}
+
+//获取多条记录,fn返回false停止
+func (db *memimp) each(tbl string, idx string, arg interface{}, fn func(obj interface{}) bool) error {
+	iter, err := db.read().Get(tbl, idx, arg)
+	if err != nil {
+		return err
+	}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		if !fn(obj) {
+			break
+		}
+	}
+	return nil
+}
+
+//获取表中所有记录,fn返回false停止
+func (db *memimp) eachAll(tbl string, fn func(obj interface{}) bool) error {
+	iter, err := db.read().LowerBound(tbl, "id", "")
+	if err != nil {
+		return err
+	}
+	for obj := iter.Next(); obj != nil; obj = iter.Next() {
+		if !fn(obj) {
+			break
+		}
+	}
+	return nil
+}
+
+//统计记录数量
+func (db *memimp) count(tbl string, idx string, arg interface{}) (int, error) {
+	num := 0
+	err := db.each(tbl, idx, arg, func(obj interface{}) bool {
+		num++
+		return true
+	})
+	return num, err
+}
+
+//写入一条记录的副本
+func (db *memimp) insert(tbl string, v interface{}, obj interface{}) error {
+	err := memClone(v, obj)
+	if err != nil {
+		return err
+	}
+	return db.write(func(txn *memdb.Txn) error {
+		return txn.Insert(tbl, obj)
+	})
+}
+
+//删除索引匹配的所有记录
+func (db *memimp) deleteAll(tbl string, idx string, arg interface{}) error {
+	return db.write(func(txn *memdb.Txn) error {
+		_, err := txn.DeleteAll(tbl, idx, arg)
+		return err
+	})
+}
+
+func (db *memimp) SetPushID(uid primitive.ObjectID, pid string) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.PushID = pid
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetUserToken(uid primitive.ObjectID, tk string) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.Token = tk
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) InsertUser(obj *TUser) error {
+	_, err := db.GetUserInfoWithMobile(obj.Mobile)
+	if err == nil {
+		return errors.New("user exists")
+	}
+	return db.insert(TUsersName, obj, &TUser{})
+}
+
+func (db *memimp) GetUserInfo(id interface{}) (*TUser, error) {
+	v := &TUser{}
+	err := db.first(v, TUsersName, "id", ToObjectID(id))
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) DeleteUser(id interface{}) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	uid := ToObjectID(id)
+	//删除用户的私钥
+	err := db.deleteAll(TPrivatesName, "uid", uid)
+	if err != nil {
+		return err
+	}
+	//删除用户创建的账号
+	accs, err := db.ListAccounts(uid)
+	if err != nil {
+		return err
+	}
+	for _, acc := range accs {
+		err = db.DeleteAccount(acc.ID, uid)
+		if err != nil {
+			return err
+		}
+	}
+	//删除需要用户签名的数据
+	err = db.deleteAll(TSigName, "uid", uid)
+	if err != nil {
+		return err
+	}
+	//释放用户交易占用的金额
+	err = db.deleteAll(TReserveName, "uid", uid)
+	if err != nil {
+		return err
+	}
+	//删除用户交易
+	err = db.deleteAll(TTxName, "uid", uid)
+	if err != nil {
+		return err
+	}
+	//注销用户所有会话,refresh token不能再使用
+	err = RevokeUserSessions(db, uid)
+	if err != nil {
+		return err
+	}
+	//删除用户信息
+	return db.deleteAll(TUsersName, "id", uid)
+}
+
+func (db *memimp) GetUserInfoWithMobile(mobile string) (*TUser, error) {
+	v := &TUser{}
+	err := db.first(v, TUsersName, "mobile", mobile)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) SetUserPass(uid primitive.ObjectID, pwd TPassword) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.Pwd = pwd
+	user.Pass = xginx.HASH256{}
+	user.Reset = false
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetUserKeys(uid primitive.ObjectID, keys string, xpub string, cipher CipherType, idx uint32) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.Keys = keys
+	user.XPub = xpub
+	user.Cipher = cipher
+	user.Idx = idx
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetUserXPub(uid primitive.ObjectID, xpub string) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.XPub = xpub
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetUserTOTP(uid primitive.ObjectID, totp TTOTP) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.TOTP = totp
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) ForceResetPass(uid primitive.ObjectID) error {
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	user.Reset = true
+	user.Token = ""
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetUserKeyPass(uid primitive.ObjectID, old string, new string) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	user, err := db.GetUserInfo(uid)
+	if err != nil {
+		return err
+	}
+	dk, err := user.GetDeterKey(old)
+	if err != nil {
+		return err
+	}
+	keys, err := dk.Dump(new)
+	if err != nil {
+		return err
+	}
+	user.Keys = keys
+	return db.insert(TUsersName, user, &TUser{})
+}
+
+func (db *memimp) SetPrivateKeyPass(uid primitive.ObjectID, pid string, old string, new string) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	pri, err := db.GetPrivate(pid)
+	if err != nil {
+		return err
+	}
+	if !ObjectIDEqual(pri.UserID, uid) {
+		return errors.New("can't update key pass")
+	}
+	if pri.IsCipherPublicKey() {
+		return errors.New("public derived private use root key pass")
+	}
+	if pri.IsCipherOnlyKey() {
+		xpri, err := pri.ToPrivate(old)
+		if err != nil {
+			return err
+		}
+		pri.Keys, err = xpri.Dump(new)
+		if err != nil {
+			return err
+		}
+	} else {
+		dk, err := pri.GetDeter(old)
+		if err != nil {
+			return err
+		}
+		pri.Keys, err = dk.Dump(new)
+		if err != nil {
+			return err
+		}
+	}
+	return db.insert(TPrivatesName, pri, &TPrivate{})
+}
+
+func (db *memimp) InsertPrivate(obj *TPrivate) error {
+	if !db.IsTx() {
+		return errors.New("need tx")
+	}
+	_, err := db.GetPrivate(obj.ID)
+	if err == nil {
+		return errors.New("private exists")
+	}
+	return db.insert(TPrivatesName, obj, &TPrivate{})
+}
+
+func (db *memimp) HasPrivateRef(id string) (bool, error) {
+	num, err := db.GetPrivateRefs(id)
+	return num > 0, err
+}
+
+func (db *memimp) GetPrivateRefs(id string) (int, error) {
+	return db.count(TAccountName, "kid", id)
+}
+
+func (db *memimp) DeletePrivate(id string) error {
+	//没有引用账户才能删除
+	has, err := db.HasPrivateRef(id)
+	if err != nil || has {
+		return fmt.Errorf("has refs acc,can't delete,err = %w", err)
+	}
+	return db.deleteAll(TPrivatesName, "id", id)
+}
+
+func (db *memimp) GetPrivate(id string) (*TPrivate, error) {
+	v := &TPrivate{}
+	err := db.first(v, TPrivatesName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) GetUserPrivate(id string, uid primitive.ObjectID) (*TPrivate, error) {
+	v, err := db.GetPrivate(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ObjectIDEqual(v.UserID, uid) {
+		return nil, mongo.ErrNoDocuments
+	}
+	return v, nil
+}
+
+func (db *memimp) InsertAccount(obj *TAccount) error {
+	_, err := db.GetAccount(obj.ID)
+	if err == nil {
+		return errors.New("account exists")
+	}
+	return db.insert(TAccountName, obj, &TAccount{})
+}
+
+func (db *memimp) GetAccount(id xginx.Address) (*TAccount, error) {
+	v := &TAccount{}
+	err := db.first(v, TAccountName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) DeleteAccount(id xginx.Address, uid primitive.ObjectID) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	if !acc.HasUserID(uid) {
+		return mongo.ErrNoDocuments
+	}
+	// 移除账户内相关的所属用户
+	uids := []primitive.ObjectID{}
+	for _, v := range acc.UserID {
+		if !ObjectIDEqual(v, uid) {
+			uids = append(uids, v)
+		}
+	}
+	acc.UserID = uids
+	// 如果没有所属用户删除账号信息
+	if len(acc.UserID) == 0 {
+		return db.deleteAll(TAccountName, "id", id)
+	}
+	return db.insert(TAccountName, acc, &TAccount{})
+}
+
+func (db *memimp) ListPrivates(uid primitive.ObjectID) ([]*TPrivate, error) {
+	rets := []*TPrivate{}
+	var err error
+	err2 := db.each(TPrivatesName, "uid", uid, func(obj interface{}) bool {
+		v := &TPrivate{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) ListAccounts(uid primitive.ObjectID) ([]*TAccount, error) {
+	rets := []*TAccount{}
+	var err error
+	err2 := db.each(TAccountName, "uid", uid, func(obj interface{}) bool {
+		v := &TAccount{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) AddAccountUser(id xginx.Address, uid primitive.ObjectID) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	if acc.HasUserID(uid) {
+		return nil
+	}
+	acc.UserID = append(acc.UserID, uid)
+	return db.insert(TAccountName, acc, &TAccount{})
+}
+
+func (db *memimp) ListAccountsWithKid(kid string) ([]*TAccount, error) {
+	rets := []*TAccount{}
+	var err error
+	err2 := db.each(TAccountName, "kid", kid, func(obj interface{}) bool {
+		v := &TAccount{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) GetTx(id []byte) (*TTx, error) {
+	v := &TTx{}
+	err := db.first(v, TTxName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) SetTxState(id []byte, state TTxState) error {
+	tx, err := db.GetTx(id)
+	if err != nil {
+		return err
+	}
+	tx.State = state
+	return db.insert(TTxName, tx, &TTx{})
+}
+
+func (db *memimp) DeleteTx(id []byte) error {
+	if !db.IsTx() {
+		return errors.New("need use tx")
+	}
+	//删除交易对应的签名列表
+	err := db.deleteAll(TSigName, "tid", id)
+	if err != nil {
+		return err
+	}
+	//释放占用的金额
+	err = db.DeleteReserves(id)
+	if err != nil {
+		return err
+	}
+	//删除交易
+	return db.deleteAll(TTxName, "id", id)
+}
+
+func (db *memimp) CancelTx(id []byte, cancel TTxCancel) error {
+	if !db.IsTx() {
+		return errors.New("need use tx")
+	}
+	tx, err := db.GetTx(id)
+	if err != nil {
+		return err
+	}
+	err = db.deleteAll(TSigName, "tid", id)
+	if err != nil {
+		return err
+	}
+	err = db.DeleteReserves(id)
+	if err != nil {
+		return err
+	}
+	tx.State = TTxStateCancel
+	tx.Cancel = cancel
+	return db.insert(TTxName, tx, &TTx{})
+}
+
+func (db *memimp) SetTxBlock(id []byte, blk []byte, height uint32, need uint32) error {
+	tx, err := db.GetTx(id)
+	if err != nil {
+		return err
+	}
+	tx.Block = blk
+	tx.Height = height
+	tx.Need = need
+	tx.Confirm = 0
+	if blk != nil {
+		tx.Confirm = 1
+	}
+	return db.insert(TTxName, tx, &TTx{})
+}
+
+func (db *memimp) SetTxConfirm(id []byte, confirm uint32) error {
+	tx, err := db.GetTx(id)
+	if err != nil {
+		return err
+	}
+	tx.Confirm = confirm
+	return db.insert(TTxName, tx, &TTx{})
+}
+
+func (db *memimp) ListBlockTxs() ([]*TTx, error) {
+	rets := []*TTx{}
+	var err error
+	err2 := db.each(TTxName, "state", TTxState(TTxStateBlock), func(obj interface{}) bool {
+		v := &TTx{}
+		err = memClone(obj, v)
+		if err != nil {
+			return false
+		}
+		rets = append(rets, v)
+		return true
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rets, nil
+}
+
+func (db *memimp) ListExpiredTxs(now int64) ([]*TTx, error) {
+	rets := []*TTx{}
+	var err error
+	for _, state := range []TTxState{TTxStateNew, TTxStateSign} {
+		err2 := db.each(TTxName, "state", state, func(obj interface{}) bool {
+			v := &TTx{}
+			err = memClone(obj, v)
+			if err != nil {
+				return false
+			}
+			if v.Expire > 0 && v.Expire < now {
+				rets = append(rets, v)
+			}
+			return true
+		})
+		if err2 != nil {
+			return nil, err2
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rets, nil
+}
+
+func (db *memimp) InsertTx(tx *TTx) error {
+	_, err := db.GetTx(tx.ID)
+	if err == nil {
+		return errors.New("tx exists")
+	}
+	return db.insert(TTxName, tx, &TTx{})
+}
+
+func (db *memimp) InsertSigs(sigs ...*TSigs) error {
+	for _, sig := range sigs {
+		err := db.insert(TSigName, sig, &TSigs{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memimp) SetSigs(id primitive.ObjectID, sigs xginx.SigBytes) error {
+	v := &TSigs{}
+	err := db.first(v, TSigName, "id", id)
+	if err != nil {
+		return err
+	}
+	v.IsSign = true
+	v.Sigs = sigs
+	return db.insert(TSigName, v, &TSigs{})
+}
+
+//获取交易的签名对象,fn返回是否需要
+func (db *memimp) listSigs(tid xginx.HASH256, fn func(sig *TSigs) bool) (TxSigs, error) {
+	rets := TxSigs{}
+	var err error
+	err2 := db.each(TSigName, "tid", tid, func(obj interface{}) bool {
+		v := &TSigs{}
+		err = memClone(obj, v)
+		if err != nil {
+			return false
+		}
+		if fn(v) {
+			rets = append(rets, v)
+		}
+		return true
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) ListSigs(tid xginx.HASH256) (TxSigs, error) {
+	return db.listSigs(tid, func(sig *TSigs) bool {
+		return !sig.IsSign
+	})
+}
+
+func (db *memimp) ListUserSigs(uid primitive.ObjectID, tid xginx.HASH256) (TxSigs, error) {
+	return db.listSigs(tid, func(sig *TSigs) bool {
+		return !sig.IsSign && ObjectIDEqual(sig.UserID, uid)
+	})
+}
+
+func (db *memimp) GetSigs(tid xginx.HASH256, kid string, hash []byte, idx int) (*TSigs, error) {
+	sigs, err := db.listSigs(tid, func(sig *TSigs) bool {
+		return sig.KeyID == kid && sig.Idx == idx && bytes.Equal(sig.Hash, hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) == 0 {
+		return nil, mongo.ErrNoDocuments
+	}
+	return sigs[0], nil
+}
+
+func (db *memimp) ListUserTxs(uid primitive.ObjectID, sign bool) ([]*TTx, error) {
+	bi := xginx.GetBlockIndex()
+	ids := map[xginx.HASH256]bool{}
+	//获取需要uid签名的记录
+	err := db.each(TSigName, "uid", uid, func(obj interface{}) bool {
+		v := obj.(*TSigs)
+		if v.IsSign == sign {
+			ids[v.TxID] = true
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	//获取对应的交易信息
+	txs := []*TTx{}
+	now := time.Now()
+	for tid := range ids {
+		tx, err := db.GetTx(tid[:])
+		if err != nil {
+			continue
+		}
+		//已经取消或者过期的交易不返回
+		if tx.IsDead(now) {
+			continue
+		}
+		//如果获取的是未签名的，并且已经验证成功，不返回这个交易
+		if !sign && tx.Verify(db, bi) {
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	return txs, nil
+}
+
+func (db *memimp) SetPrivateXPub(id string, xpub string) error {
+	pri, err := db.GetPrivate(id)
+	if err != nil {
+		return err
+	}
+	pri.XPub = xpub
+	return db.insert(TPrivatesName, pri, &TPrivate{})
+}
+
+func (db *memimp) IncDeterIdx(tbl string, id interface{}) error {
+	switch tbl {
+	case TUsersName:
+		user, err := db.GetUserInfo(id)
+		if err != nil {
+			return err
+		}
+		user.Idx++
+		return db.insert(TUsersName, user, &TUser{})
+	case TPrivatesName:
+		pri, err := db.GetPrivate(id.(string))
+		if err != nil {
+			return err
+		}
+		pri.Idx++
+		return db.insert(TPrivatesName, pri, &TPrivate{})
+	default:
+		return fmt.Errorf("table %s not support idx", tbl)
+	}
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMemDbTxAbort(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000001", "xh0714")
+	as.NoError(err)
+	//事务返回错误时数据回滚
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		_, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	as.Error(err)
+	err = app.UseDb(func(db IDbImp) error {
+		_, err := db.GetUserInfo(user.ID)
+		return err
+	})
+	as.Error(err, "tx abort error")
+	//事务提交
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		_, err = user.NewPrivate(db, "私钥")
+		return err
+	})
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		v, err := db.GetUserInfoWithMobile(user.Mobile)
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(1), v.Idx, "idx error")
+		pris, err := db.ListPrivates(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(1, len(pris), "privates count error")
+		//修改返回的对象不影响存储
+		v.Mobile = "111"
+		_, err = db.GetUserInfoWithMobile(user.Mobile)
+		if err != nil {
+			return err
+		}
+		return db.DeleteUser(user.ID)
+	})
+	as.NoError(err)
+}
+
+func TestMemRedis(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	err := app.UseRedis(func(redv IRedisImp) error {
+		//token超时
+		uid := primitive.NewObjectID()
+		err := redv.SetUserID("memtoken", uid, time.Millisecond*50)
+		if err != nil {
+			return err
+		}
+		v, err := redv.GetUserID("memtoken")
+		if err != nil {
+			return err
+		}
+		as.True(ObjectIDEqual(v, uid), "user id error")
+		time.Sleep(time.Millisecond * 100)
+		_, err = redv.GetUserID("memtoken")
+		as.Error(err, "token expire error")
+		//订阅发布
+		ps := redv.Subscribe("memchan")
+		defer ps.Close()
+		err = redv.Publish("memchan", "hello")
+		if err != nil {
+			return err
+		}
+		err = redv.Publish("otherchan", "world")
+		if err != nil {
+			return err
+		}
+		select {
+		case msg := <-ps.Channel():
+			as.Equal("hello", msg.Payload)
+		case <-time.After(time.Second):
+			as.Fail("subscribe timeout")
+		}
+		as.Equal(0, len(ps.Channel()), "channel filter error")
+		//分布式锁
+		l1, err := redv.Locker("memlock", time.Second, "meta")
+		if err != nil {
+			return err
+		}
+		as.Equal("meta", l1.Metadata())
+		_, err = redv.Locker("memlock", time.Second)
+		as.Error(err, "lock twice error")
+		l1.Release()
+		ttl, err := l1.TTL()
+		as.NoError(err)
+		as.Equal(time.Duration(0), ttl)
+		l2, err := redv.Locker("memlock", time.Second)
+		if err != nil {
+			return err
+		}
+		l2.Release()
+		return nil
+	})
+	as.NoError(err)
+}
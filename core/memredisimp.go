@@ -0,0 +1,287 @@
+package core
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v7"
+)
+
+//订阅消息缓存数量,和go-redis默认一致
+const (
+	memPubSubSize = 100
+)
+
+//带有超时时间的缓存值
+type memValue struct {
+	val    string
+	expire time.Time //为零值时不过期
+}
+
+func (v memValue) isExpire(now time.Time) bool {
+	return !v.expire.IsZero() && !now.Before(v.expire)
+}
+
+//memRedis 内存中的redis替代实现
+type memRedis struct {
+	mu    sync.Mutex
+	vals  map[string]memValue
+	locks map[string]memValue
+	subs  map[*memPubSub]bool
+}
+
+func newMemRedis() *memRedis {
+	return &memRedis{
+		vals:  map[string]memValue{},
+		locks: map[string]memValue{},
+		subs:  map[*memPubSub]bool{},
+	}
+}
+
+//设置值 ttl=0 不过期
+func (r *memRedis) set(vals map[string]memValue, k string, v string, ttl time.Duration) {
+	mv := memValue{val: v}
+	if ttl > 0 {
+		mv.expire = time.Now().Add(ttl)
+	}
+	vals[k] = mv
+}
+
+//获取值,过期的值会被删除
+func (r *memRedis) get(vals map[string]memValue, k string) (memValue, bool) {
+	v, has := vals[k]
+	if !has {
+		return v, false
+	}
+	if v.isExpire(time.Now()) {
+		delete(vals, k)
+		return v, false
+	}
+	return v, true
+}
+
+//memPubSub 内存订阅连接
+type memPubSub struct {
+	r        *memRedis
+	ch       chan *redis.Message
+	channels map[string]bool
+	once     sync.Once
+}
+
+func (ps *memPubSub) Channel() <-chan *redis.Message {
+	return ps.ch
+}
+
+func (ps *memPubSub) Close() error {
+	ps.once.Do(func() {
+		ps.r.mu.Lock()
+		delete(ps.r.subs, ps)
+		ps.r.mu.Unlock()
+		close(ps.ch)
+	})
+	return nil
+}
+
+//memLocker 内存锁
+type memLocker struct {
+	r     *memRedis
+	key   string
+	token string
+	meta  string
+}
+
+func (l *memLocker) Release() {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	if v, has := l.r.get(l.r.locks, l.key); has && v.val == l.token {
+		delete(l.r.locks, l.key)
+	}
+}
+
+func (l *memLocker) TTL() (time.Duration, error) {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	v, has := l.r.get(l.r.locks, l.key)
+	if !has || v.val != l.token {
+		return 0, nil
+	}
+	return time.Until(v.expire), nil
+}
+
+func (l *memLocker) Refresh(ttl time.Duration) error {
+	l.r.mu.Lock()
+	defer l.r.mu.Unlock()
+	v, has := l.r.get(l.r.locks, l.key)
+	if !has || v.val != l.token {
+		return redislock.ErrNotObtained
+	}
+	l.r.set(l.r.locks, l.key, l.token, ttl)
+	return nil
+}
+
+func (l *memLocker) Metadata() string {
+	return l.meta
+}
+
+//memRedisImp 内存redis接口实现
+type memRedisImp struct {
+	context.Context
+	store *memRedis
+}
+
+func (rimp *memRedisImp) SetUserID(k string, id primitive.ObjectID, time time.Duration) error {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	rimp.store.set(rimp.store.vals, k, id.Hex(), time)
+	return nil
+}
+
+func (rimp *memRedisImp) GetUserID(k string) (primitive.ObjectID, error) {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	v, has := rimp.store.get(rimp.store.vals, k)
+	if !has {
+		return primitive.NilObjectID, redis.Nil
+	}
+	return primitive.ObjectIDFromHex(v.val)
+}
+
+func (rimp *memRedisImp) DelUserID(k string) error {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	delete(rimp.store.vals, k)
+	return nil
+}
+
+func (rimp *memRedisImp) Subscribe(channels ...string) IPubSub {
+	ps := &memPubSub{
+		r:        rimp.store,
+		ch:       make(chan *redis.Message, memPubSubSize),
+		channels: map[string]bool{},
+	}
+	for _, c := range channels {
+		ps.channels[c] = true
+	}
+	rimp.store.mu.Lock()
+	rimp.store.subs[ps] = true
+	rimp.store.mu.Unlock()
+	return ps
+}
+
+//Publish 发布消息,接收方缓存满时消息将被丢弃
+func (rimp *memRedisImp) Publish(channel string, message interface{}) error {
+	msg := &redis.Message{Channel: channel}
+	switch message.(type) {
+	case string:
+		msg.Payload = message.(string)
+	case []byte:
+		msg.Payload = string(message.([]byte))
+	case encoding.BinaryMarshaler:
+		bb, err := message.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		msg.Payload = string(bb)
+	default:
+		msg.Payload = fmt.Sprint(message)
+	}
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	for ps := range rimp.store.subs {
+		if !ps.channels[channel] {
+			continue
+		}
+		select {
+		case ps.ch <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+func (rimp *memRedisImp) Locker(key string, ttl time.Duration, meta ...string) (ILocker, error) {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	if _, has := rimp.store.get(rimp.store.locks, key); has {
+		return nil, redislock.ErrNotObtained
+	}
+	l := &memLocker{
+		r:     rimp.store,
+		key:   key,
+		token: primitive.NewObjectID().Hex(),
+	}
+	if len(meta) > 0 {
+		l.meta = meta[0]
+	}
+	rimp.store.set(rimp.store.locks, key, l.token, ttl)
+	return l, nil
+}
+
+func (rimp *memRedisImp) SetValue(k string, v string, ttl time.Duration) error {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	rimp.store.set(rimp.store.vals, k, v, ttl)
+	return nil
+}
+
+func (rimp *memRedisImp) SetValueNX(k string, v string, ttl time.Duration) (bool, error) {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	if _, has := rimp.store.get(rimp.store.vals, k); has {
+		return false, nil
+	}
+	rimp.store.set(rimp.store.vals, k, v, ttl)
+	return true, nil
+}
+
+func (rimp *memRedisImp) GetValue(k string) (string, error) {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	v, has := rimp.store.get(rimp.store.vals, k)
+	if !has {
+		return "", redis.Nil
+	}
+	return v.val, nil
+}
+
+func (rimp *memRedisImp) DelValue(k ...string) error {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	for _, v := range k {
+		delete(rimp.store.vals, v)
+	}
+	return nil
+}
+
+func (rimp *memRedisImp) IncrValue(k string, ttl time.Duration) (int64, error) {
+	rimp.store.mu.Lock()
+	defer rimp.store.mu.Unlock()
+	v, has := rimp.store.get(rimp.store.vals, k)
+	if !has {
+		rimp.store.set(rimp.store.vals, k, "1", ttl)
+		return 1, nil
+	}
+	num, err := strconv.ParseInt(v.val, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	num++
+	v.val = strconv.FormatInt(num, 10)
+	rimp.store.vals[k] = v
+	return num, nil
+}
+
+//NewMemRedisImp 创建内存缓存接口
+func NewMemRedisImp(ctx context.Context, store *memStore) IRedisImp {
+	return &memRedisImp{
+		Context: ctx,
+		store:   store.redis,
+	}
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/cxuhua/xginx"
+	"github.com/tyler-smith/go-bip39/wordlists"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//助记词设置
+var (
+	//恢复时连续未使用的私钥达到这个数量后停止
+	RestoreGap = uint32(20)
+)
+
+//ErrRestoreMismatch 助记词和用户现有的主私钥不同
+var ErrRestoreMismatch = errors.New("mnemonic not match user deter key")
+
+//DeterKey 64字节,按BIP39规则附加sha256前16位校验,共48个单词
+const (
+	mnemonicBits     = 11
+	mnemonicDataLen  = 64
+	mnemonicCheckLen = mnemonicDataLen * 8 / 32
+	mnemonicWords    = (mnemonicDataLen*8 + mnemonicCheckLen) / mnemonicBits
+)
+
+//单词索引
+var mnemonicIndex = func() map[string]int64 {
+	m := map[string]int64{}
+	for i, w := range wordlists.English {
+		m[w] = int64(i)
+	}
+	return m
+}()
+
+//Mnemonic 导出助记词
+func (k DeterKey) Mnemonic() (string, error) {
+	if len(k.Body) != 32 || len(k.Key) != 32 {
+		return "", errors.New("deter key length error")
+	}
+	data := append([]byte{}, k.Body...)
+	data = append(data, k.Key...)
+	hv := sha256.Sum256(data)
+	num := new(big.Int).SetBytes(data)
+	num.Lsh(num, mnemonicCheckLen)
+	num.Or(num, new(big.Int).SetBytes(hv[:mnemonicCheckLen/8]))
+	mask := big.NewInt(1<<mnemonicBits - 1)
+	words := make([]string, mnemonicWords)
+	for i := mnemonicWords - 1; i >= 0; i-- {
+		idx := new(big.Int).And(num, mask)
+		words[i] = wordlists.English[idx.Int64()]
+		num.Rsh(num, mnemonicBits)
+	}
+	return strings.Join(words, " "), nil
+}
+
+//LoadDeterKeyWithMnemonic 从助记词恢复密钥
+func LoadDeterKeyWithMnemonic(s string) (*DeterKey, error) {
+	words := strings.Fields(strings.ToLower(s))
+	if len(words) != mnemonicWords {
+		return nil, fmt.Errorf("mnemonic words count %d error", len(words))
+	}
+	num := new(big.Int)
+	for _, w := range words {
+		idx, has := mnemonicIndex[w]
+		if !has {
+			return nil, fmt.Errorf("mnemonic word %s error", w)
+		}
+		num.Lsh(num, mnemonicBits)
+		num.Or(num, big.NewInt(idx))
+	}
+	check := new(big.Int).And(num, big.NewInt(1<<mnemonicCheckLen-1))
+	num.Rsh(num, mnemonicCheckLen)
+	bs := num.Bytes()
+	data := make([]byte, mnemonicDataLen)
+	copy(data[mnemonicDataLen-len(bs):], bs)
+	hv := sha256.Sum256(data)
+	if new(big.Int).SetBytes(hv[:mnemonicCheckLen/8]).Cmp(check) != 0 {
+		return nil, errors.New("mnemonic checksum error")
+	}
+	dk := &DeterKey{
+		Body: data[:32],
+		Key:  data[32:],
+	}
+	if _, err := dk.GetPrivateKey(); err != nil {
+		return nil, err
+	}
+	return dk, nil
+}
+
+//RestoreResult 恢复结果
+type RestoreResult struct {
+	Idx      uint32          //恢复后的派生索引
+	Privates []string        //新恢复的私钥id
+	Accounts []xginx.Address //新恢复或者重新关联的账号
+}
+
+//私钥是否在链上使用过,单签名账号存在交易记录
+func singleAccountUsed(bi *xginx.BlockIndex, pri *TPrivate) (*xginx.Account, bool, error) {
+	if bi == nil {
+		return nil, false, nil
+	}
+	acc, err := xginx.NewAccountWithPks(1, 1, false, []xginx.PKBytes{pri.Pks})
+	if err != nil {
+		return nil, false, err
+	}
+	addr, err := acc.GetAddress()
+	if err != nil {
+		return nil, false, err
+	}
+	txs, err := bi.ListTxs(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return acc, len(txs) > 0, nil
+}
+
+//检测派生的私钥是否使用过,重新关联数据库中的账号,创建链上有交易的单签名账号
+//返回是否使用过和数据库中是否已经存在
+func (u *TUser) restorePrivate(db IDbImp, bi *xginx.BlockIndex, pri *TPrivate, accs map[xginx.Address]bool, res *RestoreResult) (bool, bool, error) {
+	used, exists := false, false
+	if old, err := db.GetPrivate(pri.ID); err == nil {
+		if !ObjectIDEqual(old.UserID, u.ID) {
+			return false, false, fmt.Errorf("private %s owned by other user", pri.ID)
+		}
+		used = true
+		exists = true
+	}
+	//数据库中引用这个私钥的账号,重新关联到用户
+	refs, err := db.ListAccountsWithKid(pri.ID)
+	if err != nil {
+		return false, false, err
+	}
+	for _, acc := range refs {
+		used = true
+		if acc.HasUserID(u.ID) || accs[acc.ID] {
+			continue
+		}
+		err = db.AddAccountUser(acc.ID, u.ID)
+		if err != nil {
+			return false, false, err
+		}
+		accs[acc.ID] = true
+		res.Accounts = append(res.Accounts, acc.ID)
+	}
+	//链上有交易的单签名账号
+	acc, onchain, err := singleAccountUsed(bi, pri)
+	if err != nil {
+		return false, false, err
+	}
+	if !onchain {
+		return used, exists, nil
+	}
+	tacc, err := NewAccountFrom([]primitive.ObjectID{u.ID}, acc, "恢复", nil)
+	if err != nil {
+		return false, false, err
+	}
+	if _, err := db.GetAccount(tacc.ID); err != nil && !accs[tacc.ID] {
+		err = db.InsertAccount(tacc)
+		if err != nil {
+			return false, false, err
+		}
+		accs[tacc.ID] = true
+		res.Accounts = append(res.Accounts, tacc.ID)
+	}
+	return true, exists, nil
+}
+
+//用户已经有主私钥时,助记词必须和原来的主私钥相同
+//replace为true时可以替换,需要原来的私钥密码
+func (u *TUser) checkRestoreKey(xpub *ExtPubKey, replace bool, opass string) error {
+	if u.Keys == "" && u.XPub == "" {
+		return nil
+	}
+	old := u.XPub
+	//没有保存扩展公钥的用户从原来的主私钥获取
+	if old == "" {
+		odk, err := u.GetDeterKey(opass)
+		if err != nil {
+			return err
+		}
+		oxp, err := odk.PublicExtPub()
+		if err != nil {
+			return err
+		}
+		old = oxp.Dump()
+	}
+	if old == xpub.Dump() {
+		return nil
+	}
+	if !replace {
+		return ErrRestoreMismatch
+	}
+	if _, err := u.GetDeterKey(opass); err != nil {
+		return fmt.Errorf("old key pass error %w", err)
+	}
+	return nil
+}
+
+//RestoreDeterKey 使用助记词恢复主私钥
+//按照Idx依次派生强化和非强化私钥,直到连续RestoreGap个索引未被使用,
+//恢复私钥并重建数据库中关联的账号和链上存在交易的单签名账号
+//用户已经有不同的主私钥时,只有replace为true并且opass是原私钥密码才能替换
+func (u *TUser) RestoreDeterKey(db IDbImp, bi *xginx.BlockIndex, words string, replace bool, opass string, kpass ...string) (*RestoreResult, error) {
+	if !db.IsTx() {
+		return nil, errors.New("use tx")
+	}
+	dk, err := LoadDeterKeyWithMnemonic(words)
+	if err != nil {
+		return nil, err
+	}
+	cipher := CipherTypeNone
+	if len(kpass) > 0 && kpass[0] != "" {
+		cipher = CipherTypeAes
+	}
+	keys, err := dk.Dump(kpass...)
+	if err != nil {
+		return nil, err
+	}
+	xpub, err := dk.PublicExtPub()
+	if err != nil {
+		return nil, err
+	}
+	//旧版本直接从主私钥非强化派生
+	mxpub, err := dk.ExtPub()
+	if err != nil {
+		return nil, err
+	}
+	err = u.checkRestoreKey(xpub, replace, opass)
+	if err != nil {
+		return nil, err
+	}
+	res := &RestoreResult{}
+	accs := map[xginx.Address]bool{}
+	gap := uint32(0)
+	for idx := uint32(0); idx < u.Idx || gap < RestoreGap; idx++ {
+		hpri, err := NewPrivate(u.ID, idx, dk, "恢复", kpass...)
+		if err != nil {
+			return nil, err
+		}
+		hused, hexists, err := u.restorePrivate(db, bi, hpri, accs, res)
+		if err != nil {
+			return nil, err
+		}
+		ppri, err := NewPublicPrivate(u.ID, "", nil, xpub, idx, cipher, "恢复")
+		if err != nil {
+			return nil, err
+		}
+		pused, pexists, err := u.restorePrivate(db, bi, ppri, accs, res)
+		if err != nil {
+			return nil, err
+		}
+		lpri, err := NewPublicPrivate(u.ID, "", nil, mxpub, idx, cipher, "恢复")
+		if err != nil {
+			return nil, err
+		}
+		lused, lexists, err := u.restorePrivate(db, bi, lpri, accs, res)
+		if err != nil {
+			return nil, err
+		}
+		//Idx之前的索引都已经派生过,无法确定方式时按强化派生恢复
+		if idx < u.Idx && !pused && !lused {
+			hused = true
+		}
+		if !hused && !pused && !lused {
+			gap++
+			continue
+		}
+		gap = 0
+		res.Idx = idx + 1
+		for _, v := range []struct {
+			pri    *TPrivate
+			used   bool
+			exists bool
+		}{{hpri, hused, hexists}, {ppri, pused, pexists}, {lpri, lused, lexists}} {
+			if !v.used || v.exists {
+				continue
+			}
+			err = db.InsertPrivate(v.pri)
+			if err != nil {
+				return nil, err
+			}
+			res.Privates = append(res.Privates, v.pri.ID)
+		}
+	}
+	err = db.SetUserKeys(u.ID, keys, xpub.Dump(), cipher, res.Idx)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreDeterKey(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000005", "xh0714", "kpass")
+	as.NoError(err)
+	dk, err := user.GetDeterKey("kpass")
+	as.NoError(err)
+	words, err := dk.Mnemonic()
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		ids := []string{}
+		for i := 0; i < 3; i++ {
+			pri, err := user.NewPrivate(db, "test", "kpass")
+			if err != nil {
+				return err
+			}
+			ids = append(ids, pri.ID)
+		}
+		//助记词和现有主私钥不同时不能覆盖
+		other, err := NewDeterKey().Mnemonic()
+		if err != nil {
+			return err
+		}
+		_, err = user.RestoreDeterKey(db, nil, other, false, "")
+		as.Equal(ErrRestoreMismatch, err)
+		_, err = user.RestoreDeterKey(db, nil, other, true, "badpass")
+		as.Error(err)
+		//模拟丢失主私钥和部分私钥
+		err = db.DeletePrivate(ids[2])
+		if err != nil {
+			return err
+		}
+		err = db.SetUserKeys(user.ID, "", "", CipherTypeNone, 0)
+		if err != nil {
+			return err
+		}
+		user, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		res, err := user.RestoreDeterKey(db, nil, words, false, "", "newpass")
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(2), res.Idx)
+		as.Len(res.Privates, 0)
+		user, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(2), user.Idx)
+		rdk, err := user.GetDeterKey("newpass")
+		if err != nil {
+			return err
+		}
+		as.Equal(dk.Body, rdk.Body)
+		//已知派生索引之前的私钥全部恢复
+		user.Idx = 3
+		res, err = user.RestoreDeterKey(db, nil, words, false, "", "newpass")
+		if err != nil {
+			return err
+		}
+		as.Equal(uint32(3), res.Idx)
+		as.Equal([]string{ids[2]}, res.Privates)
+		for _, id := range ids {
+			err = db.DeletePrivate(id)
+			if err != nil {
+				return err
+			}
+		}
+		return db.DeleteUser(user.ID)
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,508 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//分页设置
+var (
+	//默认每页数量
+	PageLimit = 50
+	//最大每页数量
+	PageMaxLimit = 500
+)
+
+//排序字段
+const (
+	PageSortID     = "id"     //按id排序
+	PageSortTime   = "time"   //按创建时间排序
+	PageSortValue  = "value"  //按金额排序
+	PageSortHeight = "height" //按区块高度排序
+)
+
+//Page 游标分页参数
+type Page struct {
+	Limit  int    //每页数量,为0使用默认数量
+	Cursor string //上一页返回的游标,为空从第一条开始
+	Sort   string //排序字段,为空使用默认字段
+	Desc   bool   //是否降序
+}
+
+//Check 检查分页参数,sorts是允许的排序字段,第一个是默认字段
+func (p *Page) Check(sorts ...string) error {
+	if p.Limit <= 0 {
+		p.Limit = PageLimit
+	}
+	if p.Limit > PageMaxLimit {
+		p.Limit = PageMaxLimit
+	}
+	if p.Sort == "" && len(sorts) > 0 {
+		p.Sort = sorts[0]
+	}
+	has := false
+	for _, v := range sorts {
+		if v == p.Sort {
+			has = true
+			break
+		}
+	}
+	if !has {
+		return fmt.Errorf("sort %s not support", p.Sort)
+	}
+	_, err := ParsePageCursor(p.Cursor)
+	return err
+}
+
+//PageCursor 分页游标,上一页最后一条记录的排序值和id
+type PageCursor struct {
+	Value int64  //排序字段值
+	ID    string //记录id
+}
+
+//NewPageCursor 创建游标字符串
+func NewPageCursor(v int64, id string) string {
+	s := strconv.FormatInt(v, 10) + ":" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+//ParsePageCursor 解析游标字符串,为空返回nil
+func ParsePageCursor(s string) (*PageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("page cursor error")
+	}
+	vs := strings.SplitN(string(bs), ":", 2)
+	if len(vs) != 2 {
+		return nil, errors.New("page cursor error")
+	}
+	v, err := strconv.ParseInt(vs[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("page cursor error")
+	}
+	return &PageCursor{Value: v, ID: vs[1]}, nil
+}
+
+//记录1是否排在记录2之前
+func (p Page) less(v1 int64, id1 string, v2 int64, id2 string) bool {
+	if v1 != v2 {
+		return (v1 < v2) != p.Desc
+	}
+	if id1 == id2 {
+		return false
+	}
+	return (id1 < id2) != p.Desc
+}
+
+//PageSlice 对n条记录分页,key返回第i条记录的排序值和id
+//返回当前页记录的索引和下一页游标,没有下一页时游标为空
+func PageSlice(p Page, n int, key func(i int) (int64, string)) ([]int, string, error) {
+	cur, err := ParsePageCursor(p.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	idxs := []int{}
+	for i := 0; i < n; i++ {
+		v, id := key(i)
+		//只保留游标之后的记录
+		if cur != nil && !p.less(cur.Value, cur.ID, v, id) {
+			continue
+		}
+		idxs = append(idxs, i)
+	}
+	sort.SliceStable(idxs, func(i, j int) bool {
+		v1, id1 := key(idxs[i])
+		v2, id2 := key(idxs[j])
+		return p.less(v1, id1, v2, id2)
+	})
+	if p.Limit <= 0 || len(idxs) <= p.Limit {
+		return idxs, "", nil
+	}
+	idxs = idxs[:p.Limit]
+	return idxs, NewPageCursor(key(idxs[len(idxs)-1])), nil
+}
+
+//PageIndex 对已经排好顺序的n条记录按位置分页,不需要在内存中排序
+//游标记录上一页最后一条记录的位置,id返回第i条记录的id
+func PageIndex(p Page, n int, id func(i int) string) ([]int, string, error) {
+	cur, err := ParsePageCursor(p.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	i, step := 0, 1
+	if p.Desc {
+		i, step = n-1, -1
+	}
+	if cur != nil {
+		i = int(cur.Value) + step
+	}
+	idxs := []int{}
+	for ; i >= 0 && i < n && (p.Limit <= 0 || len(idxs) < p.Limit); i += step {
+		idxs = append(idxs, i)
+	}
+	if len(idxs) == 0 || i < 0 || i >= n {
+		return idxs, "", nil
+	}
+	last := idxs[len(idxs)-1]
+	return idxs, NewPageCursor(int64(last), id(last)), nil
+}
+
+//创建mongo分页查询,field是排序字段对应的数据库字段,按id排序时为空
+//cid转换游标中的记录id为数据库中的_id,为空直接使用游标中的字符串
+//查询多获取一条记录用来判断是否有下一页
+func (p Page) find(filter bson.M, field string, cid func(id string) (interface{}, error)) (bson.M, *options.FindOptions, error) {
+	cur, err := ParsePageCursor(p.Cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+	var id interface{}
+	if cur != nil {
+		id = cur.ID
+	}
+	if cur != nil && cid != nil {
+		id, err = cid(cur.ID)
+		if err != nil {
+			return nil, nil, errors.New("page cursor error")
+		}
+	}
+	dir, op := 1, "$gt"
+	if p.Desc {
+		dir, op = -1, "$lt"
+	}
+	sorts := bson.D{}
+	if field != "" {
+		sorts = append(sorts, bson.E{Key: field, Value: dir})
+	}
+	sorts = append(sorts, bson.E{Key: "_id", Value: dir})
+	if cur != nil && field == "" {
+		filter["_id"] = bson.M{op: id}
+	} else if cur != nil {
+		filter["$or"] = bson.A{
+			bson.M{field: bson.M{op: cur.Value}},
+			bson.M{field: cur.Value, "_id": bson.M{op: id}},
+		}
+	}
+	opts := options.Find().SetSort(sorts).SetLimit(int64(p.Limit) + 1)
+	return filter, opts, nil
+}
+
+//根据多获取的一条记录判断是否有下一页,返回当前页数量和下一页游标
+func (p Page) next(n int, key func(i int) (int64, string)) (int, string) {
+	if p.Limit <= 0 || n <= p.Limit {
+		return n, ""
+	}
+	return p.Limit, NewPageCursor(key(p.Limit - 1))
+}
+
+//ListFilter 列表过滤条件,为空不限制
+type ListFilter struct {
+	CoinFilter            //只返回这些账号或者包含任意一个标签的账号
+	States     []TTxState //交易状态
+	Start      int64      //开始时间,包含
+	End        int64      //结束时间,不包含
+	MaxHeight  uint32     //区块高度不大于,为0不限制,用来获取达到确认数的记录
+}
+
+//MatchHeight 区块高度是否在范围内
+func (f ListFilter) MatchHeight(h uint32) bool {
+	return f.MaxHeight == 0 || h <= f.MaxHeight
+}
+
+//MatchTime 时间是否在范围内
+func (f ListFilter) MatchTime(t int64) bool {
+	if f.Start > 0 && t < f.Start {
+		return false
+	}
+	if f.End > 0 && t >= f.End {
+		return false
+	}
+	return true
+}
+
+//MatchState 交易状态是否匹配
+func (f ListFilter) MatchState(state TTxState) bool {
+	if len(f.States) == 0 {
+		return true
+	}
+	for _, v := range f.States {
+		if v == state {
+			return true
+		}
+	}
+	return false
+}
+
+//添加时间范围查询条件
+func (f ListFilter) timeFilter(filter bson.M, field string) bson.M {
+	tf := bson.M{}
+	if f.Start > 0 {
+		tf["$gte"] = f.Start
+	}
+	if f.End > 0 {
+		tf["$lt"] = f.End
+	}
+	if len(tf) > 0 {
+		filter[field] = tf
+	}
+	return filter
+}
+
+//PageKey 账号分页排序值
+func (acc *TAccount) PageKey(sort string) (int64, string) {
+	if sort == PageSortTime {
+		return acc.Time, string(acc.ID)
+	}
+	return 0, string(acc.ID)
+}
+
+//PageKey 私钥分页排序值
+func (p *TPrivate) PageKey(sort string) (int64, string) {
+	if sort == PageSortTime {
+		return p.Time, p.ID
+	}
+	return 0, p.ID
+}
+
+//PageKey 交易分页排序值
+func (stx *TTx) PageKey(sort string) (int64, string) {
+	id := fmt.Sprintf("%x", stx.ID)
+	if sort == PageSortTime {
+		return stx.Time, id
+	}
+	return 0, id
+}
+
+//排序字段对应的数据库字段
+func pageField(sort string) string {
+	switch sort {
+	case PageSortTime:
+		return "time"
+	case PageSortHeight:
+		return "height"
+	case PageSortValue:
+		return "value"
+	}
+	return ""
+}
+
+//分页获取用户相关的账号
+func (ctx *dbimp) PageAccounts(uid primitive.ObjectID, f ListFilter, p Page) ([]*TAccount, string, error) {
+	filter := bson.M{"uid": uid}
+	if len(f.Accs) > 0 {
+		filter["_id"] = bson.M{"$in": f.Accs}
+	}
+	if len(f.Tags) > 0 {
+		filter["tags"] = bson.M{"$in": f.Tags}
+	}
+	filter = f.timeFilter(filter, "time")
+	//游标条件和账号条件同时存在时使用$and
+	if v, has := filter["_id"]; has {
+		delete(filter, "_id")
+		filter = bson.M{"$and": bson.A{bson.M{"_id": v}, filter}}
+	}
+	query, opts, err := p.find(filter, pageField(p.Sort), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	col := ctx.table(TAccountName)
+	iter, err := col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close(ctx)
+	rets := []*TAccount{}
+	for iter.Next(ctx) {
+		v := &TAccount{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, "", err
+		}
+		rets = append(rets, v)
+	}
+	n, next := p.next(len(rets), func(i int) (int64, string) {
+		return rets[i].PageKey(p.Sort)
+	})
+	return rets[:n], next, nil
+}
+
+//分页获取用户的私钥
+func (ctx *dbimp) PagePrivates(uid primitive.ObjectID, f ListFilter, p Page) ([]*TPrivate, string, error) {
+	filter := f.timeFilter(bson.M{"uid": uid}, "time")
+	query, opts, err := p.find(filter, pageField(p.Sort), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	col := ctx.table(TPrivatesName)
+	iter, err := col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close(ctx)
+	rets := []*TPrivate{}
+	for iter.Next(ctx) {
+		v := &TPrivate{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, "", err
+		}
+		rets = append(rets, v)
+	}
+	n, next := p.next(len(rets), func(i int) (int64, string) {
+		return rets[i].PageKey(p.Sort)
+	})
+	return rets[:n], next, nil
+}
+
+//分页获取用户需要处理的交易,从签名记录关联交易,过滤条件,游标和排序都在数据库中执行
+//未签名的只返回新交易,验证成功的交易已经更新为已签名
+func (ctx *dbimp) PageUserTxs(uid primitive.ObjectID, sign bool, f ListFilter, p Page) ([]*TTx, string, error) {
+	now := time.Now().Unix()
+	conds := bson.A{
+		//已经取消或者过期的交易不返回
+		bson.M{"state": bson.M{"$ne": TTxStateCancel}},
+		bson.M{"$nor": bson.A{bson.M{
+			"state":  bson.M{"$in": bson.A{TTxStateNew, TTxStateSign}},
+			"expire": bson.M{"$gt": 0, "$lt": now},
+		}}},
+	}
+	if !sign {
+		conds = append(conds, bson.M{"state": TTxStateNew})
+	}
+	if len(f.States) > 0 {
+		conds = append(conds, bson.M{"state": bson.M{"$in": f.States}})
+	}
+	if tf := f.timeFilter(bson.M{}, "time"); len(tf) > 0 {
+		conds = append(conds, tf)
+	}
+	query, opts, err := p.find(bson.M{"$and": conds}, pageField(p.Sort), func(id string) (interface{}, error) {
+		return hex.DecodeString(id)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	pipe := bson.A{
+		bson.M{"$match": bson.M{"uid": uid, "sigb": sign}},
+		bson.M{"$group": bson.M{"_id": "$tid"}},
+		bson.M{"$lookup": bson.M{"from": TTxName, "localField": "_id", "foreignField": "_id", "as": "tx"}},
+		bson.M{"$unwind": "$tx"},
+		bson.M{"$replaceRoot": bson.M{"newRoot": "$tx"}},
+		bson.M{"$match": query},
+		bson.M{"$sort": opts.Sort},
+		bson.M{"$limit": *opts.Limit},
+	}
+	col := ctx.table(TSigName)
+	iter, err := col.Aggregate(ctx, pipe)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close(ctx)
+	rets := []*TTx{}
+	for iter.Next(ctx) {
+		v := &TTx{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, "", err
+		}
+		rets = append(rets, v)
+	}
+	n, next := p.next(len(rets), func(i int) (int64, string) {
+		return rets[i].PageKey(p.Sort)
+	})
+	return rets[:n], next, nil
+}
+
+//过滤交易并分页
+func pageTxs(txs []*TTx, f ListFilter, p Page) ([]*TTx, string, error) {
+	vs := []*TTx{}
+	for _, tx := range txs {
+		if f.MatchState(tx.State) && f.MatchTime(tx.Time) {
+			vs = append(vs, tx)
+		}
+	}
+	idxs, next, err := PageSlice(p, len(vs), func(i int) (int64, string) {
+		return vs[i].PageKey(p.Sort)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rets := []*TTx{}
+	for _, i := range idxs {
+		rets = append(rets, vs[i])
+	}
+	return rets, next, nil
+}
+
+func (db *memimp) PageAccounts(uid primitive.ObjectID, f ListFilter, p Page) ([]*TAccount, string, error) {
+	accs, err := db.ListAccounts(uid)
+	if err != nil {
+		return nil, "", err
+	}
+	vs := []*TAccount{}
+	for _, acc := range accs {
+		if f.Match(acc) && f.MatchTime(acc.Time) {
+			vs = append(vs, acc)
+		}
+	}
+	idxs, next, err := PageSlice(p, len(vs), func(i int) (int64, string) {
+		return vs[i].PageKey(p.Sort)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rets := []*TAccount{}
+	for _, i := range idxs {
+		rets = append(rets, vs[i])
+	}
+	return rets, next, nil
+}
+
+func (db *memimp) PagePrivates(uid primitive.ObjectID, f ListFilter, p Page) ([]*TPrivate, string, error) {
+	pris, err := db.ListPrivates(uid)
+	if err != nil {
+		return nil, "", err
+	}
+	vs := []*TPrivate{}
+	for _, pri := range pris {
+		if f.MatchTime(pri.Time) {
+			vs = append(vs, pri)
+		}
+	}
+	idxs, next, err := PageSlice(p, len(vs), func(i int) (int64, string) {
+		return vs[i].PageKey(p.Sort)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rets := []*TPrivate{}
+	for _, i := range idxs {
+		rets = append(rets, vs[i])
+	}
+	return rets, next, nil
+}
+
+func (db *memimp) PageUserTxs(uid primitive.ObjectID, sign bool, f ListFilter, p Page) ([]*TTx, string, error) {
+	txs, err := db.ListUserTxs(uid, sign)
+	if err != nil {
+		return nil, "", err
+	}
+	vs := []*TTx{}
+	for _, tx := range txs {
+		if sign || tx.State == TTxStateNew {
+			vs = append(vs, tx)
+		}
+	}
+	return pageTxs(vs, f, p)
+}
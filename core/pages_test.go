@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPageSlice(t *testing.T) {
+	as := assert.New(t)
+	p := Page{Sort: "miss"}
+	as.Error(p.Check(PageSortTime, PageSortID))
+	p = Page{Limit: PageMaxLimit + 1, Cursor: "!"}
+	as.Error(p.Check(PageSortTime))
+	p = Page{Limit: PageMaxLimit + 1}
+	as.NoError(p.Check(PageSortTime))
+	as.Equal(PageMaxLimit, p.Limit)
+	as.Equal(PageSortTime, p.Sort)
+	cur, err := ParsePageCursor(NewPageCursor(-10, "a:b"))
+	as.NoError(err)
+	as.Equal(int64(-10), cur.Value)
+	as.Equal("a:b", cur.ID)
+	//相同排序值的记录按id排序
+	vals := []int64{3, 1, 2, 1, 5}
+	ids := []string{"a", "b", "c", "d", "e"}
+	key := func(i int) (int64, string) {
+		return vals[i], ids[i]
+	}
+	pages := func(p Page) [][]int {
+		rets := [][]int{}
+		for {
+			idxs, next, err := PageSlice(p, len(vals), key)
+			as.NoError(err)
+			rets = append(rets, idxs)
+			if next == "" {
+				return rets
+			}
+			p.Cursor = next
+		}
+	}
+	as.Equal([][]int{{1, 3}, {2, 0}, {4}}, pages(Page{Limit: 2}))
+	as.Equal([][]int{{4, 0}, {2, 3}, {1}}, pages(Page{Limit: 2, Desc: true}))
+	as.Equal([][]int{{1, 3, 2, 0, 4}}, pages(Page{}))
+	//已经排序的记录按位置分页
+	index := func(p Page) [][]int {
+		rets := [][]int{}
+		for {
+			idxs, next, err := PageIndex(p, len(ids), func(i int) string {
+				return ids[i]
+			})
+			as.NoError(err)
+			rets = append(rets, idxs)
+			if next == "" {
+				return rets
+			}
+			p.Cursor = next
+		}
+	}
+	as.Equal([][]int{{0, 1}, {2, 3}, {4}}, index(Page{Limit: 2}))
+	as.Equal([][]int{{4, 3}, {2, 1}, {0}}, index(Page{Limit: 2, Desc: true}))
+	as.Equal([][]int{{0, 1, 2, 3, 4}}, index(Page{}))
+	as.Equal([][]int{{0, 1, 2, 3}, {4}}, index(Page{Limit: 4}))
+}
+
+func TestPageAccounts(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	err := app.UseDb(func(db IDbImp) error {
+		for i := 0; i < 5; i++ {
+			acc := &TAccount{
+				ID:     xginx.Address(fmt.Sprintf("page_test_%d", i)),
+				UserID: []primitive.ObjectID{uid},
+				Time:   int64(100 - i),
+			}
+			if i%2 == 0 {
+				acc.Tags = []string{"even"}
+			}
+			err := db.InsertAccount(acc)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteAccount(acc.ID, uid)
+		}
+		p := Page{Limit: 2}
+		as.NoError(p.Check(PageSortTime))
+		accs, next, err := db.PageAccounts(uid, ListFilter{}, p)
+		as.NoError(err)
+		as.Len(accs, 2)
+		as.Equal(xginx.Address("page_test_4"), accs[0].ID)
+		as.Equal(xginx.Address("page_test_3"), accs[1].ID)
+		as.NotEqual("", next)
+		p.Cursor = next
+		accs, _, err = db.PageAccounts(uid, ListFilter{}, p)
+		as.NoError(err)
+		as.Equal(xginx.Address("page_test_2"), accs[0].ID)
+		//标签和时间过滤
+		f := ListFilter{CoinFilter: CoinFilter{Tags: []string{"even"}}, Start: 97}
+		accs, next, err = db.PageAccounts(uid, f, Page{Sort: PageSortID, Desc: true})
+		as.NoError(err)
+		as.Equal("", next)
+		as.Len(accs, 2)
+		as.Equal(xginx.Address("page_test_2"), accs[0].ID)
+		as.Equal(xginx.Address("page_test_0"), accs[1].ID)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,151 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//PartialCoin 输入引用的金额
+type PartialCoin struct {
+	Idx    int           //输入索引
+	Addr   xginx.Address //金额所属地址
+	Value  xginx.Amount  //金额
+	Script xginx.Script  //锁定脚本
+}
+
+//PartialSig 等待签名的记录和对应的公钥
+type PartialSig struct {
+	*TSigs
+	Pks xginx.PKBytes //签名使用的公钥
+}
+
+//PartialTx 部分签名交易,离线签名使用
+//包含交易,输入引用的金额和所有未完成的签名记录
+type PartialTx struct {
+	Tx    *TTx
+	Coins []*PartialCoin
+	Sigs  []*PartialSig
+}
+
+//获取私钥id对应的公钥,只读账号没有私钥记录,从账号中获取
+func getKidPks(db IDbImp, kid string) (xginx.PKBytes, error) {
+	accs, err := db.ListAccountsWithKid(kid)
+	if err != nil {
+		return xginx.PKBytes{}, err
+	}
+	for _, acc := range accs {
+		for i, v := range acc.Kid {
+			if v == kid && i < len(acc.Pks) {
+				return acc.Pks[i], nil
+			}
+		}
+	}
+	return xginx.PKBytes{}, fmt.Errorf("kid %s pks miss", kid)
+}
+
+//获取输入引用的输出,未确认的从交易池获取
+func loadTxInOut(bi *xginx.BlockIndex, in TTxIn) (*xginx.TxOut, error) {
+	id := xginx.NewHASH256(in.OutHash)
+	tx, err := bi.LoadTX(id)
+	if err != nil {
+		tx, err = bi.GetTxPool().Get(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int(in.OutIndex) >= len(tx.Outs) {
+		return nil, fmt.Errorf("tx %s out index %d out bound", id, in.OutIndex)
+	}
+	return tx.Outs[in.OutIndex], nil
+}
+
+//NewPartial 创建部分签名交易
+func (stx *TTx) NewPartial(db IDbImp, bi *xginx.BlockIndex) (*PartialTx, error) {
+	ptx := &PartialTx{
+		Tx:    stx,
+		Coins: []*PartialCoin{},
+		Sigs:  []*PartialSig{},
+	}
+	for idx, in := range stx.Ins {
+		out, err := loadTxInOut(bi, in)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			return nil, err
+		}
+		ptx.Coins = append(ptx.Coins, &PartialCoin{
+			Idx:    idx,
+			Addr:   addr,
+			Value:  out.Value,
+			Script: out.Script.Clone(),
+		})
+	}
+	sigs, err := db.ListSigs(xginx.NewHASH256(stx.ID))
+	if err != nil {
+		return nil, err
+	}
+	for _, sig := range sigs {
+		pks, err := getKidPks(db, sig.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		ptx.Sigs = append(ptx.Sigs, &PartialSig{TSigs: sig, Pks: pks})
+	}
+	return ptx, nil
+}
+
+//SetExternalSig 导入外部签名,使用公钥验证签名后保存
+//只能导入属于uid的签名记录,和签名一样需要检查输入账号的策略
+func (stx *TTx) SetExternalSig(db IDbImp, bi *xginx.BlockIndex, uid primitive.ObjectID, id primitive.ObjectID, sb []byte) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	if stx.State != TTxStateNew {
+		return errors.New("new tx can sign")
+	}
+	if stx.IsExpired(time.Now()) {
+		return errors.New("tx expired")
+	}
+	sigs, err := db.ListSigs(xginx.NewHASH256(stx.ID))
+	if err != nil {
+		return err
+	}
+	var sig *TSigs = nil
+	for _, v := range sigs {
+		if ObjectIDEqual(v.ID, id) {
+			sig = v
+			break
+		}
+	}
+	if sig == nil {
+		return fmt.Errorf("sigs %s miss or signed", id.Hex())
+	}
+	if !ObjectIDEqual(sig.UserID, uid) {
+		return errors.New("no access")
+	}
+	if _, err := stx.CheckPolicy(db, bi, time.Now(), true); err != nil {
+		return err
+	}
+	pks, err := getKidPks(db, sig.KeyID)
+	if err != nil {
+		return err
+	}
+	pub, err := xginx.NewPublicKey(pks.Bytes())
+	if err != nil {
+		return err
+	}
+	sv, err := xginx.NewSigValue(sb)
+	if err != nil {
+		return err
+	}
+	if !pub.Verify(sig.Hash, sv) {
+		return fmt.Errorf("sigs %s verify error", id.Hex())
+	}
+	return db.SetSigs(sig.ID, sv.GetSigs())
+}
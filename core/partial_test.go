@@ -0,0 +1,113 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSetExternalSig(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	pks := xginx.PKBytes{2, 1, 2, 3}
+	kid := GetPrivateID(pks.Hash())
+	acc := &TAccount{
+		ID:     xginx.Address("partial_test"),
+		UserID: []primitive.ObjectID{uid},
+		Num:    1,
+		Less:   1,
+		Pks:    []xginx.PKBytes{pks},
+		Kid:    []string{kid},
+		Watch:  true,
+	}
+	stx := &TTx{ID: xginx.Hash256From([]byte("partial_test_tx")).Bytes(), UserID: uid, State: TTxStateNew}
+	sig := NewSigs(xginx.NewHASH256(stx.ID), uid, kid, []byte("hash"), 0)
+	sig.External = true
+	err := app.UseTx(func(db IDbImp) error {
+		err := db.InsertAccount(acc)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteAccount(acc.ID, uid)
+		err = db.InsertTx(stx)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteTx(stx.ID)
+		err = db.InsertSigs(sig)
+		if err != nil {
+			return err
+		}
+		//只读账号的公钥从账号中获取
+		v, err := getKidPks(db, kid)
+		if err != nil {
+			return err
+		}
+		as.Equal(pks, v)
+		_, err = getKidPks(db, "miss")
+		as.Error(err)
+		//不存在的签名记录
+		as.Error(stx.SetExternalSig(db, nil, uid, primitive.NewObjectID(), nil))
+		//其他用户不能导入签名
+		as.Error(stx.SetExternalSig(db, nil, primitive.NewObjectID(), sig.ID, nil))
+		//非新交易不能签名
+		stx.State = TTxStateSign
+		as.Error(stx.SetExternalSig(db, nil, uid, sig.ID, nil))
+		return nil
+	})
+	as.NoError(err)
+}
+
+//使用私钥离线签名后导入
+func (st *TxsTestSuite) TestExternalSigSigned() {
+	st.Require().NotNil(st.acc, "default account miss")
+	bi := xginx.NewTestBlockIndex(100, st.acc.GetAddress())
+	defer xginx.CloseTestBlock(bi)
+	accs := xginx.GetTestAccount(bi)
+	st.Require().NotNil(accs, "get test accounts error")
+	dst, err := accs[1].GetAddress()
+	st.Require().NoError(err)
+	lis := NewSignListener(st.db, st.user)
+	mi := bi.NewTrans(lis)
+	mi.Add(dst, 1*xginx.Coin, xginx.DefaultLockedScript)
+	mi.Fee = 1 * xginx.Coin
+	tx, err := mi.NewTx(0, xginx.DefaultTxScript)
+	st.Require().NoError(err)
+	stx, err := st.user.SaveTx(st.db, tx, lis, "离线签名交易")
+	st.Require().NoError(err)
+	defer st.db.DeleteTx(stx.ID)
+	ptx, err := stx.NewPartial(st.db, bi)
+	st.Require().NoError(err)
+	st.Require().Equal(len(stx.Ins), len(ptx.Coins))
+	st.Require().Equal(2, len(ptx.Sigs))
+	//离线使用私钥签名
+	for _, sig := range ptx.Sigs {
+		pri, err := st.db.GetPrivate(sig.KeyID)
+		st.Require().NoError(err)
+		xpri, err := pri.LoadPrivate(st.db)
+		st.Require().NoError(err)
+		st.Require().Equal(xpri.PublicKey().GetPks(), sig.Pks)
+		sv, err := xpri.Sign(sig.Hash)
+		st.Require().NoError(err)
+		//错误的签名不能导入
+		st.Require().Error(stx.SetExternalSig(st.db, bi, st.user.ID, sig.ID, sv.Encode()[1:]))
+		err = stx.SetExternalSig(st.db, bi, st.user.ID, sig.ID, sv.Encode())
+		st.Require().NoError(err)
+	}
+	//签名已经保存
+	sigs, err := st.db.ListSigs(xginx.NewHASH256(stx.ID))
+	st.Require().NoError(err)
+	st.Require().True(sigs.IsSign())
+	//签名验证成功后更新为已经签名
+	signed, err := stx.SetSigned(st.db, bi)
+	st.Require().NoError(err)
+	st.Require().True(signed)
+	v, err := st.db.GetTx(stx.ID)
+	st.Require().NoError(err)
+	st.Require().Equal(TTxState(TTxStateSign), v.State)
+}
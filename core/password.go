@@ -0,0 +1,115 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/cxuhua/xginx"
+	"golang.org/x/crypto/scrypt"
+)
+
+//PassVer 登陆密码hash版本
+type PassVer int
+
+//密码版本定义
+const (
+	//PassVerSha256 旧版本,TUser.Pass 中保存的hash256
+	PassVerSha256 PassVer = 0
+	//PassVerScrypt scrypt加盐hash
+	PassVerScrypt PassVer = 1
+)
+
+//scrypt参数,修改后用户下次登陆时自动升级
+var (
+	PassScryptN   = 1 << 15
+	PassScryptR   = 8
+	PassScryptP   = 1
+	PassKeyLen    = 32
+	PassSaltLen   = 16
+	PassVerLatest = PassVerScrypt
+)
+
+//TPassword 登陆密码hash和计算参数
+type TPassword struct {
+	Ver  PassVer `bson:"ver"`  //版本
+	Salt []byte  `bson:"salt"` //每个用户独立的盐
+	N    int     `bson:"n"`    //scrypt N
+	R    int     `bson:"r"`    //scrypt r
+	P    int     `bson:"p"`    //scrypt p
+	Hash []byte  `bson:"hash"` //hash结果
+}
+
+//NewPassword 使用最新版本和参数生成密码hash
+func NewPassword(pass string) (TPassword, error) {
+	pwd := TPassword{
+		Ver:  PassVerScrypt,
+		Salt: make([]byte, PassSaltLen),
+		N:    PassScryptN,
+		R:    PassScryptR,
+		P:    PassScryptP,
+	}
+	if pass == "" {
+		return pwd, errors.New("pass empty")
+	}
+	_, err := rand.Read(pwd.Salt)
+	if err != nil {
+		return pwd, err
+	}
+	pwd.Hash, err = pwd.hash(pass)
+	return pwd, err
+}
+
+func (pwd TPassword) hash(pass string) ([]byte, error) {
+	if pwd.Ver != PassVerScrypt {
+		return nil, errors.New("pass ver error")
+	}
+	return scrypt.Key([]byte(pass), pwd.Salt, pwd.N, pwd.R, pwd.P, PassKeyLen)
+}
+
+//Check 检测密码是否正确
+func (pwd TPassword) Check(pass string) bool {
+	if len(pass) == 0 || len(pwd.Hash) == 0 {
+		return false
+	}
+	hv, err := pwd.hash(pass)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hv, pwd.Hash) == 1
+}
+
+//IsLatest 是否是最新版本和参数
+func (pwd TPassword) IsLatest() bool {
+	return pwd.Ver == PassVerLatest &&
+		pwd.N == PassScryptN &&
+		pwd.R == PassScryptR &&
+		pwd.P == PassScryptP &&
+		len(pwd.Hash) == PassKeyLen
+}
+
+//CheckPass 检测登陆密码
+//兼容旧版本保存在Pass中的hash256密码
+func (u *TUser) CheckPass(pass string) bool {
+	if u.Pwd.Ver != PassVerSha256 {
+		return u.Pwd.Check(pass)
+	}
+	hv := xginx.Hash256From([]byte(pass))
+	return len(pass) > 0 && subtle.ConstantTimeCompare(hv[:], u.Pass[:]) == 1
+}
+
+//NeedUpgradePass 登陆密码是否需要升级到最新版本
+func (u *TUser) NeedUpgradePass() bool {
+	return !u.Pwd.IsLatest()
+}
+
+//SetPass 设置登陆密码,同时清除旧版本密码
+func (u *TUser) SetPass(pass string) error {
+	pwd, err := NewPassword(pass)
+	if err != nil {
+		return err
+	}
+	u.Pwd = pwd
+	u.Pass = xginx.HASH256{}
+	return nil
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassword(t *testing.T) {
+	as := assert.New(t)
+	p1, err := NewPassword("xh0714")
+	as.NoError(err)
+	p2, err := NewPassword("xh0714")
+	as.NoError(err)
+	//每次生成的盐不同
+	as.NotEqual(p1.Salt, p2.Salt)
+	as.NotEqual(p1.Hash, p2.Hash)
+	as.True(p1.Check("xh0714"))
+	as.False(p1.Check("xh0715"))
+	as.False(p1.Check(""))
+	as.True(p1.IsLatest())
+	_, err = NewPassword("")
+	as.Error(err)
+}
+
+func TestUpgradePassword(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000002", "xh0714")
+	as.NoError(err)
+	as.False(user.NeedUpgradePass())
+	//模拟旧版本用户
+	user.Pwd = TPassword{}
+	user.Pass = xginx.Hash256From([]byte("xh0714"))
+	as.True(user.NeedUpgradePass())
+	as.True(user.CheckPass("xh0714"))
+	as.False(user.CheckPass("xh0715"))
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		pwd, err := NewPassword("xh0714")
+		if err != nil {
+			return err
+		}
+		err = db.SetUserPass(user.ID, pwd)
+		if err != nil {
+			return err
+		}
+		v, err := db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.False(v.NeedUpgradePass())
+		as.True(v.CheckPass("xh0714"))
+		as.Equal(xginx.HASH256{}, v.Pass, "legacy pass not clear")
+		//强制重置
+		err = db.ForceResetPass(user.ID)
+		if err != nil {
+			return err
+		}
+		v, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.True(v.Reset)
+		return db.DeleteUser(user.ID)
+	})
+	as.NoError(err)
+}
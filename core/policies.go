@@ -0,0 +1,611 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//策略相关表
+const (
+	TSpendName        = "spends"
+	TPolicyChangeName = "policy_changes"
+)
+
+//策略设置
+var (
+	//时间窗口使用的时区
+	PolicyLocation = time.Local
+)
+
+//TPolicyWindow 允许签名的时间窗口
+type TPolicyWindow struct {
+	Days  []int `bson:"days"`  //允许的星期,0是星期日,为空不限制
+	Start int   `bson:"start"` //开始时间,一天中的分钟数
+	End   int   `bson:"end"`   //结束时间,一天中的分钟数,和开始时间相同时不限制
+}
+
+//IsEmpty 是否没有限制
+func (w TPolicyWindow) IsEmpty() bool {
+	return len(w.Days) == 0 && w.Start == w.End
+}
+
+//Match 时间是否在窗口内,结束时间小于开始时间时跨越零点
+func (w TPolicyWindow) Match(now time.Time) bool {
+	now = now.In(PolicyLocation)
+	if len(w.Days) > 0 {
+		has := false
+		for _, d := range w.Days {
+			if d == int(now.Weekday()) {
+				has = true
+				break
+			}
+		}
+		if !has {
+			return false
+		}
+	}
+	if w.Start == w.End {
+		return true
+	}
+	min := now.Hour()*60 + now.Minute()
+	if w.Start < w.End {
+		return min >= w.Start && min < w.End
+	}
+	return min >= w.Start || min < w.End
+}
+
+//TPolicy 账号链下审批策略
+type TPolicy struct {
+	TxLimit   xginx.Amount    `bson:"txl"`    //单笔交易限额,0不限制
+	DayLimit  xginx.Amount    `bson:"dayl"`   //每日限额,0不限制
+	Whitelist []xginx.Address `bson:"wl"`     //目标地址白名单,为空不限制
+	Window    TPolicyWindow   `bson:"window"` //允许签名的时间窗口
+}
+
+//IsEmpty 是否没有设置策略
+func (p TPolicy) IsEmpty() bool {
+	return p.TxLimit == 0 && p.DayLimit == 0 && len(p.Whitelist) == 0 && p.Window.IsEmpty()
+}
+
+//Check 检查策略参数
+func (p TPolicy) Check() error {
+	if p.TxLimit < 0 || p.DayLimit < 0 {
+		return errors.New("policy limit error")
+	}
+	if p.Window.Start < 0 || p.Window.Start >= 24*60 || p.Window.End < 0 || p.Window.End >= 24*60 {
+		return errors.New("policy window time error")
+	}
+	for _, d := range p.Window.Days {
+		if d < 0 || d > 6 {
+			return errors.New("policy window day error")
+		}
+	}
+	for _, addr := range p.Whitelist {
+		if err := addr.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//策略规则名称
+const (
+	PolicyRuleTxLimit   = "tx_limit"
+	PolicyRuleDayLimit  = "day_limit"
+	PolicyRuleWhitelist = "whitelist"
+	PolicyRuleWindow    = "window"
+)
+
+//Violation 违反的策略规则
+type Violation struct {
+	Account xginx.Address //违反策略的账号
+	Rule    string        //PolicyRule*
+	Message string        //详细信息
+}
+
+//PolicyError 违反策略返回的错误
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (e *PolicyError) Error() string {
+	ss := []string{}
+	for _, v := range e.Violations {
+		ss = append(ss, fmt.Sprintf("%s %s: %s", v.Account, v.Rule, v.Message))
+	}
+	return "policy violation: " + strings.Join(ss, "; ")
+}
+
+//Evaluate 检查账号支出是否违反策略
+//spend本次支出,used当日其他交易已经支出,dsts目标地址,sign是否是签名时检查
+func (p TPolicy) Evaluate(acc xginx.Address, spend xginx.Amount, used xginx.Amount, dsts []xginx.Address, now time.Time, sign bool) []Violation {
+	vs := []Violation{}
+	if p.TxLimit > 0 && spend > p.TxLimit {
+		vs = append(vs, Violation{
+			Account: acc,
+			Rule:    PolicyRuleTxLimit,
+			Message: fmt.Sprintf("spend %d > tx limit %d", spend, p.TxLimit),
+		})
+	}
+	if p.DayLimit > 0 && used+spend > p.DayLimit {
+		vs = append(vs, Violation{
+			Account: acc,
+			Rule:    PolicyRuleDayLimit,
+			Message: fmt.Sprintf("day spend %d > day limit %d", used+spend, p.DayLimit),
+		})
+	}
+	if len(p.Whitelist) > 0 {
+		for _, dst := range dsts {
+			has := false
+			for _, addr := range p.Whitelist {
+				if addr == dst {
+					has = true
+					break
+				}
+			}
+			if !has {
+				vs = append(vs, Violation{
+					Account: acc,
+					Rule:    PolicyRuleWhitelist,
+					Message: fmt.Sprintf("address %s not in whitelist", dst),
+				})
+			}
+		}
+	}
+	if sign && !p.Window.Match(now) {
+		vs = append(vs, Violation{
+			Account: acc,
+			Rule:    PolicyRuleWindow,
+			Message: "sign not allowed at this time",
+		})
+	}
+	return vs
+}
+
+//TSpend 账号在交易中的支出,统计每日支出使用
+type TSpend struct {
+	ID      string        `bson:"_id"`   //txid:account
+	Account xginx.Address `bson:"acc"`   //支出账号
+	TxID    []byte        `bson:"tid"`   //交易id
+	Value   xginx.Amount  `bson:"value"` //支出金额
+	Time    int64         `bson:"time"`  //交易创建时间
+}
+
+//交易输入或者输出的地址和金额
+type spendValue struct {
+	addr  xginx.Address
+	value xginx.Amount
+}
+
+//TxSpends 计算交易中每个账号的支出和目标地址
+func (stx *TTx) TxSpends(db IDbImp, bi *xginx.BlockIndex) ([]*TSpend, []xginx.Address, error) {
+	ins := []spendValue{}
+	for _, in := range stx.Ins {
+		out, err := loadTxInOut(bi, in)
+		if err != nil {
+			return nil, nil, err
+		}
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			return nil, nil, err
+		}
+		ins = append(ins, spendValue{addr: addr, value: out.Value})
+	}
+	outs := []spendValue{}
+	for _, out := range stx.Outs {
+		addr, err := out.Script.GetAddress()
+		if err != nil {
+			return nil, nil, err
+		}
+		outs = append(outs, spendValue{addr: addr, value: xginx.Amount(out.Value)})
+	}
+	return stx.txSpends(db, ins, outs)
+}
+
+//计算每个账号的支出和目标地址,交易费和转出的金额按照输入顺序分配到账号
+//只有找零回到输入账号不作为支出,转到所有者相同的其他账号也是支出,否则可以转到规则更宽松的账号绕过策略
+func (stx *TTx) txSpends(db IDbImp, ins []spendValue, outs []spendValue) ([]*TSpend, []xginx.Address, error) {
+	txid := xginx.NewHASH256(stx.ID)
+	accs := []xginx.Address{}
+	nets := map[xginx.Address]xginx.Amount{}
+	total := xginx.Amount(0)
+	for _, in := range ins {
+		if _, has := nets[in.addr]; !has {
+			accs = append(accs, in.addr)
+		}
+		nets[in.addr] += in.value
+		total += in.value
+	}
+	dsts := []xginx.Address{}
+	for _, out := range outs {
+		//找零回到输入账号
+		if _, has := nets[out.addr]; has {
+			nets[out.addr] -= out.value
+			total -= out.value
+			continue
+		}
+		dsts = append(dsts, out.addr)
+	}
+	rets := []*TSpend{}
+	for _, addr := range accs {
+		value := nets[addr]
+		if value > total {
+			value = total
+		}
+		if value <= 0 {
+			continue
+		}
+		total -= value
+		rets = append(rets, &TSpend{
+			ID:      fmt.Sprintf("%s:%s", txid.String(), addr),
+			Account: addr,
+			TxID:    stx.ID,
+			Value:   value,
+			Time:    stx.Time,
+		})
+	}
+	return rets, dsts, nil
+}
+
+//当天开始时间
+func policyDayStart(now time.Time) int64 {
+	now = now.In(PolicyLocation)
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, PolicyLocation).Unix()
+}
+
+//获取账号当天其他未取消交易的支出
+func dayUsed(db IDbImp, acc xginx.Address, tid []byte, now time.Time) (xginx.Amount, error) {
+	ss, err := db.ListSpends(acc, policyDayStart(now))
+	if err != nil {
+		return 0, err
+	}
+	used := xginx.Amount(0)
+	for _, s := range ss {
+		if string(s.TxID) == string(tid) {
+			continue
+		}
+		stx, err := db.GetTx(s.TxID)
+		if err != nil || stx.IsDead(now) {
+			continue
+		}
+		used += s.Value
+	}
+	return used, nil
+}
+
+//CheckPolicy 检查交易是否违反输入账号的策略,违反时返回*PolicyError
+//sign为true时是签名时检查,同时检查时间窗口
+func (stx *TTx) CheckPolicy(db IDbImp, bi *xginx.BlockIndex, now time.Time, sign bool) ([]*TSpend, error) {
+	spends, dsts, err := stx.TxSpends(db, bi)
+	if err != nil {
+		return nil, err
+	}
+	vs := []Violation{}
+	for _, s := range spends {
+		acc, err := db.GetAccount(s.Account)
+		if err != nil {
+			return nil, err
+		}
+		if acc.Policy.IsEmpty() {
+			continue
+		}
+		used := xginx.Amount(0)
+		if acc.Policy.DayLimit > 0 {
+			//锁定账号支出,并发交易检查同一账号时事务冲突重试,不会同时超过每日限额
+			if !db.IsTx() {
+				return nil, errors.New("use tx")
+			}
+			err = db.LockAccountSpends(acc.ID)
+			if err != nil {
+				return nil, err
+			}
+			used, err = dayUsed(db, acc.ID, stx.ID, now)
+			if err != nil {
+				return nil, err
+			}
+		}
+		vs = append(vs, acc.Policy.Evaluate(acc.ID, s.Value, used, dsts, now, sign)...)
+	}
+	if len(vs) > 0 {
+		return nil, &PolicyError{Violations: vs}
+	}
+	return spends, nil
+}
+
+//TPolicyChangeState 策略修改状态
+type TPolicyChangeState int
+
+//策略修改状态定义
+const (
+	TPolicyChangePending  TPolicyChangeState = 0 //等待其他所有者同意
+	TPolicyChangeApplied  TPolicyChangeState = 1 //已生效
+	TPolicyChangeRejected TPolicyChangeState = 2 //被拒绝
+)
+
+//TPolicyChange 策略修改申请,需要账号其他所有者同意
+type TPolicyChange struct {
+	ID       primitive.ObjectID   `bson:"_id"`   //申请id
+	Account  xginx.Address        `bson:"acc"`   //账号
+	UserID   primitive.ObjectID   `bson:"uid"`   //申请用户
+	Policy   TPolicy              `bson:"pol"`   //新策略
+	Approves []primitive.ObjectID `bson:"apvs"`  //同意的用户
+	Reject   primitive.ObjectID   `bson:"rej"`   //拒绝的用户
+	State    TPolicyChangeState   `bson:"state"` //TPolicyChange*
+	Time     int64                `bson:"time"`  //申请时间
+}
+
+//HasApprove 用户是否已经同意
+func (pc *TPolicyChange) HasApprove(uid primitive.ObjectID) bool {
+	for _, v := range pc.Approves {
+		if ObjectIDEqual(v, uid) {
+			return true
+		}
+	}
+	return false
+}
+
+//所有所有者同意后生效
+func (pc *TPolicyChange) apply(db IDbImp, acc *TAccount) error {
+	for _, uid := range acc.UserID {
+		if !pc.HasApprove(uid) {
+			return nil
+		}
+	}
+	pc.State = TPolicyChangeApplied
+	return db.SetAccountPolicy(acc.ID, pc.Policy)
+}
+
+//ProposePolicy 申请修改账号策略,只有一个所有者时直接生效
+func ProposePolicy(db IDbImp, id xginx.Address, uid primitive.ObjectID, policy TPolicy) (*TPolicyChange, error) {
+	if !db.IsTx() {
+		return nil, errors.New("use tx")
+	}
+	if err := policy.Check(); err != nil {
+		return nil, err
+	}
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.HasUserID(uid) {
+		return nil, errors.New("account not mine")
+	}
+	pcs, err := db.ListPolicyChanges(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range pcs {
+		if v.State == TPolicyChangePending {
+			return nil, errors.New("account has pending policy change")
+		}
+	}
+	pc := &TPolicyChange{
+		ID:       primitive.NewObjectID(),
+		Account:  id,
+		UserID:   uid,
+		Policy:   policy,
+		Approves: []primitive.ObjectID{uid},
+		State:    TPolicyChangePending,
+		Time:     time.Now().Unix(),
+	}
+	err = pc.apply(db, acc)
+	if err != nil {
+		return nil, err
+	}
+	err = db.InsertPolicyChange(pc)
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+//Approve 账号所有者同意或者拒绝策略修改
+func (pc *TPolicyChange) Approve(db IDbImp, uid primitive.ObjectID, ok bool) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	if pc.State != TPolicyChangePending {
+		return errors.New("policy change not pending")
+	}
+	acc, err := db.GetAccount(pc.Account)
+	if err != nil {
+		return err
+	}
+	if !acc.HasUserID(uid) {
+		return errors.New("account not mine")
+	}
+	if pc.HasApprove(uid) {
+		return errors.New("policy change approved")
+	}
+	if !ok {
+		pc.Reject = uid
+		pc.State = TPolicyChangeRejected
+		return db.UpdatePolicyChange(pc)
+	}
+	pc.Approves = append(pc.Approves, uid)
+	err = pc.apply(db, acc)
+	if err != nil {
+		return err
+	}
+	return db.UpdatePolicyChange(pc)
+}
+
+//设置账号策略
+func (ctx *dbimp) SetAccountPolicy(id xginx.Address, policy TPolicy) error {
+	col := ctx.table(TAccountName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"policy": policy}})
+	return sr.Err()
+}
+
+//更新账号支出版本,事务中锁定账号
+func (ctx *dbimp) LockAccountSpends(id xginx.Address) error {
+	col := ctx.table(TAccountName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$inc": bson.M{"spendv": 1}})
+	return sr.Err()
+}
+
+//添加账号支出
+func (ctx *dbimp) InsertSpends(ss ...*TSpend) error {
+	if len(ss) == 0 {
+		return nil
+	}
+	col := ctx.table(TSpendName)
+	docs := []interface{}{}
+	for _, v := range ss {
+		docs = append(docs, v)
+	}
+	_, err := col.InsertMany(ctx, docs)
+	return err
+}
+
+//获取账号since之后的支出
+func (ctx *dbimp) ListSpends(acc xginx.Address, since int64) ([]*TSpend, error) {
+	col := ctx.table(TSpendName)
+	iter, err := col.Find(ctx, bson.M{"acc": acc, "time": bson.M{"$gte": since}})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TSpend{}
+	for iter.Next(ctx) {
+		v := &TSpend{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//添加策略修改申请
+func (ctx *dbimp) InsertPolicyChange(pc *TPolicyChange) error {
+	col := ctx.table(TPolicyChangeName)
+	_, err := col.InsertOne(ctx, pc)
+	return err
+}
+
+//获取策略修改申请
+func (ctx *dbimp) GetPolicyChange(id primitive.ObjectID) (*TPolicyChange, error) {
+	col := ctx.table(TPolicyChangeName)
+	v := &TPolicyChange{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新策略修改申请
+func (ctx *dbimp) UpdatePolicyChange(pc *TPolicyChange) error {
+	col := ctx.table(TPolicyChangeName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": pc.ID}, pc)
+	return sr.Err()
+}
+
+//获取账号的策略修改申请
+func (ctx *dbimp) ListPolicyChanges(acc xginx.Address) ([]*TPolicyChange, error) {
+	col := ctx.table(TPolicyChangeName)
+	iter, err := col.Find(ctx, bson.M{"acc": acc})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TPolicyChange{}
+	for iter.Next(ctx) {
+		v := &TPolicyChange{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+func (db *memimp) SetAccountPolicy(id xginx.Address, policy TPolicy) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	acc.Policy = policy
+	return db.insert(TAccountName, acc, &TAccount{})
+}
+
+func (db *memimp) LockAccountSpends(id xginx.Address) error {
+	acc, err := db.GetAccount(id)
+	if err != nil {
+		return err
+	}
+	acc.SpendVer++
+	return db.insert(TAccountName, acc, &TAccount{})
+}
+
+func (db *memimp) InsertSpends(ss ...*TSpend) error {
+	for _, v := range ss {
+		err := db.insert(TSpendName, v, &TSpend{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memimp) ListSpends(acc xginx.Address, since int64) ([]*TSpend, error) {
+	rets := []*TSpend{}
+	var err error
+	err2 := db.each(TSpendName, "acc", acc, func(obj interface{}) bool {
+		v := &TSpend{}
+		err = memClone(obj, v)
+		if err == nil && v.Time >= since {
+			rets = append(rets, v)
+		}
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) InsertPolicyChange(pc *TPolicyChange) error {
+	return db.insert(TPolicyChangeName, pc, &TPolicyChange{})
+}
+
+func (db *memimp) GetPolicyChange(id primitive.ObjectID) (*TPolicyChange, error) {
+	v := &TPolicyChange{}
+	err := db.first(v, TPolicyChangeName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) UpdatePolicyChange(pc *TPolicyChange) error {
+	_, err := db.GetPolicyChange(pc.ID)
+	if err != nil {
+		return err
+	}
+	return db.insert(TPolicyChangeName, pc, &TPolicyChange{})
+}
+
+func (db *memimp) ListPolicyChanges(acc xginx.Address) ([]*TPolicyChange, error) {
+	rets := []*TPolicyChange{}
+	var err error
+	err2 := db.each(TPolicyChangeName, "acc", acc, func(obj interface{}) bool {
+		v := &TPolicyChange{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
@@ -0,0 +1,184 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPolicyEvaluate(t *testing.T) {
+	as := assert.New(t)
+	PolicyLocation = time.UTC
+	defer func() {
+		PolicyLocation = time.Local
+	}()
+	//2020-01-06 是星期一
+	mon := time.Date(2020, 1, 6, 10, 30, 0, 0, time.UTC)
+	w := TPolicyWindow{Days: []int{1, 2, 3, 4, 5}, Start: 9 * 60, End: 18 * 60}
+	as.True(w.Match(mon))
+	as.False(w.Match(mon.Add(time.Hour * 8)))
+	as.False(w.Match(mon.Add(-time.Hour * 48)))
+	//跨越零点
+	w = TPolicyWindow{Start: 22 * 60, End: 6 * 60}
+	as.False(w.Match(mon))
+	as.True(w.Match(mon.Add(time.Hour * 12)))
+	as.True(TPolicyWindow{}.Match(mon))
+
+	p := TPolicy{}
+	as.True(p.IsEmpty())
+	as.NoError(p.Check())
+	as.Error(TPolicy{Window: TPolicyWindow{Days: []int{7}}}.Check())
+	as.Error(TPolicy{TxLimit: -1}.Check())
+	as.Len(p.Evaluate("acc", 1000, 1000, []xginx.Address{"dst"}, mon, true), 0)
+
+	p = TPolicy{
+		TxLimit:   100,
+		DayLimit:  150,
+		Whitelist: []xginx.Address{"dst1"},
+		Window:    TPolicyWindow{Start: 9 * 60, End: 18 * 60},
+	}
+	as.False(p.IsEmpty())
+	as.Len(p.Evaluate("acc", 100, 50, []xginx.Address{"dst1"}, mon, true), 0)
+	vs := p.Evaluate("acc", 101, 50, []xginx.Address{"dst1", "dst2"}, mon.Add(time.Hour*10), true)
+	rules := []string{}
+	for _, v := range vs {
+		as.Equal(xginx.Address("acc"), v.Account)
+		rules = append(rules, v.Rule)
+	}
+	as.Equal([]string{PolicyRuleTxLimit, PolicyRuleDayLimit, PolicyRuleWhitelist, PolicyRuleWindow}, rules)
+	//创建交易时不检查时间窗口
+	as.Len(p.Evaluate("acc", 10, 0, []xginx.Address{"dst1"}, mon.Add(time.Hour*10), false), 0)
+	err := &PolicyError{Violations: vs}
+	as.Contains(err.Error(), PolicyRuleWhitelist)
+}
+
+func TestPolicyChange(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	u1 := primitive.NewObjectID()
+	u2 := primitive.NewObjectID()
+	u3 := primitive.NewObjectID()
+	policy := TPolicy{TxLimit: 100}
+	err := app.UseTx(func(db IDbImp) error {
+		accs := []*TAccount{
+			{ID: "policy_test_one", UserID: []primitive.ObjectID{u1}},
+			{ID: "policy_test_two", UserID: []primitive.ObjectID{u1, u2}},
+		}
+		for _, acc := range accs {
+			err := db.InsertAccount(acc)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteAccount(acc.ID, u1)
+		}
+		//只有一个所有者直接生效
+		pc, err := ProposePolicy(db, "policy_test_one", u1, policy)
+		as.NoError(err)
+		as.Equal(TPolicyChangeApplied, pc.State)
+		acc, err := db.GetAccount("policy_test_one")
+		as.NoError(err)
+		as.Equal(policy.TxLimit, acc.Policy.TxLimit)
+		//不是账号所有者
+		_, err = ProposePolicy(db, "policy_test_two", u3, policy)
+		as.Error(err)
+		//多个所有者需要其他所有者同意
+		pc, err = ProposePolicy(db, "policy_test_two", u1, policy)
+		as.NoError(err)
+		as.Equal(TPolicyChangePending, pc.State)
+		acc, err = db.GetAccount("policy_test_two")
+		as.NoError(err)
+		as.True(acc.Policy.IsEmpty())
+		//等待同意时不能再次申请
+		_, err = ProposePolicy(db, "policy_test_two", u2, policy)
+		as.Error(err)
+		as.Error(pc.Approve(db, u1, true))
+		as.Error(pc.Approve(db, u3, true))
+		as.NoError(pc.Approve(db, u2, true))
+		as.Equal(TPolicyChangeApplied, pc.State)
+		acc, err = db.GetAccount("policy_test_two")
+		as.NoError(err)
+		as.Equal(policy.TxLimit, acc.Policy.TxLimit)
+		//拒绝后策略不变
+		pc, err = ProposePolicy(db, "policy_test_two", u2, TPolicy{})
+		as.NoError(err)
+		as.NoError(pc.Approve(db, u1, false))
+		pc, err = db.GetPolicyChange(pc.ID)
+		as.NoError(err)
+		as.Equal(TPolicyChangeRejected, pc.State)
+		as.Error(pc.Approve(db, u1, true))
+		acc, err = db.GetAccount("policy_test_two")
+		as.NoError(err)
+		as.Equal(policy.TxLimit, acc.Policy.TxLimit)
+		pcs, err := db.ListPolicyChanges("policy_test_two")
+		as.NoError(err)
+		as.Len(pcs, 2)
+		return nil
+	})
+	as.NoError(err)
+}
+
+func TestTxSpendsOwners(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	u1 := primitive.NewObjectID()
+	u2 := primitive.NewObjectID()
+	shared := xginx.Address("policy_spend_shared")
+	own := xginx.Address("policy_spend_own")
+	both := xginx.Address("policy_spend_both")
+	loose := xginx.Address("policy_spend_loose")
+	stx := &TTx{ID: xginx.Hash256From([]byte("policy_spend_tx")).Bytes(), UserID: u1, Time: time.Now().Unix()}
+	err := app.UseTx(func(db IDbImp) error {
+		accs := []*TAccount{
+			{ID: shared, UserID: []primitive.ObjectID{u1, u2}, Num: 2, Less: 2, Policy: TPolicy{DayLimit: 100}},
+			{ID: own, UserID: []primitive.ObjectID{u1}},
+			{ID: both, UserID: []primitive.ObjectID{u2, u1}},
+			{ID: loose, UserID: []primitive.ObjectID{u1, u2}, Num: 2, Less: 1},
+		}
+		for _, acc := range accs {
+			err := db.InsertAccount(acc)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteAccount(acc.ID, u1)
+		}
+		//共有账号转到创建者自己的账号作为支出,不能绕过策略
+		ss, dsts, err := stx.txSpends(db, []spendValue{{shared, 1000}}, []spendValue{{own, 900}, {shared, 50}})
+		as.NoError(err)
+		as.Len(ss, 1)
+		as.Equal(shared, ss[0].Account)
+		as.Equal(xginx.Amount(950), ss[0].Value)
+		as.Equal([]xginx.Address{own}, dsts)
+		//目标账号包含所有所有者时也作为支出
+		ss, dsts, err = stx.txSpends(db, []spendValue{{shared, 1000}}, []spendValue{{both, 900}, {shared, 50}})
+		as.NoError(err)
+		as.Len(ss, 1)
+		as.Equal(xginx.Amount(950), ss[0].Value)
+		as.Equal([]xginx.Address{both}, dsts)
+		//共有者创建规则更宽松的同所有者账号,转入不能绕过策略
+		ss, dsts, err = stx.txSpends(db, []spendValue{{shared, 1000}}, []spendValue{{loose, 1000}})
+		as.NoError(err)
+		as.Len(ss, 1)
+		as.Equal(shared, ss[0].Account)
+		as.Equal(xginx.Amount(1000), ss[0].Value)
+		as.Equal([]xginx.Address{loose}, dsts)
+		//输入不是账号时都作为支出
+		ss, dsts, err = stx.txSpends(db, []spendValue{{"policy_spend_miss", 100}}, []spendValue{{both, 100}})
+		as.NoError(err)
+		as.Len(ss, 1)
+		as.Equal(xginx.Amount(100), ss[0].Value)
+		as.Equal([]xginx.Address{both}, dsts)
+		//检查每日限额时锁定账号
+		as.NoError(db.LockAccountSpends(shared))
+		acc, err := db.GetAccount(shared)
+		as.NoError(err)
+		as.Equal(int64(1), acc.SpendVer)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -24,6 +24,7 @@ const (
 	CipherTypeNone  CipherType = 0
 	CipherTypeAes   CipherType = 1      //aes加密方式
 	CipherOnlyKey   CipherType = 1 << 7 //如果只有私钥key（非派生密钥)
+	CipherPublicKey CipherType = 1 << 6 //非强化派生,只保存扩展公钥,私钥签名时从Root按Path派生
 	PrivateIDPrefix            = "kp"   //私钥前缀
 )
 
@@ -37,6 +38,11 @@ func IsCipherOnlyKey(t CipherType) bool {
 	return t&CipherOnlyKey != 0
 }
 
+//IsCipherPublicKey 是否只有扩展公钥(非强化派生)
+func IsCipherPublicKey(t CipherType) bool {
+	return t&CipherPublicKey != 0
+}
+
 //GetPrivateID 获取私钥ID
 func GetPrivateID(pkh xginx.HASH160) string {
 	id, err := xginx.EncodeAddressWithPrefix(PrivateIDPrefix, pkh)
@@ -93,9 +99,63 @@ func NewPrivate(uid primitive.ObjectID, idx uint32, dk *DeterKey, desc string, p
 		return nil, err
 	}
 	dp.Keys = keys
+	xpub, err := ndk.PublicExtPub()
+	if err != nil {
+		return nil, err
+	}
+	dp.XPub = xpub.Dump()
 	return dp, nil
 }
 
+//NewPublicPrivate 使用扩展公钥非强化派生一个私钥,不需要私钥和密码
+//root 为私钥根,空表示用户主私钥,path 为从根到parent的派生路径
+func NewPublicPrivate(uid primitive.ObjectID, root string, path []uint32, parent *ExtPubKey, idx uint32, cipher CipherType, desc string) (*TPrivate, error) {
+	xpub, err := parent.New(idx)
+	if err != nil {
+		return nil, err
+	}
+	dp := &TPrivate{}
+	dp.Pks = xpub.Pks
+	dp.Pkh = dp.Pks.Hash()
+	dp.ID = GetPrivateID(dp.Pkh)
+	dp.UserID = uid
+	dp.Cipher = CipherPublicKey | GetCipherType(cipher)
+	dp.XPub = xpub.Dump()
+	dp.Root = root
+	dp.Path = append(append([]uint32{}, path...), idx)
+	dp.Desc = desc
+	dp.Time = time.Now().Unix()
+	return dp, nil
+}
+
+//NewPublicPrivate 使用用户主扩展公钥派生并写入私钥
+func (user *TUser) NewPublicPrivate(db IDbImp, desc string) (*TPrivate, error) {
+	if !db.IsTx() {
+		return nil, errors.New("need use tx")
+	}
+	if user.XPub == "" {
+		return nil, errors.New("user xpub miss")
+	}
+	xpub, err := LoadExtPubKey(user.XPub)
+	if err != nil {
+		return nil, err
+	}
+	ptr, err := NewPublicPrivate(user.ID, "", nil, xpub, user.Idx, user.Cipher, desc)
+	if err != nil {
+		return nil, err
+	}
+	err = db.InsertPrivate(ptr)
+	if err != nil {
+		return nil, err
+	}
+	err = db.IncDeterIdx(TUsersName, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	user.Idx++
+	return ptr, nil
+}
+
 //NewPrivate 新建并写入私钥
 func (user *TUser) NewPrivate(db IDbImp, desc string, kpass ...string) (*TPrivate, error) {
 	if !db.IsTx() {
@@ -122,6 +182,9 @@ func (user *TUser) NewPrivate(db IDbImp, desc string, kpass ...string) (*TPrivat
 	return ptr, nil
 }
 
+//ErrPublicDerived 非强化派生的私钥不能导出
+var ErrPublicDerived = errors.New("public derived private can't export")
+
 //TPrivate 私钥管理
 type TPrivate struct {
 	ID     string             `bson:"_id"`    //私钥id GetPrivateId(pkh)生成
@@ -131,6 +194,9 @@ type TPrivate struct {
 	Pkh    xginx.HASH160      `bson:"pkh"`    //公钥hash
 	Keys   string             `bson:"keys"`   //私钥内容
 	Idx    uint32             `bson:"idx"`    //索引
+	XPub   string             `bson:"xpub"`   //非强化派生根的扩展公钥,可以不使用私钥派生子公钥
+	Root   string             `bson:"root"`   //CipherPublicKey 私钥根id,空为用户主私钥
+	Path   []uint32           `bson:"path"`   //CipherPublicKey 从根开始的派生路径
 	Time   int64              `bson:"time"`   //创建时间
 	Desc   string             `bson:"desc"`   //描述
 }
@@ -140,8 +206,58 @@ func (p *TPrivate) GetDeter(pass ...string) (*DeterKey, error) {
 	return LoadDeterKey(p.Keys, pass...)
 }
 
+//NewPublic 使用扩展公钥派生子私钥,不需要密码
+func (p *TPrivate) NewPublic(db IDbImp, desc string) (*TPrivate, error) {
+	if p.IsCipherOnlyKey() || p.XPub == "" {
+		return nil, errors.New("private can't derive public")
+	}
+	xpub, err := LoadExtPubKey(p.XPub)
+	if err != nil {
+		return nil, err
+	}
+	//强化派生的私钥作为根
+	root, path := p.ID, []uint32{}
+	if p.IsCipherPublicKey() {
+		root, path = p.Root, p.Path
+	}
+	pri, err := NewPublicPrivate(p.UserID, root, path, xpub, p.Idx, p.Cipher, desc)
+	if err != nil {
+		return nil, err
+	}
+	err = db.InsertPrivate(pri)
+	if err != nil {
+		return nil, err
+	}
+	err = db.IncDeterIdx(TPrivatesName, p.ID)
+	if err != nil {
+		return nil, err
+	}
+	p.Idx++
+	return pri, nil
+}
+
+//SetXPub 重新生成非强化派生根的扩展公钥,需要私钥密码
+func (p *TPrivate) SetXPub(db IDbImp, pass ...string) error {
+	if p.IsCipherOnlyKey() || p.IsCipherPublicKey() {
+		return errors.New("private can't derive public")
+	}
+	dk, err := p.GetDeter(pass...)
+	if err != nil {
+		return err
+	}
+	xpub, err := dk.PublicExtPub()
+	if err != nil {
+		return err
+	}
+	p.XPub = xpub.Dump()
+	return db.SetPrivateXPub(p.ID, p.XPub)
+}
+
 //New pass存在启用加密方式
 func (p *TPrivate) New(db IDbImp, desc string, pass ...string) (*TPrivate, error) {
+	if p.IsCipherPublicKey() {
+		return nil, errors.New("public derived private can't derive hardened")
+	}
 	dk, err := p.GetDeter(pass...)
 	if err != nil {
 		return nil, err
@@ -172,8 +288,82 @@ func (p *TPrivate) IsCipherOnlyKey() bool {
 	return IsCipherOnlyKey(p.Cipher)
 }
 
+//IsCipherPublicKey 是否只有扩展公钥
+func (p *TPrivate) IsCipherPublicKey() bool {
+	return IsCipherPublicKey(p.Cipher)
+}
+
+//NeedPass 签名时是否需要密码
+func (p *TPrivate) NeedPass(db IDbImp) (bool, error) {
+	if !p.IsCipherPublicKey() {
+		return GetCipherType(p.Cipher) != CipherTypeNone, nil
+	}
+	if p.Root != "" {
+		root, err := db.GetPrivate(p.Root)
+		if err != nil {
+			return false, err
+		}
+		return root.NeedPass(db)
+	}
+	user, err := db.GetUserInfo(p.UserID)
+	if err != nil {
+		return false, err
+	}
+	return user.Cipher != CipherTypeNone, nil
+}
+
+//LoadPrivate 加载私钥,非强化派生的私钥从根私钥派生
+func (p *TPrivate) LoadPrivate(db IDbImp, pass ...string) (*xginx.PrivateKey, error) {
+	if !p.IsCipherPublicKey() {
+		return p.ToPrivate(pass...)
+	}
+	var dk *DeterKey
+	if p.Root == "" {
+		user, err := db.GetUserInfo(p.UserID)
+		if err != nil {
+			return nil, err
+		}
+		dk, err = user.GetDeterKey(pass...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		root, err := db.GetPrivate(p.Root)
+		if err != nil {
+			return nil, err
+		}
+		dk, err = root.GetDeter(pass...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	root, err := dk.PublicRoot()
+	if err != nil {
+		return nil, err
+	}
+	ndk, err := root.NewPublicPath(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	//旧版本直接从根私钥非强化派生
+	if ndk.GetPks() != p.Pks {
+		ndk, err = dk.NewPublicPath(p.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ndk.GetPks() != p.Pks {
+		return nil, errors.New("derive private pks error")
+	}
+	return ndk.GetPrivateKey()
+}
+
 //ToPrivate  根据加密方式暂时解密生成私钥对象
 func (p *TPrivate) ToPrivate(pass ...string) (*xginx.PrivateKey, error) {
+	//非强化派生的私钥需要从根私钥派生
+	if p.IsCipherPublicKey() {
+		return nil, errors.New("public derived private use LoadPrivate")
+	}
 	//如果有加密，密码不能为空
 	if p.GetCipherType() == CipherTypeAes && (len(pass) == 0 || pass[0] == "") {
 		return nil, errors.New("miss keys pass")
@@ -200,6 +390,9 @@ func (ctx *dbimp) SetPrivateKeyPass(uid primitive.ObjectID, pid string, old stri
 	if !ObjectIDEqual(pri.UserID, uid) {
 		return errors.New("can't update key pass")
 	}
+	if pri.IsCipherPublicKey() {
+		return errors.New("public derived private use root key pass")
+	}
 	if pri.IsCipherOnlyKey() {
 		xpri, err := pri.ToPrivate(old)
 		if err != nil {
@@ -298,6 +491,13 @@ func (ctx *dbimp) IncDeterIdx(tbl string, id interface{}) error {
 	return err
 }
 
+//设置私钥非强化派生根的扩展公钥
+func (ctx *dbimp) SetPrivateXPub(id string, xpub string) error {
+	col := ctx.table(TPrivatesName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"xpub": xpub}})
+	return sr.Err()
+}
+
 //添加一个私钥
 func (ctx *dbimp) InsertPrivate(obj *TPrivate) error {
 	if !ctx.IsTx() {
@@ -161,3 +161,90 @@ func TestNewPrivate(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestPublicPrivate(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000006", "xh0714", "kpass")
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		//不需要私钥密码
+		p1, err := user.NewPublicPrivate(db, "public")
+		if err != nil {
+			return err
+		}
+		as.True(p1.IsCipherPublicKey())
+		as.Equal("", p1.Keys)
+		as.Equal([]uint32{0}, p1.Path)
+		p2, err := p1.NewPublic(db, "child")
+		if err != nil {
+			return err
+		}
+		as.Equal([]uint32{0, 0}, p2.Path)
+		//从强化派生的私钥再公钥派生
+		h1, err := user.NewPrivate(db, "hardened", "kpass")
+		if err != nil {
+			return err
+		}
+		p3, err := h1.NewPublic(db, "child")
+		if err != nil {
+			return err
+		}
+		as.Equal(h1.ID, p3.Root)
+		//签名时按路径派生私钥
+		dk, err := user.GetDeterKey("kpass")
+		if err != nil {
+			return err
+		}
+		for _, v := range []*TPrivate{p1, p2, p3} {
+			_, err = v.LoadPrivate(db)
+			as.Error(err, "miss pass")
+			_, err = v.LoadPrivate(db, "kpass")
+			as.NoError(err)
+			_, err = v.ToPrivate("kpass")
+			as.Error(err)
+		}
+		//不使用主私钥的扩展公钥派生
+		mxpub, err := dk.ExtPub()
+		if err != nil {
+			return err
+		}
+		as.NotEqual(mxpub.Dump(), user.XPub)
+		root, err := dk.PublicRoot()
+		if err != nil {
+			return err
+		}
+		cdk, err := root.NewPublic(0)
+		if err != nil {
+			return err
+		}
+		cdk, err = cdk.NewPublic(0)
+		if err != nil {
+			return err
+		}
+		xpub, err := cdk.ExtPub()
+		if err != nil {
+			return err
+		}
+		as.Equal(xpub.Pks, p2.Pks)
+		as.Error(db.SetPrivateKeyPass(user.ID, p1.ID, "kpass", "newpass"))
+		//非强化派生的私钥不能导出
+		acc := &TAccount{Kid: []string{h1.ID, p3.ID}}
+		as.Equal(ErrPublicDerived, acc.CheckExport(db))
+		acc = &TAccount{Kid: []string{h1.ID}}
+		as.NoError(acc.CheckExport(db))
+		for _, v := range []*TPrivate{p1, p2, p3, h1} {
+			err = db.DeletePrivate(v.ID)
+			if err != nil {
+				return err
+			}
+		}
+		return db.DeleteUser(user.ID)
+	})
+	as.NoError(err)
+}
@@ -56,6 +56,14 @@ func NewRedisLocker(c redislock.RedisClient, key string, ttl time.Duration, meta
 	return &redislocker{l: lp}, nil
 }
 
+//IPubSub 订阅连接
+type IPubSub interface {
+	//接收消息通道
+	Channel() <-chan *redis.Message
+	//关闭订阅
+	Close() error
+}
+
 //IRedisImp redis接口
 type IRedisImp interface {
 	//保存用户id到redis
@@ -65,11 +73,21 @@ type IRedisImp interface {
 	//删除token
 	DelUserID(k string) error
 	//订阅消息
-	Subscribe(channels ...string) *redis.PubSub
+	Subscribe(channels ...string) IPubSub
 	//发布消息
 	Publish(channel string, message interface{}) error
 	//分布式锁实现
 	Locker(key string, ttl time.Duration, meta ...string) (ILocker, error)
+	//保存字符串 ttl=0不过期
+	SetValue(k string, v string, ttl time.Duration) error
+	//不存在时保存字符串,返回是否保存成功
+	SetValueNX(k string, v string, ttl time.Duration) (bool, error)
+	//获取字符串
+	GetValue(k string) (string, error)
+	//删除key
+	DelValue(k ...string) error
+	//自增计数,第一次创建时设置超时时间
+	IncrValue(k string, ttl time.Duration) (int64, error)
 }
 
 type redisImp struct {
@@ -88,7 +106,7 @@ func (rimp *redisImp) DelUserID(k string) error {
 
 // Subscribe 开始利用redis订阅，成功后返回订阅连接
 // 发布消息使用 IRidisImp Publish
-func (rimp *redisImp) Subscribe(channels ...string) *redis.PubSub {
+func (rimp *redisImp) Subscribe(channels ...string) IPubSub {
 	return rimp.rcli.Subscribe(channels...)
 }
 
@@ -112,6 +130,33 @@ func (rimp *redisImp) GetUserID(k string) (primitive.ObjectID, error) {
 	return primitive.ObjectIDFromHex(hs)
 }
 
+func (rimp *redisImp) SetValue(k string, v string, ttl time.Duration) error {
+	return rimp.conn.Set(k, v, ttl).Err()
+}
+
+func (rimp *redisImp) SetValueNX(k string, v string, ttl time.Duration) (bool, error) {
+	return rimp.conn.SetNX(k, v, ttl).Result()
+}
+
+func (rimp *redisImp) GetValue(k string) (string, error) {
+	return rimp.conn.Get(k).Result()
+}
+
+func (rimp *redisImp) DelValue(k ...string) error {
+	return rimp.conn.Del(k...).Err()
+}
+
+func (rimp *redisImp) IncrValue(k string, ttl time.Duration) (int64, error) {
+	num, err := rimp.conn.Incr(k).Result()
+	if err != nil {
+		return 0, err
+	}
+	if num == 1 && ttl > 0 {
+		err = rimp.conn.Expire(k, ttl).Err()
+	}
+	return num, err
+}
+
 //NewRedisImp 创建缓存接口
 func NewRedisImp(ctx context.Context, rcli *redis.Client, conn *redis.Conn) IRedisImp {
 	return &redisImp{
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//金额占用表
+const (
+	TReserveName = "reserves"
+)
+
+//TReserve 未完成交易占用的金额,防止多个交易使用同一个输出
+type TReserve struct {
+	ID       string             `bson:"_id"`  //OutHash:OutIndex
+	TxID     []byte             `bson:"tid"`  //占用金额的交易
+	UserID   primitive.ObjectID `bson:"uid"`  //交易创建者
+	OutHash  []byte             `bson:"oid"`  //引用的交易id
+	OutIndex uint32             `bson:"idx"`  //引用的输出索引
+	Time     int64              `bson:"time"` //占用时间
+}
+
+//ReserveID 输出对应的占用id
+func ReserveID(hash xginx.HASH256, idx uint32) string {
+	return fmt.Sprintf("%s:%d", hash.String(), idx)
+}
+
+//IsReserved 金额是否被未完成的交易占用
+func IsReserved(db IDbImp, hash xginx.HASH256, idx uint32) bool {
+	_, err := db.GetReserve(ReserveID(hash, idx))
+	return err == nil
+}
+
+//Reserve 占用交易输入引用的金额,和交易在同一个事务中保存
+func (stx *TTx) Reserve(db IDbImp) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	rs := []*TReserve{}
+	now := time.Now().Unix()
+	for _, in := range stx.Ins {
+		rs = append(rs, &TReserve{
+			ID:       ReserveID(xginx.NewHASH256(in.OutHash), in.OutIndex),
+			TxID:     stx.ID,
+			UserID:   stx.UserID,
+			OutHash:  in.OutHash,
+			OutIndex: in.OutIndex,
+			Time:     now,
+		})
+	}
+	return db.InsertReserves(rs...)
+}
+
+//添加金额占用,已经被占用返回错误
+func (ctx *dbimp) InsertReserves(rs ...*TReserve) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	col := ctx.table(TReserveName)
+	docs := []interface{}{}
+	for _, v := range rs {
+		docs = append(docs, v)
+	}
+	_, err := col.InsertMany(ctx, docs)
+	return err
+}
+
+//获取金额占用
+func (ctx *dbimp) GetReserve(id string) (*TReserve, error) {
+	col := ctx.table(TReserveName)
+	v := &TReserve{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//释放交易占用的金额
+func (ctx *dbimp) DeleteReserves(tid []byte) error {
+	col := ctx.table(TReserveName)
+	_, err := col.DeleteMany(ctx, bson.M{"tid": tid})
+	return err
+}
+
+func (db *memimp) InsertReserves(rs ...*TReserve) error {
+	for _, v := range rs {
+		if _, err := db.GetReserve(v.ID); err == nil {
+			return fmt.Errorf("out %s reserved", v.ID)
+		}
+		err := db.insert(TReserveName, v, &TReserve{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *memimp) GetReserve(id string) (*TReserve, error) {
+	v := &TReserve{}
+	err := db.first(v, TReserveName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) DeleteReserves(tid []byte) error {
+	return db.deleteAll(TReserveName, "tid", tid)
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReserve(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	out := xginx.Hash256From([]byte("reserve_test_out"))
+	newtx := func(id string, idx ...uint32) *TTx {
+		stx := &TTx{ID: xginx.Hash256From([]byte(id)).Bytes(), UserID: uid, State: TTxStateNew}
+		for _, v := range idx {
+			stx.Ins = append(stx.Ins, TTxIn{OutHash: out.Bytes(), OutIndex: v})
+		}
+		return stx
+	}
+	tx1 := newtx("reserve_test_tx1", 0, 1)
+	tx2 := newtx("reserve_test_tx2", 1, 2)
+	tx3 := newtx("reserve_test_tx3", 2)
+	err := app.UseTx(func(db IDbImp) error {
+		for _, stx := range []*TTx{tx1, tx2, tx3} {
+			err := db.InsertTx(stx)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteTx(stx.ID)
+		}
+		as.NoError(tx1.Reserve(db))
+		as.True(IsReserved(db, out, 0))
+		as.True(IsReserved(db, out, 1))
+		as.False(IsReserved(db, out, 2))
+		//已经被占用的输出不能再使用
+		as.Error(tx2.Reserve(db))
+		//撤回后释放
+		as.NoError(tx1.CancelTx(db, uid, "cancel"))
+		as.False(IsReserved(db, out, 0))
+		as.False(IsReserved(db, out, 1))
+		as.NoError(tx2.Reserve(db))
+		//进入区块后释放
+		as.NoError(tx2.SetTxState(db, TTxStateBlock))
+		as.False(IsReserved(db, out, 2))
+		as.NoError(tx3.Reserve(db))
+		//删除交易后释放
+		as.NoError(db.DeleteTx(tx3.ID))
+		as.False(IsReserved(db, out, 2))
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//计划付款表
+const (
+	TScheduleName = "schedules"
+)
+
+//计划付款设置
+var (
+	//检查到期计划的间隔
+	ScheduleInterval = time.Minute
+	//执行计划时锁的超时时间
+	ScheduleLockTTL = time.Minute * 5
+)
+
+//TSchedule 计划付款模版
+type TSchedule struct {
+	ID      primitive.ObjectID `bson:"_id"`    //计划id
+	UserID  primitive.ObjectID `bson:"uid"`    //创建用户
+	Desc    string             `bson:"desc"`   //描述,也作为交易描述
+	Dst     []string           `bson:"dst"`    //addr->amount,script
+	Fee     string             `bson:"fee"`    //固定交易费
+	Rate    int64              `bson:"rate"`   //每字节交易费
+	Level   string             `bson:"level"`  //估算交易费的优先级
+	Coin    string             `bson:"coin"`   //金额选择策略
+	Accs    []xginx.Address    `bson:"accs"`   //只使用这些账号的金额
+	Tags    []string           `bson:"tags"`   //只使用包含这些标签的账号的金额
+	Keep    string             `bson:"keep"`   //找零策略
+	KAcc    xginx.Address      `bson:"kacc"`   //找零账号
+	Cron    string             `bson:"cron"`   //执行计划,为空只执行一次
+	Auto    bool               `bson:"auto"`   //自动签名并发布
+	Enable  bool               `bson:"enable"` //是否启用
+	Next    int64              `bson:"next"`   //下次执行时间
+	Last    int64              `bson:"last"`   //最后执行时间
+	LastTx  []byte             `bson:"ltx"`    //最后创建的交易
+	LastErr string             `bson:"lerr"`   //最后执行错误
+	Runs    int                `bson:"runs"`   //执行次数
+	Time    int64              `bson:"time"`   //创建时间
+}
+
+//NewSchedule 创建计划付款,cron为空时在at执行一次,否则在at之后按照cron执行
+func NewSchedule(uid primitive.ObjectID, cron string, at time.Time) (*TSchedule, error) {
+	s := &TSchedule{
+		ID:     primitive.NewObjectID(),
+		UserID: uid,
+		Cron:   cron,
+		Enable: true,
+		Time:   time.Now().Unix(),
+	}
+	if cron == "" {
+		if at.IsZero() {
+			return nil, errors.New("schedule time miss")
+		}
+		s.Next = at.Unix()
+		return s, nil
+	}
+	next, err := s.NextTime(at)
+	if err != nil {
+		return nil, err
+	}
+	s.Next = next
+	return s, nil
+}
+
+//NextTime 获取t之后下次执行时间,只执行一次的计划返回0
+func (s *TSchedule) NextTime(t time.Time) (int64, error) {
+	if s.Cron == "" {
+		return 0, nil
+	}
+	c, err := util.ParseCron(s.Cron)
+	if err != nil {
+		return 0, err
+	}
+	next := c.Next(t)
+	if next.IsZero() {
+		return 0, fmt.Errorf("cron %s no next time", s.Cron)
+	}
+	return next.Unix(), nil
+}
+
+//IsDue 是否到了执行时间
+func (s *TSchedule) IsDue(now time.Time) bool {
+	return s.Enable && s.Next > 0 && s.Next <= now.Unix()
+}
+
+//SetRun 记录执行结果并计算下次执行时间,没有下次执行时间时停用
+func (s *TSchedule) SetRun(now time.Time, stx *TTx, err error) {
+	s.Last = now.Unix()
+	s.Runs++
+	s.LastTx = nil
+	if stx != nil {
+		s.LastTx = stx.ID
+	}
+	s.LastErr = ""
+	if err != nil {
+		s.LastErr = err.Error()
+	}
+	next, err := s.NextTime(now)
+	if err != nil {
+		s.LastErr = err.Error()
+	}
+	s.Next = next
+	if s.Next == 0 {
+		s.Enable = false
+	}
+}
+
+//CheckAutoSign 检测账号是否可以自动签名,用户在账号中的私钥都不能需要密码
+func CheckAutoSign(db IDbImp, uid primitive.ObjectID, accs []xginx.Address) error {
+	if len(accs) == 0 {
+		return errors.New("auto sign accounts miss")
+	}
+	for _, id := range accs {
+		acc, err := db.GetAccount(id)
+		if err != nil {
+			return err
+		}
+		if !acc.HasUserID(uid) {
+			return fmt.Errorf("account %s not mine", id)
+		}
+		if acc.Watch {
+			return ErrWatchOnly
+		}
+		for _, kid := range acc.Kid {
+			pri, err := db.GetPrivate(kid)
+			if err != nil {
+				return err
+			}
+			if !ObjectIDEqual(pri.UserID, uid) {
+				continue
+			}
+			need, err := pri.NeedPass(db)
+			if err != nil {
+				return err
+			}
+			if need {
+				return fmt.Errorf("account %s private %s need pass", id, kid)
+			}
+		}
+	}
+	return nil
+}
+
+//ScheduleFunc 在事务中执行计划付款,返回创建的交易
+//执行记录和创建的交易在同一个事务中保存
+type ScheduleFunc func(db IDbImp, s *TSchedule) (*TTx, error)
+
+//ScheduleDone 执行记录保存后调用,自动签名发布使用
+//返回的错误记录到计划,不影响已经创建的交易
+type ScheduleDone func(s *TSchedule, stx *TTx) error
+
+//计划执行锁
+func scheduleLockKey(id primitive.ObjectID) string {
+	return fmt.Sprintf("schedule:lock:%s", id.Hex())
+}
+
+//执行一个计划,获取不到锁说明其他实例正在执行
+func (app *App) runSchedule(id primitive.ObjectID, now time.Time, fn ScheduleFunc, done ScheduleDone) (bool, error) {
+	run := false
+	err := app.UseRedis(func(redv IRedisImp) error {
+		locker, err := redv.Locker(scheduleLockKey(id), ScheduleLockTTL)
+		if errors.Is(err, redislock.ErrNotObtained) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer locker.Release()
+		//获取锁后再次检测,其他实例可能刚执行完成
+		//创建交易和执行记录在同一个事务中,不会重复付款
+		var s *TSchedule
+		var stx *TTx
+		var ferr error
+		due := false
+		err = app.UseTx(func(db IDbImp) error {
+			s, err = db.GetSchedule(id)
+			if err != nil {
+				return err
+			}
+			due = s.IsDue(now)
+			if !due {
+				return nil
+			}
+			stx, ferr = fn(db, s)
+			if ferr != nil {
+				return ferr
+			}
+			s.SetRun(now, stx, nil)
+			return db.UpdateSchedule(s)
+		})
+		if ferr != nil {
+			//创建交易失败,事务已经回滚,单独记录执行错误
+			xginx.LogError("run schedule", id.Hex(), "error", ferr)
+			s.SetRun(now, nil, ferr)
+			run = true
+			return app.UseDb(func(db IDbImp) error {
+				return db.UpdateSchedule(s)
+			})
+		}
+		if err != nil || !due {
+			return err
+		}
+		run = true
+		if done == nil {
+			return nil
+		}
+		err = done(s, stx)
+		if err == nil {
+			return nil
+		}
+		xginx.LogError("run schedule", id.Hex(), "done error", err)
+		s.LastErr = err.Error()
+		return app.UseDb(func(db IDbImp) error {
+			return db.UpdateSchedule(s)
+		})
+	})
+	return run, err
+}
+
+//RunSchedules 执行所有到期的计划付款,返回执行的数量
+//每个计划使用分布式锁,保证只有一个实例执行
+//一个计划出错时继续执行其他计划,返回第一个错误
+func (app *App) RunSchedules(now time.Time, fn ScheduleFunc, done ScheduleDone) (int, error) {
+	var ss []*TSchedule
+	err := app.UseDb(func(db IDbImp) error {
+		var err error
+		ss, err = db.ListDueSchedules(now.Unix())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	var first error
+	for _, s := range ss {
+		run, err := app.runSchedule(s.ID, now, fn, done)
+		if err != nil {
+			xginx.LogError("run schedule", s.ID.Hex(), "error", err)
+			if first == nil {
+				first = err
+			}
+		}
+		if run {
+			num++
+		}
+	}
+	return num, first
+}
+
+//添加计划付款
+func (ctx *dbimp) InsertSchedule(s *TSchedule) error {
+	col := ctx.table(TScheduleName)
+	_, err := col.InsertOne(ctx, s)
+	return err
+}
+
+//获取计划付款
+func (ctx *dbimp) GetSchedule(id primitive.ObjectID) (*TSchedule, error) {
+	col := ctx.table(TScheduleName)
+	v := &TSchedule{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新计划付款
+func (ctx *dbimp) UpdateSchedule(s *TSchedule) error {
+	col := ctx.table(TScheduleName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": s.ID}, s)
+	return sr.Err()
+}
+
+//删除计划付款
+func (ctx *dbimp) DeleteSchedule(id primitive.ObjectID) error {
+	col := ctx.table(TScheduleName)
+	_, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+//获取用户的计划付款
+func (ctx *dbimp) ListSchedules(uid primitive.ObjectID) ([]*TSchedule, error) {
+	return ctx.findSchedules(bson.M{"uid": uid})
+}
+
+//获取到期的计划付款
+func (ctx *dbimp) ListDueSchedules(now int64) ([]*TSchedule, error) {
+	return ctx.findSchedules(bson.M{"enable": true, "next": bson.M{"$gt": 0, "$lte": now}})
+}
+
+func (ctx *dbimp) findSchedules(filter bson.M) ([]*TSchedule, error) {
+	col := ctx.table(TScheduleName)
+	iter, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TSchedule{}
+	for iter.Next(ctx) {
+		v := &TSchedule{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+func (db *memimp) InsertSchedule(s *TSchedule) error {
+	return db.insert(TScheduleName, s, &TSchedule{})
+}
+
+func (db *memimp) GetSchedule(id primitive.ObjectID) (*TSchedule, error) {
+	v := &TSchedule{}
+	err := db.first(v, TScheduleName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) UpdateSchedule(s *TSchedule) error {
+	_, err := db.GetSchedule(s.ID)
+	if err != nil {
+		return err
+	}
+	return db.insert(TScheduleName, s, &TSchedule{})
+}
+
+func (db *memimp) DeleteSchedule(id primitive.ObjectID) error {
+	return db.deleteAll(TScheduleName, "id", id)
+}
+
+func (db *memimp) ListSchedules(uid primitive.ObjectID) ([]*TSchedule, error) {
+	return db.findSchedules("uid", uid, func(s *TSchedule) bool {
+		return true
+	})
+}
+
+func (db *memimp) ListDueSchedules(now int64) ([]*TSchedule, error) {
+	return db.findSchedules("enable", true, func(s *TSchedule) bool {
+		return s.Next > 0 && s.Next <= now
+	})
+}
+
+func (db *memimp) findSchedules(idx string, arg interface{}, fn func(s *TSchedule) bool) ([]*TSchedule, error) {
+	rets := []*TSchedule{}
+	var err error
+	err2 := db.each(TScheduleName, idx, arg, func(obj interface{}) bool {
+		v := &TSchedule{}
+		err = memClone(obj, v)
+		if err == nil && fn(v) {
+			rets = append(rets, v)
+		}
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
@@ -0,0 +1,106 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRunSchedules(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	now := time.Now()
+	uid := primitive.NewObjectID()
+	_, err := NewSchedule(uid, "", time.Time{})
+	as.Error(err)
+	_, err = NewSchedule(uid, "miss", now)
+	as.Error(err)
+	once, err := NewSchedule(uid, "", now.Add(-time.Minute))
+	as.NoError(err)
+	cron, err := NewSchedule(uid, "* * * * *", now.Add(-time.Hour))
+	as.NoError(err)
+	later, err := NewSchedule(uid, "", now.Add(time.Hour))
+	as.NoError(err)
+	stx := &TTx{ID: xginx.Hash256From([]byte("schedules_test_tx")).Bytes(), UserID: uid}
+	err = app.UseDb(func(db IDbImp) error {
+		for _, s := range []*TSchedule{once, cron, later} {
+			err := db.InsertSchedule(s)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	as.NoError(err)
+	defer app.UseDb(func(db IDbImp) error {
+		for _, s := range []*TSchedule{once, cron, later} {
+			db.DeleteSchedule(s.ID)
+		}
+		return nil
+	})
+	//其他实例正在执行的计划跳过
+	err = app.UseRedis(func(redv IRedisImp) error {
+		locker, err := redv.Locker(scheduleLockKey(cron.ID), time.Minute)
+		if err != nil {
+			return err
+		}
+		defer locker.Release()
+		//创建交易出错时事务回滚,只记录执行错误
+		num, err := app.RunSchedules(now, func(db IDbImp, s *TSchedule) (*TTx, error) {
+			as.Equal(once.ID, s.ID)
+			err := db.InsertTx(stx)
+			if err != nil {
+				return nil, err
+			}
+			return nil, errors.New("coins not enough")
+		}, nil)
+		as.NoError(err)
+		as.Equal(1, num)
+		return nil
+	})
+	as.NoError(err)
+	//执行记录保存后签名发布出错,记录错误
+	num, err := app.RunSchedules(now, func(db IDbImp, s *TSchedule) (*TTx, error) {
+		as.Equal(cron.ID, s.ID)
+		return stx, nil
+	}, func(s *TSchedule, v *TTx) error {
+		as.Equal(cron.ID, s.ID)
+		as.Equal(stx, v)
+		as.Equal(stx.ID, s.LastTx)
+		return errors.New("sign error")
+	})
+	as.NoError(err)
+	as.Equal(1, num)
+	err = app.UseDb(func(db IDbImp) error {
+		//只执行一次的计划执行后停用
+		s, err := db.GetSchedule(once.ID)
+		if err != nil {
+			return err
+		}
+		as.False(s.Enable)
+		as.Equal(1, s.Runs)
+		as.Equal("coins not enough", s.LastErr)
+		s, err = db.GetSchedule(cron.ID)
+		if err != nil {
+			return err
+		}
+		as.True(s.Enable)
+		as.True(s.Next > now.Unix())
+		as.Equal(1, s.Runs)
+		as.Equal(stx.ID, s.LastTx)
+		as.Equal("sign error", s.LastErr)
+		_, err = db.GetTx(stx.ID)
+		as.Error(err)
+		ss, err := db.ListDueSchedules(now.Unix())
+		as.NoError(err)
+		as.Equal(0, len(ss))
+		return nil
+	})
+	as.NoError(err)
+}
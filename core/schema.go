@@ -0,0 +1,410 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//已执行的迁移表
+const (
+	TMigrationName = "migrations"
+)
+
+//迁移设置
+var (
+	//执行迁移时锁的超时时间
+	MigrateLockTTL = time.Minute * 10
+	//迁移锁
+	migrateLockKey = "migrate:lock"
+)
+
+//TIndex 数据库索引定义
+type TIndex struct {
+	Table  string //表名
+	Keys   bson.D //索引字段
+	Unique bool   //是否唯一
+}
+
+//Indexes 程序依赖的数据库索引,启动时创建
+var Indexes = []TIndex{
+	{Table: TAccountName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TAccountName, Keys: bson.D{{Key: "tags", Value: 1}}},
+	{Table: TAccountName, Keys: bson.D{{Key: "kid", Value: 1}}},
+	{Table: TPrivatesName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TTxName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TTxName, Keys: bson.D{{Key: "state", Value: 1}, {Key: "expire", Value: 1}}},
+	{Table: TUsersName, Keys: bson.D{{Key: "mobile", Value: 1}}, Unique: true},
+	{Table: TSigName, Keys: bson.D{{Key: "tid", Value: 1}}},
+	{Table: TSigName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TSessionName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TSessionName, Keys: bson.D{{Key: "refresh", Value: 1}}},
+	{Table: TSessionName, Keys: bson.D{{Key: "prev", Value: 1}}},
+	{Table: TReserveName, Keys: bson.D{{Key: "tid", Value: 1}}},
+	{Table: TReserveName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TBatchName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TScheduleName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TScheduleName, Keys: bson.D{{Key: "enable", Value: 1}, {Key: "next", Value: 1}}},
+	{Table: TSpendName, Keys: bson.D{{Key: "acc", Value: 1}, {Key: "time", Value: 1}}},
+	{Table: TPolicyChangeName, Keys: bson.D{{Key: "acc", Value: 1}}},
+	{Table: TContactName, Keys: bson.D{{Key: "uid", Value: 1}, {Key: "label", Value: 1}}, Unique: true},
+	{Table: TContactName, Keys: bson.D{{Key: "uid", Value: 1}, {Key: "addr", Value: 1}}},
+	{Table: TWebhookName, Keys: bson.D{{Key: "uid", Value: 1}}},
+	{Table: TDeliveryName, Keys: bson.D{{Key: "hid", Value: 1}, {Key: "time", Value: 1}}},
+	{Table: TDeliveryName, Keys: bson.D{{Key: "state", Value: 1}, {Key: "next", Value: 1}}},
+	{Table: THistoryName, Keys: bson.D{{Key: "acc", Value: 1}, {Key: "height", Value: 1}}},
+	{Table: THistoryName, Keys: bson.D{{Key: "blk", Value: 1}}},
+	{Table: THistoryName, Keys: bson.D{{Key: "done", Value: 1}}},
+}
+
+//EnsureIndexes 创建所有索引,已经存在的索引不会重复创建
+func EnsureIndexes(ctx context.Context, cli *mongo.Client) error {
+	db := cli.Database(config.DbName)
+	for _, idx := range Indexes {
+		opts := options.Index()
+		if idx.Unique {
+			opts.SetUnique(true)
+		}
+		model := mongo.IndexModel{Keys: idx.Keys, Options: opts}
+		_, err := db.Collection(idx.Table).Indexes().CreateOne(ctx, model)
+		if err != nil {
+			return fmt.Errorf("create index %s %v error: %w", idx.Table, idx.Keys, err)
+		}
+	}
+	return nil
+}
+
+//是否是唯一索引冲突错误
+func isDuplicateKey(err error) bool {
+	var we mongo.WriteException
+	if !errors.As(err, &we) {
+		return false
+	}
+	for _, v := range we.WriteErrors {
+		if v.Code == 11000 {
+			return true
+		}
+	}
+	return false
+}
+
+//TMigration 已经执行的迁移记录
+type TMigration struct {
+	Version int    `bson:"_id"`  //版本号
+	Name    string `bson:"name"` //名称
+	Time    int64  `bson:"time"` //执行时间
+}
+
+//Migration 数据迁移,在事务中执行
+type Migration struct {
+	Version int                   //版本号,按从小到大执行,不能重复
+	Name    string                //名称
+	Up      func(db IDbImp) error //迁移数据
+}
+
+//已注册的迁移
+var migrations = []Migration{
+	{Version: 1, Name: "clear legacy user token", Up: clearUserTokens},
+	{Version: 2, Name: "rename duplicate user mobile", Up: renameDupMobiles},
+	{Version: 3, Name: "move public derive root", Up: movePublicRoot},
+}
+
+//清除所有用户的旧版本登陆token
+func clearUserTokens(db IDbImp) error {
+	switch v := db.(type) {
+	case *dbimp:
+		col := v.table(TUsersName)
+		_, err := col.UpdateMany(v, bson.M{"token": bson.M{"$ne": ""}}, bson.M{"$set": bson.M{"token": ""}})
+		return err
+	case *memimp:
+		users := []*TUser{}
+		var err error
+		err2 := v.eachAll(TUsersName, func(obj interface{}) bool {
+			u := &TUser{}
+			err = memClone(obj, u)
+			if err == nil && u.Token != "" {
+				users = append(users, u)
+			}
+			return err == nil
+		})
+		if err2 != nil {
+			return err2
+		}
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			user.Token = ""
+			err := v.insert(TUsersName, user, &TUser{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("db %T not support", db)
+}
+
+//DupMobileSuffix 重复手机号重命名后缀,保留最早创建的用户,其他用户需要人工合并
+const DupMobileSuffix = "#dup:"
+
+//mobile唯一索引创建前,重命名重复手机号的用户,否则创建索引失败
+func renameDupMobiles(db IDbImp) error {
+	v, ok := db.(*dbimp)
+	if !ok {
+		//内存数据库mobile是唯一索引,不会重复
+		return nil
+	}
+	col := v.table(TUsersName)
+	iter, err := col.Aggregate(v, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{"_id": "$mobile", "ids": bson.M{"$push": "$_id"}, "num": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"num": bson.M{"$gt": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer iter.Close(v)
+	type dup struct {
+		Mobile string               `bson:"_id"`
+		IDs    []primitive.ObjectID `bson:"ids"`
+	}
+	dups := []*dup{}
+	for iter.Next(v) {
+		d := &dup{}
+		err := iter.Decode(d)
+		if err != nil {
+			return err
+		}
+		dups = append(dups, d)
+	}
+	for _, d := range dups {
+		for _, id := range d.IDs[1:] {
+			mobile := d.Mobile + DupMobileSuffix + id.Hex()
+			_, err := col.UpdateOne(v, bson.M{"_id": id}, bson.M{"$set": bson.M{"mobile": mobile}})
+			if err != nil {
+				return err
+			}
+			xginx.LogInfof("user %s duplicate mobile %s renamed to %s", id.Hex(), d.Mobile, mobile)
+		}
+	}
+	return nil
+}
+
+//旧版本扩展公钥为主私钥的扩展公钥,泄露后和任一子私钥可以推导出主私钥
+//未加密的重新从强化派生根生成,加密的清空,需要用户提供密码重新生成
+func movePublicRoot(db IDbImp) error {
+	users := []*TUser{}
+	pris := []*TPrivate{}
+	switch v := db.(type) {
+	case *dbimp:
+		iter, err := v.table(TUsersName).Find(v, bson.M{"xpub": bson.M{"$ne": ""}})
+		if err != nil {
+			return err
+		}
+		err = iter.All(v, &users)
+		if err != nil {
+			return err
+		}
+		iter, err = v.table(TPrivatesName).Find(v, bson.M{"xpub": bson.M{"$ne": ""}})
+		if err != nil {
+			return err
+		}
+		err = iter.All(v, &pris)
+		if err != nil {
+			return err
+		}
+	case *memimp:
+		var err error
+		err2 := v.eachAll(TUsersName, func(obj interface{}) bool {
+			u := &TUser{}
+			err = memClone(obj, u)
+			if err == nil && u.XPub != "" {
+				users = append(users, u)
+			}
+			return err == nil
+		})
+		if err2 != nil {
+			return err2
+		}
+		if err != nil {
+			return err
+		}
+		err2 = v.eachAll(TPrivatesName, func(obj interface{}) bool {
+			p := &TPrivate{}
+			err = memClone(obj, p)
+			if err == nil && p.XPub != "" {
+				pris = append(pris, p)
+			}
+			return err == nil
+		})
+		if err2 != nil {
+			return err2
+		}
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("db %T not support", db)
+	}
+	for _, user := range users {
+		xpub := ""
+		if user.Cipher == CipherTypeNone {
+			dk, err := user.GetDeterKey()
+			if err != nil {
+				return err
+			}
+			epk, err := dk.PublicExtPub()
+			if err != nil {
+				return err
+			}
+			xpub = epk.Dump()
+		}
+		err := db.SetUserXPub(user.ID, xpub)
+		if err != nil {
+			return err
+		}
+	}
+	for _, pri := range pris {
+		//非强化派生的私钥继续使用原有路径
+		if pri.IsCipherPublicKey() || pri.IsCipherOnlyKey() {
+			continue
+		}
+		var err error
+		if GetCipherType(pri.Cipher) == CipherTypeNone {
+			err = pri.SetXPub(db)
+		} else {
+			err = db.SetPrivateXPub(pri.ID, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//RegisterMigration 注册迁移,版本号重复时panic
+func RegisterMigration(m Migration) {
+	for _, v := range migrations {
+		if v.Version == m.Version {
+			panic(fmt.Errorf("migration version %d exists", m.Version))
+		}
+	}
+	migrations = append(migrations, m)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+}
+
+//Migrate 执行所有未执行的迁移,返回执行的数量
+//使用分布式锁保证只有一个实例执行,每个迁移和迁移记录在同一个事务中
+func (app *App) Migrate() (int, error) {
+	num := 0
+	err := app.UseRedisWithTimeout(MigrateLockTTL, func(redv IRedisImp) error {
+		//其他实例正在迁移时等待完成
+		var locker ILocker
+		var err error
+		for start := time.Now(); ; time.Sleep(time.Second) {
+			locker, err = redv.Locker(migrateLockKey, MigrateLockTTL)
+			if err == nil || time.Since(start) > MigrateLockTTL {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+		defer locker.Release()
+		applied := map[int]bool{}
+		err = app.UseDb(func(db IDbImp) error {
+			ms, err := db.ListMigrations()
+			if err != nil {
+				return err
+			}
+			for _, m := range ms {
+				applied[m.Version] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if applied[m.Version] {
+				continue
+			}
+			err = app.UseTxWithTimeout(MigrateLockTTL, func(db IDbImp) error {
+				err := m.Up(db)
+				if err != nil {
+					return err
+				}
+				return db.InsertMigration(&TMigration{
+					Version: m.Version,
+					Name:    m.Name,
+					Time:    time.Now().Unix(),
+				})
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s error: %w", m.Version, m.Name, err)
+			}
+			xginx.LogInfof("migration %d %s applied", m.Version, m.Name)
+			num++
+		}
+		return nil
+	})
+	return num, err
+}
+
+//获取已经执行的迁移
+func (ctx *dbimp) ListMigrations() ([]*TMigration, error) {
+	col := ctx.table(TMigrationName)
+	iter, err := col.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TMigration{}
+	for iter.Next(ctx) {
+		v := &TMigration{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//添加迁移记录
+func (ctx *dbimp) InsertMigration(m *TMigration) error {
+	col := ctx.table(TMigrationName)
+	_, err := col.InsertOne(ctx, m)
+	return err
+}
+
+func (db *memimp) ListMigrations() ([]*TMigration, error) {
+	rets := []*TMigration{}
+	var err error
+	err2 := db.eachAll(TMigrationName, func(obj interface{}) bool {
+		v := &TMigration{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) InsertMigration(m *TMigration) error {
+	return db.insert(TMigrationName, m, &TMigration{})
+}
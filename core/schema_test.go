@@ -0,0 +1,153 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMigrate(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	old := migrations
+	defer func() {
+		migrations = old
+	}()
+	//启动时已经执行
+	num, err := app.Migrate()
+	as.NoError(err)
+	as.Equal(0, num)
+	runs := 0
+	RegisterMigration(Migration{Version: 1001, Name: "second", Up: func(db IDbImp) error {
+		runs++
+		return nil
+	}})
+	RegisterMigration(Migration{Version: 1000, Name: "first", Up: func(db IDbImp) error {
+		as.Equal(0, runs)
+		runs++
+		return nil
+	}})
+	as.Panics(func() {
+		RegisterMigration(Migration{Version: 1000})
+	})
+	num, err = app.Migrate()
+	as.NoError(err)
+	as.Equal(2, num)
+	as.Equal(2, runs)
+	num, err = app.Migrate()
+	as.NoError(err)
+	as.Equal(0, num)
+	//失败的迁移不记录
+	RegisterMigration(Migration{Version: 1002, Name: "fail", Up: func(db IDbImp) error {
+		return errors.New("fail")
+	}})
+	_, err = app.Migrate()
+	as.Error(err)
+	err = app.UseDb(func(db IDbImp) error {
+		ms, err := db.ListMigrations()
+		if err != nil {
+			return err
+		}
+		vs := map[int]bool{}
+		for _, m := range ms {
+			vs[m.Version] = true
+		}
+		as.True(vs[1])
+		as.True(vs[2])
+		as.True(vs[1000])
+		as.True(vs[1001])
+		as.False(vs[1002])
+		return nil
+	})
+	as.NoError(err)
+}
+
+func TestClearUserTokens(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user := &TUser{ID: primitive.NewObjectID(), Mobile: "clear_token_test", Token: "token"}
+	err := app.UseDb(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		as.Error(db.InsertUser(&TUser{ID: primitive.NewObjectID(), Mobile: user.Mobile}))
+		err = clearUserTokens(db)
+		if err != nil {
+			return err
+		}
+		v, err := db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal("", v.Token)
+		return nil
+	})
+	as.NoError(err)
+}
+
+func TestMovePublicRoot(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	u1, err := NewUser("move_public_root1", "xh0714")
+	as.NoError(err)
+	u2, err := NewUser("move_public_root2", "xh0714", "kpass")
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		//模拟旧版本使用主私钥扩展公钥
+		for i, u := range []*TUser{u1, u2} {
+			pass := []string{}
+			if i == 1 {
+				pass = append(pass, "kpass")
+			}
+			dk, err := u.GetDeterKey(pass...)
+			if err != nil {
+				return err
+			}
+			xpub, err := dk.ExtPub()
+			if err != nil {
+				return err
+			}
+			u.XPub = xpub.Dump()
+			err = db.InsertUser(u)
+			if err != nil {
+				return err
+			}
+		}
+		err = movePublicRoot(db)
+		if err != nil {
+			return err
+		}
+		v1, err := db.GetUserInfo(u1.ID)
+		if err != nil {
+			return err
+		}
+		dk, err := u1.GetDeterKey()
+		if err != nil {
+			return err
+		}
+		xpub, err := dk.PublicExtPub()
+		if err != nil {
+			return err
+		}
+		as.Equal(xpub.Dump(), v1.XPub)
+		//加密的需要用户提供密码重新生成
+		v2, err := db.GetUserInfo(u2.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal("", v2.XPub)
+		err = db.DeleteUser(u1.ID)
+		if err != nil {
+			return err
+		}
+		return db.DeleteUser(u2.ID)
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,362 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/util"
+	"github.com/hashicorp/go-memdb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+//会话表
+const (
+	TSessionName = "sessions"
+)
+
+//会话设置
+var (
+	//refresh token有效时间
+	RefreshTokenTime = time.Hour * 24 * 30
+	//最后活跃时间更新间隔
+	SessionSeenTime = time.Minute
+)
+
+//TSession 用户登陆会话,每个设备一个
+type TSession struct {
+	ID      primitive.ObjectID `bson:"_id"`     //会话id
+	UserID  primitive.ObjectID `bson:"uid"`     //所属用户
+	Device  string             `bson:"device"`  //设备标识
+	Agent   string             `bson:"agent"`   //user agent
+	IP      string             `bson:"ip"`      //登陆ip
+	Access  string             `bson:"access"`  //当前access token
+	Refresh xginx.HASH256      `bson:"refresh"` //当前refresh token hash
+	Prev    xginx.HASH256      `bson:"prev"`    //上一个refresh token hash,再次使用说明token泄露
+	Time    int64              `bson:"time"`    //创建时间
+	Last    int64              `bson:"last"`    //最后活跃时间
+	Expire  int64              `bson:"expire"`  //refresh token过期时间
+}
+
+//SessionToken 返回给客户端的token
+type SessionToken struct {
+	Access        string //加密的access token
+	Refresh       string //refresh token
+	AccessExpire  int64  //access token过期时间
+	RefreshExpire int64  //refresh token过期时间
+}
+
+//access token对应的会话id
+func sessionKey(tk string) string {
+	return fmt.Sprintf("session:%s", tk)
+}
+
+//会话活跃时间更新标记
+func sessionSeenKey(sid primitive.ObjectID) string {
+	return fmt.Sprintf("session:seen:%s", sid.Hex())
+}
+
+//refresh token hash
+func refreshHash(refresh string) xginx.HASH256 {
+	return xginx.Hash256From([]byte(refresh))
+}
+
+//生成新的access token和refresh token
+func (app *App) issueSession(db IDbImp, sess *TSession) (*SessionToken, error) {
+	now := time.Now()
+	tk := app.GenToken()
+	err := db.SetUserID(tk, sess.UserID, TokenTime)
+	if err != nil {
+		return nil, err
+	}
+	err = db.SetValue(sessionKey(tk), sess.ID.Hex(), TokenTime)
+	if err != nil {
+		return nil, err
+	}
+	refresh := util.NonceStr(32)
+	sess.Access = tk
+	sess.Refresh = refreshHash(refresh)
+	sess.Last = now.Unix()
+	sess.Expire = now.Add(RefreshTokenTime).Unix()
+	return &SessionToken{
+		Access:        app.EncryptToken(tk),
+		Refresh:       refresh,
+		AccessExpire:  now.Add(TokenTime).Unix(),
+		RefreshExpire: sess.Expire,
+	}, nil
+}
+
+//NewSession 登陆成功后创建会话,同一设备只保留一个会话
+func (app *App) NewSession(db IDbImp, uid primitive.ObjectID, device string, agent string, ip string) (*TSession, *SessionToken, error) {
+	if device != "" {
+		ss, err := db.ListSessions(uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, v := range ss {
+			if v.Device != device {
+				continue
+			}
+			err = RevokeSession(db, v)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	sess := &TSession{
+		ID:     primitive.NewObjectID(),
+		UserID: uid,
+		Device: device,
+		Agent:  agent,
+		IP:     ip,
+		Time:   time.Now().Unix(),
+	}
+	tk, err := app.issueSession(db, sess)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.InsertSession(sess)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sess, tk, nil
+}
+
+//RefreshSession 使用refresh token换取新的token,旧的refresh token失效
+func (app *App) RefreshSession(db IDbImp, refresh string, ip string) (*TSession, *SessionToken, error) {
+	hv := refreshHash(refresh)
+	sess, err := db.GetSessionWithRefresh(hv)
+	if err != nil {
+		return nil, nil, errors.New("refresh token error")
+	}
+	//使用了已经轮换的token,会话可能被盗用
+	if sess.Prev == hv && sess.Refresh != hv {
+		err = RevokeSession(db, sess)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("refresh token reused")
+	}
+	if time.Now().Unix() > sess.Expire {
+		err = RevokeSession(db, sess)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, errors.New("refresh token expired")
+	}
+	//旧的access token失效
+	err = db.DelUserID(sess.Access)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.DelValue(sessionKey(sess.Access))
+	if err != nil {
+		return nil, nil, err
+	}
+	sess.Prev = sess.Refresh
+	sess.IP = ip
+	tk, err := app.issueSession(db, sess)
+	if err != nil {
+		return nil, nil, err
+	}
+	//只有refresh token没有被其他请求轮换时才能更新,同一个token只能使用一次
+	err = db.RotateSession(sess, hv)
+	if err != nil {
+		db.DelUserID(sess.Access)
+		db.DelValue(sessionKey(sess.Access))
+		return nil, nil, errors.New("refresh token reused")
+	}
+	return sess, tk, nil
+}
+
+//GetSessionID 获取access token对应的会话id
+func GetSessionID(redv IRedisImp, tk string) (primitive.ObjectID, error) {
+	sid, err := redv.GetValue(sessionKey(tk))
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	return primitive.ObjectIDFromHex(sid)
+}
+
+//TouchSession 更新会话最后活跃时间,SessionSeenTime内只更新一次
+func TouchSession(db IDbImp, sid primitive.ObjectID) error {
+	ok, err := db.SetValueNX(sessionSeenKey(sid), "1", SessionSeenTime)
+	if err != nil || !ok {
+		return err
+	}
+	return db.SetSessionLast(sid, time.Now().Unix())
+}
+
+//RevokeSession 删除会话和对应的access token
+func RevokeSession(db IDbImp, sess *TSession) error {
+	err := db.DelUserID(sess.Access)
+	if err != nil {
+		return err
+	}
+	err = db.DelValue(sessionKey(sess.Access), sessionSeenKey(sess.ID))
+	if err != nil {
+		return err
+	}
+	return db.DeleteSession(sess.ID)
+}
+
+//RevokeUserSessions 删除用户所有会话
+func RevokeUserSessions(db IDbImp, uid primitive.ObjectID) error {
+	ss, err := db.ListSessions(uid)
+	if err != nil {
+		return err
+	}
+	for _, sess := range ss {
+		err = RevokeSession(db, sess)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//添加会话
+func (ctx *dbimp) InsertSession(sess *TSession) error {
+	col := ctx.table(TSessionName)
+	_, err := col.InsertOne(ctx, sess)
+	return err
+}
+
+//获取会话
+func (ctx *dbimp) GetSession(id primitive.ObjectID) (*TSession, error) {
+	col := ctx.table(TSessionName)
+	v := &TSession{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//根据当前或者上一个refresh token获取会话
+func (ctx *dbimp) GetSessionWithRefresh(hv xginx.HASH256) (*TSession, error) {
+	col := ctx.table(TSessionName)
+	v := &TSession{}
+	err := col.FindOne(ctx, bson.M{"$or": bson.A{bson.M{"refresh": hv}, bson.M{"prev": hv}}}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//轮换会话token,当前refresh token hash必须是refresh
+func (ctx *dbimp) RotateSession(sess *TSession, refresh xginx.HASH256) error {
+	col := ctx.table(TSessionName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": sess.ID, "refresh": refresh}, sess)
+	return sr.Err()
+}
+
+//更新会话最后活跃时间
+func (ctx *dbimp) SetSessionLast(id primitive.ObjectID, last int64) error {
+	col := ctx.table(TSessionName)
+	_, err := col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last": last}})
+	return err
+}
+
+//删除会话
+func (ctx *dbimp) DeleteSession(id primitive.ObjectID) error {
+	col := ctx.table(TSessionName)
+	_, err := col.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+//获取用户的会话
+func (ctx *dbimp) ListSessions(uid primitive.ObjectID) ([]*TSession, error) {
+	col := ctx.table(TSessionName)
+	iter, err := col.Find(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TSession{}
+	for iter.Next(ctx) {
+		v := &TSession{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+func (db *memimp) InsertSession(sess *TSession) error {
+	return db.insert(TSessionName, sess, &TSession{})
+}
+
+func (db *memimp) GetSession(id primitive.ObjectID) (*TSession, error) {
+	v := &TSession{}
+	err := db.first(v, TSessionName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) GetSessionWithRefresh(hv xginx.HASH256) (*TSession, error) {
+	v := &TSession{}
+	err := db.first(v, TSessionName, "refresh", hv)
+	if err == nil {
+		return v, nil
+	}
+	err = db.first(v, TSessionName, "prev", hv)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) RotateSession(sess *TSession, refresh xginx.HASH256) error {
+	v := &TSession{}
+	err := memClone(sess, v)
+	if err != nil {
+		return err
+	}
+	//在同一个写事务中检查和更新
+	return db.write(func(txn *memdb.Txn) error {
+		obj, err := txn.First(TSessionName, "id", sess.ID)
+		if err != nil {
+			return err
+		}
+		if obj == nil || obj.(*TSession).Refresh != refresh {
+			return mongo.ErrNoDocuments
+		}
+		return txn.Insert(TSessionName, v)
+	})
+}
+
+func (db *memimp) SetSessionLast(id primitive.ObjectID, last int64) error {
+	sess, err := db.GetSession(id)
+	if err != nil {
+		return err
+	}
+	sess.Last = last
+	return db.insert(TSessionName, sess, &TSession{})
+}
+
+func (db *memimp) DeleteSession(id primitive.ObjectID) error {
+	return db.deleteAll(TSessionName, "id", id)
+}
+
+func (db *memimp) ListSessions(uid primitive.ObjectID) ([]*TSession, error) {
+	rets := []*TSession{}
+	var err error
+	err2 := db.each(TSessionName, "uid", uid, func(obj interface{}) bool {
+		v := &TSession{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
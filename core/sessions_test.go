@@ -0,0 +1,122 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionRefresh(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000003", "xh0714")
+	as.NoError(err)
+	err = app.UseDb(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteUser(user.ID)
+		s1, t1, err := app.NewSession(db, user.ID, "phone", "agent", "127.0.0.1")
+		if err != nil {
+			return err
+		}
+		//同一设备登陆,旧会话失效
+		s2, t2, err := app.NewSession(db, user.ID, "phone", "agent", "127.0.0.1")
+		if err != nil {
+			return err
+		}
+		_, err = db.GetSession(s1.ID)
+		as.Error(err)
+		_, _, err = app.RefreshSession(db, t1.Refresh, "")
+		as.Error(err)
+		tk, err := app.DecryptToken(t2.Access)
+		if err != nil {
+			return err
+		}
+		sid, err := GetSessionID(db, tk)
+		if err != nil {
+			return err
+		}
+		as.Equal(s2.ID, sid)
+		//刷新后旧token失效
+		_, t3, err := app.RefreshSession(db, t2.Refresh, "")
+		if err != nil {
+			return err
+		}
+		as.NotEqual(t2.Refresh, t3.Refresh)
+		_, err = db.GetUserID(tk)
+		as.Error(err)
+		//旧的refresh token再次使用,会话被注销
+		_, _, err = app.RefreshSession(db, t2.Refresh, "")
+		as.Error(err)
+		_, err = db.GetSession(s2.ID)
+		as.Error(err)
+		_, _, err = app.RefreshSession(db, t3.Refresh, "")
+		as.Error(err)
+		//不同设备可以同时登陆
+		_, _, err = app.NewSession(db, user.ID, "pc", "agent", "")
+		if err != nil {
+			return err
+		}
+		_, _, err = app.NewSession(db, user.ID, "", "agent", "")
+		if err != nil {
+			return err
+		}
+		ss, err := db.ListSessions(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Len(ss, 2)
+		err = RevokeUserSessions(db, user.ID)
+		if err != nil {
+			return err
+		}
+		ss, err = db.ListSessions(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Len(ss, 0)
+		return nil
+	})
+	as.NoError(err)
+}
+
+func TestSessionRotateOnce(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000013", "xh0714")
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		sess, tk, err := app.NewSession(db, user.ID, "phone", "agent", "")
+		if err != nil {
+			return err
+		}
+		//其他请求已经轮换了refresh token
+		old := refreshHash(tk.Refresh)
+		_, _, err = app.RefreshSession(db, tk.Refresh, "")
+		if err != nil {
+			return err
+		}
+		as.Error(db.RotateSession(sess, old))
+		//删除用户后会话被注销
+		err = db.DeleteUser(user.ID)
+		if err != nil {
+			return err
+		}
+		ss, err := db.ListSessions(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Len(ss, 0)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cxuhua/xginx"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//TOTP设置 RFC 6238
+var (
+	//发行方名称,显示在验证器app中
+	TOTPIssuer = "xmgrs"
+	//密钥长度
+	TOTPSecretLen = 20
+	//时间步长
+	TOTPPeriod = int64(30)
+	//验证码位数
+	TOTPDigits = 6
+	//允许前后偏差的步数
+	TOTPSkew = int64(1)
+	//恢复码数量
+	TOTPRecoveryNum = 10
+	//恢复码字节长度
+	TOTPRecoveryLen = 5
+	//连续失败次数达到后锁定
+	TOTPMaxFail = 5
+	//失败计数和锁定时间
+	TOTPLockTime = time.Minute * 15
+)
+
+//TOTP错误定义
+var (
+	ErrTOTPRequired = errors.New("totp code required")
+	ErrTOTPCode     = errors.New("totp code error")
+	ErrTOTPLocked   = errors.New("totp too many failures, try later")
+)
+
+//base32编码,不使用填充
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TTOTP 用户两步验证设置
+type TTOTP struct {
+	Secret   []byte          `bson:"secret"`   //加密保存的密钥
+	Enable   bool            `bson:"enable"`   //是否已经启用,验证一次后启用
+	Last     int64           `bson:"last"`     //最后使用的时间步,防止重放
+	Recovery []xginx.HASH256 `bson:"recovery"` //旧版本未加盐的恢复码hash,使用后删除
+	Codes    []TPassword     `bson:"codes"`    //未使用的恢复码,scrypt加盐hash
+}
+
+//IsEnable 是否启用了两步验证
+func (t TTOTP) IsEnable() bool {
+	return t.Enable && len(t.Secret) > 0
+}
+
+//NewTOTP 生成新的密钥,返回base32编码的密钥
+func NewTOTP() (TTOTP, string, error) {
+	t := TTOTP{}
+	key := make([]byte, TOTPSecretLen)
+	_, err := rand.Read(key)
+	if err != nil {
+		return t, "", err
+	}
+	t.Secret, err = xginx.AesEncrypt(cipher, key)
+	if err != nil {
+		return t, "", err
+	}
+	return t, totpEncoding.EncodeToString(key), nil
+}
+
+//TOTPURL 生成验证器app使用的otpauth地址
+func TOTPURL(account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("period", fmt.Sprintf("%d", TOTPPeriod))
+	v.Set("digits", fmt.Sprintf("%d", TOTPDigits))
+	label := url.PathEscape(TOTPIssuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+//TOTPCode 计算密钥在时间步的验证码
+func TOTPCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	num := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, num%mod)
+}
+
+//TOTPStep 时间对应的时间步
+func TOTPStep(now time.Time) int64 {
+	return now.Unix() / TOTPPeriod
+}
+
+//NewRecovery 生成新的恢复码,只返回一次
+func (t *TTOTP) NewRecovery() ([]string, error) {
+	codes := []string{}
+	t.Recovery = nil
+	t.Codes = []TPassword{}
+	for i := 0; i < TOTPRecoveryNum; i++ {
+		bs := make([]byte, TOTPRecoveryLen)
+		_, err := rand.Read(bs)
+		if err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(bs)
+		pwd, err := NewPassword(code)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		t.Codes = append(t.Codes, pwd)
+	}
+	return codes, nil
+}
+
+//检测验证码,成功后更新最后使用的时间步,返回使用标识
+func (t *TTOTP) checkCode(code string, now time.Time) (string, bool) {
+	if len(code) != TOTPDigits {
+		return "", false
+	}
+	key, err := xginx.AesDecrypt(cipher, t.Secret)
+	if err != nil {
+		return "", false
+	}
+	step := TOTPStep(now)
+	for i := -TOTPSkew; i <= TOTPSkew; i++ {
+		cs := step + i
+		//已经使用过的验证码不能再使用
+		if cs <= t.Last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(key, cs)), []byte(code)) == 1 {
+			t.Last = cs
+			return fmt.Sprintf("step:%d", cs), true
+		}
+	}
+	return "", false
+}
+
+//检测恢复码,成功后恢复码失效,返回使用标识
+func (t *TTOTP) checkRecovery(code string) (string, bool) {
+	code = strings.ToLower(code)
+	for i, v := range t.Codes {
+		if v.Check(code) {
+			t.Codes = append(t.Codes[:i], t.Codes[i+1:]...)
+			return "recovery:" + hex.EncodeToString(v.Salt), true
+		}
+	}
+	//兼容旧版本未加盐的恢复码
+	hv := xginx.Hash256From([]byte(code))
+	for i, v := range t.Recovery {
+		if v == hv {
+			t.Recovery = append(t.Recovery[:i], t.Recovery[i+1:]...)
+			return "recovery:" + hv.String(), true
+		}
+	}
+	return "", false
+}
+
+//Check 检测验证码或者恢复码,返回使用的验证码标识
+func (t *TTOTP) Check(code string, now time.Time) (string, bool) {
+	if len(t.Secret) == 0 || code == "" {
+		return "", false
+	}
+	if used, ok := t.checkCode(code, now); ok {
+		return used, true
+	}
+	//验证码长度的输入不会是恢复码,避免每次失败都计算scrypt
+	if len(code) == TOTPDigits {
+		return "", false
+	}
+	return t.checkRecovery(code)
+}
+
+//两步验证失败次数
+func totpFailKey(uid primitive.ObjectID) string {
+	return fmt.Sprintf("totp:fail:%s", uid.Hex())
+}
+
+//已经使用的验证码或者恢复码
+func totpUsedKey(uid primitive.ObjectID, used string) string {
+	return fmt.Sprintf("totp:used:%s:%s", uid.Hex(), used)
+}
+
+//标记保存时间,验证码超过允许的偏差后不能再使用,恢复码一直保存
+func totpUsedTime(used string) time.Duration {
+	if strings.HasPrefix(used, "step:") {
+		return time.Second * time.Duration(TOTPPeriod*(TOTPSkew*2+2))
+	}
+	return 0
+}
+
+//CheckTOTP 检测用户两步验证码,未启用时直接通过
+//连续失败TOTPMaxFail次后锁定TOTPLockTime
+//使用标记和失败次数保存在redis,不受调用者事务回滚影响
+func (u *TUser) CheckTOTP(db IDbImp, code string) error {
+	if !u.TOTP.IsEnable() {
+		return nil
+	}
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	fkey := totpFailKey(u.ID)
+	if v, err := db.GetValue(fkey); err == nil {
+		if num, _ := strconv.Atoi(v); num >= TOTPMaxFail {
+			return ErrTOTPLocked
+		}
+	}
+	used, ok := u.TOTP.Check(code, time.Now())
+	if ok {
+		//其他请求已经使用了这个验证码
+		ok, err := db.SetValueNX(totpUsedKey(u.ID, used), "1", totpUsedTime(used))
+		if err != nil {
+			return err
+		}
+		if ok {
+			err = db.DelValue(fkey)
+			if err != nil {
+				return err
+			}
+			return db.SetUserTOTP(u.ID, u.TOTP)
+		}
+	}
+	_, err := db.IncrValue(fkey, TOTPLockTime)
+	if err != nil {
+		return err
+	}
+	return ErrTOTPCode
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//RFC 6238 测试向量,取后6位
+	key := []byte("12345678901234567890")
+	as := assert.New(t)
+	as.Equal("287082", TOTPCode(key, TOTPStep(time.Unix(59, 0))))
+	as.Equal("081804", TOTPCode(key, TOTPStep(time.Unix(1111111109, 0))))
+	as.Equal("050471", TOTPCode(key, TOTPStep(time.Unix(1111111111, 0))))
+	as.Equal("005924", TOTPCode(key, TOTPStep(time.Unix(1234567890, 0))))
+	as.Equal("279037", TOTPCode(key, TOTPStep(time.Unix(2000000000, 0))))
+}
+
+func TestTOTPCheck(t *testing.T) {
+	as := assert.New(t)
+	totp, secret, err := NewTOTP()
+	as.NoError(err)
+	key, err := totpEncoding.DecodeString(secret)
+	as.NoError(err)
+	now := time.Now()
+	check := func(code string) bool {
+		_, ok := totp.Check(code, now)
+		return ok
+	}
+	code := TOTPCode(key, TOTPStep(now))
+	as.True(check(code))
+	//同一个验证码不能使用两次
+	as.False(check(code))
+	//下一个时间步的验证码可以使用
+	next := now.Add(time.Second * time.Duration(TOTPPeriod))
+	as.True(check(TOTPCode(key, TOTPStep(next))))
+	//恢复码只能使用一次,加盐保存
+	codes, err := totp.NewRecovery()
+	as.NoError(err)
+	as.Len(codes, TOTPRecoveryNum)
+	as.NotEqual(totp.Codes[0].Salt, totp.Codes[1].Salt)
+	as.True(check(codes[0]))
+	as.False(check(codes[0]))
+	as.Len(totp.Codes, TOTPRecoveryNum-1)
+	as.False(check(""))
+}
+
+func TestUserTOTP(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	user, err := NewUser("13900000004", "xh0714")
+	as.NoError(err)
+	err = app.UseDb(func(db IDbImp) error {
+		err := db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		defer db.DeleteUser(user.ID)
+		//未启用时不需要验证码
+		as.NoError(user.CheckTOTP(db, ""))
+		totp, _, err := NewTOTP()
+		if err != nil {
+			return err
+		}
+		codes, err := totp.NewRecovery()
+		if err != nil {
+			return err
+		}
+		totp.Enable = true
+		err = db.SetUserTOTP(user.ID, totp)
+		if err != nil {
+			return err
+		}
+		user, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(ErrTOTPRequired, user.CheckTOTP(db, ""))
+		as.Equal(ErrTOTPCode, user.CheckTOTP(db, "000000x"))
+		as.NoError(user.CheckTOTP(db, codes[1]))
+		//使用过的恢复码已保存
+		user, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(ErrTOTPCode, user.CheckTOTP(db, codes[1]))
+		//业务事务回滚,数据库中还有这个恢复码时也不能再次使用
+		err = db.SetUserTOTP(user.ID, totp)
+		if err != nil {
+			return err
+		}
+		user, err = db.GetUserInfo(user.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(ErrTOTPCode, user.CheckTOTP(db, codes[1]))
+		//连续失败后锁定,正确的恢复码也不能使用
+		for i := 0; i < TOTPMaxFail; i++ {
+			user.CheckTOTP(db, "000000")
+		}
+		as.Equal(ErrTOTPLocked, user.CheckTOTP(db, codes[2]))
+		return db.DelValue(totpFailKey(user.ID))
+	})
+	as.NoError(err)
+}
@@ -18,6 +18,15 @@ const (
 	TSigName = "sigs"
 )
 
+//交易设置
+var (
+	//未完成交易的过期时间,过期后自动取消,为0不过期
+	TxExpireTime = time.Hour * 24 * 7
+)
+
+//ErrWatchOnly 只读账号不能直接消费
+var ErrWatchOnly = errors.New("watch only account need external sigs")
+
 //ISaveSigs 保存签名接口
 type ISaveSigs interface {
 	SaveSigs() error
@@ -28,6 +37,15 @@ type DbSignListener struct {
 	user *TUser //当前用户
 	db   IDbImp //db接口
 	sigs []*TSigs
+	ext  bool          //是否允许外部签名，允许后可以使用只读账号
+	sel  ICoinSelector //金额选择策略
+	amt  xginx.Amount  //需要的金额,选择策略使用
+	flt  CoinFilter    //限制使用的账号
+	used xginx.Coins   //提供给交易使用的金额
+	kp   KeepPolicy    //找零策略
+	kacc xginx.Address //指定的找零账号
+	keep xginx.Address //已经确定的找零地址
+	kerr error         //获取找零地址时的错误
 }
 
 //NewSignListener 创建签名列表
@@ -39,6 +57,22 @@ func NewSignListener(db IDbImp, user *TUser) *DbSignListener {
 	}
 }
 
+//SetExternal 设置是否允许外部签名
+func (st *DbSignListener) SetExternal(ext bool) {
+	st.ext = ext
+}
+
+//SetSelector 设置金额选择策略和需要的金额
+func (st *DbSignListener) SetSelector(sel ICoinSelector, amt xginx.Amount) {
+	st.sel = sel
+	st.amt = amt
+}
+
+//SetFilter 限制使用的账号
+func (st *DbSignListener) SetFilter(flt CoinFilter) {
+	st.flt = flt
+}
+
 //GetSigs 获取需要保存的交易签名列表
 func (st *DbSignListener) GetSigs() []*TSigs {
 	return st.sigs
@@ -73,24 +107,30 @@ func (st *DbSignListener) GetTxInExec(ckv *xginx.CoinKeyValue) []byte {
 //GetCoins 获取使用的金额
 func (st *DbSignListener) GetCoins() xginx.Coins {
 	bi := xginx.GetBlockIndex()
-	ds, err := st.user.ListCoins(st.db, bi)
+	ds, err := st.user.listCoins(st.db, bi, func(acc *TAccount) bool {
+		//不允许外部签名时只读账号的金额不可用
+		if acc.Watch && !st.ext {
+			return false
+		}
+		return st.flt.Match(acc)
+	})
 	if err != nil {
 		return nil
 	}
-	return ds.Coins.Sort()
-}
-
-//GetKeep 获取找零地址
-func (st *DbSignListener) GetKeep() xginx.Address {
-	accs, err := st.user.ListAccounts(st.db)
-	if err != nil {
-		panic(err)
+	//跳过被其他未完成交易占用的金额
+	coins := xginx.Coins{}
+	for _, coin := range ds.Coins {
+		if IsReserved(st.db, coin.TxID, coin.Index.ToUInt32()) {
+			continue
+		}
+		coins = append(coins, coin)
 	}
-	if len(accs) == 0 {
-		panic(errors.New("user no accounts"))
+	if st.sel == nil {
+		st.used = coins.Sort()
+	} else {
+		st.used = st.sel.Select(coins, st.amt)
 	}
-	//默认使用第一个地址作为找零地址
-	return accs[0].GetAddress()
+	return st.used
 }
 
 //SignTx 获取签名信息,保存需要签名的信息
@@ -103,6 +143,9 @@ func (st *DbSignListener) SignTx(singer xginx.ISigner, pass ...string) error {
 	if err != nil {
 		return err
 	}
+	if acc.Watch && !st.ext {
+		return ErrWatchOnly
+	}
 	tx, _, _, idx := singer.GetObjs()
 	tid, err := tx.ID()
 	if err != nil {
@@ -113,6 +156,15 @@ func (st *DbSignListener) SignTx(singer xginx.ISigner, pass ...string) error {
 		return err
 	}
 	st.sigs = []*TSigs{}
+	//只读账号没有私钥，由当前用户提交外部签名
+	if acc.Watch {
+		for _, kid := range acc.Kid {
+			sigs := NewSigs(tid, st.user.ID, kid, hash, idx)
+			sigs.External = true
+			st.sigs = append(st.sigs, sigs)
+		}
+		return nil
+	}
 	//分析账户用到的密钥，并保存记录等候签名
 	for _, kid := range acc.Kid {
 		pk, err := st.db.GetPrivate(kid)
@@ -177,14 +229,15 @@ func (out TTxOut) ToTxOut() *xginx.TxOut {
 
 //TSigs 保存私钥id 需要签名的hash 并且标记是否已经签名
 type TSigs struct {
-	ID     primitive.ObjectID `bson:"_id"`  //ID
-	UserID primitive.ObjectID `bson:"uid"`  //私钥所属用户
-	TxID   xginx.HASH256      `bson:"tid"`  //交易id
-	KeyID  string             `bson:"kid"`  //私钥id
-	Hash   []byte             `bson:"hash"` //需要签名的HASH数据
-	Idx    int                `bson:"idx"`  //输入索引
-	IsSign bool               `bson:"sigb"` //是否签名
-	Sigs   xginx.SigBytes     `bson:"sigs"` //签名结果
+	ID       primitive.ObjectID `bson:"_id"`  //ID
+	UserID   primitive.ObjectID `bson:"uid"`  //私钥所属用户
+	TxID     xginx.HASH256      `bson:"tid"`  //交易id
+	KeyID    string             `bson:"kid"`  //私钥id
+	Hash     []byte             `bson:"hash"` //需要签名的HASH数据
+	Idx      int                `bson:"idx"`  //输入索引
+	IsSign   bool               `bson:"sigb"` //是否签名
+	Sigs     xginx.SigBytes     `bson:"sigs"` //签名结果
+	External bool               `bson:"ext"`  //是否由外部签名，只读账号使用
 }
 
 //Sign 签名并保存
@@ -193,11 +246,14 @@ func (sig *TSigs) Sign(db IDbImp, pass ...string) error {
 	if sig.IsSign {
 		return nil
 	}
+	if sig.External {
+		return ErrWatchOnly
+	}
 	pri, err := db.GetPrivate(sig.KeyID)
 	if err != nil {
 		return err
 	}
-	xpri, err := pri.ToPrivate(pass...)
+	xpri, err := pri.LoadPrivate(db, pass...)
 	if err != nil {
 		return err
 	}
@@ -230,24 +286,51 @@ type TTxState int
 
 //交易状态定义
 const (
-	TTxStateNew    TTxState = 0 //新交易
-	TTxStateSign            = 1 //已签名
-	TTxStatePool            = 2 //进入交易池
-	TTxStateBlock           = 3 //进入区块
-	TTxStateCancel          = 4 //取消作废
+	TTxStateNew       TTxState = 0 //新交易
+	TTxStateSign               = 1 //已签名
+	TTxStatePool               = 2 //进入交易池
+	TTxStateBlock              = 3 //进入区块
+	TTxStateCancel             = 4 //取消作废
+	TTxStateConfirmed          = 5 //达到需要的确认数,交易完成
+)
+
+//TTxCancelType 交易取消方式
+type TTxCancelType int
+
+//交易取消方式定义
+const (
+	TTxCancelNone     TTxCancelType = 0 //未取消
+	TTxCancelUser                   = 1 //创建者撤回
+	TTxCancelReject                 = 2 //签名者拒绝
+	TTxCancelExpire                 = 3 //过期取消
+	TTxCancelConflict               = 4 //区块断开后冲突交易进入区块
 )
 
+//TTxCancel 交易取消信息
+type TTxCancel struct {
+	Type   TTxCancelType      `bson:"type"`   //取消方式
+	UserID primitive.ObjectID `bson:"uid"`    //操作用户,过期取消时为空
+	Reason string             `bson:"reason"` //取消或者拒绝的原因
+	Time   int64              `bson:"time"`   //取消时间
+}
+
 //TTx 临时交易信息
 type TTx struct {
-	ID     []byte             `bson:"_id"`    //交易id
-	UserID primitive.ObjectID `bson:"uid"`    //谁创建的交易
-	Ver    uint32             `bson:"ver"`    //TxVer
-	Ins    []TTxIn            `bson:"ins"`    //TxInputs
-	Outs   []TTxOut           `bson:"outs"`   //TxOuts
-	Script xginx.Script       `bson:"script"` //交易脚本
-	Time   int64              `bson:"time"`   //创建时间
-	Desc   string             `bson:"desc"`   //TxDesc
-	State  TTxState           `bson:"state"`  //TTxState*
+	ID      []byte             `bson:"_id"`     //交易id
+	UserID  primitive.ObjectID `bson:"uid"`     //谁创建的交易
+	Ver     uint32             `bson:"ver"`     //TxVer
+	Ins     []TTxIn            `bson:"ins"`     //TxInputs
+	Outs    []TTxOut           `bson:"outs"`    //TxOuts
+	Script  xginx.Script       `bson:"script"`  //交易脚本
+	Time    int64              `bson:"time"`    //创建时间
+	Desc    string             `bson:"desc"`    //TxDesc
+	State   TTxState           `bson:"state"`   //TTxState*
+	Expire  int64              `bson:"expire"`  //过期时间,为0不过期
+	Cancel  TTxCancel          `bson:"cancel"`  //取消信息
+	Block   []byte             `bson:"blk"`     //所在区块id,不在区块中为空
+	Height  uint32             `bson:"height"`  //所在区块高度
+	Confirm uint32             `bson:"confirm"` //确认数,链高度变化时更新
+	Need    uint32             `bson:"need"`    //完成需要的确认数,进入区块时根据相关账号设置
 }
 
 //NewSigs 创建待签名对象
@@ -319,9 +402,89 @@ func (st *setsigner) SignTx(singer xginx.ISigner, pass ...string) error {
 	return nil
 }
 
-//SetTxState 设置交易状态
+//SetTxState 设置交易状态,进入区块或者作废后释放占用的金额
 func (stx *TTx) SetTxState(db IDbImp, state TTxState) error {
-	return db.SetTxState(stx.ID, state)
+	err := db.SetTxState(stx.ID, state)
+	if err != nil {
+		return err
+	}
+	stx.State = state
+	if state == TTxStateBlock || state == TTxStateCancel {
+		err = db.DeleteReserves(stx.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if typ, has := stateEvents[state]; has {
+		stx.publish(db, stx.eventUsers(db), typ)
+	}
+	return nil
+}
+
+//IsPending 是否是未完成的交易,新交易或者已经签名未发布
+func (stx *TTx) IsPending() bool {
+	return stx.State == TTxStateNew || stx.State == TTxStateSign
+}
+
+//IsExpired 未完成的交易是否已经过期
+func (stx *TTx) IsExpired(now time.Time) bool {
+	return stx.IsPending() && stx.Expire > 0 && now.Unix() > stx.Expire
+}
+
+//IsDead 交易是否已经作废,取消或者过期
+func (stx *TTx) IsDead(now time.Time) bool {
+	return stx.State == TTxStateCancel || stx.IsExpired(now)
+}
+
+//取消交易并删除签名记录
+func (stx *TTx) cancel(db IDbImp, typ TTxCancelType, uid primitive.ObjectID, reason string) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	if !stx.IsPending() {
+		return fmt.Errorf("tx state %d can't cancel", stx.State)
+	}
+	return stx.setCancel(db, typ, uid, reason)
+}
+
+//CancelTx 创建者撤回交易
+func (stx *TTx) CancelTx(db IDbImp, uid primitive.ObjectID, reason string) error {
+	if !ObjectIDEqual(stx.UserID, uid) {
+		return errors.New("not mine ttx")
+	}
+	return stx.cancel(db, TTxCancelUser, uid, reason)
+}
+
+//RejectTx 签名者拒绝签名,交易作废
+func (stx *TTx) RejectTx(db IDbImp, uid primitive.ObjectID, reason string) error {
+	if stx.State != TTxStateNew {
+		return errors.New("new tx can reject")
+	}
+	sigs, err := db.ListUserSigs(uid, xginx.NewHASH256(stx.ID))
+	if err != nil {
+		return err
+	}
+	if len(sigs) == 0 {
+		return errors.New("no sigs need reject")
+	}
+	return stx.cancel(db, TTxCancelReject, uid, reason)
+}
+
+//ExpireTxs 取消所有已经过期的未完成交易,返回取消的数量
+func ExpireTxs(db IDbImp, now time.Time) (int, error) {
+	txs, err := db.ListExpiredTxs(now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, stx := range txs {
+		err = stx.cancel(db, TTxCancelExpire, primitive.NilObjectID, "expired")
+		if err != nil {
+			return num, err
+		}
+		num++
+	}
+	return num, nil
 }
 
 //Verify 验证签名是否成功
@@ -331,6 +494,14 @@ func (stx *TTx) Verify(db IDbImp, bi *xginx.BlockIndex) bool {
 	return err == nil
 }
 
+//SetSigned 签名验证成功后更新为已经签名,返回是否完成签名
+func (stx *TTx) SetSigned(db IDbImp, bi *xginx.BlockIndex) (bool, error) {
+	if !stx.Verify(db, bi) {
+		return false, nil
+	}
+	return true, stx.SetTxState(db, TTxStateSign)
+}
+
 //ToTx 转换为tx并将签名合并进去
 func (stx *TTx) ToTx(db IDbImp, bi *xginx.BlockIndex, pass ...string) (*xginx.TX, error) {
 	tx := xginx.NewTx(0)
@@ -381,6 +552,11 @@ func (u *TUser) SaveTx(db IDbImp, tx *xginx.TX, lis ISaveSigs, desc ...string) (
 	if err != nil {
 		return nil, err
 	}
+	//占用使用的金额
+	err = stx.Reserve(db)
+	if err != nil {
+		return nil, err
+	}
 	//保存签名
 	return stx, lis.SaveSigs()
 }
@@ -400,6 +576,9 @@ func NewTTx(uid primitive.ObjectID, tx *xginx.TX) *TTx {
 	v.Script = tx.Script.Clone()
 	v.UserID = uid
 	v.Time = time.Now().Unix()
+	if TxExpireTime > 0 {
+		v.Expire = v.Time + int64(TxExpireTime/time.Second)
+	}
 	return v
 }
 
@@ -429,11 +608,16 @@ func (ctx *dbimp) ListUserTxs(uid primitive.ObjectID, sign bool) ([]*TTx, error)
 	}
 	//获取对应的交易信息
 	txs := []*TTx{}
+	now := time.Now()
 	for tid := range ids {
 		tx, err := ctx.GetTx(tid[:])
 		if err != nil {
 			continue
 		}
+		//已经取消或者过期的交易不返回
+		if tx.IsDead(now) {
+			continue
+		}
 		//如果获取的是未签名的，并且已经验证成功，不返回这个交易
 		if !sign && tx.Verify(ctx, bi) {
 			continue
@@ -539,12 +723,97 @@ func (ctx *dbimp) DeleteTx(id []byte) error {
 	if err != nil {
 		return err
 	}
+	//释放占用的金额
+	err = ctx.DeleteReserves(id)
+	if err != nil {
+		return err
+	}
 	//删除交易
 	col = ctx.table(TTxName)
 	_, err = col.DeleteOne(ctx, bson.M{"_id": id})
 	return err
 }
 
+//取消交易,删除交易对应的签名列表
+func (ctx *dbimp) CancelTx(id []byte, cancel TTxCancel) error {
+	if !ctx.IsTx() {
+		return errors.New("need use tx")
+	}
+	col := ctx.table(TSigName)
+	_, err := col.DeleteMany(ctx, bson.M{"tid": xginx.NewHASH256(id)})
+	if err != nil {
+		return err
+	}
+	err = ctx.DeleteReserves(id)
+	if err != nil {
+		return err
+	}
+	col = ctx.table(TTxName)
+	doc := bson.M{"$set": bson.M{"state": TTxStateCancel, "cancel": cancel}}
+	return col.FindOneAndUpdate(ctx, bson.M{"_id": id}, doc).Err()
+}
+
+//设置交易所在区块,进入区块时确认数为1
+func (ctx *dbimp) SetTxBlock(id []byte, blk []byte, height uint32, need uint32) error {
+	confirm := uint32(0)
+	if blk != nil {
+		confirm = 1
+	}
+	col := ctx.table(TTxName)
+	doc := bson.M{"$set": bson.M{"blk": blk, "height": height, "confirm": confirm, "need": need}}
+	return col.FindOneAndUpdate(ctx, bson.M{"_id": id}, doc).Err()
+}
+
+//设置交易确认数
+func (ctx *dbimp) SetTxConfirm(id []byte, confirm uint32) error {
+	col := ctx.table(TTxName)
+	doc := bson.M{"$set": bson.M{"confirm": confirm}}
+	return col.FindOneAndUpdate(ctx, bson.M{"_id": id}, doc).Err()
+}
+
+//获取进入区块还未完成的交易
+func (ctx *dbimp) ListBlockTxs() ([]*TTx, error) {
+	col := ctx.table(TTxName)
+	iter, err := col.Find(ctx, bson.M{"state": TTxStateBlock})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TTx{}
+	for iter.Next(ctx) {
+		v := &TTx{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//获取已经过期的未完成交易
+func (ctx *dbimp) ListExpiredTxs(now int64) ([]*TTx, error) {
+	col := ctx.table(TTxName)
+	iter, err := col.Find(ctx, bson.M{
+		"state":  bson.M{"$in": []TTxState{TTxStateNew, TTxStateSign}},
+		"expire": bson.M{"$gt": 0, "$lt": now},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TTx{}
+	for iter.Next(ctx) {
+		v := &TTx{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
 //添加一个私钥
 func (ctx *dbimp) InsertTx(tx *TTx) error {
 	col := ctx.table(TTxName)
@@ -4,10 +4,12 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/cxuhua/xginx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type TxsTestSuite struct {
@@ -142,3 +144,83 @@ func TestTxsSuite(t *testing.T) {
 	})
 	assert.NoError(t, err)
 }
+
+func TestCancelTx(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	sid := primitive.NewObjectID()
+	now := time.Now()
+	newtx := func(id string, expire int64) (*TTx, *TSigs) {
+		stx := &TTx{ID: xginx.Hash256From([]byte(id)).Bytes(), UserID: uid, State: TTxStateNew, Expire: expire}
+		sig := NewSigs(xginx.NewHASH256(stx.ID), sid, "kid", []byte("hash"), 0)
+		return stx, sig
+	}
+	err := app.UseTx(func(db IDbImp) error {
+		tx1, sig1 := newtx("cancel_test_tx1", now.Unix()+3600)
+		tx2, sig2 := newtx("cancel_test_tx2", now.Unix()+3600)
+		tx3, sig3 := newtx("cancel_test_tx3", now.Unix()-10)
+		for _, v := range []struct {
+			tx  *TTx
+			sig *TSigs
+		}{{tx1, sig1}, {tx2, sig2}, {tx3, sig3}} {
+			err := db.InsertTx(v.tx)
+			if err != nil {
+				return err
+			}
+			defer db.DeleteTx(v.tx.ID)
+			err = db.InsertSigs(v.sig)
+			if err != nil {
+				return err
+			}
+		}
+		as.True(tx3.IsDead(now))
+		as.False(tx1.IsDead(now))
+		//只有创建者可以撤回
+		as.Error(tx1.CancelTx(db, sid, "not mine"))
+		as.NoError(tx1.CancelTx(db, uid, "cancel"))
+		as.Error(tx1.CancelTx(db, uid, "cancel"))
+		v, err := db.GetTx(tx1.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(TTxState(TTxStateCancel), v.State)
+		as.Equal(TTxCancelType(TTxCancelUser), v.Cancel.Type)
+		as.Equal("cancel", v.Cancel.Reason)
+		sigs, err := db.ListSigs(xginx.NewHASH256(tx1.ID))
+		if err != nil {
+			return err
+		}
+		as.Len(sigs, 0)
+		//只有需要签名的用户可以拒绝
+		as.Error(tx2.RejectTx(db, uid, "reject"))
+		as.NoError(tx2.RejectTx(db, sid, "reject"))
+		v, err = db.GetTx(tx2.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(TTxCancelType(TTxCancelReject), v.Cancel.Type)
+		as.True(ObjectIDEqual(sid, v.Cancel.UserID))
+		//取消过期交易
+		num, err := ExpireTxs(db, now)
+		if err != nil {
+			return err
+		}
+		as.Equal(1, num)
+		v, err = db.GetTx(tx3.ID)
+		if err != nil {
+			return err
+		}
+		as.Equal(TTxState(TTxStateCancel), v.State)
+		as.Equal(TTxCancelType(TTxCancelExpire), v.Cancel.Type)
+		//作废的交易不返回
+		txs, err := db.ListUserTxs(sid, false)
+		if err != nil {
+			return err
+		}
+		as.Len(txs, 0)
+		return nil
+	})
+	as.NoError(err)
+}
@@ -16,13 +16,19 @@ const (
 
 //TUser 用户管理
 type TUser struct {
-	ID     primitive.ObjectID `bson:"_id"`    //id
-	Mobile string             `bson:"mobile"` //手机号
-	Pass   xginx.HASH256      `bson:"pass"`   //hash256登陆密码
-	Keys   string             `bson:"keys"`   //b58编码存储的DeterKey内容,如果创建用户时设置了密码，这里会被加密
-	Cipher CipherType         `bson:"cipher"` //key加密方式
-	Idx    uint32             `bson:"idx"`    //keys idx
-	Token  string             `bson:"token"`  //登陆token
+	ID       primitive.ObjectID `bson:"_id"`    //id
+	Mobile   string             `bson:"mobile"` //手机号
+	Pass     xginx.HASH256      `bson:"pass"`   //旧版本hash256登陆密码,升级后清空
+	Pwd      TPassword          `bson:"pwd"`    //加盐的登陆密码
+	Reset    bool               `bson:"reset"`  //是否需要重置登陆密码
+	Keys     string             `bson:"keys"`   //b58编码存储的DeterKey内容,如果创建用户时设置了密码，这里会被加密
+	Cipher   CipherType         `bson:"cipher"` //key加密方式
+	Idx      uint32             `bson:"idx"`    //keys idx
+	Token    string             `bson:"token"`  //旧版本登陆token,已使用TSession代替
+	PushID   string             `bson:"pid"`    //推送id
+	TOTP     TTOTP              `bson:"totp"`   //两步验证设置
+	XPub     string             `bson:"xpub"`   //非强化派生根的扩展公钥,可以不使用私钥派生新地址
+	BookOnly bool               `bson:"bonly"`  //只允许向地址簿中的地址付款
 }
 
 //NewUser 创建用户
@@ -44,8 +50,16 @@ func NewUser(mobile string, upass string, kpass ...string) (*TUser, error) {
 		return nil, err
 	}
 	u.Keys = keys
+	xpub, err := ndk.PublicExtPub()
+	if err != nil {
+		return nil, err
+	}
+	u.XPub = xpub.Dump()
 	u.Idx = 0
-	u.Pass = xginx.Hash256From([]byte(upass))
+	err = u.SetPass(upass)
+	if err != nil {
+		return nil, err
+	}
 	return u, nil
 }
 
@@ -82,6 +96,22 @@ func (u *TUser) ImportAccount(db IDbImp, acc *xginx.Account, desc string, tags [
 	return nacc, err
 }
 
+//ImportWatchAccount 导入只读账号，只需要公钥
+func (u *TUser) ImportWatchAccount(db IDbImp, num uint8, less uint8, arb bool, pks []xginx.PKBytes, desc string, tags []string) (*TAccount, error) {
+	if !db.IsTx() {
+		return nil, fmt.Errorf("must use tx")
+	}
+	nacc, err := NewWatchAccount([]primitive.ObjectID{u.ID}, num, less, arb, pks, desc, tags)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.GetAccount(nacc.ID); err == nil {
+		return nil, fmt.Errorf("account %s exists", nacc.ID)
+	}
+	err = db.InsertAccount(nacc)
+	return nacc, err
+}
+
 //GetDeterKey 获取密钥
 func (u *TUser) GetDeterKey(pass ...string) (*DeterKey, error) {
 	if u.Cipher == CipherTypeAes && (len(pass) == 0 || pass[0] == "") {
@@ -90,12 +120,6 @@ func (u *TUser) GetDeterKey(pass ...string) (*DeterKey, error) {
 	return LoadDeterKey(u.Keys, pass...)
 }
 
-//CheckPass 检测登陆密码
-func (u *TUser) CheckPass(pass string) bool {
-	hv := xginx.Hash256From([]byte(pass))
-	return len(pass) > 0 && hv.Equal(u.Pass)
-}
-
 //ListTxs 获取用户相关的交易
 func (u *TUser) ListTxs(db IDbImp, sign bool) ([]*TTx, error) {
 	return db.ListUserTxs(u.ID, sign)
@@ -106,14 +130,38 @@ func (u *TUser) ListAccounts(db IDbImp) ([]*TAccount, error) {
 	return db.ListAccounts(u.ID)
 }
 
-//ListCoins 获取用户余额
+//ListCoins 获取用户余额,包括只读账号
 func (u *TUser) ListCoins(db IDbImp, bi *xginx.BlockIndex) (*xginx.CoinsState, error) {
+	return u.listCoins(db, bi, func(acc *TAccount) bool {
+		return true
+	})
+}
+
+//ListSpendCoins 获取可以直接消费的余额,不包括只读账号
+func (u *TUser) ListSpendCoins(db IDbImp, bi *xginx.BlockIndex) (*xginx.CoinsState, error) {
+	return u.listCoins(db, bi, func(acc *TAccount) bool {
+		return !acc.Watch
+	})
+}
+
+//ListWatchCoins 获取只读账号余额
+func (u *TUser) ListWatchCoins(db IDbImp, bi *xginx.BlockIndex) (*xginx.CoinsState, error) {
+	return u.listCoins(db, bi, func(acc *TAccount) bool {
+		return acc.Watch
+	})
+}
+
+//获取符合条件的账号余额
+func (u *TUser) listCoins(db IDbImp, bi *xginx.BlockIndex, fn func(acc *TAccount) bool) (*xginx.CoinsState, error) {
 	accs, err := db.ListAccounts(u.ID)
 	if err != nil {
 		return nil, err
 	}
 	s := &xginx.CoinsState{}
 	for _, acc := range accs {
+		if !fn(acc) {
+			continue
+		}
 		cs, err := acc.ListCoins(bi)
 		if err != nil {
 			return nil, err
@@ -198,6 +246,44 @@ func (ctx *dbimp) SetUserKeyPass(uid primitive.ObjectID, old string, new string)
 	return err
 }
 
+//设置登陆密码，清除旧版本密码和重置标记
+func (ctx *dbimp) SetUserPass(uid primitive.ObjectID, pwd TPassword) error {
+	col := ctx.table(TUsersName)
+	doc := bson.M{"$set": bson.M{"pwd": pwd, "pass": xginx.HASH256{}, "reset": false}}
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, doc)
+	return sr.Err()
+}
+
+//设置主私钥和派生索引
+func (ctx *dbimp) SetUserKeys(uid primitive.ObjectID, keys string, xpub string, cipher CipherType, idx uint32) error {
+	col := ctx.table(TUsersName)
+	doc := bson.M{"$set": bson.M{"keys": keys, "xpub": xpub, "cipher": cipher, "idx": idx}}
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, doc)
+	return sr.Err()
+}
+
+//设置用户非强化派生根的扩展公钥
+func (ctx *dbimp) SetUserXPub(uid primitive.ObjectID, xpub string) error {
+	col := ctx.table(TUsersName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{"xpub": xpub}})
+	return sr.Err()
+}
+
+//设置两步验证
+func (ctx *dbimp) SetUserTOTP(uid primitive.ObjectID, totp TTOTP) error {
+	col := ctx.table(TUsersName)
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, bson.M{"$set": bson.M{"totp": totp}})
+	return sr.Err()
+}
+
+//强制用户重置登陆密码，同时清除登陆token
+func (ctx *dbimp) ForceResetPass(uid primitive.ObjectID) error {
+	col := ctx.table(TUsersName)
+	doc := bson.M{"$set": bson.M{"reset": true, "token": ""}}
+	sr := col.FindOneAndUpdate(ctx, bson.M{"_id": uid}, doc)
+	return sr.Err()
+}
+
 // 设置用户推送id
 func (ctx *dbimp) SetPushID(uid primitive.ObjectID, pid string) error {
 	col := ctx.table(TUsersName)
@@ -233,12 +319,23 @@ func (ctx *dbimp) DeleteUser(id interface{}) error {
 	if err != nil {
 		return err
 	}
+	//释放用户交易占用的金额
+	col = ctx.table(TReserveName)
+	_, err = col.DeleteMany(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return err
+	}
 	//删除用户交易
 	col = ctx.table(TTxName)
 	_, err = col.DeleteMany(ctx, bson.M{"uid": uid})
 	if err != nil {
 		return err
 	}
+	//注销用户所有会话,refresh token不能再使用
+	err = RevokeUserSessions(ctx, uid)
+	if err != nil {
+		return err
+	}
 	//删除用户信息
 	col = ctx.table(TUsersName)
 	_, err = col.DeleteOne(ctx, bson.M{"_id": uid})
@@ -253,5 +350,9 @@ func (ctx *dbimp) InsertUser(obj *TUser) error {
 	}
 	col := ctx.table(TUsersName)
 	_, err = col.InsertOne(ctx, obj)
+	//同时注册时由唯一索引保证手机号不重复
+	if isDuplicateKey(err) {
+		return errors.New("user exists")
+	}
 	return err
 }
@@ -62,6 +62,66 @@ func TestImportAccount(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestImportWatchAccount(t *testing.T) {
+	app := InitApp(context.Background())
+	defer app.Close()
+	err := app.UseTx(func(db IDbImp) error {
+		user, err := db.GetUserInfoWithMobile("17716858037")
+		if err == nil {
+			db.DeleteUser(user.ID)
+		}
+		user, err = NewUser("17716858037", "xh0714")
+		if err != nil {
+			return err
+		}
+		err = db.InsertUser(user)
+		if err != nil {
+			return err
+		}
+		//只使用公钥导入
+		acc, err := xginx.NewAccount(2, 2, false)
+		if err != nil {
+			return err
+		}
+		tacc, err := user.ImportWatchAccount(db, 2, 2, false, acc.GetPks(), "watch", nil)
+		if err != nil {
+			return err
+		}
+		id, err := acc.GetAddress()
+		if err != nil {
+			return err
+		}
+		if tacc.ID != id {
+			return errors.New("watch account address error")
+		}
+		tacc, err = db.GetAccount(tacc.ID)
+		if err != nil {
+			return err
+		}
+		if !tacc.Watch {
+			return errors.New("watch flag error")
+		}
+		//不保存私钥
+		for _, kid := range tacc.Kid {
+			if _, err := db.GetPrivate(kid); err == nil {
+				return errors.New("watch account save private")
+			}
+		}
+		//重复导入
+		_, err = user.ImportWatchAccount(db, 2, 2, false, acc.GetPks(), "watch", nil)
+		if err == nil {
+			return errors.New("import exists account")
+		}
+		//只读账号不能导出私钥
+		_, err = tacc.ToAccount(db, true)
+		if err == nil {
+			return errors.New("watch account load private")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
 func TestAddUsersWithKeyPassword(t *testing.T) {
 	kpass := "11223344"
 	//添加测试用户
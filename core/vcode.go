@@ -0,0 +1,159 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/cxuhua/xginx"
+)
+
+//CodeType 验证码类型
+type CodeType string
+
+//验证码类型定义
+const (
+	//注册验证码
+	CodeTypeRegister CodeType = "register"
+	//重置登陆密码验证码
+	CodeTypeResetPass CodeType = "reset"
+)
+
+//IsValid 是否是支持的验证码类型
+func (t CodeType) IsValid() bool {
+	return t == CodeTypeRegister || t == CodeTypeResetPass
+}
+
+//验证码设置
+var (
+	//验证码长度
+	CodeLength = 6
+	//验证码有效时间
+	CodeTime = time.Minute * 5
+	//两次发送最短间隔
+	CodeResendTime = time.Minute
+	//最多尝试次数,超过后验证码失效
+	CodeMaxTry = int64(5)
+	//验证码发送实现
+	CodeSender ICodeSender = NewLogCodeSender(nil)
+)
+
+//验证码错误定义
+var (
+	ErrCodeResend  = errors.New("code send too frequently")
+	ErrCodeExpired = errors.New("code expired")
+	ErrCodeTry     = errors.New("code try too many times")
+	ErrCodeError   = errors.New("code error")
+)
+
+//ICodeSender 验证码发送接口,对接短信服务商实现
+type ICodeSender interface {
+	//发送验证码到手机
+	Send(mobile string, typ CodeType, code string) error
+}
+
+//LogCodeSender 输出验证码到日志或者文件,测试使用
+type LogCodeSender struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+//NewLogCodeSender w为空时输出到日志
+func NewLogCodeSender(w io.Writer) *LogCodeSender {
+	return &LogCodeSender{w: w}
+}
+
+//Send 每个验证码输出一行 mobile type code
+func (s *LogCodeSender) Send(mobile string, typ CodeType, code string) error {
+	if s.w == nil {
+		xginx.LogInfo("send code", mobile, typ, code)
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.w, "%s %s %s\n", mobile, typ, code)
+	return err
+}
+
+//验证码保存key
+func codeKey(typ CodeType, mobile string) string {
+	return fmt.Sprintf("code:%s:%s", typ, mobile)
+}
+
+//验证码尝试次数key
+func codeTryKey(typ CodeType, mobile string) string {
+	return fmt.Sprintf("code:try:%s:%s", typ, mobile)
+}
+
+//验证码重发限制key
+func codeResendKey(typ CodeType, mobile string) string {
+	return fmt.Sprintf("code:resend:%s:%s", typ, mobile)
+}
+
+//生成数字验证码
+func newCode() (string, error) {
+	bs := make([]byte, CodeLength)
+	max := big.NewInt(10)
+	for i := range bs {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		bs[i] = byte('0' + n.Int64())
+	}
+	return string(bs), nil
+}
+
+//SendCode 生成并发送验证码,同一手机号CodeResendTime内只能发送一次
+func SendCode(redv IRedisImp, typ CodeType, mobile string) error {
+	if !typ.IsValid() {
+		return fmt.Errorf("code type %s error", typ)
+	}
+	ok, err := redv.SetValueNX(codeResendKey(typ, mobile), "1", CodeResendTime)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrCodeResend
+	}
+	code, err := newCode()
+	if err != nil {
+		return err
+	}
+	err = redv.SetValue(codeKey(typ, mobile), code, CodeTime)
+	if err != nil {
+		return err
+	}
+	//新验证码重新计算尝试次数
+	err = redv.DelValue(codeTryKey(typ, mobile))
+	if err != nil {
+		return err
+	}
+	return CodeSender.Send(mobile, typ, code)
+}
+
+//CheckCode 检测验证码,验证成功后验证码失效
+func CheckCode(redv IRedisImp, typ CodeType, mobile string, code string) error {
+	num, err := redv.IncrValue(codeTryKey(typ, mobile), CodeTime)
+	if err != nil {
+		return err
+	}
+	ckey := codeKey(typ, mobile)
+	if num > CodeMaxTry {
+		redv.DelValue(ckey)
+		return ErrCodeTry
+	}
+	v, err := redv.GetValue(ckey)
+	if err != nil {
+		return ErrCodeExpired
+	}
+	if subtle.ConstantTimeCompare([]byte(v), []byte(code)) != 1 {
+		return ErrCodeError
+	}
+	return redv.DelValue(ckey, codeTryKey(typ, mobile))
+}
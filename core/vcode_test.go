@@ -0,0 +1,58 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendCheckCode(t *testing.T) {
+	as := assert.New(t)
+	buf := &bytes.Buffer{}
+	sender := CodeSender
+	CodeSender = NewLogCodeSender(buf)
+	defer func() {
+		CodeSender = sender
+	}()
+	app := InitApp(context.Background())
+	defer app.Close()
+	mobile := "13900000003"
+	err := app.UseRedis(func(redv IRedisImp) error {
+		err := SendCode(redv, CodeTypeRegister, mobile)
+		if err != nil {
+			return err
+		}
+		fs := strings.Fields(buf.String())
+		as.Equal(3, len(fs))
+		code := fs[2]
+		as.Equal(CodeLength, len(code))
+		//限制重发
+		as.Equal(ErrCodeResend, SendCode(redv, CodeTypeRegister, mobile))
+		//类型不同不能使用
+		as.Equal(ErrCodeExpired, CheckCode(redv, CodeTypeResetPass, mobile, code))
+		as.Equal(ErrCodeError, CheckCode(redv, CodeTypeRegister, mobile, "x"))
+		as.NoError(CheckCode(redv, CodeTypeRegister, mobile, code))
+		//只能使用一次
+		as.Equal(ErrCodeExpired, CheckCode(redv, CodeTypeRegister, mobile, code))
+		//超过尝试次数后验证码失效
+		buf.Reset()
+		err = redv.DelValue(codeResendKey(CodeTypeRegister, mobile))
+		if err != nil {
+			return err
+		}
+		err = SendCode(redv, CodeTypeRegister, mobile)
+		if err != nil {
+			return err
+		}
+		code = strings.Fields(buf.String())[2]
+		for i := int64(0); i < CodeMaxTry; i++ {
+			as.Equal(ErrCodeError, CheckCode(redv, CodeTypeRegister, mobile, "x"))
+		}
+		as.Equal(ErrCodeTry, CheckCode(redv, CodeTypeRegister, mobile, code))
+		return nil
+	})
+	as.NoError(err)
+}
@@ -0,0 +1,711 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/cxuhua/xginx"
+	"github.com/cxuhua/xmgrs/util"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//webhook和投递记录表
+const (
+	TWebhookName  = "webhooks"
+	TDeliveryName = "deliveries"
+)
+
+//webhook请求头
+const (
+	WebhookEventHeader     = "X-Xmgrs-Event"     //事件类型
+	WebhookDeliveryHeader  = "X-Xmgrs-Delivery"  //投递id,重试时不变
+	WebhookTimestampHeader = "X-Xmgrs-Timestamp" //签名时间
+	WebhookSignHeader      = "X-Xmgrs-Signature" //sha256=hex(hmac_sha256(secret,timestamp.body))
+)
+
+//webhook设置
+var (
+	//检查待投递记录的间隔
+	WebhookInterval = time.Second * 10
+	//单次请求超时时间
+	WebhookTimeout = time.Second * 10
+	//第一次重试的间隔,之后每次翻倍
+	WebhookRetryBase = time.Second * 30
+	//最大重试间隔
+	WebhookRetryMax = time.Hour * 6
+	//最多投递次数,超过后标记为失败
+	WebhookMaxTries = 10
+	//每个用户最多的webhook数量
+	WebhookMaxNum = 10
+	//投递时锁的超时时间
+	WebhookLockTTL = time.Minute
+	//是否允许回调本机和内网地址,只用于测试
+	WebhookAllowPrivate = false
+)
+
+//内网地址段
+var privateNets = func() []*net.IPNet {
+	ns := []*net.IPNet{}
+	for _, s := range []string{"0.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ns = append(ns, n)
+	}
+	return ns
+}()
+
+//IsPublicIP 是否是可以回调的公网地址
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+//域名解析后连接前检查地址,防止通过域名访问内网
+func webhookDialControl(network, address string, c syscall.RawConn) error {
+	if WebhookAllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return fmt.Errorf("webhook address %s not allowed", host)
+	}
+	return nil
+}
+
+//回调使用的http客户端,不跟随重定向
+var webhookClient = &http.Client{
+	Timeout: WebhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: WebhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     time.Minute,
+		TLSHandshakeTimeout: WebhookTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("webhook redirect not allowed")
+	},
+}
+
+//TWebhook 用户注册的回调地址
+type TWebhook struct {
+	ID     primitive.ObjectID `bson:"_id"`    //webhook id
+	UserID primitive.ObjectID `bson:"uid"`    //所属用户
+	URL    string             `bson:"url"`    //回调地址
+	Secret []byte             `bson:"secret"` //加密后的签名密钥
+	Events []EventType        `bson:"events"` //接收的事件,为空接收所有事件
+	Enable bool               `bson:"enable"` //是否启用
+	Time   int64              `bson:"time"`   //创建时间
+}
+
+//NewWebhook 创建webhook,secret为空时随机生成,返回明文密钥
+func NewWebhook(uid primitive.ObjectID, surl string, secret string, events []EventType) (*TWebhook, string, error) {
+	h := &TWebhook{
+		ID:     primitive.NewObjectID(),
+		UserID: uid,
+		URL:    surl,
+		Events: events,
+		Enable: true,
+		Time:   time.Now().Unix(),
+	}
+	err := h.Check()
+	if err != nil {
+		return nil, "", err
+	}
+	if secret == "" {
+		secret = util.NonceStr(32)
+	}
+	err = h.SetSecret(secret)
+	if err != nil {
+		return nil, "", err
+	}
+	return h, secret, nil
+}
+
+//IsEventType 是否是支持的事件类型
+func IsEventType(typ EventType) bool {
+	switch typ {
+	case EventSignRequest, EventCosigned, EventSigned, EventPool, EventBlock, EventCancel, EventIncoming, EventConfirmed, EventIncomingConfirmed:
+		return true
+	}
+	return false
+}
+
+//Check 检查回调地址和事件
+func (h *TWebhook) Check() error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("webhook url error")
+	}
+	//直接使用ip时检查地址,域名在连接时检查
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !WebhookAllowPrivate && !IsPublicIP(ip) {
+		return errors.New("webhook url address not allowed")
+	}
+	for _, typ := range h.Events {
+		if !IsEventType(typ) {
+			return fmt.Errorf("event type %s not support", typ)
+		}
+	}
+	return nil
+}
+
+//SetSecret 加密保存签名密钥
+func (h *TWebhook) SetSecret(secret string) error {
+	if secret == "" {
+		return errors.New("webhook secret miss")
+	}
+	ck, err := xginx.AesEncrypt(cipher, []byte(secret))
+	if err != nil {
+		return err
+	}
+	h.Secret = ck
+	return nil
+}
+
+//Match 是否接收事件
+func (h *TWebhook) Match(typ EventType) bool {
+	if !h.Enable {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, v := range h.Events {
+		if v == typ {
+			return true
+		}
+	}
+	return false
+}
+
+//Sign 计算签名 hex(hmac_sha256(secret,timestamp.body))
+func (h *TWebhook) Sign(ts int64, body []byte) (string, error) {
+	key, err := xginx.AesDecrypt(cipher, h.Secret)
+	if err != nil {
+		return "", err
+	}
+	return WebhookSign(key, ts, body), nil
+}
+
+//WebhookSign 计算签名,接收方使用相同方法验证
+func WebhookSign(key []byte, ts int64, body []byte) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(strconv.FormatInt(ts, 10)))
+	m.Write([]byte("."))
+	m.Write(body)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+//TDeliveryState 投递状态
+type TDeliveryState int
+
+//投递状态定义
+const (
+	DeliveryPending TDeliveryState = 0 //等待投递或者重试
+	DeliverySuccess TDeliveryState = 1 //投递成功
+	DeliveryFailed  TDeliveryState = 2 //超过最大次数或者webhook不可用
+)
+
+//TDelivery 事件投递记录
+type TDelivery struct {
+	ID      primitive.ObjectID `bson:"_id"`     //投递id
+	HookID  primitive.ObjectID `bson:"hid"`     //webhook id
+	UserID  primitive.ObjectID `bson:"uid"`     //所属用户
+	Type    EventType          `bson:"type"`    //事件类型
+	Payload string             `bson:"payload"` //事件json,作为请求内容
+	State   TDeliveryState     `bson:"state"`   //投递状态
+	Tries   int                `bson:"tries"`   //已经投递次数
+	Next    int64              `bson:"next"`    //下次投递时间
+	Code    int                `bson:"code"`    //最后一次响应状态码
+	Error   string             `bson:"error"`   //最后一次错误
+	Time    int64              `bson:"time"`    //创建时间
+	Done    int64              `bson:"done"`    //成功或者失败的时间
+}
+
+//NewDelivery 创建投递记录
+func (h *TWebhook) NewDelivery(typ EventType, payload string) *TDelivery {
+	now := time.Now().Unix()
+	return &TDelivery{
+		ID:      primitive.NewObjectID(),
+		HookID:  h.ID,
+		UserID:  h.UserID,
+		Type:    typ,
+		Payload: payload,
+		State:   DeliveryPending,
+		Next:    now,
+		Time:    now,
+	}
+}
+
+//IsDue 是否到了投递时间
+func (d *TDelivery) IsDue(now time.Time) bool {
+	return d.State == DeliveryPending && d.Next <= now.Unix()
+}
+
+//第tries次投递失败后的重试间隔
+func retryDelay(tries int) time.Duration {
+	delay := WebhookRetryBase
+	for i := 1; i < tries; i++ {
+		delay *= 2
+		if delay >= WebhookRetryMax {
+			return WebhookRetryMax
+		}
+	}
+	return delay
+}
+
+//SetResult 记录投递结果,失败时按指数退避计算下次投递时间
+func (d *TDelivery) SetResult(now time.Time, code int, err error) {
+	d.Tries++
+	d.Code = code
+	d.Error = ""
+	if err == nil {
+		d.State = DeliverySuccess
+		d.Done = now.Unix()
+		return
+	}
+	d.Error = err.Error()
+	if d.Tries >= WebhookMaxTries {
+		d.State = DeliveryFailed
+		d.Done = now.Unix()
+		return
+	}
+	d.Next = now.Add(retryDelay(d.Tries)).Unix()
+}
+
+//Retry 重新投递失败的记录
+func (d *TDelivery) Retry(now time.Time) error {
+	if d.State == DeliveryPending {
+		return errors.New("delivery pending")
+	}
+	d.State = DeliveryPending
+	d.Tries = 0
+	d.Next = now.Unix()
+	d.Done = 0
+	return nil
+}
+
+//PageKey 投递记录分页排序值
+func (d *TDelivery) PageKey(sort string) (int64, string) {
+	if sort == PageSortTime {
+		return d.Time, d.ID.Hex()
+	}
+	return 0, d.ID.Hex()
+}
+
+//为用户的webhook创建投递记录,和业务在同一个事务中保存
+func enqueueWebhooks(db IDbImp, uid primitive.ObjectID, typ EventType, payload string) error {
+	hooks, err := db.ListWebhooks(uid)
+	if err != nil {
+		return err
+	}
+	for _, h := range hooks {
+		if !h.Match(typ) {
+			continue
+		}
+		err = db.InsertDelivery(h.NewDelivery(typ, payload))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DeliverFunc 投递一个事件,返回响应状态码
+type DeliverFunc func(h *TWebhook, d *TDelivery) (int, error)
+
+//SendWebhook 发送事件到回调地址,2xx状态码为成功
+func SendWebhook(h *TWebhook, d *TDelivery) (int, error) {
+	body := []byte(d.Payload)
+	ts := time.Now().Unix()
+	sign, err := h.Sign(ts, body)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(d.Type))
+	req.Header.Set(WebhookDeliveryHeader, d.ID.Hex())
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+	req.Header.Set(WebhookSignHeader, "sha256="+sign)
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("http status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+//投递锁
+func deliveryLockKey(id primitive.ObjectID) string {
+	return fmt.Sprintf("delivery:lock:%s", id.Hex())
+}
+
+//投递一个事件,获取不到锁说明其他实例正在投递
+func (app *App) runDelivery(id primitive.ObjectID, now time.Time, fn DeliverFunc) (bool, error) {
+	run := false
+	err := app.UseRedis(func(redv IRedisImp) error {
+		locker, err := redv.Locker(deliveryLockKey(id), WebhookLockTTL)
+		if errors.Is(err, redislock.ErrNotObtained) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer locker.Release()
+		//获取锁后再次检测,其他实例可能刚投递完成
+		var d *TDelivery
+		var h *TWebhook
+		err = app.UseDb(func(db IDbImp) error {
+			d, err = db.GetDelivery(id)
+			if err != nil || !d.IsDue(now) {
+				return err
+			}
+			h, err = db.GetWebhook(d.HookID)
+			return err
+		})
+		if err != nil || !d.IsDue(now) {
+			return err
+		}
+		//webhook停用后不再投递
+		if !h.Enable {
+			d.State = DeliveryFailed
+			d.Error = "webhook disabled"
+			d.Done = now.Unix()
+		} else {
+			code, err := fn(h, d)
+			d.SetResult(now, code, err)
+		}
+		run = true
+		return app.UseDb(func(db IDbImp) error {
+			return db.UpdateDelivery(d)
+		})
+	})
+	return run, err
+}
+
+//RunDeliveries 投递所有到期的事件,返回投递的数量
+//每个投递记录使用分布式锁,保证只有一个实例投递
+func (app *App) RunDeliveries(now time.Time, fn DeliverFunc) (int, error) {
+	var ds []*TDelivery
+	err := app.UseDb(func(db IDbImp) error {
+		var err error
+		ds, err = db.ListDueDeliveries(now.Unix())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, d := range ds {
+		run, err := app.runDelivery(d.ID, now, fn)
+		if err != nil {
+			return num, err
+		}
+		if run {
+			num++
+		}
+	}
+	return num, nil
+}
+
+//RunWebhooks 定时投递到期的事件,直到ctx结束
+func (app *App) RunWebhooks(ctx context.Context, fn DeliverFunc) {
+	ticker := time.NewTicker(WebhookInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			num, err := app.RunDeliveries(now, fn)
+			if err != nil {
+				xginx.LogError("run deliveries error", err)
+			}
+			if num > 0 {
+				xginx.LogInfof("run %d deliveries", num)
+			}
+		}
+	}
+}
+
+//添加webhook
+func (ctx *dbimp) InsertWebhook(h *TWebhook) error {
+	col := ctx.table(TWebhookName)
+	_, err := col.InsertOne(ctx, h)
+	return err
+}
+
+//获取webhook
+func (ctx *dbimp) GetWebhook(id primitive.ObjectID) (*TWebhook, error) {
+	col := ctx.table(TWebhookName)
+	v := &TWebhook{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新webhook
+func (ctx *dbimp) UpdateWebhook(h *TWebhook) error {
+	col := ctx.table(TWebhookName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": h.ID}, h)
+	return sr.Err()
+}
+
+//删除webhook和投递记录
+func (ctx *dbimp) DeleteWebhook(id primitive.ObjectID) error {
+	if !ctx.IsTx() {
+		return errors.New("use tx")
+	}
+	_, err := ctx.table(TDeliveryName).DeleteMany(ctx, bson.M{"hid": id})
+	if err != nil {
+		return err
+	}
+	_, err = ctx.table(TWebhookName).DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+//获取用户的webhook
+func (ctx *dbimp) ListWebhooks(uid primitive.ObjectID) ([]*TWebhook, error) {
+	col := ctx.table(TWebhookName)
+	iter, err := col.Find(ctx, bson.M{"uid": uid})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TWebhook{}
+	for iter.Next(ctx) {
+		v := &TWebhook{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//添加投递记录
+func (ctx *dbimp) InsertDelivery(d *TDelivery) error {
+	col := ctx.table(TDeliveryName)
+	_, err := col.InsertOne(ctx, d)
+	return err
+}
+
+//获取投递记录
+func (ctx *dbimp) GetDelivery(id primitive.ObjectID) (*TDelivery, error) {
+	col := ctx.table(TDeliveryName)
+	v := &TDelivery{}
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//更新投递记录
+func (ctx *dbimp) UpdateDelivery(d *TDelivery) error {
+	col := ctx.table(TDeliveryName)
+	sr := col.FindOneAndReplace(ctx, bson.M{"_id": d.ID}, d)
+	return sr.Err()
+}
+
+//获取到期的投递记录
+func (ctx *dbimp) ListDueDeliveries(now int64) ([]*TDelivery, error) {
+	filter := bson.M{"state": DeliveryPending, "next": bson.M{"$lte": now}}
+	col := ctx.table(TDeliveryName)
+	iter, err := col.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(ctx)
+	rets := []*TDelivery{}
+	for iter.Next(ctx) {
+		v := &TDelivery{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		rets = append(rets, v)
+	}
+	return rets, nil
+}
+
+//分页获取webhook的投递记录
+func (ctx *dbimp) PageDeliveries(hid primitive.ObjectID, f ListFilter, p Page) ([]*TDelivery, string, error) {
+	filter := f.timeFilter(bson.M{"hid": hid}, "time")
+	query, opts, err := p.find(filter, pageField(p.Sort), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	col := ctx.table(TDeliveryName)
+	iter, err := col.Find(ctx, query, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer iter.Close(ctx)
+	rets := []*TDelivery{}
+	for iter.Next(ctx) {
+		v := &TDelivery{}
+		err := iter.Decode(v)
+		if err != nil {
+			return nil, "", err
+		}
+		rets = append(rets, v)
+	}
+	n, next := p.next(len(rets), func(i int) (int64, string) {
+		return rets[i].PageKey(p.Sort)
+	})
+	return rets[:n], next, nil
+}
+
+func (db *memimp) InsertWebhook(h *TWebhook) error {
+	return db.insert(TWebhookName, h, &TWebhook{})
+}
+
+func (db *memimp) GetWebhook(id primitive.ObjectID) (*TWebhook, error) {
+	v := &TWebhook{}
+	err := db.first(v, TWebhookName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) UpdateWebhook(h *TWebhook) error {
+	_, err := db.GetWebhook(h.ID)
+	if err != nil {
+		return err
+	}
+	return db.insert(TWebhookName, h, &TWebhook{})
+}
+
+func (db *memimp) DeleteWebhook(id primitive.ObjectID) error {
+	if !db.IsTx() {
+		return errors.New("use tx")
+	}
+	err := db.deleteAll(TDeliveryName, "hid", id)
+	if err != nil {
+		return err
+	}
+	return db.deleteAll(TWebhookName, "id", id)
+}
+
+func (db *memimp) ListWebhooks(uid primitive.ObjectID) ([]*TWebhook, error) {
+	rets := []*TWebhook{}
+	var err error
+	err2 := db.each(TWebhookName, "uid", uid, func(obj interface{}) bool {
+		v := &TWebhook{}
+		err = memClone(obj, v)
+		rets = append(rets, v)
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
+
+func (db *memimp) InsertDelivery(d *TDelivery) error {
+	return db.insert(TDeliveryName, d, &TDelivery{})
+}
+
+func (db *memimp) GetDelivery(id primitive.ObjectID) (*TDelivery, error) {
+	v := &TDelivery{}
+	err := db.first(v, TDeliveryName, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (db *memimp) UpdateDelivery(d *TDelivery) error {
+	_, err := db.GetDelivery(d.ID)
+	if err != nil {
+		return err
+	}
+	return db.insert(TDeliveryName, d, &TDelivery{})
+}
+
+func (db *memimp) ListDueDeliveries(now int64) ([]*TDelivery, error) {
+	return db.findDeliveries("state", DeliveryPending, func(d *TDelivery) bool {
+		return d.Next <= now
+	})
+}
+
+func (db *memimp) PageDeliveries(hid primitive.ObjectID, f ListFilter, p Page) ([]*TDelivery, string, error) {
+	vs, err := db.findDeliveries("hid", hid, func(d *TDelivery) bool {
+		return f.MatchTime(d.Time)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	idxs, next, err := PageSlice(p, len(vs), func(i int) (int64, string) {
+		return vs[i].PageKey(p.Sort)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	rets := []*TDelivery{}
+	for _, i := range idxs {
+		rets = append(rets, vs[i])
+	}
+	return rets, next, nil
+}
+
+func (db *memimp) findDeliveries(idx string, arg interface{}, fn func(d *TDelivery) bool) ([]*TDelivery, error) {
+	rets := []*TDelivery{}
+	var err error
+	err2 := db.each(TDeliveryName, idx, arg, func(obj interface{}) bool {
+		v := &TDelivery{}
+		err = memClone(obj, v)
+		if err == nil && fn(v) {
+			rets = append(rets, v)
+		}
+		return err == nil
+	})
+	if err2 != nil {
+		return nil, err2
+	}
+	return rets, err
+}
@@ -0,0 +1,168 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRetryDelay(t *testing.T) {
+	as := assert.New(t)
+	as.Equal(WebhookRetryBase, retryDelay(1))
+	as.Equal(WebhookRetryBase*4, retryDelay(3))
+	as.Equal(WebhookRetryMax, retryDelay(100))
+	d := &TDelivery{}
+	now := time.Now()
+	for i := 1; i < WebhookMaxTries; i++ {
+		d.SetResult(now, 500, errors.New("fail"))
+		as.Equal(DeliveryPending, d.State)
+	}
+	d.SetResult(now, 500, errors.New("fail"))
+	as.Equal(DeliveryFailed, d.State)
+	as.NoError(d.Retry(now))
+	d.SetResult(now, 200, nil)
+	as.Equal(DeliverySuccess, d.State)
+	as.Equal(1, d.Tries)
+}
+
+func TestSendWebhook(t *testing.T) {
+	as := assert.New(t)
+	WebhookAllowPrivate = true
+	defer func() {
+		WebhookAllowPrivate = false
+	}()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(WebhookTimestampHeader), 10, 64)
+		sign := "sha256=" + WebhookSign([]byte("secret"), ts, body)
+		if r.Header.Get(WebhookSignHeader) != sign {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+	h, _, err := NewWebhook(primitive.NewObjectID(), srv.URL, "secret", nil)
+	as.NoError(err)
+	d := h.NewDelivery(EventBlock, `{"type":"block"}`)
+	code, err := SendWebhook(h, d)
+	as.NoError(err)
+	as.Equal(http.StatusOK, code)
+	as.NoError(h.SetSecret("other"))
+	code, err = SendWebhook(h, d)
+	as.Error(err)
+	as.Equal(http.StatusUnauthorized, code)
+	_, _, err = NewWebhook(primitive.NewObjectID(), "ftp://host", "", nil)
+	as.Error(err)
+	_, _, err = NewWebhook(primitive.NewObjectID(), srv.URL, "", []EventType{"miss"})
+	as.Error(err)
+}
+
+func TestWebhookPrivateAddr(t *testing.T) {
+	as := assert.New(t)
+	hit := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit = true
+	}))
+	defer srv.Close()
+	//直接使用内网ip不能注册
+	for _, surl := range []string{srv.URL, "http://10.1.2.3/", "http://[::1]/", "http://169.254.169.254/", "http://0.0.0.0/", "http://0.1.2.3/"} {
+		_, _, err := NewWebhook(primitive.NewObjectID(), surl, "", nil)
+		as.Error(err, surl)
+	}
+	//域名解析到本机时连接被拒绝
+	u, err := url.Parse(srv.URL)
+	as.NoError(err)
+	h := &TWebhook{ID: primitive.NewObjectID(), URL: "http://localhost:" + u.Port()}
+	as.NoError(h.SetSecret("secret"))
+	d := h.NewDelivery(EventBlock, `{"type":"block"}`)
+	_, err = SendWebhook(h, d)
+	as.Error(err)
+	as.False(hit)
+	//不跟随重定向
+	WebhookAllowPrivate = true
+	defer func() {
+		WebhookAllowPrivate = false
+	}()
+	rdr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, srv.URL, http.StatusFound)
+	}))
+	defer rdr.Close()
+	h.URL = rdr.URL
+	_, err = SendWebhook(h, d)
+	as.Error(err)
+	as.False(hit)
+}
+
+func TestRunDeliveries(t *testing.T) {
+	as := assert.New(t)
+	app := InitApp(context.Background())
+	defer app.Close()
+	uid := primitive.NewObjectID()
+	all, _, err := NewWebhook(uid, "http://example.com/all", "", nil)
+	as.NoError(err)
+	inc, _, err := NewWebhook(uid, "http://example.com/incoming", "", []EventType{EventIncoming})
+	as.NoError(err)
+	err = app.UseTx(func(db IDbImp) error {
+		err := db.InsertWebhook(all)
+		if err != nil {
+			return err
+		}
+		err = db.InsertWebhook(inc)
+		if err != nil {
+			return err
+		}
+		return PublishEvent(db, uid, NewEvent(EventBlock, []byte("webhook_test_tx")))
+	})
+	as.NoError(err)
+	defer app.UseTx(func(db IDbImp) error {
+		db.DeleteWebhook(inc.ID)
+		return db.DeleteWebhook(all.ID)
+	})
+	now := time.Now()
+	fails := 0
+	num, err := app.RunDeliveries(now, func(h *TWebhook, d *TDelivery) (int, error) {
+		as.Equal(all.ID, h.ID)
+		as.Equal(EventBlock, d.Type)
+		fails++
+		return 500, errors.New("fail")
+	})
+	as.NoError(err)
+	as.Equal(1, num)
+	as.Equal(1, fails)
+	//重试时间未到
+	num, err = app.RunDeliveries(now, func(h *TWebhook, d *TDelivery) (int, error) {
+		return 200, nil
+	})
+	as.NoError(err)
+	as.Equal(0, num)
+	num, err = app.RunDeliveries(now.Add(WebhookRetryBase), func(h *TWebhook, d *TDelivery) (int, error) {
+		return 200, nil
+	})
+	as.NoError(err)
+	as.Equal(1, num)
+	err = app.UseDb(func(db IDbImp) error {
+		ds, _, err := db.PageDeliveries(all.ID, ListFilter{}, Page{Sort: PageSortTime})
+		if err != nil {
+			return err
+		}
+		as.Len(ds, 1)
+		as.Equal(DeliverySuccess, ds[0].State)
+		as.Equal(2, ds[0].Tries)
+		as.Equal(200, ds[0].Code)
+		ds, _, err = db.PageDeliveries(inc.ID, ListFilter{}, Page{Sort: PageSortTime})
+		if err != nil {
+			return err
+		}
+		as.Len(ds, 0)
+		return nil
+	})
+	as.NoError(err)
+}
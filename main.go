@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"time"
@@ -18,6 +19,15 @@ import (
 	"github.com/cxuhua/xginx"
 )
 
+var (
+	//交易完成默认需要的确认数
+	confirms = flag.Uint("confirms", uint(core.TxConfirmNum), "tx confirmed need block confirms")
+	//数据库引擎
+	engine = flag.String("engine", core.DbEngine, "db engine mongo or memory")
+	//管理员接口token,为空时禁用管理员接口
+	admin = flag.String("admin", core.AdminToken, "admin api token, empty disable admin api")
+)
+
 //实现自己的监听器
 type mylis struct {
 	xginx.Listener
@@ -29,21 +39,23 @@ type mylis struct {
 
 func (lis *mylis) OnLinkBlock(blk *xginx.BlockInfo) {
 	//当一个区块连接到链上
-	//更新相关交易状态
-	lis.app.UseDb(func(db core.IDbImp) error {
-		for _, tx := range blk.Txs {
-			id, err := tx.ID()
-			if err != nil {
-				continue
-			}
-			ttx, err := db.GetTx(id[:])
-			if err != nil {
-				continue
-			}
-			err = ttx.SetTxState(db, core.TTxStateBlock)
-			if err != nil {
-				xginx.LogError("set tx state error", err)
-			}
+	//从处理进度同步到最新区块,保存收支记录,更新相关交易状态
+	bi := xginx.GetBlockIndex()
+	_, err := lis.app.SyncBlocks(bi)
+	if err != nil {
+		xginx.LogError("sync blocks error", err)
+	}
+	//统计区块交易费
+	core.GetFeeEstimator().OnLinkBlock(bi, blk)
+	//取消过期的未完成交易
+	lis.app.UseTx(func(db core.IDbImp) error {
+		num, err := core.ExpireTxs(db, time.Now())
+		if err != nil {
+			xginx.LogError("expire txs error", err)
+			return err
+		}
+		if num > 0 {
+			xginx.LogInfof("expire %d txs", num)
 		}
 		return nil
 	})
@@ -51,32 +63,33 @@ func (lis *mylis) OnLinkBlock(blk *xginx.BlockInfo) {
 
 func (lis *mylis) OnUnlinkBlock(blk *xginx.BlockInfo) {
 	//当一个区块从链断开
-	//更新相关交易状态
-	lis.app.UseDb(func(db core.IDbImp) error {
-		for _, tx := range blk.Txs {
-			id, err := tx.ID()
-			if err != nil {
-				continue
-			}
-			ttx, err := db.GetTx(id[:])
-			if err != nil {
-				continue
-			}
-			err = ttx.SetTxState(db, core.TTxStateCancel)
-			if err != nil {
-				xginx.LogError("set tx state error", err)
-			}
-		}
-		return nil
-	})
+	//删除收支记录,更新相关交易状态
+	bi := xginx.GetBlockIndex()
+	err := lis.app.SyncUnlinkBlock(bi, blk)
+	if err != nil {
+		xginx.LogError("unlink block error", err)
+	}
+	//移除区块交易费统计
+	core.GetFeeEstimator().OnUnlinkBlock(blk)
 }
 
 func (lis *mylis) run() {
 	lis.ctx, lis.cancel = xginx.GetContext()
 	//创建一个全局连接
 	lis.app = core.InitApp(lis.ctx)
+	//处理停止期间连接的区块
+	num, err := lis.app.SyncBlocks(xginx.GetBlockIndex())
+	if err != nil {
+		xginx.LogError("sync blocks error", err)
+	} else if num > 0 {
+		xginx.LogInfof("sync %d blocks", num)
+	}
 	//
 	m := api.InitEngine(lis.ctx)
+	//执行计划付款
+	go api.RunScheduler(lis.ctx, lis.app)
+	//投递webhook事件
+	go lis.app.RunWebhooks(lis.ctx, core.SendWebhook)
 
 	lis.xhttp = &http.Server{
 		Addr:    config.HTTPAddr,
@@ -115,5 +128,14 @@ func (lis *mylis) OnStop(sig os.Signal) {
 
 func main() {
 	flag.Parse()
+	if *confirms > 0 {
+		core.TxConfirmNum = uint32(*confirms)
+	}
+	if *engine != core.DbEngineMongo && *engine != core.DbEngineMemory {
+		fmt.Fprintf(os.Stderr, "db engine %s not support\n", *engine)
+		os.Exit(2)
+	}
+	core.DbEngine = *engine
+	core.AdminToken = *admin
 	xginx.Run(&mylis{})
 }
@@ -0,0 +1,141 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//cron字段范围
+var cronRanges = [5][2]int{
+	{0, 59}, //分
+	{0, 23}, //时
+	{1, 31}, //日
+	{1, 12}, //月
+	{0, 6},  //星期,0是星期日
+}
+
+//cron别名
+var cronAlias = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+//Cron 分 时 日 月 星期 格式的执行计划
+//每个字段支持 * 数字 a-b a,b */n a-b/n
+type Cron struct {
+	fields [5]map[int]bool
+	dom    bool //是否限制了日
+	dow    bool //是否限制了星期
+}
+
+//解析一个字段
+func parseCronField(s string, min int, max int) (map[int]bool, bool, error) {
+	rets := map[int]bool{}
+	limit := false
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if p := strings.Index(part, "/"); p >= 0 {
+			v, err := strconv.Atoi(part[p+1:])
+			if err != nil || v <= 0 {
+				return nil, false, fmt.Errorf("cron step %s error", part)
+			}
+			step = v
+			part = part[:p]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			limit = true
+			rs := strings.SplitN(part, "-", 2)
+			v, err := strconv.Atoi(rs[0])
+			if err != nil {
+				return nil, false, fmt.Errorf("cron value %s error", part)
+			}
+			lo, hi = v, v
+			if len(rs) == 2 {
+				hi, err = strconv.Atoi(rs[1])
+				if err != nil {
+					return nil, false, fmt.Errorf("cron value %s error", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		} else if step > 1 {
+			limit = true
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, false, fmt.Errorf("cron range %s error", part)
+		}
+		for i := lo; i <= hi; i += step {
+			rets[i] = true
+		}
+	}
+	return rets, limit, nil
+}
+
+//ParseCron 解析执行计划
+func ParseCron(s string) (*Cron, error) {
+	s = strings.TrimSpace(s)
+	if v, has := cronAlias[s]; has {
+		s = v
+	}
+	vs := strings.Fields(s)
+	if len(vs) != 5 {
+		return nil, errors.New("cron fields error")
+	}
+	c := &Cron{}
+	for i, v := range vs {
+		field, limit, err := parseCronField(v, cronRanges[i][0], cronRanges[i][1])
+		if err != nil {
+			return nil, err
+		}
+		c.fields[i] = field
+		if i == 2 {
+			c.dom = limit
+		} else if i == 4 {
+			c.dow = limit
+		}
+	}
+	return c, nil
+}
+
+//日期是否匹配,日和星期都限制时满足一个即可
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.fields[2][t.Day()]
+	dow := c.fields[4][int(t.Weekday())]
+	if c.dom && c.dow {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+//Next 获取t之后的下一次执行时间,精确到分钟,5年内没有返回零值
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if !c.fields[3][int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.fields[1][t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.fields[0][t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
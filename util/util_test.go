@@ -5,6 +5,7 @@ import (
 	"math/big"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/cxuhua/xginx"
 
@@ -58,3 +59,34 @@ func TestRemoveRepeat(t *testing.T) {
 		t.Fatal("error")
 	}
 }
+
+func TestCron(t *testing.T) {
+	loc := time.UTC
+	now := time.Date(2020, 5, 10, 10, 30, 20, 0, loc)
+	tests := []struct {
+		cron string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2020, 5, 10, 10, 31, 0, 0, loc)},
+		{"*/15 * * * *", time.Date(2020, 5, 10, 10, 45, 0, 0, loc)},
+		{"0 9 * * *", time.Date(2020, 5, 11, 9, 0, 0, 0, loc)},
+		{"@monthly", time.Date(2020, 6, 1, 0, 0, 0, 0, loc)},
+		{"0 0 * * 1-5", time.Date(2020, 5, 11, 0, 0, 0, 0, loc)},
+		{"30 8 1,15 * *", time.Date(2020, 5, 15, 8, 30, 0, 0, loc)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, loc)},
+	}
+	for _, v := range tests {
+		c, err := ParseCron(v.cron)
+		if err != nil {
+			t.Fatal(v.cron, err)
+		}
+		if next := c.Next(now); !next.Equal(v.next) {
+			t.Fatal(v.cron, "next", next, "want", v.next)
+		}
+	}
+	for _, v := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(v); err == nil {
+			t.Fatal(v, "should error")
+		}
+	}
+}